@@ -0,0 +1,250 @@
+// Package main - Allocation affinity for reconnecting clients
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultAffinityWindow is how long the server holds a client's allocations
+// after another client took over the room, unless affinityWindow is set
+const defaultAffinityWindow = 2 * time.Minute
+
+// newClientID returns a random client identity
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientIdentity returns the ID a client presents to the server: clientId
+// when configured, else the one saved in the stateFile, so a restarted
+// client is recognized too, else a new one kept for the process's lifetime
+func clientIdentity(config Configuration) string {
+	if config.ClientID != "" {
+		return config.ClientID
+	}
+	if config.StateFile != "" {
+		if id := savedClientID(config.StateFile, config); id != "" {
+			return id
+		}
+	}
+	return newClientID()
+}
+
+// clientAllocations are the allocations the server made for one client
+type clientAllocations struct {
+	mappings  map[string]ServerPortMapping  // By mapping String()
+	cancels   map[string]context.CancelFunc // Of each mapping's forwarders, by mapping String()
+	listeners *serverListeners
+	released  time.Time // When another client took over the room, zero while current
+}
+
+// affinityCache keeps each client's allocations, so a client re-registering
+// under the same ID gets the same ports back and the listeners it had keep
+// serving instead of new ones being bound. The server cannot tell when a
+// client's link drops, so the allocations of the current client are held
+// for as long as it runs; once a client with another ID registers, the
+// previous client's are held for the affinity window and then closed.
+type affinityCache struct {
+	window  time.Duration
+	clients map[string]*clientAllocations
+	current string // ID of the client that registered last
+	mutex   sync.Mutex
+}
+
+// newAffinityCache returns a cache holding released allocations for window,
+// or defaultAffinityWindow when window is 0
+func newAffinityCache(window time.Duration) *affinityCache {
+	if window == 0 {
+		window = defaultAffinityWindow
+	}
+	return &affinityCache{window: window, clients: make(map[string]*clientAllocations)}
+}
+
+// reclaim splits the mappings a client registers into the allocations it
+// keeps, whose listeners are still serving, and the mappings left to
+// allocate. Kept hole-punched UDP mappings bind no listener: their previous
+// port is added to the requested ports, so they get it back with a fresh
+// punch towards the client's new address. A mapping whose options changed
+// is allocated afresh. Clients without an ID are always allocated afresh.
+func (ac *affinityCache) reclaim(clientID string, mappings []PortMapping, requested map[string]int, serverInfo, clientInfo *NetworkInfo) ([]ServerPortMapping, []PortMapping, map[string]int) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	entry := ac.clients[clientID]
+	if clientID == "" || entry == nil {
+		return nil, mappings, requested
+	}
+	entry.released = time.Time{}
+
+	var kept []ServerPortMapping
+	var rest []PortMapping
+	ports := make(map[string]int, len(requested))
+	for mapping, port := range requested {
+		ports[mapping] = port
+	}
+	for _, mapping := range mappings {
+		pm, ok := entry.mappings[mapping.String()]
+		if !ok || !sameMapping(pm.ClientMapping, mapping) {
+			rest = append(rest, mapping)
+			continue
+		}
+		if entry.listening(pm, serverInfo, clientInfo) {
+			log.Printf("♻️  Mapping %s kept on port %d for returning client %s", mapping, pm.AllocatedPort, clientID)
+			kept = append(kept, pm)
+			continue
+		}
+		ports[mapping.String()] = pm.AllocatedPort
+		rest = append(rest, mapping)
+	}
+	return kept, rest, ports
+}
+
+// forwarderContext returns the context the forwarders of a client's mapping
+// run under, cancelled when the mapping is removed or allocated afresh. The
+// forwarders of clients without an ID run under ctx itself.
+func (ac *affinityCache) forwarderContext(ctx context.Context, clientID string, mapping PortMapping) context.Context {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	entry := ac.clients[clientID]
+	if clientID == "" || entry == nil {
+		return ctx
+	}
+	mappingCtx, cancel := context.WithCancel(ctx)
+	entry.cancels[mapping.String()] = cancel
+	return mappingCtx
+}
+
+// remove tears down the allocations of a client that its update no longer
+// lists, so the ports of mappings removed on the client stop forwarding
+func (ac *affinityCache) remove(clientID string, mappings []PortMapping) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	entry := ac.clients[clientID]
+	if clientID == "" || entry == nil {
+		return
+	}
+	listed := make(map[string]bool, len(mappings))
+	for _, mapping := range mappings {
+		listed[mapping.String()] = true
+	}
+	for key, pm := range entry.mappings {
+		if !listed[key] {
+			log.Printf("🗑️  Mapping %s removed by client %s, closing port %d", key, clientID, pm.AllocatedPort)
+			entry.drop(key)
+		}
+	}
+}
+
+// record adds the allocations made for a client to its entry and makes it
+// the current client, releasing the previous one. Allocations replacing
+// ones the entry held are torn down first.
+func (ac *affinityCache) record(clientID string, portMappings []ServerPortMapping, listeners *serverListeners) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if clientID != ac.current {
+		ac.releaseLocked(ac.current)
+		ac.current = clientID
+	}
+	if clientID == "" {
+		return
+	}
+	entry := ac.clients[clientID]
+	if entry == nil {
+		entry = &clientAllocations{
+			mappings: make(map[string]ServerPortMapping),
+			cancels:  make(map[string]context.CancelFunc),
+			listeners: &serverListeners{
+				tcp: make(map[int]net.Listener),
+				udp: make(map[int]*net.UDPConn),
+			},
+		}
+		ac.clients[clientID] = entry
+	}
+	for _, pm := range portMappings {
+		key := pm.ClientMapping.String()
+		if _, ok := entry.mappings[key]; ok {
+			entry.drop(key)
+		}
+		entry.mappings[key] = pm
+	}
+	for port, ln := range listeners.tcp {
+		entry.listeners.tcp[port] = ln
+	}
+	for port, conn := range listeners.udp {
+		entry.listeners.udp[port] = conn
+	}
+}
+
+// releaseLocked starts the affinity window of a client that another client
+// replaced; ac.mutex must be held
+func (ac *affinityCache) releaseLocked(clientID string) {
+	entry := ac.clients[clientID]
+	if entry == nil {
+		return
+	}
+	released := time.Now()
+	entry.released = released
+	log.Printf("⏳ Holding %d allocations of client %s for %v", len(entry.mappings), clientID, ac.window)
+	time.AfterFunc(ac.window, func() {
+		ac.expire(clientID, released)
+	})
+}
+
+// expire closes the listeners of a client released at released that has
+// not come back since
+func (ac *affinityCache) expire(clientID string, released time.Time) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	entry := ac.clients[clientID]
+	if entry == nil || !entry.released.Equal(released) {
+		return
+	}
+	log.Printf("⌛ Client %s did not return within %v, releasing its %d allocations", clientID, ac.window, len(entry.mappings))
+	for _, cancel := range entry.cancels {
+		cancel()
+	}
+	entry.listeners.Close()
+	delete(ac.clients, clientID)
+}
+
+// drop stops the forwarders of the mapping keyed key and closes its
+// listener; the cache's mutex must be held
+func (ca *clientAllocations) drop(key string) {
+	pm := ca.mappings[key]
+	if cancel := ca.cancels[key]; cancel != nil {
+		cancel()
+	}
+	if ln := ca.listeners.tcp[pm.AllocatedPort]; ln != nil && pm.ClientMapping.Protocol == "tcp" {
+		ln.Close()
+		delete(ca.listeners.tcp, pm.AllocatedPort)
+	}
+	if conn := ca.listeners.udp[pm.AllocatedPort]; conn != nil && pm.ClientMapping.Protocol != "tcp" {
+		conn.Close()
+		delete(ca.listeners.udp, pm.AllocatedPort)
+	}
+	delete(ca.cancels, key)
+	delete(ca.mappings, key)
+}
+
+// listening reports whether pm still has the listener its mapping needs
+// with the client's current network, so its forwarder keeps serving
+func (ca *clientAllocations) listening(pm ServerPortMapping, serverInfo, clientInfo *NetworkInfo) bool {
+	if pm.ClientMapping.Protocol == "tcp" {
+		return ca.listeners.tcp[pm.AllocatedPort] != nil
+	}
+	return udpRelayed(pm.ClientMapping, serverInfo, clientInfo) && ca.listeners.udp[pm.AllocatedPort] != nil
+}
+
+// sameMapping reports whether two mappings have the same options
+func sameMapping(a, b PortMapping) bool {
+	keyA, _ := json.Marshal(a)
+	keyB, _ := json.Marshal(b)
+	return string(keyA) == string(keyB)
+}
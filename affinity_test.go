@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTCPEcho runs a TCP service echoing what each connection sends
+func startTCPEcho(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestMappingRemovalClosesServerPort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	var posted []ServerPortMapping
+	signaling := fakeSignaling(t, func(data *ServerRegistrationData) { posted = data.PortMappings })
+	affinity := newAffinityCache(0)
+
+	echoPort := startTCPEcho(t)
+	kept := PortMapping{Protocol: "tcp", LocalPort: 18080, RemotePort: echoPort}
+	removedTCP := PortMapping{Protocol: "tcp", LocalPort: 18081, RemotePort: echoPort}
+	removedUDP := PortMapping{Protocol: "udp", LocalPort: 18053, RemotePort: 1}
+	postMappingUpdate(t, ctx, signaling.URL, "client-1", affinity, &wg, kept, removedTCP, removedUDP)
+
+	ports := make(map[string]int)
+	for _, pm := range posted {
+		ports[pm.ClientMapping.String()] = pm.AllocatedPort
+	}
+	if len(ports) != 3 {
+		t.Fatalf("allocated %v, want 3 mappings", ports)
+	}
+	keptAddr := "127.0.0.1:" + strconv.Itoa(ports[kept.String()])
+	removedAddr := "127.0.0.1:" + strconv.Itoa(ports[removedTCP.String()])
+
+	// A connection through the mapping about to be removed
+	open := dialRetry(t, removedAddr)
+	defer open.Close()
+	open.Write([]byte("x"))
+	open.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(open, make([]byte, 1)); err != nil {
+		t.Fatalf("no echo through %s: %v", removedTCP, err)
+	}
+
+	postMappingUpdate(t, ctx, signaling.URL, "client-1", affinity, &wg, kept)
+
+	if len(posted) != 1 || posted[0].AllocatedPort != ports[kept.String()] {
+		t.Errorf("second update posted %v, want only %s on port %d", posted, kept, ports[kept.String()])
+	}
+	conn := dialRetry(t, keptAddr)
+	conn.Close()
+
+	if conn, err := net.DialTimeout("tcp", removedAddr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("port %d of removed mapping %s still accepts", ports[removedTCP.String()], removedTCP)
+	}
+	if _, err := io.ReadFull(open, make([]byte, 1)); err == nil {
+		t.Error("connection through the removed mapping still open")
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: ports[removedUDP.String()]})
+	if err != nil {
+		t.Errorf("port %d of removed mapping %s still bound: %v", ports[removedUDP.String()], removedUDP, err)
+	} else {
+		udp.Close()
+	}
+}
@@ -0,0 +1,83 @@
+// Package main - Local port aliases sharing one server allocation
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// aliasKey identifies what the server does for a TCP mapping: the mapping
+// with its client-side settings cleared. Mappings with equal keys reach the
+// same service the same way.
+func aliasKey(mapping PortMapping) string {
+	mapping.LocalPort = 0
+	mapping.LogLevel = ""
+	mapping.Quiet = false
+	mapping.DualPath = false
+	mapping.NoSwapWarning = false
+	key, _ := json.Marshal(mapping)
+	return string(key)
+}
+
+// coalesceMappings splits mappings into those sent to the server and local
+// aliases: TCP mappings that share a remote target with an earlier mapping
+// are left out of the registration and forward through the earlier one's
+// allocation, keyed by its String(). UDP mappings are never coalesced, since
+// datagrams of a shared path carry nothing that tells their local ports
+// apart on the way back.
+func coalesceMappings(mappings []PortMapping) ([]PortMapping, map[string][]PortMapping) {
+	var primaries []PortMapping
+	aliases := make(map[string][]PortMapping)
+	primaryByKey := make(map[string]PortMapping)
+	for _, mapping := range mappings {
+		if mapping.Protocol != "tcp" {
+			primaries = append(primaries, mapping)
+			continue
+		}
+		key := aliasKey(mapping)
+		primary, ok := primaryByKey[key]
+		if !ok {
+			primaryByKey[key] = mapping
+			primaries = append(primaries, mapping)
+			continue
+		}
+		log.Printf("🔗 Mapping %s shares the server allocation of %s", mapping, primary)
+		aliases[primary.String()] = append(aliases[primary.String()], mapping)
+	}
+	return primaries, aliases
+}
+
+// expandAliases adds an entry for each alias with its primary's allocated
+// port, so aliases are forwarded like the mapping they share. Aliases take
+// the options the server echoed for the primary, such as a resolved
+// service port or a declined compress, and keep their client-side settings.
+func expandAliases(portMappings []ServerPortMapping, aliases map[string][]PortMapping) []ServerPortMapping {
+	if len(aliases) == 0 {
+		return portMappings
+	}
+	expanded := make([]ServerPortMapping, 0, len(portMappings))
+	for _, pm := range portMappings {
+		expanded = append(expanded, pm)
+		for _, alias := range aliases[pm.ClientMapping.String()] {
+			shared := pm.ClientMapping
+			shared.LocalPort = alias.LocalPort
+			shared.LogLevel = alias.LogLevel
+			shared.Quiet = alias.Quiet
+			shared.DualPath = alias.DualPath
+			expanded = append(expanded, ServerPortMapping{ClientMapping: shared, AllocatedPort: pm.AllocatedPort})
+		}
+	}
+	return expanded
+}
+
+// reportFailedAliases marks the aliases of mappings the server could not
+// allocate failed too
+func reportFailedAliases(failures []MappingFailure, aliases map[string][]PortMapping) {
+	for _, failure := range failures {
+		for _, alias := range aliases[failure.Mapping] {
+			log.Printf("⚠️  Alias %s of mapping %s not forwarded", alias, failure.Mapping)
+			readiness.FailMapping(forwardedPortKey(alias), fmt.Errorf("server could not allocate %s for alias %s: %s", failure.Mapping, alias, failure.Error))
+		}
+	}
+}
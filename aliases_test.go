@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestCoalesceAndExpandAliases(t *testing.T) {
+	mappings := []PortMapping{
+		{Protocol: "tcp", LocalPort: 8080, RemotePort: 80},
+		{Protocol: "tcp", LocalPort: 8081, RemotePort: 80, LogLevel: "debug"},
+		{Protocol: "udp", LocalPort: 5353, RemotePort: 53},
+		{Protocol: "udp", LocalPort: 5354, RemotePort: 53},
+	}
+	primaries, aliases := coalesceMappings(mappings)
+
+	// UDP mappings are never coalesced
+	if len(primaries) != 3 || primaries[0].LocalPort != 8080 {
+		t.Fatalf("registered %v, want tcp 8080 and both udp mappings", primaries)
+	}
+	if len(aliases) != 1 || len(aliases[primaries[0].String()]) != 1 {
+		t.Fatalf("aliases %v, want 8081 under %s", aliases, primaries[0])
+	}
+
+	allocated := []ServerPortMapping{
+		{ClientMapping: primaries[0], AllocatedPort: 40000},
+		{ClientMapping: primaries[1], AllocatedPort: 40001},
+		{ClientMapping: primaries[2], AllocatedPort: 40002},
+	}
+	expanded := expandAliases(allocated, aliases)
+	if len(expanded) != 4 {
+		t.Fatalf("expanded to %d entries, want 4: %v", len(expanded), expanded)
+	}
+	var alias []ServerPortMapping
+	for _, pm := range expanded {
+		if pm.ClientMapping.LocalPort == 8081 {
+			alias = append(alias, pm)
+		}
+	}
+	if len(alias) != 1 {
+		t.Fatalf("%d entries for the alias, want exactly 1", len(alias))
+	}
+	if alias[0].AllocatedPort != 40000 || alias[0].ClientMapping.LogLevel != "debug" || alias[0].ClientMapping.RemotePort != 80 {
+		t.Errorf("alias entry %+v, want allocation 40000 with its own log level", alias[0])
+	}
+}
@@ -0,0 +1,224 @@
+// Package main - Concurrent port allocation for client mappings
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultAllocationConcurrency is how many mappings the server allocates
+	// at once unless allocationConcurrency says otherwise
+	defaultAllocationConcurrency = 8
+	// allocationAttempts bounds the retries of a mapping whose allocated
+	// port was taken before its listener could bind it
+	allocationAttempts = 3
+)
+
+// RegistrationErrorCapacity is the code of a registration the server
+// refused because it ran out of ports
+const RegistrationErrorCapacity = "capacityExceeded"
+
+// errPortsExhausted marks allocations that failed because the server ran
+// out of ports or sockets rather than because of the mapping
+var errPortsExhausted = errors.New("server out of ports")
+
+// MappingFailure reports a mapping the server could not allocate
+type MappingFailure struct {
+	Mapping string `json:"mapping"` // "protocol:localPort:remotePort"
+	Error   string `json:"error"`
+
+	exhausted bool // Failed with errPortsExhausted
+}
+
+// RegistrationError tells a client why the server refused its registration
+type RegistrationError struct {
+	Code    string `json:"code"` // RegistrationErrorCapacity
+	Message string `json:"message"`
+}
+
+// portsExhausted reports whether err from binding a free port means the
+// server has none left to give, or no sockets to bind them with
+func portsExhausted(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// capacityRejection returns the error refusing a registration none of whose
+// mappings could be allocated because the server is out of ports, so the
+// client knows to come back later. It is nil when anything was allocated or
+// a mapping failed for a reason of its own.
+func capacityRejection(allocated []ServerPortMapping, failures []MappingFailure) *RegistrationError {
+	if len(allocated) > 0 || len(failures) == 0 {
+		return nil
+	}
+	for _, failure := range failures {
+		if !failure.exhausted {
+			return nil
+		}
+	}
+	log.Printf("🚫 Server full, refusing a registration of %d mappings", len(failures))
+	return &RegistrationError{
+		Code:    RegistrationErrorCapacity,
+		Message: fmt.Sprintf("server has no free ports for any of the %d mappings", len(failures)),
+	}
+}
+
+// allocationResult is the outcome of allocating one mapping
+type allocationResult struct {
+	pm  ServerPortMapping
+	tcp net.Listener
+	udp *net.UDPConn
+	err error
+}
+
+// portClaims keeps concurrent allocations of one batch from handing out the
+// same port, which hole-punched UDP mappings only use as an identifier and
+// never bind
+type portClaims struct {
+	ports map[int]bool
+	mutex sync.Mutex
+}
+
+// claim reserves port, reporting false if the batch already uses it
+func (pc *portClaims) claim(port int) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.ports[port] {
+		return false
+	}
+	pc.ports[port] = true
+	return true
+}
+
+// allocateMappings allocates a port for each mapping and binds its listener,
+// running up to concurrency allocations at once. Ports a resuming client
+// requests are tried first. Mappings that cannot be allocated are returned
+// as failures for the client instead of aborting the others. Allocated
+// mappings keep the order of mappings.
+func allocateMappings(ctx context.Context, mappings []PortMapping, requested map[string]int, concurrency int, serverInfo, clientInfo *NetworkInfo) ([]ServerPortMapping, *serverListeners, []MappingFailure) {
+	if concurrency <= 0 {
+		concurrency = defaultAllocationConcurrency
+	}
+
+	results := make([]allocationResult, len(mappings))
+	claims := &portClaims{ports: make(map[int]bool)}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, mapping := range mappings {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(result *allocationResult, mapping PortMapping) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			*result = allocateMapping(ctx, mapping, requested[mapping.String()], claims, serverInfo, clientInfo)
+		}(&results[i], mapping)
+	}
+	wg.Wait()
+
+	listeners := &serverListeners{
+		tcp: make(map[int]net.Listener),
+		udp: make(map[int]*net.UDPConn),
+	}
+	var allocated []ServerPortMapping
+	var failures []MappingFailure
+	for i, result := range results {
+		mapping := mappings[i]
+		if result.err != nil {
+			log.Printf("❌ Failed to allocate port for mapping %s: %v", mapping, result.err)
+			failures = append(failures, MappingFailure{Mapping: mapping.String(), Error: result.err.Error(), exhausted: errors.Is(result.err, errPortsExhausted)})
+			continue
+		}
+		port := result.pm.AllocatedPort
+		if result.tcp != nil {
+			listeners.tcp[port] = result.tcp
+		}
+		if result.udp != nil {
+			listeners.udp[port] = result.udp
+		}
+		allocated = append(allocated, result.pm)
+		log.Printf("Allocated %s port %d for client mapping %d->%d",
+			mapping.Protocol, port, mapping.LocalPort, mapping.RemotePort)
+	}
+	return allocated, listeners, failures
+}
+
+// allocateMapping allocates a port for mapping and binds its listener,
+// retrying with a new port when the allocated one is taken in between. A
+// requested port is tried first and, when taken, costs no attempt.
+func allocateMapping(ctx context.Context, mapping PortMapping, requestedPort int, claims *portClaims, serverInfo, clientInfo *NetworkInfo) allocationResult {
+	if requestedPort > 0 && claims.claim(requestedPort) {
+		result := allocationResult{pm: ServerPortMapping{ClientMapping: mapping, AllocatedPort: requestedPort}}
+		var err error
+		result.tcp, result.udp, err = bindServerListener(result.pm, serverInfo, clientInfo)
+		if err == nil {
+			log.Printf("♻️  Mapping %s resumed on requested port %d", mapping, requestedPort)
+			return result
+		}
+		log.Printf("ℹ️  Requested port %d for mapping %s unavailable, allocating another: %v", requestedPort, mapping, err)
+	}
+
+	var err error
+	for attempt := 1; attempt <= allocationAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return allocationResult{err: ctx.Err()}
+		}
+
+		var port int
+		port, err = allocatePortForMapping(ctx, mapping)
+		if err != nil {
+			if portsExhausted(err) {
+				err = fmt.Errorf("%w: %v", errPortsExhausted, err)
+			}
+			continue
+		}
+		if !claims.claim(port) {
+			err = fmt.Errorf("port %d already allocated to another mapping", port)
+			continue
+		}
+
+		result := allocationResult{pm: ServerPortMapping{ClientMapping: mapping, AllocatedPort: port}}
+		result.tcp, result.udp, err = bindServerListener(result.pm, serverInfo, clientInfo)
+		if err == nil {
+			return result
+		}
+	}
+	return allocationResult{err: err}
+}
+
+// refusedRegistration surfaces a registration the server refused, marking
+// every mapping failed. A full server is asked again after serverFullRetry
+// once ctx allows; without it, or for other refusals, the client exits.
+func refusedRegistration(ctx context.Context, config Configuration, rejection *RegistrationError) {
+	log.Printf("🚫 Server refused the registration: %s (%s)", rejection.Message, rejection.Code)
+	for _, mapping := range config.Mappings {
+		readiness.FailMapping(forwardedPortKey(mapping), fmt.Errorf("server refused the registration: %s", rejection.Message))
+	}
+	if rejection.Code != RegistrationErrorCapacity {
+		fatalf(ExitSignaling, "Server refused the registration: %s", rejection.Message)
+	}
+	if config.ServerFullRetry <= 0 {
+		fatalf(ExitCapacity, "Server is full; set 'serverFullRetry' to keep trying")
+	}
+	log.Printf("⏳ Registering again in %v", time.Duration(config.ServerFullRetry))
+	sleepContext(ctx, time.Duration(config.ServerFullRetry))
+}
+
+// reportFailedMappings logs the mappings the server could not allocate and
+// marks them failed in the readiness report
+func reportFailedMappings(mappings []PortMapping, serverData *ServerRegistrationData) {
+	for _, failure := range serverData.FailedMappings {
+		log.Printf("⚠️  Server could not allocate mapping %s: %s", failure.Mapping, failure.Error)
+		for _, mapping := range mappings {
+			if mapping.String() == failure.Mapping {
+				readiness.FailMapping(forwardedPortKey(mapping), fmt.Errorf("server could not allocate %s: %s", failure.Mapping, failure.Error))
+			}
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Package main - Throughput self-test through established mappings
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	benchmarkStartDelay = 3 * time.Second
+	benchmarkPings      = 10
+	benchmarkUDPPayload = 1200
+	benchmarkUDPBatch   = 32
+	benchmarkUDPLinger  = 2 * time.Second
+	benchmarkIOTimeout  = 10 * time.Second
+	benchmarkTCPChunk   = 32 * 1024
+)
+
+// benchmarkSizeMB is how many megabytes each mapping transfers in benchmark
+// mode; 0 disables benchmark mode
+var benchmarkSizeMB int
+
+// BenchmarkResult is the outcome of one mapping's self-test
+type BenchmarkResult struct {
+	Bytes    int64
+	Duration time.Duration
+	RTT      time.Duration
+	Sent     int64 // UDP packets sent
+	Received int64 // UDP packets echoed back
+}
+
+// MBps returns the achieved throughput in megabytes per second
+func (br BenchmarkResult) MBps() float64 {
+	if br.Duration <= 0 {
+		return 0
+	}
+	return float64(br.Bytes) / (1 << 20) / br.Duration.Seconds()
+}
+
+// Loss returns the fraction of UDP packets that were not echoed back
+func (br BenchmarkResult) Loss() float64 {
+	if br.Sent == 0 {
+		return 0
+	}
+	return 1 - float64(br.Received)/float64(br.Sent)
+}
+
+// runBenchmarks self-tests every established mapping in turn through its
+// local port. The server must run with -benchmark too, so that its synthetic
+// echo services sit behind the mappings.
+func runBenchmarks(ctx context.Context, mappings []ServerPortMapping) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(benchmarkStartDelay):
+	}
+
+	size := int64(benchmarkSizeMB) << 20
+	for _, pm := range mappings {
+		mapping := pm.ClientMapping
+		if mapping.Protocol == "icmp" {
+			continue
+		}
+		logger := mappingLogger(mapping)
+		logger.Infof("⏱️  Benchmarking %s with %d MB...", mapping, benchmarkSizeMB)
+
+		var result BenchmarkResult
+		var err error
+		if mapping.Protocol == "tcp" {
+			result, err = benchmarkTCP(ctx, mapping.LocalPort, size)
+		} else {
+			result, err = benchmarkUDP(ctx, mapping.LocalPort, size)
+		}
+		if err != nil {
+			logger.Errorf("❌ Benchmark of %s failed: %v", mapping, err)
+			continue
+		}
+
+		if mapping.Protocol == "tcp" {
+			logger.Infof("📊 Benchmark %s: %.2f MB/s, RTT %v", mapping, result.MBps(), result.RTT)
+		} else {
+			logger.Infof("📊 Benchmark %s: %.2f MB/s, loss %.2f%% (%d/%d packets), RTT %v",
+				mapping, result.MBps(), result.Loss()*100, result.Received, result.Sent, result.RTT)
+		}
+	}
+}
+
+// benchmarkTCP measures round trips and then echoes size bytes through the
+// mapping's local port
+func benchmarkTCP(ctx context.Context, localPort int, size int64) (BenchmarkResult, error) {
+	var result BenchmarkResult
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(localPort), benchmarkIOTimeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var rtts []time.Duration
+	ping := make([]byte, 8)
+	for i := 0; i < benchmarkPings; i++ {
+		conn.SetDeadline(time.Now().Add(benchmarkIOTimeout))
+		start := time.Now()
+		if _, err := conn.Write(ping); err != nil {
+			return result, err
+		}
+		if _, err := io.ReadFull(conn, ping); err != nil {
+			return result, fmt.Errorf("no echo from service: %w", err)
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	result.RTT = medianDuration(rtts)
+	conn.SetDeadline(time.Time{})
+
+	chunk := make([]byte, benchmarkTCPChunk)
+	rand.Read(chunk)
+
+	start := time.Now()
+	writeErr := make(chan error, 1)
+	go func() {
+		var written int64
+		for written < size {
+			n := min(int64(len(chunk)), size-written)
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				writeErr <- err
+				return
+			}
+			written += n
+		}
+		writeErr <- nil
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(benchmarkIOTimeout))
+	received, err := io.Copy(io.Discard, &deadlineReader{conn: conn, limit: size})
+	if err != nil {
+		return result, err
+	}
+	if err := <-writeErr; err != nil {
+		return result, err
+	}
+	result.Bytes = received
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// deadlineReader reads up to limit bytes, extending the read deadline as
+// long as data keeps arriving
+type deadlineReader struct {
+	conn  net.Conn
+	limit int64
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if dr.limit <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > dr.limit {
+		p = p[:dr.limit]
+	}
+	n, err := dr.conn.Read(p)
+	dr.limit -= int64(n)
+	dr.conn.SetReadDeadline(time.Now().Add(benchmarkIOTimeout))
+	return n, err
+}
+
+// benchmarkUDP measures round trips and then sends size bytes of sequenced
+// datagrams through the mapping's local port, counting the echoes
+func benchmarkUDP(ctx context.Context, localPort int, size int64) (BenchmarkResult, error) {
+	var result BenchmarkResult
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort})
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, benchmarkUDPPayload)
+	var rtts []time.Duration
+	for i := 0; i < benchmarkPings; i++ {
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		start := time.Now()
+		if _, err := conn.Write(buf[:8]); err != nil {
+			return result, err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			continue // Lost pings only lower the sample count
+		}
+		if n == 8 && binary.BigEndian.Uint64(buf) == uint64(i) {
+			rtts = append(rtts, time.Since(start))
+		}
+	}
+	if len(rtts) == 0 {
+		return result, fmt.Errorf("no echo from service")
+	}
+	result.RTT = medianDuration(rtts)
+
+	var received atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reply := make([]byte, benchmarkUDPPayload)
+		for {
+			conn.SetReadDeadline(time.Now().Add(benchmarkUDPLinger))
+			n, err := conn.Read(reply)
+			if err != nil {
+				return
+			}
+			if n == benchmarkUDPPayload {
+				received.Add(1)
+			}
+		}
+	}()
+
+	payload := make([]byte, benchmarkUDPPayload)
+	rand.Read(payload)
+	packets := (size + benchmarkUDPPayload - 1) / benchmarkUDPPayload
+
+	start := time.Now()
+	for seq := int64(0); seq < packets; seq++ {
+		binary.BigEndian.PutUint64(payload, uint64(seq))
+		if _, err := conn.Write(payload); err != nil {
+			return result, err
+		}
+		result.Sent++
+		// Pace batches so the local socket buffers do not drop everything
+		if seq%benchmarkUDPBatch == benchmarkUDPBatch-1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	<-done
+
+	result.Received = received.Load()
+	result.Bytes = result.Received * benchmarkUDPPayload
+	result.Duration = time.Since(start) - benchmarkUDPLinger
+	return result, nil
+}
+
+// medianDuration returns the median of samples
+func medianDuration(samples []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// startBenchmarkSink serves a synthetic echo service at a mapping's service
+// address in benchmark mode, so the client's self-test needs no real service.
+// Only loopback service addresses get one: the sink would otherwise listen
+// on an address of the server's network, open to anyone who can reach it.
+func startBenchmarkSink(ctx context.Context, mapping PortMapping) {
+	if benchmarkSizeMB <= 0 || mapping.Protocol == "icmp" {
+		return
+	}
+	logger := mappingLogger(mapping)
+	service := newServiceTarget(mapping)
+	target := service.String()
+	if !service.isLoopback() {
+		logger.Warnf("⚠️  Benchmark echo service not started on %s: only loopback service targets get one", target)
+		return
+	}
+
+	if mapping.Protocol == "tcp" {
+		ln, err := net.Listen("tcp", target)
+		if err != nil {
+			logger.Warnf("⚠️  Benchmark echo service not started on %s: %v", target, err)
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+	} else {
+		conn, err := net.ListenPacket("udp", target)
+		if err != nil {
+			logger.Warnf("⚠️  Benchmark echo service not started on %s: %v", target, err)
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		go func() {
+			buf := make([]byte, 65535)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteTo(buf[:n], addr)
+			}
+		}()
+	}
+	logger.Infof("⏱️  Benchmark echo service listening on %s", target)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServiceTargetIsLoopback(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"", true},
+		{"127.0.0.1:80", true},
+		{"127.1.2.3:80", true},
+		{"localhost:80", true},
+		{"[::1]:80", true},
+		{"10.0.0.5:80", false},
+		{"db.internal:5432", false},
+		{GatewayServiceHost, false},
+	}
+	for _, tt := range tests {
+		service := newServiceTarget(PortMapping{Protocol: "tcp", RemotePort: 80, ServiceTarget: tt.target})
+		if got := service.isLoopback(); got != tt.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+// nonLoopbackIP returns an IPv4 address of a local interface other than
+// loopback
+func nonLoopbackIP(t *testing.T) net.IP {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return nil
+}
+
+func TestBenchmarkSinkOnlyOnLoopback(t *testing.T) {
+	saved := benchmarkSizeMB
+	defer func() { benchmarkSizeMB = saved }()
+	benchmarkSizeMB = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port := freeTCPPort(t)
+	startBenchmarkSink(ctx, PortMapping{Protocol: "tcp", LocalPort: 1, RemotePort: port})
+	conn := dialRetry(t, "127.0.0.1:"+strconv.Itoa(port))
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("loopback sink echoed %q, %v", echoed, err)
+	}
+	conn.Close()
+
+	ip := nonLoopbackIP(t)
+	target := net.JoinHostPort(ip.String(), strconv.Itoa(freeTCPPort(t)))
+	startBenchmarkSink(ctx, PortMapping{Protocol: "tcp", LocalPort: 2, RemotePort: 1, ServiceTarget: target})
+	if conn, err := net.DialTimeout("tcp", target, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("benchmark sink listening on %s", target)
+	}
+
+	udpTarget := net.JoinHostPort(ip.String(), strconv.Itoa(freeUDPPort(t)))
+	startBenchmarkSink(ctx, PortMapping{Protocol: "udp", LocalPort: 3, RemotePort: 1, ServiceTarget: udpTarget})
+	addr, _ := net.ResolveUDPAddr("udp", udpTarget)
+	probe, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Errorf("benchmark sink bound %s: %v", udpTarget, err)
+	} else {
+		probe.Close()
+	}
+}
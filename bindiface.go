@@ -0,0 +1,206 @@
+// Package main - Pinning STUN and hole punching to one local interface
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// BindInterfaceAuto makes discovery pick the interface by trying STUN from
+// each of them
+const BindInterfaceAuto = "auto"
+
+// The interface STUN and hole punching sockets are pinned to, set by
+// selectBindInterface. Both are empty when sockets follow the default route.
+var (
+	bindInterfaceName string
+	bindIP            net.IP
+)
+
+// bindDeviceWarning makes a failed device binding warn only once
+var bindDeviceWarning sync.Once
+
+// interfaceIPv4 returns the first usable IPv4 address of iface
+func interfaceIPv4(iface net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil && !ip4.IsLinkLocalUnicast() {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", iface.Name)
+}
+
+// candidateInterfaces returns the interfaces that are up, not loopback and
+// have an IPv4 address
+func candidateInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var candidates []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err := interfaceIPv4(iface); err == nil {
+			candidates = append(candidates, iface)
+		}
+	}
+	return candidates
+}
+
+// interfaceProbe is the STUN result of one interface in auto selection
+type interfaceProbe struct {
+	iface      net.Interface
+	ip         net.IP
+	publicAddr string
+	err        error
+}
+
+// selectBindInterface applies the bindInterface setting: an interface name,
+// "auto", or empty for the default route
+func selectBindInterface(setting, stunServer string) error {
+	if setting == "" {
+		return nil
+	}
+	if setting != BindInterfaceAuto {
+		iface, err := net.InterfaceByName(setting)
+		if err != nil {
+			return fmt.Errorf("bindInterface %q: %v (available: %s)", setting, err, interfaceNames(candidateInterfaces()))
+		}
+		ip, err := interfaceIPv4(*iface)
+		if err != nil {
+			return fmt.Errorf("bindInterface: %v", err)
+		}
+		bindInterfaceName, bindIP = iface.Name, ip
+		log.Printf("📌 STUN and hole punching bound to interface %s (%s)", bindInterfaceName, bindIP)
+		return nil
+	}
+
+	probes := probeInterfaces(candidateInterfaces(), stunServer)
+	log.Printf("🔎 STUN from each interface via %s:", stunServer)
+	var usable []interfaceProbe
+	for _, probe := range probes {
+		if probe.err != nil {
+			log.Printf("   %s (%s): %v", probe.iface.Name, probe.ip, probe.err)
+			continue
+		}
+		log.Printf("   %s (%s): public %s", probe.iface.Name, probe.ip, probe.publicAddr)
+		usable = append(usable, probe)
+	}
+	if len(usable) == 0 {
+		log.Printf("⚠️  No interface got a STUN mapping, using the default route")
+		return nil
+	}
+
+	// Point-to-point links are usually VPN tunnels, which tend to break hole
+	// punching, so other interfaces are preferred
+	sort.SliceStable(usable, func(i, j int) bool {
+		return usable[i].iface.Flags&net.FlagPointToPoint == 0 && usable[j].iface.Flags&net.FlagPointToPoint != 0
+	})
+	bindInterfaceName, bindIP = usable[0].iface.Name, usable[0].ip
+	log.Printf("📌 Selected interface %s (%s) for STUN and hole punching", bindInterfaceName, bindIP)
+	return nil
+}
+
+// probeInterfaces runs a STUN binding request from each interface in
+// parallel, returning the results in interface order
+func probeInterfaces(ifaces []net.Interface, stunServer string) []interfaceProbe {
+	probes := make([]interfaceProbe, len(ifaces))
+	var wg sync.WaitGroup
+	for i, iface := range ifaces {
+		probes[i].iface = iface
+		wg.Add(1)
+		go func(probe *interfaceProbe) {
+			defer wg.Done()
+			probe.ip, probe.err = interfaceIPv4(probe.iface)
+			if probe.err != nil {
+				return
+			}
+			conn, err := listenUDPOnInterface(probe.iface.Name, &net.UDPAddr{IP: probe.ip})
+			if err != nil {
+				probe.err = err
+				return
+			}
+			defer conn.Close()
+			probe.publicAddr, probe.err = performSTUNDiscoveryOnConn(conn, stunServer)
+		}(&probes[i])
+	}
+	wg.Wait()
+	return probes
+}
+
+// interfaceNames lists interface names for error messages
+func interfaceNames(ifaces []net.Interface) string {
+	names := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		names[i] = iface.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// interfaceControl returns a socket Control function pinning sockets to
+// the named interface where the platform supports it. Sockets are bound to
+// the interface's address either way; pinning the device also keeps them
+// off a default route through another interface.
+func interfaceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if name == "" {
+			return nil
+		}
+		if err := bindToDevice(c, name); err != nil {
+			bindDeviceWarning.Do(func() {
+				log.Printf("⚠️  Cannot pin sockets to interface %s, binding its address only: %v", name, err)
+			})
+		}
+		return nil
+	}
+}
+
+// listenUDPOnInterface opens an unconnected UDP socket on addr, pinned to
+// the named interface
+func listenUDPOnInterface(name string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: interfaceControl(name)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenUDPOnBindInterface opens a hole punching socket on addr, using the
+// bindInterface address when addr leaves the IP open
+func listenUDPOnBindInterface(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if bindIP == nil {
+		return net.ListenUDP("udp", addr)
+	}
+	bound := *addr
+	if bound.IP == nil || bound.IP.IsUnspecified() {
+		bound.IP = bindIP
+	}
+	return listenUDPOnInterface(bindInterfaceName, &bound)
+}
+
+// dialFromBindInterface dials a UDP address from the bindInterface, or from
+// the default route's interface when none is set
+func dialFromBindInterface(network, address string) (net.Conn, error) {
+	if bindIP == nil {
+		return net.Dial(network, address)
+	}
+	dialer := net.Dialer{LocalAddr: &net.UDPAddr{IP: bindIP}, Control: interfaceControl(bindInterfaceName)}
+	return dialer.Dial(network, address)
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+// Package main - Interface pinning with SO_BINDTODEVICE
+package main
+
+import "syscall"
+
+// bindToDevice pins a socket to the named interface
+func bindToDevice(c syscall.RawConn, name string) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.BindToDevice(int(fd), name)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
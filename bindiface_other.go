@@ -0,0 +1,12 @@
+//go:build !linux
+
+// Package main - Interface pinning fallback
+package main
+
+import "syscall"
+
+// bindToDevice is a no-op where sockets cannot be pinned to a device; they
+// are still bound to the interface's address
+func bindToDevice(c syscall.RawConn, name string) error {
+	return nil
+}
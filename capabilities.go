@@ -0,0 +1,117 @@
+// Package main - Capabilities the server advertises and client negotiation
+package main
+
+import "log"
+
+// ProtocolVersion is the version of the registration exchange. Servers that
+// predate capabilities are version 0.
+const ProtocolVersion = 1
+
+// Capability names advertised by the server
+const (
+	CapabilityRelay     = "relay"        // Transport: relayed through the server's public ports
+	CapabilityHolePunch = "holePunch"    // Transport: hole-punched UDP paths
+	CapabilityQUIC      = "quic"         // Transport: TCP mappings as QUIC streams
+	CapabilityUDPMux    = "udpMux"       // Feature: UDP mappings multiplexed over one socket
+	CapabilityUDPFin    = "udpFin"       // Feature: FIN frames over the UDP mux
+	CapabilityCompress  = "compress"     // Feature: deflated TCP hop
+	CapabilityJitter    = "jitterBuffer" // Feature: reordering of hole-punched UDP datagrams
+	CapabilityCoalesce  = "udpCoalesce"  // Feature: bundling of small hole-punched UDP datagrams
+	CapabilityServices  = "services"     // Feature: "@name" service mappings
+)
+
+// ServerCapabilities tells the client what the server supports, so it uses
+// only what both sides have instead of failing on a feature the server
+// lacks
+type ServerCapabilities struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Transports      []string `json:"transports"` // relay (offered for mappings that cannot be hole punched), holePunch, quic
+	Protocols       []string `json:"protocols"`  // Mapping protocols: tcp, udp, icmp
+	Features        []string `json:"features"`   // udpMux, udpFin, compress, jitterBuffer, udpCoalesce, services
+}
+
+// serverCapabilities returns the capabilities of this build
+func serverCapabilities() *ServerCapabilities {
+	return &ServerCapabilities{
+		ProtocolVersion: ProtocolVersion,
+		Transports:      []string{CapabilityRelay, CapabilityHolePunch, CapabilityQUIC},
+		Protocols:       []string{"tcp", "udp", "icmp"},
+		Features: []string{CapabilityUDPMux, CapabilityUDPFin, CapabilityCompress,
+			CapabilityJitter, CapabilityCoalesce, CapabilityServices},
+	}
+}
+
+// has reports whether name is among the advertised transports, protocols
+// or features
+func (c *ServerCapabilities) has(name string) bool {
+	for _, list := range [][]string{c.Transports, c.Protocols, c.Features} {
+		for _, item := range list {
+			if item == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiatedFeatures is what the client uses of the session-wide options it
+// asked for. Per-mapping options such as compress and jitterBuffer are
+// negotiated by the server echoing each mapping back with the options it
+// applied.
+type negotiatedFeatures struct {
+	quic   bool
+	udpMux bool
+	udpFin bool
+}
+
+// negotiateFeatures applies the negotiation rules: an option is used when
+// the client asked for it and the server advertises it. Servers without
+// capabilities (protocol version 0) keep the behavior of older clients:
+// QUIC when the server sent a certificate fingerprint, and the UDP mux and
+// FIN frames as configured.
+func negotiateFeatures(config Configuration, serverData *ServerRegistrationData) negotiatedFeatures {
+	caps := serverData.Capabilities
+	if caps == nil {
+		log.Printf("ℹ️  Server does not advertise capabilities (protocol version 0), assuming the legacy feature set")
+		return negotiatedFeatures{
+			quic:   config.Transport == TransportQUIC && serverData.QUICFingerprint != "",
+			udpMux: config.UDPMux,
+			udpFin: config.UDPMux && config.UDPFin,
+		}
+	}
+
+	log.Printf("🧩 Server protocol version %d: transports %v, protocols %v, features %v",
+		caps.ProtocolVersion, caps.Transports, caps.Protocols, caps.Features)
+	if caps.ProtocolVersion > ProtocolVersion {
+		log.Printf("ℹ️  Server speaks a newer protocol version (%d > %d), using the common subset", caps.ProtocolVersion, ProtocolVersion)
+	}
+
+	features := negotiatedFeatures{
+		quic:   config.Transport == TransportQUIC && caps.has(CapabilityQUIC) && serverData.QUICFingerprint != "",
+		udpMux: config.UDPMux && caps.has(CapabilityUDPMux),
+		udpFin: config.UDPMux && config.UDPFin && caps.has(CapabilityUDPMux) && caps.has(CapabilityUDPFin),
+	}
+	if config.Transport == TransportQUIC && !features.quic {
+		log.Printf("⚠️  Server does not offer QUIC, TCP mappings use the relay")
+	}
+	if config.UDPMux && !features.udpMux {
+		log.Printf("⚠️  Server does not support udpMux, UDP mappings are punched individually")
+	}
+	if config.UDPMux && config.UDPFin && features.udpMux && !features.udpFin {
+		log.Printf("⚠️  Server does not support udpFin, UDP session ends are not propagated")
+	}
+	return features
+}
+
+// reportUnsupportedProtocols warns about mappings whose protocol the server
+// does not advertise; such mappings are not allocated
+func reportUnsupportedProtocols(mappings []PortMapping, caps *ServerCapabilities) {
+	if caps == nil {
+		return
+	}
+	for _, mapping := range mappings {
+		if !caps.has(mapping.Protocol) {
+			log.Printf("⚠️  Mapping %s: server does not support %s mappings", mapping, mapping.Protocol)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Package main - Time source of hole punching, replaceable in tests
+package main
+
+import "time"
+
+// Clock is the time source hole punching paces its sends, delays and
+// timeouts with. Tests set HolePunchConfig.Clock to a clock they advance by
+// hand, so they can assert the sequence of sends and the timeout behavior
+// without real sleeps. Socket read deadlines stay on the real clock, as the
+// kernel enforces them; they only back up the clock's timeouts.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of the time package
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time { return time.Now() }
+
+// After waits for d in a goroutine, then sends the current time
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep pauses the calling goroutine for d
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewTicker returns a ticker ticking every d
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker is the Ticker of the time package
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+// C returns the channel the ticks are delivered on
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+
+// Stop turns the ticker off
+func (t realTicker) Stop() { t.ticker.Stop() }
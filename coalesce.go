@@ -0,0 +1,148 @@
+// Package main - Coalescing of small datagrams on hole-punched UDP paths
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// coalesceLenSize is the length prefix of each datagram in a bundle
+	coalesceLenSize = 2
+	// coalesceMaxBundle keeps bundles below common path MTUs; a datagram
+	// that does not fit in the current bundle flushes it
+	coalesceMaxBundle = 1200
+	// maxUDPCoalesceDelay caps udpCoalesceDelay, beyond which the added
+	// latency outweighs any saving
+	maxUDPCoalesceDelay = 100 * time.Millisecond
+)
+
+// validateUDPCoalesceDelay checks a mapping's udpCoalesceDelay
+func validateUDPCoalesceDelay(delay Duration) error {
+	if delay < 0 || time.Duration(delay) > maxUDPCoalesceDelay {
+		return fmt.Errorf("'udpCoalesceDelay' must be between 0 and %v", maxUDPCoalesceDelay)
+	}
+	return nil
+}
+
+// coalescedConn bundles the datagrams written within delay of each other
+// into one datagram of length-prefixed frames, and splits received bundles
+// back into datagrams. Both ends of a path must use it.
+type coalescedConn struct {
+	net.Conn
+	delay    time.Duration
+	bundle   []byte
+	timer    *time.Timer
+	flushErr error // Error of the last timed flush, returned by the next Write
+	mutex    sync.Mutex
+
+	readBuf []byte
+	pending [][]byte // Datagrams of the last bundle not yet read
+}
+
+// newCoalescedConn wraps conn, holding written datagrams for up to delay
+func newCoalescedConn(conn net.Conn, delay time.Duration) *coalescedConn {
+	return &coalescedConn{
+		Conn:    conn,
+		delay:   delay,
+		bundle:  make([]byte, 0, coalesceMaxBundle),
+		readBuf: make([]byte, UDPBufferSize+coalesceLenSize),
+	}
+}
+
+// Write adds p to the current bundle, sending the bundle once it is full
+// or delay after its first datagram
+func (cc *coalescedConn) Write(p []byte) (int, error) {
+	if len(p) > UDPBufferSize {
+		return 0, errors.New("datagram too large to coalesce")
+	}
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if err := cc.flushErr; err != nil {
+		cc.flushErr = nil
+		return 0, err
+	}
+
+	if len(cc.bundle) > 0 && len(cc.bundle)+coalesceLenSize+len(p) > coalesceMaxBundle {
+		if err := cc.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	cc.bundle = binary.BigEndian.AppendUint16(cc.bundle, uint16(len(p)))
+	cc.bundle = append(cc.bundle, p...)
+	if len(cc.bundle) >= coalesceMaxBundle {
+		if err := cc.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cc.timer == nil {
+		cc.timer = time.AfterFunc(cc.delay, cc.flush)
+	}
+	return len(p), nil
+}
+
+// flush sends the current bundle when its delay is up
+func (cc *coalescedConn) flush() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if err := cc.flushLocked(); err != nil {
+		cc.flushErr = err
+	}
+}
+
+// flushLocked sends the current bundle; cc.mutex must be held
+func (cc *coalescedConn) flushLocked() error {
+	if cc.timer != nil {
+		cc.timer.Stop()
+		cc.timer = nil
+	}
+	if len(cc.bundle) == 0 {
+		return nil
+	}
+	_, err := cc.Conn.Write(cc.bundle)
+	cc.bundle = cc.bundle[:0]
+	return err
+}
+
+// Read returns the next datagram, reading a bundle when the previous one
+// is used up. Malformed bundles are dropped from the bad frame on.
+func (cc *coalescedConn) Read(p []byte) (int, error) {
+	for len(cc.pending) == 0 {
+		n, err := cc.Conn.Read(cc.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		cc.pending = splitBundle(cc.readBuf[:n])
+	}
+	datagram := cc.pending[0]
+	cc.pending = cc.pending[1:]
+	return copy(p, datagram), nil
+}
+
+// splitBundle returns the datagrams framed in bundle
+func splitBundle(bundle []byte) [][]byte {
+	var datagrams [][]byte
+	for len(bundle) >= coalesceLenSize {
+		size := int(binary.BigEndian.Uint16(bundle))
+		bundle = bundle[coalesceLenSize:]
+		if size > len(bundle) {
+			break
+		}
+		datagrams = append(datagrams, bundle[:size])
+		bundle = bundle[size:]
+	}
+	return datagrams
+}
+
+// Close sends what is still bundled and closes the connection
+func (cc *coalescedConn) Close() error {
+	cc.mutex.Lock()
+	cc.flushLocked()
+	cc.mutex.Unlock()
+	return cc.Conn.Close()
+}
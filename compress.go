@@ -0,0 +1,138 @@
+// Package main - Compression of the peer-to-peer hop of TCP mappings
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// compressSampleSize bytes are compressed before compressibility is judged
+	compressSampleSize = 64 * 1024
+	// compressMinSaving is the smallest saving worth compressing for; data
+	// compressing worse than this is sent raw for the rest of the connection
+	compressMinSaving = 0.1
+)
+
+// compressedConn compresses what is written to Conn with deflate and
+// decompresses what is read from it. Both ends of the hop must use it.
+//
+// Writes are flushed immediately so interactive protocols are not delayed.
+// Once the first compressSampleSize bytes show the data barely compresses
+// (already compressed protocols such as TLS), the writer ends the deflate
+// stream and sends the remaining bytes raw; the reader follows by switching
+// to raw reads when the deflate stream ends.
+type compressedConn struct {
+	net.Conn
+
+	reader   *bufio.Reader
+	inflater io.Reader
+	readRaw  bool
+
+	deflater *flate.Writer
+	writeRaw bool
+	rawIn    int64 // Bytes given to the deflater
+	wireOut  int64 // Compressed bytes written for them
+	writeMu  sync.Mutex
+}
+
+// newCompressedConn wraps the peer side of a forwarded TCP connection
+func newCompressedConn(conn net.Conn) *compressedConn {
+	cc := &compressedConn{Conn: conn}
+	// bufio.Reader is an io.ByteReader, so the inflater never reads past the
+	// end of the deflate stream and the raw bytes after it stay in reader
+	cc.reader = bufio.NewReaderSize(conn, TCPBufferSize)
+	cc.inflater = flate.NewReader(cc.reader)
+	cc.deflater, _ = flate.NewWriter(countingWriter{cc}, flate.BestSpeed)
+	return cc
+}
+
+// countingWriter counts compressed bytes on their way to the connection
+type countingWriter struct {
+	cc *compressedConn
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.cc.Conn.Write(p)
+	w.cc.wireOut += int64(n)
+	globalStats.CompressedOut.Add(int64(n))
+	return n, err
+}
+
+// Read returns decompressed data, then raw data once the peer stopped
+// compressing
+func (cc *compressedConn) Read(p []byte) (int, error) {
+	if !cc.readRaw {
+		n, err := cc.inflater.Read(p)
+		switch err {
+		case io.EOF:
+			cc.readRaw = true
+			if n > 0 {
+				return n, nil
+			}
+		case io.ErrUnexpectedEOF:
+			// The peer closed without ending the deflate stream
+			return n, io.EOF
+		default:
+			return n, err
+		}
+	}
+	return cc.reader.Read(p)
+}
+
+// Write compresses and flushes p, or sends it raw once compression was
+// found not to pay off
+func (cc *compressedConn) Write(p []byte) (int, error) {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+
+	if cc.writeRaw {
+		return cc.Conn.Write(p)
+	}
+	if _, err := cc.deflater.Write(p); err != nil {
+		return 0, err
+	}
+	if err := cc.deflater.Flush(); err != nil {
+		return 0, err
+	}
+	cc.rawIn += int64(len(p))
+	globalStats.CompressedIn.Add(int64(len(p)))
+
+	if cc.rawIn >= compressSampleSize && float64(cc.wireOut) > float64(cc.rawIn)*(1-compressMinSaving) {
+		if err := cc.deflater.Close(); err != nil {
+			return 0, err
+		}
+		cc.writeRaw = true
+		globalStats.CompressionDisabled.Add(1)
+	}
+	return len(p), nil
+}
+
+// endStream terminates the deflate stream so the peer sees a clean end
+func (cc *compressedConn) endStream() {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	if !cc.writeRaw {
+		cc.deflater.Close()
+		cc.writeRaw = true
+	}
+}
+
+// CloseWrite ends the deflate stream and half-closes the connection
+func (cc *compressedConn) CloseWrite() error {
+	cc.endStream()
+	if tcpConn, ok := cc.Conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return cc.Conn.Close()
+}
+
+// Close closes the connection. Every write was flushed already, and the
+// peer treats a deflate stream cut short by a close as a normal end, so
+// Close does not wait for a blocked Write to end the stream.
+func (cc *compressedConn) Close() error {
+	return cc.Conn.Close()
+}
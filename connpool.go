@@ -0,0 +1,208 @@
+// Package main - Pre-dialed connection pool for server-side local service dials
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLocalConnPoolSize = 4
+	localConnPoolMaxIdle     = 30 * time.Second
+	localConnPoolRetryDelay  = 2 * time.Second
+)
+
+// LocalConnPool keeps a few connections to a TCP service dialed ahead of
+// time, so a forwarded connection does not wait for the local connect.
+// Each pooled connection is handed out once: a byte stream cannot be shared
+// between forwarded connections without knowing the protocol's message
+// boundaries.
+type LocalConnPool struct {
+	target  *ServiceTarget
+	size    int
+	idle    chan pooledConn
+	refill  chan struct{}
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// pooledConn is an idle pre-dialed connection
+type pooledConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// NewLocalConnPool starts filling a pool of size connections to target
+func NewLocalConnPool(target *ServiceTarget, size int) *LocalConnPool {
+	if size <= 0 {
+		size = defaultLocalConnPoolSize
+	}
+	p := &LocalConnPool{
+		target: target,
+		size:   size,
+		idle:   make(chan pooledConn, size),
+		refill: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+// Get returns a live pooled connection, or dials a new one when the pool is
+// empty
+func (p *LocalConnPool) Get() (net.Conn, error) {
+	defer p.requestRefill()
+
+	for {
+		select {
+		case pc := <-p.idle:
+			if time.Since(pc.created) > localConnPoolMaxIdle {
+				pc.conn.Close()
+				continue
+			}
+			if conn, ok := checkPooledConn(pc.conn); ok {
+				return conn, nil
+			}
+		default:
+			return p.target.dial("tcp")
+		}
+	}
+}
+
+// Close stops refilling and closes the idle connections
+func (p *LocalConnPool) Close() {
+	p.closing.Do(func() {
+		close(p.closed)
+		p.drain()
+	})
+}
+
+// requestRefill wakes the fill loop without blocking
+func (p *LocalConnPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fill tops the pool up whenever it is asked to, and periodically replaces
+// connections that have idled too long
+func (p *LocalConnPool) fill() {
+	ticker := time.NewTicker(localConnPoolMaxIdle / 2)
+	defer ticker.Stop()
+	// Connections added while Close was draining are closed here
+	defer p.drain()
+
+	for {
+		if !p.topUp() {
+			// The service may be down; retry later instead of spinning
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(localConnPoolRetryDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-p.closed:
+			return
+		case <-p.refill:
+		case <-ticker.C:
+			p.dropExpired()
+		}
+	}
+}
+
+// topUp dials until the pool is full, returning false if a dial failed
+func (p *LocalConnPool) topUp() bool {
+	for len(p.idle) < p.size {
+		conn, err := p.target.dial("tcp")
+		if err != nil {
+			return false
+		}
+		select {
+		case p.idle <- pooledConn{conn: conn, created: time.Now()}:
+		default:
+			conn.Close()
+			return true
+		}
+	}
+	return true
+}
+
+// drain closes every idle connection
+func (p *LocalConnPool) drain() {
+	for {
+		select {
+		case pc := <-p.idle:
+			pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dropExpired closes idle connections older than the idle limit
+func (p *LocalConnPool) dropExpired() {
+	for i := len(p.idle); i > 0; i-- {
+		select {
+		case pc := <-p.idle:
+			if time.Since(pc.created) > localConnPoolMaxIdle {
+				pc.conn.Close()
+				continue
+			}
+			select {
+			case p.idle <- pc:
+			default:
+				pc.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// checkPooledConn reports whether an idle connection is still open. Bytes the
+// service sent while idle (a greeting banner) are kept and returned first.
+func checkPooledConn(conn net.Conn) (net.Conn, bool) {
+	buf := make([]byte, TCPBufferSize)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		conn.Close()
+		return nil, false
+	}
+	if n > 0 {
+		return &prefixedConn{Conn: conn, prefix: buf[:n]}, true
+	}
+	return conn, true
+}
+
+// prefixedConn replays bytes read ahead of time before reading from Conn
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying TCP connection
+func (c *prefixedConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
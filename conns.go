@@ -0,0 +1,232 @@
+// Package main - Registry of active forwarded connections
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveConn is a forwarded TCP connection or UDP session that can be listed
+// and killed at runtime
+type ActiveConn struct {
+	ID       uint64
+	Mapping  string // "protocol:port", as in /readyz
+	Remote   string // Address of the side that opened the connection
+	Started  time.Time
+	BytesIn  atomic.Int64 // Bytes received from Remote
+	BytesOut atomic.Int64 // Bytes sent to Remote
+	close    func()
+
+	sampledIn  atomic.Int64 // BytesIn already counted in traffic samples
+	sampledOut atomic.Int64 // BytesOut already counted in traffic samples
+}
+
+// trafficCount is the bytes a mapping forwarded in each direction
+type trafficCount struct {
+	in, out int64
+}
+
+// unsampled returns the bytes of conn not yet counted in traffic samples
+// and marks them counted
+func (c *ActiveConn) unsampled() (in, out int64) {
+	in = c.BytesIn.Load()
+	out = c.BytesOut.Load()
+	return in - c.sampledIn.Swap(in), out - c.sampledOut.Swap(out)
+}
+
+// ConnRegistry tracks active connections by ID
+type ConnRegistry struct {
+	conns  map[uint64]*ActiveConn
+	ended  map[string]trafficCount // Unsampled bytes of ended connections, by mapping
+	nextID uint64
+	mutex  sync.Mutex
+}
+
+// activeConns is the process-wide connection registry
+var activeConns = &ConnRegistry{conns: make(map[uint64]*ActiveConn)}
+
+// Add registers a connection; close must tear it down and is called at
+// most once, by Kill
+func (r *ConnRegistry) Add(mapping, remote string, close func()) *ActiveConn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nextID++
+	conn := &ActiveConn{ID: r.nextID, Mapping: mapping, Remote: remote, Started: time.Now(), close: close}
+	r.conns[conn.ID] = conn
+	return conn
+}
+
+// Remove forgets a connection that ended
+func (r *ConnRegistry) Remove(conn *ActiveConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.conns, conn.ID)
+	r.endLocked(conn)
+}
+
+// endLocked keeps the bytes of an ended connection for the next traffic
+// sample; r.mutex must be held
+func (r *ConnRegistry) endLocked(conn *ActiveConn) {
+	in, out := conn.unsampled()
+	if in == 0 && out == 0 {
+		return
+	}
+	if r.ended == nil {
+		r.ended = make(map[string]trafficCount)
+	}
+	ended := r.ended[conn.Mapping]
+	ended.in += in
+	ended.out += out
+	r.ended[conn.Mapping] = ended
+}
+
+// takeEnded returns the unsampled bytes of connections that ended since the
+// last call, by mapping
+func (r *ConnRegistry) takeEnded() map[string]trafficCount {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ended := r.ended
+	r.ended = nil
+	if ended == nil {
+		ended = make(map[string]trafficCount)
+	}
+	return ended
+}
+
+// List returns the active connections ordered by ID
+func (r *ConnRegistry) List() []*ActiveConn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	conns := make([]*ActiveConn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// Kill closes the connection with the given ID
+func (r *ConnRegistry) Kill(id uint64) error {
+	r.mutex.Lock()
+	conn, ok := r.conns[id]
+	delete(r.conns, id)
+	if ok {
+		r.endLocked(conn)
+	}
+	r.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no active connection #%d", id)
+	}
+	// Called without the lock: close may end in Remove
+	conn.close()
+	log.Printf("🔪 Killed connection #%d (%s from %s)", conn.ID, conn.Mapping, conn.Remote)
+	return nil
+}
+
+// printConnections writes the active connections for the CLI
+func printConnections(w io.Writer) {
+	conns := activeConns.List()
+	if len(conns) == 0 {
+		fmt.Fprintln(w, "🔌 No active connections")
+		return
+	}
+	fmt.Fprintf(w, "🔌 Active connections (%d):\n", len(conns))
+	for _, conn := range conns {
+		fmt.Fprintf(w, "  #%d %s from %s, %d bytes in, %d bytes out, age %v\n",
+			conn.ID, conn.Mapping, conn.Remote, conn.BytesIn.Load(), conn.BytesOut.Load(),
+			time.Since(conn.Started).Round(time.Second))
+	}
+}
+
+// killConnection handles the CLI kill command
+func killConnection(w io.Writer, idStr string) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		fmt.Fprintf(w, "❌ Invalid connection ID: %s\n", idStr)
+		return
+	}
+	if err := activeConns.Kill(id); err != nil {
+		fmt.Fprintf(w, "❌ %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "✅ Connection #%d closed\n", id)
+}
+
+// StartConnectionConsole reads connection commands from stdin. It serves the
+// server side, which has no mapping CLI to host them.
+func StartConnectionConsole(ctx context.Context) {
+	if !stdinIsTerminal() {
+		return
+	}
+
+	log.Printf("🎛️  Connection console started, type 'help' for commands")
+	scanner := bufio.NewScanner(os.Stdin)
+	for ctx.Err() == nil && scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		runConnectionCommand(os.Stdout, parts)
+	}
+}
+
+// runConnectionCommand executes one connection console command, writing its
+// output to w, and reports whether it was quit
+func runConnectionCommand(w io.Writer, parts []string) bool {
+	switch command := strings.ToLower(parts[0]); command {
+	case "conns":
+		printConnections(w)
+	case "kill":
+		if len(parts) != 2 {
+			fmt.Fprintln(w, "Usage: kill <connId>")
+			return false
+		}
+		killConnection(w, parts[1])
+	case "stats":
+		runStatsCommand(w, parts)
+	case "drain":
+		if len(parts) > 2 {
+			fmt.Fprintln(w, "Usage: drain [room]")
+			return false
+		}
+		room := ""
+		if len(parts) == 2 {
+			room = parts[1]
+		}
+		drainServer(w, room)
+	case "help":
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "  conns - List active connections")
+		fmt.Fprintln(w, "  kill <connId> - Close one active connection")
+		fmt.Fprintln(w, "  stats - Show forwarding statistics")
+		fmt.Fprintln(w, "  stats reset [mapping] - Clear the throughput samples of a mapping, or of all")
+		fmt.Fprintln(w, "  drain [room] - Move clients elsewhere, finish open connections and stop")
+	case "quit", "exit":
+		return true
+	default:
+		fmt.Fprintf(w, "Unknown command: %s. Type 'help' for available commands.\n", command)
+	}
+	return false
+}
+
+// byteCounter adds the bytes written through it to a counter
+type byteCounter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw byteCounter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,88 @@
+// Package main - Control socket exposing the command console to local tools
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// controlResponseEnd terminates the output of each command on the control
+// socket, so tools know when a response is complete
+const controlResponseEnd = "."
+
+// commandHandler runs one console command, writing its output to w, and
+// reports whether the command ends the session
+type commandHandler func(w io.Writer, parts []string) bool
+
+// listenControl opens the control socket: a Unix socket for "unix:/path"
+// or any absolute path, a TCP listener for host:port
+func listenControl(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix && !strings.HasPrefix(addr, "/") {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				log.Printf("⚠️  Control port %s is not on loopback; anyone reaching it can change mappings", addr)
+			}
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket file left by a previous run would make the bind fail
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveControl accepts control connections until ctx is done, running each
+// line received as a command through handle
+func serveControl(ctx context.Context, ln net.Listener, handle commandHandler) {
+	log.Printf("🎛️  Control socket listening on %s", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go serveControlConn(ctx, conn, handle)
+	}
+}
+
+// serveControlConn runs the commands of one control connection. Every
+// response ends with a line holding a single ".".
+func serveControlConn(ctx context.Context, conn net.Conn, handle commandHandler) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	scanner := bufio.NewScanner(conn)
+	writer := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		quit := handle(writer, parts)
+		fmt.Fprintln(writer, controlResponseEnd)
+		if writer.Flush() != nil || quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package main - Peer environment exchanged at registration for debugging
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"runtime"
+	"runtime/debug"
+)
+
+// maxDiagnosticsField bounds each text field of a peer's diagnostics, so
+// they stay a compact line in the other peer's log
+const maxDiagnosticsField = 64
+
+// Diagnostics describe a peer's environment. Both sides send theirs with
+// their registration and log the other's at debug level, so a failed
+// connection can be looked at from both ends in either peer's log.
+type Diagnostics struct {
+	OS         string `json:"os"`      // GOOS/GOARCH
+	Version    string `json:"version"` // Build version or VCS revision
+	GoVersion  string `json:"goVersion"`
+	NATType    string `json:"natType,omitempty"`
+	Interfaces int    `json:"interfaces"`           // Up, non-loopback network interfaces
+	STUNServer string `json:"stunServer,omitempty"` // Server NAT discovery used
+}
+
+// localDiagnostics returns the diagnostics of this process with its network
+// info
+func localDiagnostics(config Configuration, info *NetworkInfo) *Diagnostics {
+	diagnostics := &Diagnostics{
+		OS:         runtime.GOOS + "/" + runtime.GOARCH,
+		Version:    buildVersion(),
+		GoVersion:  runtime.Version(),
+		Interfaces: countInterfaces(),
+		STUNServer: config.STUNServer,
+	}
+	if info.STUNResult != nil {
+		diagnostics.NATType = info.STUNResult.NATType.String()
+	}
+	return diagnostics.bounded()
+}
+
+// buildVersion returns the module version of the build, or its VCS
+// revision for development builds
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "devel"
+}
+
+// countInterfaces returns the number of up, non-loopback interfaces
+func countInterfaces() int {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// bounded returns d with its text fields cut to maxDiagnosticsField
+func (d *Diagnostics) bounded() *Diagnostics {
+	if d == nil {
+		return nil
+	}
+	b := *d
+	for _, field := range []*string{&b.OS, &b.Version, &b.GoVersion, &b.NATType, &b.STUNServer} {
+		if len(*field) > maxDiagnosticsField {
+			*field = (*field)[:maxDiagnosticsField]
+		}
+	}
+	return &b
+}
+
+// logPeerDiagnostics logs the diagnostics a peer sent, if any, at debug
+// level
+func logPeerDiagnostics(logger *Logger, peer string, d *Diagnostics) {
+	if d == nil {
+		logger.Debugf("%s sent no diagnostics", peer)
+		return
+	}
+	data, _ := json.Marshal(d.bounded())
+	logger.Debugf("%s diagnostics: %s", peer, data)
+}
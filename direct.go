@@ -0,0 +1,78 @@
+// Package main - Direct transport over an existing VPN between the peers
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// TransportDirect connects to the server's directAddr, e.g. its address
+	// on a WireGuard tunnel, instead of punching or relaying over the
+	// Internet
+	TransportDirect = "direct"
+
+	// directProbeTimeout bounds the reachability check of the server's
+	// directAddr
+	directProbeTimeout = 3 * time.Second
+)
+
+// validateDirectAddr checks that directAddr is an IP address
+func validateDirectAddr(addr string) error {
+	if net.ParseIP(addr) == nil {
+		return errors.New("must be an IP address, e.g. the host's WireGuard address")
+	}
+	return nil
+}
+
+// useDirectPath reports whether the client connects to the server over its
+// directAddr, which both sides only publish for the direct transport
+func useDirectPath(clientInfo, serverInfo *NetworkInfo) bool {
+	return clientInfo.DirectAddr != "" && serverInfo.DirectAddr != ""
+}
+
+// checkDirectPath probes the server's directAddr and clears it when it is
+// unreachable, so mappings fall back to the server's public listeners.
+// The probe connects to an allocated port, preferring a UDP mapping's port
+// whose TCP counterpart is normally closed: a refused connection proves the
+// path as well as an accepted one, without reaching a service.
+func checkDirectPath(clientInfo, serverInfo *NetworkInfo, portMappings []ServerPortMapping) {
+	if clientInfo.DirectAddr == "" {
+		return
+	}
+	if serverInfo.DirectAddr == "" {
+		log.Printf("⚠️  Server has no 'directAddr', direct transport unavailable: using the relay")
+		return
+	}
+	if len(portMappings) == 0 {
+		return
+	}
+	port := portMappings[0].AllocatedPort
+	for _, pm := range portMappings {
+		if pm.ClientMapping.Protocol != "tcp" {
+			port = pm.AllocatedPort
+			break
+		}
+	}
+	if !probeDirectAddr(serverInfo.DirectAddr, port) {
+		log.Printf("⚠️  Server direct address %s unreachable, falling back to the relay", serverInfo.DirectAddr)
+		serverInfo.DirectAddr = ""
+		return
+	}
+	log.Printf("🔗 Direct transport: server reachable at %s, skipping hole punching", serverInfo.DirectAddr)
+}
+
+// probeDirectAddr reports whether host answers a TCP connect to port,
+// either accepting or refusing it
+func probeDirectAddr(host string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), directProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,135 @@
+// Package main - Draining a server for maintenance and migrating its clients
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// drainTimeout bounds how long a draining server waits for its
+	// forwarded connections to end before it closes the rest and stops
+	drainTimeout = 5 * time.Minute
+	// drainPollInterval is how often a draining server counts what is left
+	drainPollInterval = time.Second
+)
+
+// errServerDraining refuses new relayed UDP sessions while the server drains
+var errServerDraining = errors.New("server is draining")
+
+// MigrateHint tells clients the server is going down for maintenance, so
+// they register again before their connections are cut
+type MigrateHint struct {
+	Room string `json:"room,omitempty"` // Room to register in instead, empty to register in the same room
+}
+
+// drainState is the process-wide maintenance drain of a server, started
+// once by the drain command
+type drainState struct {
+	hint    *MigrateHint
+	started chan struct{} // Closed when the drain starts
+	done    chan struct{} // Closed once the drain completed
+	mutex   sync.Mutex
+}
+
+// serverDrain is the drain of this process's server tunnels
+var serverDrain = &drainState{started: make(chan struct{}), done: make(chan struct{})}
+
+// Start begins draining with room as the clients' new room, reporting
+// false when a drain is already under way
+func (d *drainState) Start(room string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.hint != nil {
+		return false
+	}
+	d.hint = &MigrateHint{Room: room}
+	close(d.started)
+	go d.wait()
+	return true
+}
+
+// Hint returns the hint posted to clients, nil while not draining
+func (d *drainState) Hint() *MigrateHint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.hint
+}
+
+// Draining reports whether new connections are refused
+func (d *drainState) Draining() bool {
+	return d.Hint() != nil
+}
+
+// Started returns a channel closed when the drain starts
+func (d *drainState) Started() <-chan struct{} {
+	return d.started
+}
+
+// wait closes done once every forwarded connection ended, closing those
+// still open after drainTimeout
+func (d *drainState) wait() {
+	deadline := time.Now().Add(drainTimeout)
+	for len(activeConns.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	if remaining := activeConns.List(); len(remaining) > 0 {
+		log.Printf("⌛ %d connections still open after %v, closing them", len(remaining), drainTimeout)
+		for _, conn := range remaining {
+			activeConns.Kill(conn.ID)
+		}
+	}
+	log.Printf("✅ Server drained")
+	close(d.done)
+}
+
+// drainDone returns a channel closed once the server drained, which stops
+// the process
+func drainDone() <-chan struct{} {
+	return serverDrain.done
+}
+
+// drainServer handles the console drain command
+func drainServer(w io.Writer, room string) {
+	if !serverDrain.Start(room) {
+		fmt.Fprintln(w, "⏳ Server is already draining")
+		return
+	}
+	target := "their room again"
+	if room != "" {
+		target = "room " + redactSecret(room)
+	}
+	fmt.Fprintf(w, "🚚 Draining: clients are told to register in %s, new connections are refused, and the server stops once open ones end (at most %v)\n", target, drainTimeout)
+}
+
+// withMigrateHint returns serverData carrying hint
+func withMigrateHint(serverData string, hint *MigrateHint) (string, error) {
+	data, err := parseServerRegistrationData(serverData)
+	if err != nil {
+		return "", err
+	}
+	data.Migrate = hint
+	hinted, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal server registration data: %w", err)
+	}
+	return string(hinted), nil
+}
+
+// followMigration moves a client to the room a draining server pointed it
+// at, given the server data its session ended with, and returns the data
+// the next session should skip
+func followMigration(config *Configuration, staleServerData string) string {
+	data, err := parseServerRegistrationData(staleServerData)
+	if err != nil || data.Migrate == nil || data.Migrate.Room == "" {
+		return staleServerData
+	}
+	log.Printf("🚚 Moving to room %s as the draining server asked", redactSecret(data.Migrate.Room))
+	config.RoomID = data.Migrate.Room
+	return ""
+}
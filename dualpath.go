@@ -0,0 +1,255 @@
+// Package main - LAN/WAN dual path failover
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// PathLAN is the direct path to the server's private address
+	PathLAN = "lan"
+	// PathWAN is the path to the server's public address
+	PathWAN = "wan"
+
+	// pathProbeInterval is how often the LAN path health is checked
+	pathProbeInterval = 5 * time.Second
+	// pathProbeTimeout bounds a single LAN path probe
+	pathProbeTimeout = 2 * time.Second
+	// pathProbeBindAttempts is how often the probe responder tries to find
+	// a port free for both TCP and UDP
+	pathProbeBindAttempts = 5
+)
+
+// pathProbeMagic starts every UDP LAN path probe, which the responder
+// echoes back
+var pathProbeMagic = []byte("SFPROBE1")
+
+// PathSelector keeps both the LAN and WAN targets of a mapping and tracks
+// which one is currently active based on health probes of the LAN path
+type PathSelector struct {
+	protocol   string
+	lanAddr    string
+	wanAddr    string
+	probeAddr  string // Server's probe responder on the LAN path, empty when it runs none
+	serverInfo *NetworkInfo
+	active     string
+	mutex      sync.RWMutex
+}
+
+// activePaths exposes the path selector of every dual path mapping by mapping key
+var activePaths sync.Map
+
+// NewPathSelector creates a selector for the given LAN and WAN targets
+func NewPathSelector(protocol, lanAddr, wanAddr string, serverInfo *NetworkInfo) *PathSelector {
+	ps := &PathSelector{
+		protocol:   protocol,
+		lanAddr:    lanAddr,
+		wanAddr:    wanAddr,
+		serverInfo: serverInfo,
+		active:     PathWAN,
+	}
+	if serverInfo.ProbePort > 0 {
+		ps.probeAddr = net.JoinHostPort(extractIP(serverInfo.PrivateAddr), strconv.Itoa(serverInfo.ProbePort))
+	}
+	return ps
+}
+
+// Active returns the name and address of the currently active path
+func (ps *PathSelector) Active() (string, string) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	if ps.active == PathLAN {
+		return PathLAN, ps.lanAddr
+	}
+	return PathWAN, ps.wanAddr
+}
+
+// Target returns the host and port of the currently active path
+func (ps *PathSelector) Target() (string, int) {
+	_, addr := ps.Active()
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// Run probes the LAN path until ctx is cancelled, switching the active path
+// whenever the LAN path becomes healthy or breaks
+func (ps *PathSelector) Run(ctx context.Context) {
+	ps.probe()
+
+	ticker := time.NewTicker(pathProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ps.probe()
+		}
+	}
+}
+
+// probe checks the LAN path once and updates the active path
+func (ps *PathSelector) probe() {
+	next := PathWAN
+	if ps.lanHealthy() {
+		next = PathLAN
+	}
+
+	ps.mutex.Lock()
+	previous := ps.active
+	ps.active = next
+	ps.mutex.Unlock()
+
+	if previous != next {
+		_, addr := ps.Active()
+		log.Printf("🔀 Switched %s path %s -> %s (%s)", ps.protocol, previous, next, addr)
+	}
+}
+
+// lanHealthy reports whether the LAN path is usable. The path is probed
+// over the mapping's protocol at the server's probe responder, never at the
+// mapping's port, where a probe would open a connection to its service.
+// Servers without a responder only get the check that we are still on
+// their subnet.
+func (ps *PathSelector) lanHealthy() bool {
+	if ps.probeAddr == "" {
+		privateIP, err := getPrivateIP()
+		if err != nil {
+			return false
+		}
+		return isLANAddress(privateIP, ps.serverInfo.PrivateAddr)
+	}
+
+	if ps.protocol == "tcp" {
+		return probeTCPPath(ps.probeAddr, pathProbeTimeout) == nil
+	}
+	return probeUDPPath(ps.probeAddr, pathProbeTimeout) == nil
+}
+
+// probeTCPPath connects to the probe responder at addr
+func probeTCPPath(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeUDPPath sends a probe with a random nonce to the responder at addr
+// and waits for its echo
+func probeUDPPath(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	probe := make([]byte, len(pathProbeMagic)+8)
+	copy(probe, pathProbeMagic)
+	if _, err := rand.Read(probe[len(pathProbeMagic):]); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(probe); err != nil {
+		return err
+	}
+	buf := make([]byte, len(probe)+1)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// Echoes of earlier, timed out probes are skipped
+		if bytes.Equal(buf[:n], probe) {
+			return nil
+		}
+	}
+}
+
+// startPathProbeResponder answers the LAN path probes of dual path clients
+// on host, over TCP and UDP on the same port, until ctx is done. TCP probes
+// are accepted and closed; UDP probes are echoed.
+func startPathProbeResponder(ctx context.Context, host string) (int, error) {
+	var lastErr error
+	for attempt := 0; attempt < pathProbeBindAttempts; attempt++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			ln.Close()
+			lastErr = err
+			continue
+		}
+
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+			conn.Close()
+		}()
+		go answerTCPProbes(ln)
+		go answerUDPProbes(conn)
+		return port, nil
+	}
+	return 0, fmt.Errorf("no port free for both TCP and UDP: %w", lastErr)
+}
+
+// answerTCPProbes closes every connection ln accepts
+func answerTCPProbes(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// answerUDPProbes echoes every probe conn receives
+func answerUDPProbes(conn net.PacketConn) {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if bytes.HasPrefix(buf[:n], pathProbeMagic) {
+			conn.WriteTo(buf[:n], addr)
+		}
+	}
+}
+
+// runDualPathMapping forwards a mapping over whichever of the LAN and WAN
+// paths is healthy, failing over between them without restarting the listener
+func runDualPathMapping(ctx context.Context, mapping PortMapping, allocatedPort int, serverInfo *NetworkInfo) {
+	lanAddr := net.JoinHostPort(extractIP(serverInfo.PrivateAddr), strconv.Itoa(allocatedPort))
+	wanAddr := net.JoinHostPort(extractIP(serverInfo.PublicAddr), strconv.Itoa(allocatedPort))
+	selector := NewPathSelector(mapping.Protocol, lanAddr, wanAddr, serverInfo)
+
+	key := generateMappingKey(mapping)
+	activePaths.Store(key, selector)
+	defer activePaths.Delete(key)
+
+	log.Printf("🛤️  Dual path enabled for %s %d: LAN %s, WAN %s", mapping.Protocol, mapping.LocalPort, lanAddr, wanAddr)
+
+	go selector.Run(ctx)
+
+	logger := mappingLogger(mapping)
+	if mapping.Protocol == "tcp" {
+		runTCPClientToTarget(ctx, logger, mapping.LocalPort, selector.Target, mapping.Compress, mapping.RelayMux, mapping.dialTimeout())
+	} else {
+		runUDPClientToTarget(ctx, logger, mapping.LocalPort, selector.Target, mapping.SourcePort, mapping.udpSessionTimeout())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPathProbeResponder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port, err := startPathProbeResponder(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if err := probeTCPPath(addr, time.Second); err != nil {
+		t.Errorf("TCP probe failed: %v", err)
+	}
+	if err := probeUDPPath(addr, time.Second); err != nil {
+		t.Errorf("UDP probe failed: %v", err)
+	}
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for probeTCPPath(addr, 200*time.Millisecond) == nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := probeUDPPath(addr, 200*time.Millisecond); err == nil {
+		t.Error("UDP probe answered after the responder stopped")
+	}
+}
+
+func TestPathSelectorProbesResponder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The mapping's port counts the connections its service would see
+	mappingLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mappingLn.Close()
+	accepted := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := mappingLn.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	probePort, err := startPathProbeResponder(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInfo := &NetworkInfo{PrivateAddr: "127.0.0.1:0", PublicAddr: "192.0.2.1:0", ProbePort: probePort}
+	for _, protocol := range []string{"tcp", "udp"} {
+		selector := NewPathSelector(protocol, mappingLn.Addr().String(), "192.0.2.1:9", serverInfo)
+		selector.probe()
+		if path, _ := selector.Active(); path != PathLAN {
+			t.Errorf("%s path %s with the responder up, want %s", protocol, path, PathLAN)
+		}
+	}
+	select {
+	case <-accepted:
+		t.Error("LAN probe opened a connection on the mapping's port")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without an answer the mapping fails over to the WAN path
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	selector := NewPathSelector("udp", mappingLn.Addr().String(), "192.0.2.1:9", serverInfo)
+	selector.active = PathLAN
+	selector.probe()
+	if path, _ := selector.Active(); path != PathWAN {
+		t.Errorf("udp path %s with the responder down, want %s", path, PathWAN)
+	}
+}
@@ -0,0 +1,57 @@
+// Package main - Structured events about tunnel connections
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType names a kind of event
+type EventType string
+
+const (
+	// EventTypeConnectionLost is emitted when a hole-punched UDP path stops
+	// answering keepalives
+	EventTypeConnectionLost EventType = "connectionLost"
+)
+
+// Event is one occurrence reported to subscribers and the log
+type Event struct {
+	Type         EventType `json:"type"`
+	Mapping      string    `json:"mapping"` // "protocol:port" as in the readiness report
+	Time         time.Time `json:"time"`
+	LastActivity time.Time `json:"lastActivity,omitempty"` // Last datagram received from the peer
+	Detail       string    `json:"detail,omitempty"`
+}
+
+// eventSubscribers are called with every emitted event
+var (
+	eventSubscribers []func(Event)
+	eventMutex       sync.RWMutex
+)
+
+// SubscribeEvents registers fn to be called with every event. fn runs on
+// the emitting goroutine and must not block.
+func SubscribeEvents(fn func(Event)) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventSubscribers = append(eventSubscribers, fn)
+}
+
+// emitEvent logs e with its fields and passes it to the subscribers
+func emitEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	fields := map[string]interface{}{"event": string(e.Type), "mapping": e.Mapping}
+	if !e.LastActivity.IsZero() {
+		fields["lastActivity"] = e.LastActivity.Format(time.RFC3339)
+	}
+	defaultLogger.WithComponent("events").WithFields(fields).Warnf("📣 %s", e.Detail)
+
+	eventMutex.RLock()
+	defer eventMutex.RUnlock()
+	for _, fn := range eventSubscribers {
+		fn(e)
+	}
+}
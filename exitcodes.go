@@ -0,0 +1,36 @@
+// Package main - Process exit codes telling supervisors why we stopped
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+)
+
+// Exit codes by cause of failure, so supervisors can pick a restart policy
+const (
+	ExitOK        = 0
+	ExitRuntime   = 1 // Failure while running, or one that fits no other code
+	ExitConfig    = 2 // Invalid config file or flags, as the flag package uses
+	ExitNetwork   = 3 // STUN discovery or the peer-to-peer path failed
+	ExitSignaling = 4 // Signaling server unreachable, or it sent unusable data
+	ExitBind      = 5 // A local port or socket could not be bound
+	ExitCapacity  = 6 // The server is full and refused the client's registration
+)
+
+// fatalf logs like log.Fatalf and exits with code
+func fatalf(code int, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(code)
+}
+
+// exitCodeOf returns ExitBind for errors binding a listener and
+// ExitRuntime otherwise
+func exitCodeOf(err error) int {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "listen" {
+		return ExitBind
+	}
+	return ExitRuntime
+}
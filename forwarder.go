@@ -3,12 +3,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,38 +21,210 @@ const (
 	UDPBufferSize = 8 * 1024 // 8KB
 )
 
-// tcpProxy handles TCP data forwarding with optimized buffering
-func tcpProxy(ctx context.Context, src, dst net.Conn, direction string) {
-	defer src.Close()
-	defer dst.Close()
-
+// tcpProxy copies src to dst with optimized buffering. When src reaches EOF
+// dst is half-closed, so the far end sees the end of the stream while the
+// other direction keeps flowing; any other error closes both connections so
+// the other direction stops as well.
+func tcpProxy(logger *Logger, src, dst net.Conn, direction string, counter *atomic.Int64) {
 	buf := make([]byte, TCPBufferSize)
-	
-	done := make(chan error, 1)
+
+	var w io.Writer = dst
+	if connectionTrace != nil {
+		w = &firstByteWriter{dst: dst, direction: direction}
+	}
+	w = byteCounter{w: w, n: counter}
+
+	if _, err := io.CopyBuffer(w, src, buf); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			logger.LimitedErrorf("TCP proxy %s error: %v", direction, err)
+		}
+		src.Close()
+		dst.Close()
+		return
+	}
+	closeWrite(dst)
+}
+
+// closeWrite half-closes conn if it supports it and closes it otherwise
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// maxConnLifetime force-closes forwarded TCP connections open longer than
+// this, regardless of activity. Zero disables the limit.
+var maxConnLifetime time.Duration
+
+// defaultConnectTimeout bounds TCP dials unless connectTimeout is set
+const defaultConnectTimeout = 5 * time.Second
+
+// connectTimeout bounds the TCP dials of mappings without their own
+// connectTimeout, both to the peer and to the local service
+var connectTimeout = defaultConnectTimeout
+
+// tcpSocketOptions are applied to both sockets of every forwarded TCP
+// connection
+var tcpSocketOptions = TCPSocketOptions{
+	NoDelay:           true,
+	KeepAlive:         true,
+	KeepAliveInterval: 15 * time.Second,
+}
+
+// TCPSocketOptions are the socket options of forwarded TCP connections
+type TCPSocketOptions struct {
+	NoDelay           bool          // Disable Nagle's algorithm for interactive traffic
+	KeepAlive         bool          // Probe idle connections so dead peers are detected
+	KeepAliveInterval time.Duration // Idle time before and between keep-alive probes
+	BufferSize        int           // SO_RCVBUF and SO_SNDBUF in bytes, 0 keeps the system's autotuning
+}
+
+// checkTCPSocketBufferSize logs when size exceeds the buffers the system
+// lets a process set, since the kernel clamps it to the limit instead
+func checkTCPSocketBufferSize(size int) {
+	recv, send := socketBufferLimits()
+	if recv > 0 && size > recv {
+		log.Printf("⚠️  tcpSocketBufferSize %d exceeds the receive buffer limit, clamped to %d bytes (net.core.rmem_max)", size, recv)
+	}
+	if send > 0 && size > send {
+		log.Printf("⚠️  tcpSocketBufferSize %d exceeds the send buffer limit, clamped to %d bytes (net.core.wmem_max)", size, send)
+	}
+}
+
+// applyTCPSocketOptions sets tcpSocketOptions on the TCP connection under
+// conn, looking through the wrappers the forwarders add
+func applyTCPSocketOptions(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetNoDelay(tcpSocketOptions.NoDelay)
+			c.SetKeepAlive(tcpSocketOptions.KeepAlive)
+			if tcpSocketOptions.KeepAlive && tcpSocketOptions.KeepAliveInterval > 0 {
+				c.SetKeepAlivePeriod(tcpSocketOptions.KeepAliveInterval)
+			}
+			if tcpSocketOptions.BufferSize > 0 {
+				c.SetReadBuffer(tcpSocketOptions.BufferSize)
+				c.SetWriteBuffer(tcpSocketOptions.BufferSize)
+			}
+			return
+		case *compressedConn:
+			conn = c.Conn
+		case *prefixedConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+// proxyTCPConn proxies both directions between c and peer until either side
+// closes, ctx is cancelled or the connection exceeds maxConnLifetime
+func proxyTCPConn(ctx context.Context, logger *Logger, mapping string, c, peer net.Conn, forward, backward string) {
+	connCtx, cancel := context.WithCancel(ctx)
+	if maxConnLifetime > 0 {
+		connCtx, cancel = context.WithTimeout(ctx, maxConnLifetime)
+	}
+	defer cancel()
+
+	// Killing the connection cancels it like the end of its lifetime
+	conn := activeConns.Add(mapping, c.RemoteAddr().String(), cancel)
+	defer activeConns.Remove(conn)
+
+	applyTCPSocketOptions(c)
+	applyTCPSocketOptions(peer)
+
+	globalStats.TCPAccepted.Add(1)
+	globalStats.TCPActive.Add(1)
+	defer globalStats.TCPActive.Add(-1)
+
+	// Both directions finish once each side has half-closed; closing the
+	// connections on cancellation unblocks them early
+	finished := make(chan struct{})
+	defer close(finished)
 	go func() {
-		_, err := io.CopyBuffer(dst, src, buf)
-		done <- err
+		select {
+		case <-connCtx.Done():
+			if ctx.Err() != nil {
+				logger.Infof("TCP proxy %s cancelled", forward)
+			}
+			c.Close()
+			peer.Close()
+		case <-finished:
+		}
 	}()
 
-	select {
-	case err := <-done:
-		if err != nil && err != io.EOF {
-			log.Printf("TCP proxy %s error: %v", direction, err)
-		}
-	case <-ctx.Done():
-		log.Printf("TCP proxy %s cancelled", direction)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		tcpProxy(logger, c, peer, forward, &conn.BytesIn)
+	}()
+
+	go func() {
+		defer wg.Done()
+		tcpProxy(logger, peer, c, backward, &conn.BytesOut)
+	}()
+
+	wg.Wait()
+	c.Close()
+	peer.Close()
+
+	if errors.Is(connCtx.Err(), context.DeadlineExceeded) {
+		globalStats.TCPExpired.Add(1)
+		logger.Infof("⏱️  TCP connection %s closed after max lifetime %v", forward, maxConnLifetime)
 	}
 }
 
 // runTCPClient runs TCP client forwarding (listens locally, connects to server)
-func runTCPClient(ctx context.Context, localPort int, remoteIP string, remotePort int) {
+func runTCPClient(ctx context.Context, logger *Logger, localPort int, remoteIP string, remotePort int, compress, relayMux bool, dialTimeout time.Duration) {
+	runTCPClientToTarget(ctx, logger, localPort, func() (string, int) { return remoteIP, remotePort }, compress, relayMux, dialTimeout)
+}
+
+// runTCPClientToTarget runs TCP client forwarding, resolving the remote target
+// for every accepted connection so the target may change while running. With
+// compress the connection to the server is deflated; the server must have
+// accepted compression for the mapping. With relayMux the connections are
+// carried as sessions of one relay connection. Dials to the server give up
+// after dialTimeout.
+func runTCPClientToTarget(ctx context.Context, logger *Logger, localPort int, target func() (string, int), compress, relayMux bool, dialTimeout time.Duration) {
+	remoteIP, remotePort := target()
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(localPort))
 	if err != nil {
-		log.Fatalf("TCP client listen error: %v", err)
+		err = portInUse(err, "tcp", localPort)
+		logger.Errorf("❌ TCP client listen error, skipping the mapping: %v", err)
+		readiness.FailMapping(mappingStateKey("tcp", localPort), err)
+		return
 	}
 	defer ln.Close()
 
-	log.Printf("TCP Client listening on port %d, forwarding to %s:%d", localPort, remoteIP, remotePort)
+	// Close the listener on cancellation so Accept unblocks
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	logger.Infof("TCP Client listening on port %d, forwarding to %s:%d", localPort, remoteIP, remotePort)
+
+	// dialServer connects to the server's port of the mapping
+	dialServer := func() (net.Conn, error) {
+		remoteIP, remotePort := target()
+		peer, err := net.DialTimeout("tcp", net.JoinHostPort(remoteIP, strconv.Itoa(remotePort)), dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		traceEvent("connection_established", "tcp relay to %s", peer.RemoteAddr())
+		if compress {
+			peer = newCompressedConn(peer)
+		}
+		return peer, nil
+	}
+	var mux *relayMuxClient
+	if relayMux {
+		mux = &relayMuxClient{dial: dialServer, logger: logger}
+	}
 
 	for {
 		select {
@@ -61,48 +235,50 @@ func runTCPClient(ctx context.Context, localPort int, remoteIP string, remotePor
 
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("TCP client accept error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("TCP client accept error: %v", err)
 			continue
 		}
 
 		go func(c net.Conn) {
 			defer c.Close()
 			
-			peer, err := net.Dial("tcp", net.JoinHostPort(remoteIP, strconv.Itoa(remotePort)))
+			var peer net.Conn
+			var err error
+			if mux != nil {
+				peer, err = mux.open(ctx)
+			} else {
+				peer, err = dialServer()
+			}
 			if err != nil {
-				log.Printf("TCP client dial error: %v", err)
+				logger.LimitedErrorf("TCP client dial error: %v", err)
 				return
 			}
 
-			var wg sync.WaitGroup
-			wg.Add(2)
-
-			// Client to server
-			go func() {
-				defer wg.Done()
-				tcpProxy(ctx, c, peer, "client->server")
-			}()
-
-			// Server to client
-			go func() {
-				defer wg.Done() 
-				tcpProxy(ctx, peer, c, "server->client")
-			}()
-
-			wg.Wait()
+			proxyTCPConn(ctx, logger, mappingStateKey("tcp", localPort), c, peer, "client->server", "server->client")
 		}(conn)
 	}
 }
 
 // runTCPServer runs TCP server forwarding (accepts connections, forwards to local service)
 func runTCPServer(ctx context.Context, m PortMapping, peerHost string, peerPort int) {
+	logger := mappingLogger(m)
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(m.RemotePort))
 	if err != nil {
-		log.Fatalf("TCP server listen error: %v", err)
+		logger.Errorf("❌ TCP server listen error, skipping the mapping: %v", portInUse(err, "tcp", m.RemotePort))
+		return
 	}
 	defer ln.Close()
 
-	log.Printf("TCP Server listening on port %d, forwarding to local service 127.0.0.1:%d", m.RemotePort, m.LocalPort)
+	// Close the listener on cancellation so Accept unblocks
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	logger.Infof("TCP Server listening on port %d, forwarding to local service 127.0.0.1:%d", m.RemotePort, m.LocalPort)
 
 	for {
 		select {
@@ -113,35 +289,23 @@ func runTCPServer(ctx context.Context, m PortMapping, peerHost string, peerPort
 
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("TCP server accept error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("TCP server accept error: %v", err)
 			continue
 		}
 
 		go func(c net.Conn) {
 			defer c.Close()
 
-			local, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(m.LocalPort)))
+			local, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(m.LocalPort)), m.dialTimeout())
 			if err != nil {
-				log.Printf("TCP server dial local service error: %v", err)
+				logger.LimitedErrorf("TCP server dial local service error: %v", err)
 				return
 			}
 
-			var wg sync.WaitGroup
-			wg.Add(2)
-
-			// Client to local service
-			go func() {
-				defer wg.Done()
-				tcpProxy(ctx, c, local, "client->local")
-			}()
-
-			// Local service to client
-			go func() {
-				defer wg.Done()
-				tcpProxy(ctx, local, c, "local->client")
-			}()
-
-			wg.Wait()
+			proxyTCPConn(ctx, logger, mappingStateKey("tcp", m.RemotePort), c, local, "client->local", "local->client")
 		}(conn)
 	}
 }
@@ -150,60 +314,205 @@ func runTCPServer(ctx context.Context, m PortMapping, peerHost string, peerPort
 type UDPSession struct {
 	ClientAddr    *net.UDPAddr
 	ServerConn    *net.UDPConn
+	RemoteAddr    string // Target the ServerConn is dialed to
 	LastActivity  time.Time
 	ProxyStarted  bool // Track if bidirectional proxy is running
+	conn          *ActiveConn
+	queue         *udpSendQueue // Datagrams waiting to be written to ServerConn
+	done          chan struct{} // Closed with the session, stops the writer
+	release       func()        // Returns the session's udpSourcePool address, nil without one
+	closeOnce     sync.Once
 	mutex         sync.RWMutex
 }
 
+// replyAddr returns the client address replies of the session are sent to
+func (s *UDPSession) replyAddr() *net.UDPAddr {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ClientAddr
+}
+
+// enqueue queues a datagram for the session's destination, dropping one by
+// the queue's policy when the destination falls behind
+func (s *UDPSession) enqueue(p []byte) bool {
+	return s.queue.push(p)
+}
+
+// runWriter writes queued datagrams to the session's destination until the
+// session is closed
+func (s *UDPSession) runWriter(logger *Logger) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet := <-s.queue.packets:
+			if _, err := s.ServerConn.Write(packet); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.LimitedErrorf("UDP write to %s error: %v", s.RemoteAddr, err)
+				}
+				continue
+			}
+			s.conn.BytesIn.Add(int64(len(packet)))
+		}
+	}
+}
+
+// close closes the session's socket and stops its writer
+func (s *UDPSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.ServerConn.Close()
+		if s.release != nil {
+			s.release()
+		}
+	})
+}
+
+// SourcePortPreserve makes UDP relay sessions dial from the source port of
+// the datagrams they forward
+const SourcePortPreserve = "preserve"
+
+// validateSourcePort checks a mapping's sourcePort: "preserve" or a port
+func validateSourcePort(setting string) error {
+	if setting == "" || setting == SourcePortPreserve {
+		return nil
+	}
+	port, err := strconv.Atoi(setting)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("'sourcePort' must be %q or a port number, got %q", SourcePortPreserve, setting)
+	}
+	return nil
+}
+
+// relaySourceAddr returns the local address a UDP relay session for
+// clientAddr dials from under the sourcePort setting, nil for a port the
+// system chooses
+func relaySourceAddr(setting string, clientAddr *net.UDPAddr) *net.UDPAddr {
+	switch setting {
+	case "":
+		return nil
+	case SourcePortPreserve:
+		return &net.UDPAddr{Port: clientAddr.Port}
+	default:
+		port, _ := strconv.Atoi(setting)
+		return &net.UDPAddr{Port: port}
+	}
+}
+
+// defaultUDPSessionTimeout is how long UDP relay sessions are kept without a
+// datagram unless the mapping sets udpResponseTimeout
+const defaultUDPSessionTimeout = 5 * time.Minute
+
 // UDPSessionManager manages UDP forwarding sessions
 type UDPSessionManager struct {
-	sessions map[string]*UDPSession
-	mutex    sync.RWMutex
-	timeout  time.Duration
+	sessions   map[string]*UDPSession
+	mutex      sync.RWMutex
+	timeout    time.Duration
+	logger     *Logger
+	mapping    string            // "udp:port" label of sessions in the connection registry
+	sourcePort string            // Mapping's sourcePort setting for the sessions' dials
+	sessionKey udpSessionKeyFunc // Groups datagrams into sessions by their source
+	sourcePool *sourceAddrPool   // Server: source address of each session, nil dials from any
+	drain      *drainState       // Server: refuses new sessions while draining, nil never does
 }
 
 // NewUDPSessionManager creates a new session manager
-func NewUDPSessionManager(timeout time.Duration) *UDPSessionManager {
+func NewUDPSessionManager(timeout time.Duration, logger *Logger, mapping string) *UDPSessionManager {
 	return &UDPSessionManager{
-		sessions: make(map[string]*UDPSession),
-		timeout:  timeout,
+		sessions:   make(map[string]*UDPSession),
+		timeout:    timeout,
+		logger:     logger,
+		mapping:    mapping,
+		sessionKey: udpSessionKeyer(""),
 	}
 }
 
+// cleanupInterval is how often expired sessions are looked for: every
+// minute, or twice per timeout for shorter timeouts
+func (sm *UDPSessionManager) cleanupInterval() time.Duration {
+	return min(time.Minute, sm.timeout/2)
+}
+
 // GetOrCreateSession gets or creates a session for a client
 func (sm *UDPSessionManager) GetOrCreateSession(clientAddr *net.UDPAddr, remoteIP string, remotePort int) (*UDPSession, error) {
-	key := clientAddr.String()
+	key := sm.sessionKey(clientAddr)
 	
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 	
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP(remoteIP), Port: remotePort}
 	session, exists := sm.sessions[key]
-	if exists {
-		// Update activity and return existing session
+	if exists && session.RemoteAddr == remoteAddr.String() {
+		// Update activity and return existing session; replies go to the
+		// port the client sent from last when sessions span ports
 		session.mutex.Lock()
 		session.LastActivity = time.Now()
+		session.ClientAddr = clientAddr
 		session.mutex.Unlock()
 		return session, nil
 	}
+	if sm.drain != nil && sm.drain.Draining() {
+		return nil, errServerDraining
+	}
+	if exists {
+		// Target changed (path failover), replace the session
+		session.close()
+		activeConns.Remove(session.conn)
+		sm.logger.Infof("UDP session for client %s moved to %s", key, remoteAddr)
+	}
 	
-	// Create new session with connection to remote server
-	remoteAddr := &net.UDPAddr{IP: net.ParseIP(remoteIP), Port: remotePort}
-	serverConn, err := net.DialUDP("udp", nil, remoteAddr)
+	// Create new session with connection to remote server. A fixed or
+	// preserved source port fails while another session holds it.
+	sourceAddr := relaySourceAddr(sm.sourcePort, clientAddr)
+	var release func()
+	if sm.sourcePool != nil {
+		poolKey := sm.mapping + " " + key
+		ip, err := sm.sourcePool.acquire(poolKey)
+		if err != nil {
+			return nil, fmt.Errorf("no source address for client %s: %w", key, err)
+		}
+		if sourceAddr == nil {
+			sourceAddr = &net.UDPAddr{}
+		}
+		sourceAddr.IP = ip
+		release = func() { sm.sourcePool.release(poolKey) }
+	}
+	serverConn, err := net.DialUDP("udp", sourceAddr, remoteAddr)
 	if err != nil {
+		if release != nil {
+			release()
+		}
 		return nil, fmt.Errorf("failed to connect to remote server: %w", err)
 	}
 	
 	session = &UDPSession{
 		ClientAddr:   clientAddr,
 		ServerConn:   serverConn,
+		RemoteAddr:   remoteAddr.String(),
 		LastActivity: time.Now(),
 		ProxyStarted: false,
+		queue:        newUDPSendQueue(),
+		done:         make(chan struct{}),
+		release:      release,
 	}
+	session.conn = activeConns.Add(sm.mapping, key, func() { sm.closeSession(key, session) })
+	go session.runWriter(sm.logger)
 	
 	sm.sessions[key] = session
 	return session, nil
 }
 
+// closeSession ends a session killed through the connection registry; the
+// client's next datagram starts a new one
+func (sm *UDPSessionManager) closeSession(key string, session *UDPSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.sessions[key] == session {
+		delete(sm.sessions, key)
+	}
+	session.close()
+}
+
 // CleanupExpiredSessions removes expired sessions
 func (sm *UDPSessionManager) CleanupExpiredSessions() {
 	sm.mutex.Lock()
@@ -216,31 +525,65 @@ func (sm *UDPSessionManager) CleanupExpiredSessions() {
 		session.mutex.RUnlock()
 		
 		if expired {
-			session.ServerConn.Close()
+			session.close()
+			activeConns.Remove(session.conn)
 			delete(sm.sessions, key)
-			log.Printf("UDP session expired for client %s", key)
+			sm.logger.Infof("UDP session expired for client %s", key)
 		}
 	}
 }
 
+// CloseAll closes every session; forwarders call it on shutdown so the
+// sessions' sockets do not outlive them
+func (sm *UDPSessionManager) CloseAll() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for key, session := range sm.sessions {
+		session.close()
+		activeConns.Remove(session.conn)
+		delete(sm.sessions, key)
+	}
+}
+
 // runUDPClient runs UDP client forwarding with bidirectional proxy architecture
-func runUDPClient(ctx context.Context, localPort int, remoteIP string, remotePort int) {
+func runUDPClient(ctx context.Context, logger *Logger, localPort int, remoteIP string, remotePort int, sourcePort string, sessionTimeout time.Duration) {
+	runUDPClientToTarget(ctx, logger, localPort, func() (string, int) { return remoteIP, remotePort }, sourcePort, sessionTimeout)
+}
+
+// runUDPClientToTarget runs UDP client forwarding, resolving the remote target
+// per packet so sessions move to a new target when it changes. Sessions
+// without a datagram in either direction for sessionTimeout are closed.
+func runUDPClientToTarget(ctx context.Context, logger *Logger, localPort int, target func() (string, int), sourcePort string, sessionTimeout time.Duration) {
+	remoteIP, remotePort := target()
 	localAddr := net.UDPAddr{Port: localPort}
 	conn, err := net.ListenUDP("udp", &localAddr)
 	if err != nil {
-		log.Fatalf("UDP client listen error: %v", err)
+		err = portInUse(err, "udp", localPort)
+		logger.Errorf("❌ UDP client listen error, skipping the mapping: %v", err)
+		readiness.FailMapping(mappingStateKey("udp", localPort), err)
+		return
 	}
 	defer conn.Close()
 
-	// Create session manager with 5-minute timeout
-	sessionManager := NewUDPSessionManager(5 * time.Minute)
+	// Close the socket on cancellation so reads unblock
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Create session manager; replies of slow services arrive as long as the
+	// session lives
+	sessionManager := NewUDPSessionManager(sessionTimeout, logger, mappingStateKey("udp", localPort))
+	sessionManager.sourcePort = sourcePort
+	defer sessionManager.CloseAll()
 	buf := make([]byte, UDPBufferSize)
 	
-	log.Printf("UDP Client listening on port %d, forwarding to %s:%d", localPort, remoteIP, remotePort)
+	logger.Infof("UDP Client listening on port %d, forwarding to %s:%d", localPort, remoteIP, remotePort)
 
 	// Start cleanup goroutine
 	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
+		ticker := time.NewTicker(sessionManager.cleanupInterval())
 		defer ticker.Stop()
 		
 		for {
@@ -262,14 +605,18 @@ func runUDPClient(ctx context.Context, localPort int, remoteIP string, remotePor
 
 		n, clientAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("UDP client read error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("UDP client read error: %v", err)
 			continue
 		}
 
 		// Get or create session for this client
+		remoteIP, remotePort := target()
 		session, err := sessionManager.GetOrCreateSession(clientAddr, remoteIP, remotePort)
 		if err != nil {
-			log.Printf("Failed to create session for %s: %v", clientAddr, err)
+			logger.LimitedErrorf("Failed to create session for %s: %v", clientAddr, err)
 			continue
 		}
 
@@ -280,28 +627,27 @@ func runUDPClient(ctx context.Context, localPort int, remoteIP string, remotePor
 			session.mutex.Unlock()
 			
 			// Start continuous bidirectional forwarding
-			go runBidirectionalUDPProxy(ctx, conn, session)
+			go runBidirectionalUDPProxy(ctx, logger, conn, session)
 		} else {
 			session.mutex.Unlock()
 		}
 
-		// Forward this packet immediately
-		_, err = session.ServerConn.Write(buf[:n])
-		if err != nil {
-			log.Printf("UDP client write to remote error: %v", err)
+		// Hand the packet to the session's writer
+		if session.enqueue(buf[:n]) {
+			traceFirstByte("udp client->server")
 		}
 	}
 }
 
 // runBidirectionalUDPProxy runs continuous bidirectional UDP forwarding
-func runBidirectionalUDPProxy(ctx context.Context, localConn *net.UDPConn, session *UDPSession) {
+func runBidirectionalUDPProxy(ctx context.Context, logger *Logger, localConn *net.UDPConn, session *UDPSession) {
 	defer func() {
 		session.mutex.Lock()
 		session.ProxyStarted = false
 		session.mutex.Unlock()
 	}()
 	
-	log.Printf("🔄 Starting bidirectional UDP proxy for client %s", session.ClientAddr)
+	logger.Infof("🔄 Starting bidirectional UDP proxy for client %s", session.replyAddr())
 	
 	// Goroutine for server -> client forwarding
 	go func() {
@@ -320,7 +666,9 @@ func runBidirectionalUDPProxy(ctx context.Context, localConn *net.UDPConn, sessi
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue // Continue on timeout
 				}
-				log.Printf("📬 Server->Client read error: %v", err)
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("📬 Server->Client read error: %v", err)
+				}
 				return
 			}
 			
@@ -331,11 +679,12 @@ func runBidirectionalUDPProxy(ctx context.Context, localConn *net.UDPConn, sessi
 				session.mutex.Unlock()
 				
 				// Forward to client
-				_, err = localConn.WriteToUDP(buffer[:n], session.ClientAddr)
+				_, err = localConn.WriteToUDP(buffer[:n], session.replyAddr())
 				if err != nil {
-					log.Printf("📬 Server->Client write error: %v", err)
+					logger.Errorf("📬 Server->Client write error: %v", err)
 					return
 				}
+				session.conn.BytesOut.Add(int64(n))
 			}
 		}
 	}()
@@ -345,14 +694,14 @@ func runBidirectionalUDPProxy(ctx context.Context, localConn *net.UDPConn, sessi
 }
 
 // runBidirectionalUDPProxyServer runs continuous bidirectional UDP forwarding for server
-func runBidirectionalUDPProxyServer(ctx context.Context, peerConn *net.UDPConn, session *UDPSession) {
+func runBidirectionalUDPProxyServer(ctx context.Context, logger *Logger, peerConn *net.UDPConn, session *UDPSession) {
 	defer func() {
 		session.mutex.Lock()
 		session.ProxyStarted = false
 		session.mutex.Unlock()
 	}()
 	
-	log.Printf("🔄 Starting bidirectional UDP proxy server for peer %s", session.ClientAddr)
+	logger.Infof("🔄 Starting bidirectional UDP proxy server for peer %s", session.replyAddr())
 	
 	// Goroutine for local service -> peer forwarding
 	go func() {
@@ -371,7 +720,9 @@ func runBidirectionalUDPProxyServer(ctx context.Context, peerConn *net.UDPConn,
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue // Continue on timeout
 				}
-				log.Printf("📬 Service->Peer read error: %v", err)
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("📬 Service->Peer read error: %v", err)
+				}
 				return
 			}
 			
@@ -382,11 +733,12 @@ func runBidirectionalUDPProxyServer(ctx context.Context, peerConn *net.UDPConn,
 				session.mutex.Unlock()
 				
 				// Forward to peer
-				_, err = peerConn.WriteToUDP(buffer[:n], session.ClientAddr)
+				_, err = peerConn.WriteToUDP(buffer[:n], session.replyAddr())
 				if err != nil {
-					log.Printf("📬 Service->Peer write error: %v", err)
+					logger.Errorf("📬 Service->Peer write error: %v", err)
 					return
 				}
+				session.conn.BytesOut.Add(int64(n))
 			}
 		}
 	}()
@@ -397,22 +749,34 @@ func runBidirectionalUDPProxyServer(ctx context.Context, peerConn *net.UDPConn,
 
 // runUDPServer runs UDP server forwarding with proper session management
 func runUDPServer(ctx context.Context, m PortMapping, peerHost string, peerPort int) {
+	logger := mappingLogger(m)
 	localPeerAddr := net.UDPAddr{Port: m.RemotePort}
 	conn, err := net.ListenUDP("udp", &localPeerAddr)
 	if err != nil {
-		log.Fatalf("UDP server listen error: %v", err)
+		logger.Errorf("❌ UDP server listen error, skipping the mapping: %v", portInUse(err, "udp", m.RemotePort))
+		return
 	}
 	defer conn.Close()
 
+	// Close the socket on cancellation so reads unblock
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
 	// Create session manager for peer connections
-	sessionManager := NewUDPSessionManager(5 * time.Minute)
+	sessionManager := NewUDPSessionManager(m.udpSessionTimeout(), logger, mappingStateKey("udp", m.RemotePort))
+	sessionManager.sourcePort = m.SourcePort
+	sessionManager.sessionKey = udpSessionKeyer(m.UDPSessionKey)
+	sessionManager.sourcePool = udpSourcePool
+	defer sessionManager.CloseAll()
 	buf := make([]byte, UDPBufferSize)
 
-	log.Printf("UDP Server listening on port %d, forwarding to local service 127.0.0.1:%d", m.RemotePort, m.LocalPort)
+	logger.Infof("UDP Server listening on port %d, forwarding to local service 127.0.0.1:%d", m.RemotePort, m.LocalPort)
 
 	// Start cleanup goroutine
 	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
+		ticker := time.NewTicker(sessionManager.cleanupInterval())
 		defer ticker.Stop()
 		
 		for {
@@ -434,14 +798,17 @@ func runUDPServer(ctx context.Context, m PortMapping, peerHost string, peerPort
 
 		n, peerAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("UDP server read error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("UDP server read error: %v", err)
 			continue
 		}
 
 		// Get or create session for this peer
 		session, err := sessionManager.GetOrCreateSession(peerAddr, "127.0.0.1", m.LocalPort)
 		if err != nil {
-			log.Printf("Failed to create session for peer %s: %v", peerAddr, err)
+			logger.LimitedErrorf("Failed to create session for peer %s: %v", peerAddr, err)
 			continue
 		}
 
@@ -452,28 +819,43 @@ func runUDPServer(ctx context.Context, m PortMapping, peerHost string, peerPort
 			session.mutex.Unlock()
 			
 			// Start continuous bidirectional forwarding
-			go runBidirectionalUDPProxyServer(ctx, conn, session)
+			go runBidirectionalUDPProxyServer(ctx, logger, conn, session)
 		} else {
 			session.mutex.Unlock()
 		}
 
-		// Forward this packet immediately
-		_, err = session.ServerConn.Write(buf[:n])
-		if err != nil {
-			log.Printf("UDP server write to local service error: %v", err)
-		}
+		// Hand the packet to the session's writer
+		session.enqueue(buf[:n])
 	}
 }
 
 // runTCPServerOnPort runs TCP server on specified port, forwarding to local service
-func runTCPServerOnPort(ctx context.Context, listenPort, localServicePort int) {
+func runTCPServerOnPort(ctx context.Context, logger *Logger, listenPort int, service *ServiceTarget) {
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(listenPort))
 	if err != nil {
-		log.Fatalf("TCP server listen error on port %d: %v", listenPort, err)
+		logger.Errorf("❌ TCP server listen error, skipping the mapping: %v", portInUse(err, "tcp", listenPort))
+		return
 	}
+	serveTCPServer(ctx, logger, ln, service, false, false)
+}
+
+// serveTCPServer accepts connections on an already bound listener and
+// forwards them to the local service, decompressing them when compress is
+// set. With relayMux each connection carries sessions of the client's
+// connections.
+func serveTCPServer(ctx context.Context, logger *Logger, ln net.Listener, service *ServiceTarget, compress, relayMux bool) {
+	listenPort := ln.Addr().(*net.TCPAddr).Port
 	defer ln.Close()
+	defer service.Close()
+
+	// Close the listener on cancellation so Accept unblocks
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
 
-	log.Printf("TCP Server listening on port %d, forwarding to local service 127.0.0.1:%d", listenPort, localServicePort)
+	logger.Infof("TCP Server listening on port %d, forwarding to service %s", listenPort, service)
+	readiness.SetMapping(mappingStateKey("tcp", listenPort), MappingStateRelay)
 
 	for {
 		select {
@@ -484,45 +866,60 @@ func runTCPServerOnPort(ctx context.Context, listenPort, localServicePort int) {
 
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("TCP server accept error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("TCP server accept error: %v", err)
+			continue
+		}
+		if serverDrain.Draining() {
+			conn.Close()
 			continue
 		}
 
 		go func(c net.Conn) {
 			defer c.Close()
 
-			local, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localServicePort)))
+			if relayMux {
+				if compress {
+					c = newCompressedConn(c)
+				}
+				serveRelayMux(ctx, logger, mappingStateKey("tcp", listenPort), c, service)
+				return
+			}
+			local, err := service.Dial("tcp")
 			if err != nil {
-				log.Printf("TCP server dial local service error: %v", err)
+				logger.LimitedErrorf("TCP server dial local service error: %v", err)
 				return
 			}
+			if compress {
+				c = newCompressedConn(c)
+			}
 
-			var wg sync.WaitGroup
-			wg.Add(2)
-
-			// Client to local service
-			go func() {
-				defer wg.Done()
-				tcpProxy(ctx, c, local, "client->local")
-			}()
-
-			// Local service to client
-			go func() {
-				defer wg.Done()
-				tcpProxy(ctx, local, c, "local->client")
-			}()
-
-			wg.Wait()
+			proxyTCPConn(ctx, logger, mappingStateKey("tcp", listenPort), c, local, "client->local", "local->client")
 		}(conn)
 	}
 }
 
-// runUDPClientWithHolePunching runs UDP client with P2P hole punching
-func runUDPClientWithHolePunching(ctx context.Context, localPort, remotePort int, clientInfo, serverInfo *NetworkInfo) error {
-	log.Printf("🚀 Starting UDP hole punching client on port %d", localPort)
+// runUDPClientWithHolePunching runs UDP client with P2P hole punching,
+// punching again whenever the path is lost
+func runUDPClientWithHolePunching(ctx context.Context, logger *Logger, localPort, remotePort int, jitter *JitterBufferConfig, coalesce time.Duration, clientInfo, serverInfo *NetworkInfo) error {
+	for {
+		err := runUDPClientP2P(ctx, logger, localPort, remotePort, jitter, coalesce, clientInfo, serverInfo)
+		if !errors.Is(err, errP2PPathLost) {
+			return err
+		}
+		logger.Warnf("🔁 Re-establishing hole-punched path for port %d", localPort)
+	}
+}
+
+// runUDPClientP2P punches a path and forwards the local port over it until
+// ctx is done or the path is lost
+func runUDPClientP2P(ctx context.Context, logger *Logger, localPort, remotePort int, jitter *JitterBufferConfig, coalesce time.Duration, clientInfo, serverInfo *NetworkInfo) error {
+	logger.Infof("🚀 Starting UDP hole punching client on port %d", localPort)
 
 	// Establish P2P connection
-	p2pConn, err := establishP2PConnection(ctx, clientInfo, serverInfo, true) // Client is initiator
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, clientInfo, serverInfo, true, udpPunchLabel(remotePort)) // Client is initiator
 	if err != nil {
 		return fmt.Errorf("failed to establish P2P connection: %w", err)
 	}
@@ -536,31 +933,62 @@ func runUDPClientWithHolePunching(ctx context.Context, localPort, remotePort int
 
 	localConn, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on local port: %w", err)
+		return fmt.Errorf("failed to listen on local port: %w", portInUse(err, "udp", localPort))
 	}
 	defer localConn.Close()
 
-	log.Printf("✅ UDP hole punching established, proxying %d <-> P2P", localPort)
+	logger.Infof("✅ UDP hole punching established, proxying %d <-> P2P", localPort)
+	readiness.SetMapping(mappingStateKey("udp", localPort), MappingStateConnected)
 
-	// Bidirectional forwarding between local applications and P2P connection
-	go udpForwardP2P(ctx, localConn, p2pConn, "local->p2p")
-	go udpForwardP2P(ctx, p2pConn, localConn, "p2p->local")
+	// Only the punched peer is accepted; datagrams are sequenced and
+	// reordered when the mapping has a jitter buffer, and small ones are
+	// bundled when it coalesces
+	peer := newPeerConn(p2pConn, peerAddr, logger)
+	var p2p net.Conn = peer
+	if jitter != nil {
+		p2p = newSequencedConn(p2p, *jitter)
+	}
+	if coalesce > 0 {
+		p2p = newCoalescedConn(p2p, coalesce)
+	}
 
-	// Keep connection alive
-	<-ctx.Done()
-	return nil
+	// Bidirectional forwarding between local applications and P2P
+	// connection, stopped with this path
+	pathCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go udpForwardP2P(pathCtx, logger, localConn, p2p, "local->p2p")
+	go udpForwardP2P(pathCtx, logger, p2p, localConn, "p2p->local")
+
+	// Keep connection alive while the peer answers keepalives
+	return peer.watchPath(ctx, mappingStateKey("udp", localPort))
+}
+
+// runUDPMuxClientWithHolePunching punches one P2P socket and multiplexes all
+// given UDP mappings over it
+func runUDPMuxClientWithHolePunching(ctx context.Context, logger *Logger, mappings []ServerPortMapping, fin bool, clientInfo, serverInfo *NetworkInfo) error {
+	logger.Infof("🚀 Starting multiplexed UDP hole punching client for %d mappings", len(mappings))
+	setMappingStates(mappings, false, MappingStateConnecting)
+
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, clientInfo, serverInfo, true, "udpmux") // Client is initiator
+	if err != nil {
+		return fmt.Errorf("failed to establish P2P connection: %w", err)
+	}
+	defer p2pConn.Close()
+	setMappingStates(mappings, false, MappingStateConnected)
+
+	return runUDPMuxClient(ctx, logger, p2pConn, peerAddr, mappings, fin)
 }
 
 // udpForwardP2P forwards UDP packets between P2P connection and local application
-func udpForwardP2P(ctx context.Context, src, dst net.Conn, direction string) {
+func udpForwardP2P(ctx context.Context, logger *Logger, src, dst net.Conn, direction string) {
 	buffer := make([]byte, UDPBufferSize)
 	
-	log.Printf("🔄 Starting UDP P2P forwarding: %s", direction)
+	logger.Infof("🔄 Starting UDP P2P forwarding: %s", direction)
 	
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("🚫 UDP P2P forwarding stopped: %s", direction)
+			logger.Infof("🚫 UDP P2P forwarding stopped: %s", direction)
 			return
 		default:
 		}
@@ -573,7 +1001,7 @@ func udpForwardP2P(ctx context.Context, src, dst net.Conn, direction string) {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue // Timeout is expected, continue loop
 			}
-			log.Printf("⚠️  UDP P2P forward %s read error: %v", direction, err)
+			logger.Errorf("⚠️  UDP P2P forward %s read error: %v", direction, err)
 			return
 		}
 
@@ -581,55 +1009,94 @@ func udpForwardP2P(ctx context.Context, src, dst net.Conn, direction string) {
 			dst.SetWriteDeadline(time.Now().Add(1 * time.Second))
 			_, err = dst.Write(buffer[:n])
 			if err != nil {
-				log.Printf("⚠️  UDP P2P forward %s write error: %v", direction, err)
+				logger.Errorf("⚠️  UDP P2P forward %s write error: %v", direction, err)
 				return
 			}
+			traceFirstByte(direction)
 			// log.Printf("✅ P2P %s: forwarded %d bytes", direction, n)
 		}
 	}
 }
 
-// runUDPServerWithHolePunching runs UDP server with P2P hole punching support
-func runUDPServerWithHolePunching(ctx context.Context, listenPort, localServicePort int, clientInfo, serverInfo *NetworkInfo) error {
-	log.Printf("🚀 Starting UDP hole punching server on port %d", listenPort)
+// runUDPServerWithHolePunching runs UDP server with P2P hole punching
+// support, punching again whenever the path is lost
+func runUDPServerWithHolePunching(ctx context.Context, logger *Logger, listenPort int, service *ServiceTarget, jitter *JitterBufferConfig, coalesce time.Duration, clientInfo, serverInfo *NetworkInfo) error {
+	for {
+		err := runUDPServerP2P(ctx, logger, listenPort, service, jitter, coalesce, clientInfo, serverInfo)
+		if !errors.Is(err, errP2PPathLost) {
+			return err
+		}
+		logger.Warnf("🔁 Re-establishing hole-punched path for port %d", listenPort)
+	}
+}
+
+// runUDPServerP2P punches a path and forwards it to the service until ctx
+// is done or the path is lost
+func runUDPServerP2P(ctx context.Context, logger *Logger, listenPort int, service *ServiceTarget, jitter *JitterBufferConfig, coalesce time.Duration, clientInfo, serverInfo *NetworkInfo) error {
+	logger.Infof("🚀 Starting UDP hole punching server on port %d", listenPort)
+	readiness.SetMapping(mappingStateKey("udp", listenPort), MappingStateConnecting)
 
 	// Establish P2P connection (server is not initiator)
-	p2pConn, err := establishP2PConnection(ctx, serverInfo, clientInfo, false)
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, serverInfo, clientInfo, false, udpPunchLabel(listenPort))
 	if err != nil {
 		return fmt.Errorf("failed to establish P2P connection: %w", err)
 	}
 	defer p2pConn.Close()
 
-	log.Printf("✅ UDP hole punching established, proxying P2P <-> local service %d", localServicePort)
+	logger.Infof("✅ UDP hole punching established, proxying P2P <-> service %s", service)
+	readiness.SetMapping(mappingStateKey("udp", listenPort), MappingStateConnected)
 
-	// Create connection to local service
-	localServiceAddr := &net.UDPAddr{
-		IP:   net.ParseIP("127.0.0.1"),
-		Port: localServicePort,
+	// Only the punched peer is accepted; datagrams are sequenced and
+	// reordered when the mapping has a jitter buffer, and small ones are
+	// bundled when it coalesces
+	peer := newPeerConn(p2pConn, peerAddr, logger)
+	var p2p net.Conn = peer
+	if jitter != nil {
+		p2p = newSequencedConn(p2p, *jitter)
+	}
+	if coalesce > 0 {
+		p2p = newCoalescedConn(p2p, coalesce)
 	}
 
-	// Forward packets between P2P connection and local service
-	go udpForwardToService(ctx, p2pConn, localServiceAddr, "p2p->service")
+	// Forward packets between P2P connection and local service, stopped
+	// with this path
+	pathCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go udpForwardToService(pathCtx, logger, p2p, service, "p2p->service")
 
-	// Keep connection alive
-	<-ctx.Done()
-	return nil
+	// Keep connection alive while the peer answers keepalives
+	return peer.watchPath(ctx, mappingStateKey("udp", listenPort))
+}
+
+// runUDPMuxServerWithHolePunching punches one P2P socket and demultiplexes
+// all given UDP mappings from it to their local services
+func runUDPMuxServerWithHolePunching(ctx context.Context, logger *Logger, mappings []ServerPortMapping, fin bool, clientInfo, serverInfo *NetworkInfo) error {
+	logger.Infof("🚀 Starting multiplexed UDP hole punching server for %d mappings", len(mappings))
+	setMappingStates(mappings, true, MappingStateConnecting)
+
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, serverInfo, clientInfo, false, "udpmux")
+	if err != nil {
+		return fmt.Errorf("failed to establish P2P connection: %w", err)
+	}
+	defer p2pConn.Close()
+	setMappingStates(mappings, true, MappingStateConnected)
+
+	return runUDPMuxServer(ctx, logger, p2pConn, peerAddr, mappings, fin)
 }
 
 // udpForwardToService forwards UDP packets to local service
-func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr *net.UDPAddr, direction string) {
-	buffer := make([]byte, UDPBufferSize)
-	
+func udpForwardToService(ctx context.Context, logger *Logger, p2pConn net.Conn, service *ServiceTarget, direction string) {
 	// Create connection to local service
-	serviceConn, err := net.Dial("udp", serviceAddr.String())
+	serviceConn, err := service.Dial("udp")
 	if err != nil {
-		log.Printf("Failed to connect to local service: %v", err)
+		logger.LimitedErrorf("Failed to connect to local service: %v", err)
 		return
 	}
 	defer serviceConn.Close()
 
 	// Start bidirectional forwarding
 	go func() {
+		buffer := make([]byte, UDPBufferSize)
 		for {
 			select {
 			case <-ctx.Done():
@@ -644,7 +1111,7 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
-				log.Printf("UDP forward %s read error: %v", direction, err)
+				logger.Errorf("UDP forward %s read error: %v", direction, err)
 				return
 			}
 
@@ -653,7 +1120,7 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 				serviceConn.SetWriteDeadline(time.Now().Add(1 * time.Second))
 				_, err = serviceConn.Write(buffer[:n])
 				if err != nil {
-					log.Printf("UDP forward %s write error: %v", direction, err)
+					logger.Errorf("UDP forward %s write error: %v", direction, err)
 					return
 				}
 			}
@@ -661,6 +1128,7 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 	}()
 
 	// Read responses from local service and send back to P2P
+	buffer := make([]byte, UDPBufferSize)
 	for {
 		select {
 		case <-ctx.Done():
@@ -674,7 +1142,7 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
-			log.Printf("UDP forward service->p2p read error: %v", err)
+			logger.Errorf("UDP forward service->p2p read error: %v", err)
 			return
 		}
 
@@ -682,7 +1150,7 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 			p2pConn.SetWriteDeadline(time.Now().Add(1 * time.Second))
 			_, err = p2pConn.Write(buffer[:n])
 			if err != nil {
-				log.Printf("UDP forward service->p2p write error: %v", err)
+				logger.Errorf("UDP forward service->p2p write error: %v", err)
 				return
 			}
 		}
@@ -690,18 +1158,55 @@ func udpForwardToService(ctx context.Context, p2pConn *net.UDPConn, serviceAddr
 }
 
 // runUDPServerOnPort runs UDP server on specified port, forwarding to local service
-func runUDPServerOnPort(ctx context.Context, listenPort, localServicePort int) {
+func runUDPServerOnPort(ctx context.Context, logger *Logger, listenPort int, service *ServiceTarget) {
 	localPeerAddr := net.UDPAddr{Port: listenPort}
 	conn, err := net.ListenUDP("udp", &localPeerAddr)
 	if err != nil {
-		log.Fatalf("UDP server listen error on port %d: %v", listenPort, err)
+		logger.Errorf("❌ UDP server listen error, skipping the mapping: %v", portInUse(err, "udp", listenPort))
+		return
 	}
+	serveUDPServer(ctx, logger, conn, service)
+}
+
+// serveUDPServer relays datagrams from an already bound socket to the local
+// service
+func serveUDPServer(ctx context.Context, logger *Logger, conn *net.UDPConn, service *ServiceTarget) {
+	listenPort := conn.LocalAddr().(*net.UDPAddr).Port
+	readiness.SetMapping(mappingStateKey("udp", listenPort), MappingStateRelay)
 	defer conn.Close()
 
-	localServiceAddr := net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: localServicePort}
+	// Close the socket on cancellation so reads unblock
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Every client address gets its own socket to the service, so replies
+	// are routed back to the client that sent the request
+	sessionManager := NewUDPSessionManager(service.udpTimeout, logger, mappingStateKey("udp", listenPort))
+	sessionManager.sourcePort = service.sourcePort
+	sessionManager.drain = serverDrain
+	sessionManager.sessionKey = udpSessionKeyer(service.udpSessionKey)
+	sessionManager.sourcePool = udpSourcePool
+	defer sessionManager.CloseAll()
 	buf := make([]byte, UDPBufferSize)
 
-	log.Printf("UDP Server listening on port %d, forwarding to local service 127.0.0.1:%d", listenPort, localServicePort)
+	logger.Infof("UDP Server listening on port %d, forwarding to service %s", listenPort, service)
+
+	// Start cleanup goroutine
+	go func() {
+		ticker := time.NewTicker(sessionManager.cleanupInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sessionManager.CleanupExpiredSessions()
+			}
+		}
+	}()
 
 	for {
 		select {
@@ -712,16 +1217,41 @@ func runUDPServerOnPort(ctx context.Context, listenPort, localServicePort int) {
 
 		n, peerAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("UDP server read error: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.LimitedErrorf("UDP server read error: %v", err)
 			continue
 		}
 
-		// Forward to local service
-		go func(data []byte, peer *net.UDPAddr) {
-			_, err := conn.WriteToUDP(data, &localServiceAddr)
-			if err != nil {
-				log.Printf("UDP server write to local service error: %v", err)
-			}
-		}(buf[:n], peerAddr)
+		serviceAddr, err := service.UDPAddr()
+		if err != nil {
+			logger.LimitedErrorf("UDP server resolve service error: %v", err)
+			continue
+		}
+
+		// Get or create session for this peer
+		session, err := sessionManager.GetOrCreateSession(peerAddr, serviceAddr.IP.String(), serviceAddr.Port)
+		if errors.Is(err, errServerDraining) {
+			continue
+		}
+		if err != nil {
+			logger.LimitedErrorf("Failed to create session for peer %s: %v", peerAddr, err)
+			continue
+		}
+
+		// Start bidirectional proxy for new sessions
+		session.mutex.Lock()
+		if !session.ProxyStarted {
+			session.ProxyStarted = true
+			session.mutex.Unlock()
+
+			go runBidirectionalUDPProxyServer(ctx, logger, conn, session)
+		} else {
+			session.mutex.Unlock()
+		}
+
+		// Hand the packet to the session's writer
+		session.enqueue(buf[:n])
 	}
-}
\ No newline at end of file
+}
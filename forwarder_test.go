@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUDPEcho runs a UDP service echoing every datagram to its sender
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, UDPBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPServerKeepsClientsApart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := startUDPEcho(t)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newServiceTarget(PortMapping{Protocol: "udp", RemotePort: echo.LocalAddr().(*net.UDPAddr).Port})
+	go serveUDPServer(ctx, defaultLogger, server, service)
+
+	var clients []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	// Both clients send interleaved, each reply must come back to its sender
+	const rounds = 20
+	for round := 0; round < rounds; round++ {
+		for i, client := range clients {
+			client.Write([]byte(fmt.Sprintf("client %d round %d", i, round)))
+		}
+	}
+	for i, client := range clients {
+		prefix := fmt.Sprintf("client %d ", i)
+		buf := make([]byte, 64)
+		for received := 0; received < rounds; received++ {
+			client.SetReadDeadline(time.Now().Add(3 * time.Second))
+			n, err := client.Read(buf)
+			if err != nil {
+				t.Fatalf("client %d got %d of %d replies: %v", i, received, rounds, err)
+			}
+			if reply := string(buf[:n]); !strings.HasPrefix(reply, prefix) {
+				t.Fatalf("client %d received %q, a reply for the other client", i, reply)
+			}
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+// waitGoroutines waits until no more than want goroutines run
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, want at most %d:\n%s", runtime.NumGoroutine(), want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyTCPConnEndsAfterOneSidedClose(t *testing.T) {
+	pipe := func(*testing.T) (net.Conn, net.Conn) { return net.Pipe() }
+	tests := []struct {
+		name          string
+		pair          func(*testing.T) (net.Conn, net.Conn)
+		serviceCloses bool // TCP half-closes, so the proxy waits for the service's end
+	}{
+		{"tcp", tcpPair, true},
+		{"pipe", pipe, true},
+		// Without half-close the client's close ends the proxy on its own
+		{"pipe without service close", pipe, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			// client <-> c is the accepted side, peer <-> service the dialed one
+			client, c := tt.pair(t)
+			peer, service := tt.pair(t)
+			done := make(chan struct{})
+			go func() {
+				proxyTCPConn(context.Background(), defaultLogger, "tcp:test", c, peer, "client->service", "service->client")
+				close(done)
+			}()
+
+			client.Write([]byte("request"))
+			client.Close()
+
+			// The service reads up to the client's EOF and closes in turn
+			got, _ := io.ReadAll(service)
+			if string(got) != "request" {
+				t.Errorf("service read %q, want %q", got, "request")
+			}
+			if tt.serviceCloses {
+				service.Close()
+			}
+
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("proxyTCPConn still running after both ends closed")
+			}
+			service.Close()
+			waitGoroutines(t, before)
+		})
+	}
+}
+
+// openFiles counts the open file descriptors of the process, sockets
+// included
+func openFiles(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open files: %v", err)
+	}
+	return len(entries)
+}
+
+// freeUDPPort returns a loopback UDP port that was free a moment ago
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPSessionsClosedOnCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		start func(ctx context.Context, echoPort int) (listenPort int, done chan struct{})
+	}{
+		{"server", func(ctx context.Context, echoPort int) (int, chan struct{}) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				serveUDPServer(ctx, defaultLogger, conn, newServiceTarget(PortMapping{Protocol: "udp", RemotePort: echoPort}))
+				close(done)
+			}()
+			return conn.LocalAddr().(*net.UDPAddr).Port, done
+		}},
+		{"client", func(ctx context.Context, echoPort int) (int, chan struct{}) {
+			port := freeUDPPort(t)
+			done := make(chan struct{})
+			go func() {
+				runUDPClient(ctx, defaultLogger, port, "127.0.0.1", echoPort, "", time.Minute)
+				close(done)
+			}()
+			return port, done
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := startUDPEcho(t)
+			const clientCount = 3
+			var clients []*net.UDPConn
+			for i := 0; i < clientCount; i++ {
+				client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				clients = append(clients, client)
+			}
+			before := openFiles(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			port, done := tt.start(ctx, echo.LocalAddr().(*net.UDPAddr).Port)
+			target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+			// Every client gets a session with a socket of its own
+			buf := make([]byte, 64)
+			for i, client := range clients {
+				var err error
+				for attempt := 0; attempt < 30; attempt++ {
+					client.WriteToUDP([]byte("ping"), target)
+					client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+					if _, _, err = client.ReadFromUDP(buf); err == nil {
+						break
+					}
+				}
+				if err != nil {
+					t.Fatalf("client %d got no reply: %v", i, err)
+				}
+			}
+			if open := openFiles(t); open < before+clientCount {
+				t.Fatalf("%d files open with %d sessions, want at least %d", open, clientCount, before+clientCount)
+			}
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("forwarder still running after cancel")
+			}
+			deadline := time.Now().Add(3 * time.Second)
+			for openFiles(t) > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if open := openFiles(t); open > before {
+				t.Errorf("%d files open after cancel, %d before the forwarder started", open, before)
+			}
+		})
+	}
+}
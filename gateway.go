@@ -0,0 +1,122 @@
+// Package main - Default gateway discovery for gateway service targets
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// GatewayServiceHost is the symbolic serviceTarget host for the server's
+// default IPv4 gateway
+const GatewayServiceHost = "gateway"
+
+// lastGateway remembers the last resolved gateway so changes are logged once
+var lastGateway struct {
+	ip    string
+	mutex sync.Mutex
+}
+
+// defaultGateway returns the default IPv4 gateway from the routing table
+func defaultGateway() (net.IP, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return linuxDefaultGateway("/proc/net/route")
+	case "windows":
+		out, err := exec.Command("route", "print", "-4", "0.0.0.0").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing table: %w", err)
+		}
+		return parseWindowsRoutePrint(string(out))
+	default: // darwin and the BSDs
+		out, err := exec.Command("route", "-n", "get", "default").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing table: %w", err)
+		}
+		return parseBSDRouteGet(string(out))
+	}
+}
+
+// linuxDefaultGateway reads the default route from /proc/net/route, where
+// addresses are little-endian hex
+func linuxDefaultGateway(path string) (net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing table: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
+
+// parseBSDRouteGet extracts the gateway from `route -n get default` output
+func parseBSDRouteGet(out string) (net.IP, error) {
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || key != "gateway" {
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
+
+// parseWindowsRoutePrint extracts the gateway from the 0.0.0.0/0 row of
+// `route print` output
+func parseWindowsRoutePrint(out string) (net.IP, error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if ip := net.ParseIP(fields[2]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
+
+// resolveGatewayHost returns the default gateway as a host string, logging
+// whenever it differs from the last lookup
+func resolveGatewayHost() (string, error) {
+	ip, err := defaultGateway()
+	if err != nil {
+		return "", fmt.Errorf("failed to find default gateway: %w", err)
+	}
+
+	lastGateway.mutex.Lock()
+	defer lastGateway.mutex.Unlock()
+	if lastGateway.ip != ip.String() {
+		lastGateway.ip = ip.String()
+		log.Printf("🧭 Default gateway resolved to %s", ip)
+	}
+	return ip.String(), nil
+}
@@ -2,12 +2,17 @@ module stun_forward
 
 go 1.24.4
 
+require (
+	github.com/pion/stun v0.6.1
+	github.com/quic-go/quic-go v0.59.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/pion/dtls/v2 v2.2.7 // indirect
 	github.com/pion/logging v0.2.2 // indirect
-	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/transport/v2 v2.2.1 // indirect
-	golang.org/x/crypto v0.8.0 // indirect
-	golang.org/x/sys v0.7.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
@@ -0,0 +1,170 @@
+// Package main - Path confirmation handshake over punched UDP sockets
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// handshakeTimeout bounds the handshake; a peer that does not answer in
+	// time is assumed to predate it and the path is used unconfirmed
+	handshakeTimeout = 5 * time.Second
+	// handshakeResendInterval is how often unanswered frames are resent
+	handshakeResendInterval = 100 * time.Millisecond
+	// handshakeAckAckCopies ACK-ACKs are sent since the initiator does not
+	// wait for the last frame to arrive
+	handshakeAckAckCopies = 3
+)
+
+// Handshake frame types
+const (
+	handshakeInit   byte = 1
+	handshakeAck    byte = 2
+	handshakeAckAck byte = 3
+	handshakeProbe  byte = 4 // Sent by the answering side until the INIT arrives, ignored by receivers
+	handshakePing   byte = 5 // Keepalive over an established path, answered with a pong
+	handshakePong   byte = 6
+)
+
+// handshakeMagic starts every handshake frame: magic, type, 8-byte nonce
+var handshakeMagic = []byte("SFHS")
+
+const handshakeFrameSize = 4 + 1 + 8
+
+// handshakeFrame builds a frame of the given type for nonce
+func handshakeFrame(frameType byte, nonce []byte) []byte {
+	frame := make([]byte, 0, handshakeFrameSize)
+	frame = append(frame, handshakeMagic...)
+	frame = append(frame, frameType)
+	return append(frame, nonce...)
+}
+
+// parseHandshakeFrame returns the type and nonce of a handshake frame
+func parseHandshakeFrame(p []byte) (byte, []byte, bool) {
+	if len(p) != handshakeFrameSize || !bytes.HasPrefix(p, handshakeMagic) {
+		return 0, nil, false
+	}
+	return p[4], p[5:], true
+}
+
+// isHandshakeFrame reports whether p is a handshake frame, e.g. a late
+// retransmission that must not be forwarded as data
+func isHandshakeFrame(p []byte) bool {
+	_, _, ok := parseHandshakeFrame(p)
+	return ok
+}
+
+// confirmP2PPath runs a 3-way handshake (INIT -> ACK -> ACK-ACK, all carrying
+// the initiator's session nonce) with peer over a freshly punched socket, so
+// both sides know the path works in both directions before forwarding. The
+// first packet through the punched hole only proves one direction.
+func confirmP2PPath(ctx context.Context, conn *net.UDPConn, peer *net.UDPAddr, isInitiator bool) error {
+	defer conn.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(handshakeTimeout)
+
+	var err error
+	if isInitiator {
+		err = initiateHandshake(ctx, conn, peer, deadline)
+	} else {
+		err = answerHandshake(ctx, conn, peer, deadline)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("🤝 P2P path to %s confirmed in both directions", peer)
+	traceEvent("path_confirmed", "handshake with %s", peer)
+	return nil
+}
+
+// initiateHandshake sends INIT until the peer's ACK echoes the nonce, then
+// completes with ACK-ACK
+func initiateHandshake(ctx context.Context, conn *net.UDPConn, peer *net.UDPAddr, deadline time.Time) error {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	initFrame := handshakeFrame(handshakeInit, nonce)
+
+	err := handshakeExchange(ctx, conn, peer, deadline, func() []byte { return initFrame }, func(frameType byte, frameNonce []byte) bool {
+		return frameType == handshakeAck && bytes.Equal(frameNonce, nonce)
+	})
+	if err != nil {
+		return err
+	}
+	ackAck := handshakeFrame(handshakeAckAck, nonce)
+	for i := 0; i < handshakeAckAckCopies; i++ {
+		conn.WriteToUDP(ackAck, peer)
+	}
+	return nil
+}
+
+// answerHandshake ACKs the peer's INIT, resending the ACK until the ACK-ACK
+// for the same nonce arrives. Until the INIT arrives it probes the peer, as
+// the initiator resends its INIT: the punch may have completed on this side
+// from a peer datagram alone, and a restricted-cone NAT on either side only
+// passes the INIT once this side has sent toward the peer.
+func answerHandshake(ctx context.Context, conn *net.UDPConn, peer *net.UDPAddr, deadline time.Time) error {
+	var ack []byte
+	probe := handshakeFrame(handshakeProbe, make([]byte, 8))
+	next := func() []byte {
+		if ack == nil {
+			return probe
+		}
+		return ack
+	}
+	return handshakeExchange(ctx, conn, peer, deadline, next, func(frameType byte, frameNonce []byte) bool {
+		switch frameType {
+		case handshakeInit:
+			// A resent INIT means our ACK was lost; a new nonce means the
+			// initiator restarted
+			ack = handshakeFrame(handshakeAck, frameNonce)
+			conn.WriteToUDP(ack, peer)
+		case handshakeAckAck:
+			return ack != nil && bytes.Equal(frameNonce, ack[5:])
+		}
+		return false
+	})
+}
+
+// handshakeExchange sends the frame returned by next (if any) every
+// handshakeResendInterval and feeds handshake frames from peer to done until
+// it reports completion. Other datagrams, such as late hole punching probes,
+// are ignored.
+func handshakeExchange(ctx context.Context, conn *net.UDPConn, peer *net.UDPAddr, deadline time.Time, next func() []byte, done func(frameType byte, nonce []byte) bool) error {
+	buffer := make([]byte, UDPBufferSize)
+	nextSend := time.Now()
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		now := time.Now()
+		if now.After(deadline) {
+			return fmt.Errorf("no handshake from %s within %v", peer, handshakeTimeout)
+		}
+		if !now.Before(nextSend) {
+			if frame := next(); frame != nil {
+				conn.WriteToUDP(frame, peer)
+			}
+			nextSend = now.Add(handshakeResendInterval)
+		}
+
+		conn.SetReadDeadline(nextSend)
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !samePeer(addr, peer) {
+			continue
+		}
+		if frameType, nonce, ok := parseHandshakeFrame(buffer[:n]); ok && done(frameType, nonce) {
+			return nil
+		}
+	}
+}
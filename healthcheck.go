@@ -0,0 +1,299 @@
+// Package main - Protocol-aware health checks for local services
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 3 * time.Second
+	defaultHealthCheckPath     = "/healthz"
+	defaultHealthCheckQuery    = "localhost"
+)
+
+// HealthStatus is the health of a mapping's local service
+type HealthStatus int
+
+const (
+	HealthStatusUnknown HealthStatus = iota
+	HealthStatusHealthy
+	HealthStatusUnhealthy
+)
+
+func (hs HealthStatus) String() string {
+	switch hs {
+	case HealthStatusHealthy:
+		return "healthy"
+	case HealthStatusUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// HealthCheckConfig configures a mapping's health check
+type HealthCheckConfig struct {
+	Type     string   `json:"type" yaml:"type"`                             // tcp, http or dns
+	Path     string   `json:"path,omitempty" yaml:"path,omitempty"`         // HTTP path, default /healthz
+	Query    string   `json:"query,omitempty" yaml:"query,omitempty"`       // DNS name to query, default localhost
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"` // Default 10s
+	Timeout  Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`   // Default 3s
+}
+
+// Validate checks the health check type
+func (hc *HealthCheckConfig) Validate() error {
+	switch hc.Type {
+	case "tcp", "http", "dns":
+		return nil
+	default:
+		return fmt.Errorf("unknown health check type %q (want tcp, http or dns)", hc.Type)
+	}
+}
+
+// HealthChecker periodically checks one mapping's local service
+type HealthChecker struct {
+	config   HealthCheckConfig
+	protocol string
+	target   string
+	status   HealthStatus
+	lastErr  error
+	logger   *Logger
+	mutex    sync.RWMutex
+}
+
+// healthCheckers holds the checker of every health-checked mapping, keyed
+// like the mapping in /readyz
+var healthCheckers sync.Map
+
+// NewHealthChecker creates a checker for the service at target
+func NewHealthChecker(config HealthCheckConfig, protocol, target string, logger *Logger) *HealthChecker {
+	return &HealthChecker{
+		config:   config,
+		protocol: protocol,
+		target:   target,
+		logger:   logger,
+	}
+}
+
+// Status returns the latest health status and check error
+func (hc *HealthChecker) Status() (HealthStatus, error) {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	return hc.status, hc.lastErr
+}
+
+// Run checks the service until ctx is cancelled
+func (hc *HealthChecker) Run(ctx context.Context) {
+	interval := time.Duration(hc.config.Interval)
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	hc.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hc.check()
+		}
+	}
+}
+
+// check runs one probe and logs status transitions
+func (hc *HealthChecker) check() {
+	timeout := time.Duration(hc.config.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	var err error
+	switch hc.config.Type {
+	case "http":
+		err = checkHTTPHealth(hc.target, hc.config.Path, timeout)
+	case "dns":
+		err = checkDNSHealth(hc.protocol, hc.target, hc.config.Query, timeout)
+	default:
+		err = checkTCPHealth(hc.target, timeout)
+	}
+
+	status := HealthStatusHealthy
+	if err != nil {
+		status = HealthStatusUnhealthy
+	}
+
+	hc.mutex.Lock()
+	previous := hc.status
+	hc.status = status
+	hc.lastErr = err
+	hc.mutex.Unlock()
+
+	if status == previous {
+		return
+	}
+	if err != nil {
+		hc.logger.Warnf("💔 %s health check of %s failed: %v", hc.config.Type, hc.target, err)
+	} else {
+		hc.logger.Infof("💚 %s health check of %s passed", hc.config.Type, hc.target)
+	}
+}
+
+// startHealthCheck starts the configured health check of the local service
+// of a mapping allocated allocatedPort, if any
+func startHealthCheck(ctx context.Context, mapping PortMapping, allocatedPort int) {
+	if mapping.HealthCheck == nil {
+		return
+	}
+	target := newServiceTarget(mapping).Addr()
+	checker := NewHealthChecker(*mapping.HealthCheck, mapping.Protocol, target, mappingLogger(mapping))
+	key := mappingStateKey(mapping.transport(), allocatedPort)
+	healthCheckers.Store(key, checker)
+
+	go func() {
+		defer healthCheckers.Delete(key)
+		checker.Run(ctx)
+	}()
+}
+
+// healthReport returns the status of every health check by mapping key,
+// with the error of failing ones, and the keys of the unhealthy mappings
+func healthReport() (map[string]string, []string) {
+	report := make(map[string]string)
+	var unhealthy []string
+	healthCheckers.Range(func(key, value interface{}) bool {
+		status, err := value.(*HealthChecker).Status()
+		if err != nil {
+			report[key.(string)] = fmt.Sprintf("%s: %v", status, err)
+		} else {
+			report[key.(string)] = status.String()
+		}
+		if status == HealthStatusUnhealthy {
+			unhealthy = append(unhealthy, key.(string))
+		}
+		return true
+	})
+	sort.Strings(unhealthy)
+	return report, unhealthy
+}
+
+// checkTCPHealth checks that the service accepts connections
+func checkTCPHealth(target string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkHTTPHealth issues a GET and expects a 2xx or 3xx status
+func checkHTTPHealth(target, path string, timeout time.Duration) error {
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + target + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkDNSHealth sends an A query and expects a matching response that is
+// not SERVFAIL. TCP mappings use DNS over TCP.
+func checkDNSHealth(protocol, target, name string, timeout time.Duration) error {
+	if name == "" {
+		name = defaultHealthCheckQuery
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildDNSQuery(id, name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout(protocol, target, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	response := make([]byte, 512)
+	var n int
+	if protocol == "tcp" {
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		if _, err := conn.Write(framed); err != nil {
+			return err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		n, err = io.ReadFull(conn, response[:min(int(binary.BigEndian.Uint16(length[:])), len(response))])
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return err
+		}
+		n, err = conn.Read(response)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n < 12 || binary.BigEndian.Uint16(response[0:2]) != id || response[2]&0x80 == 0 {
+		return errors.New("invalid DNS response")
+	}
+	if rcode := response[3] & 0x0f; rcode == 2 {
+		return errors.New("DNS server returned SERVFAIL")
+	}
+	return nil
+}
+
+// buildDNSQuery builds a recursive A query for name
+func buildDNSQuery(id uint16, name string) ([]byte, error) {
+	query := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(query[0:2], id)
+	query[2] = 0x01 // Recursion desired
+	binary.BigEndian.PutUint16(query[4:6], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 1, 0, 1) // Root, type A, class IN
+	return query, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitHealth polls the health report until the first check of key ran
+func waitHealth(t *testing.T, key string) string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if health, _ := healthReport(); health[key] != "" && health[key] != "unknown" {
+			return health[key]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no health status for %s", key)
+	return ""
+}
+
+func TestReadinessReportsUnhealthyService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downPort := down.Addr().(*net.TCPAddr).Port
+	down.Close()
+
+	check := &HealthCheckConfig{Type: "tcp", Timeout: Duration(time.Second)}
+	startHealthCheck(ctx, PortMapping{Protocol: "tcp", LocalPort: 1, RemotePort: up.Addr().(*net.TCPAddr).Port, HealthCheck: check}, 41001)
+	startHealthCheck(ctx, PortMapping{Protocol: "tcp", LocalPort: 2, RemotePort: downPort, HealthCheck: check}, 41002)
+
+	if status := waitHealth(t, "tcp:41001"); status != "healthy" {
+		t.Errorf("reachable service reported %q", status)
+	}
+	waitHealth(t, "tcp:41002")
+
+	tracker := &ReadinessTracker{discovered: true, mappings: map[string]string{"tcp:41001": MappingStateRelay, "tcp:41002": MappingStateRelay}, backing: map[string]bool{}}
+	report := tracker.Report()
+	if report.Ready {
+		t.Error("ready while a service is unhealthy")
+	}
+	if len(report.Unhealthy) != 1 || report.Unhealthy[0] != "tcp:41002" {
+		t.Errorf("unhealthy = %v, want [tcp:41002]", report.Unhealthy)
+	}
+	if report.Health["tcp:41001"] != "healthy" {
+		t.Errorf("health = %v", report.Health)
+	}
+
+	// Checks end with their mapping
+	cancel()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if health, _ := healthReport(); len(health) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("health checks still reported after their mappings stopped")
+}
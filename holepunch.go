@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -11,6 +12,46 @@ import (
 	"time"
 )
 
+// Hole punching strategies, named in holePunchStrategies
+const (
+	HolePunchStrategyLAN            = "lan"            // Direct connection between private addresses
+	HolePunchStrategySimultaneous   = "simultaneous"   // Both sides send to each other's STUN address at once
+	HolePunchStrategyDirect         = "direct"         // Retried connects to the STUN addresses
+	HolePunchStrategyPortPrediction = "portPrediction" // Ports around the peer's STUN port, for symmetric NATs
+)
+
+// defaultHolePunchStrategies is the order strategies run in unless
+// holePunchStrategies says otherwise
+var defaultHolePunchStrategies = []string{
+	HolePunchStrategyLAN, HolePunchStrategySimultaneous, HolePunchStrategyDirect, HolePunchStrategyPortPrediction,
+}
+
+// holePunchStrategies are the strategies performSynchronizedHolePunching
+// runs, in order
+var holePunchStrategies = defaultHolePunchStrategies
+
+// validateHolePunchStrategies checks that strategies names known strategies,
+// each at most once
+func validateHolePunchStrategies(strategies []string) error {
+	seen := make(map[string]bool)
+	for _, name := range strategies {
+		switch name {
+		case HolePunchStrategyLAN, HolePunchStrategySimultaneous, HolePunchStrategyDirect, HolePunchStrategyPortPrediction:
+		default:
+			return fmt.Errorf("unknown strategy %q (want %v)", name, defaultHolePunchStrategies)
+		}
+		if seen[name] {
+			return fmt.Errorf("strategy %q listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// errIPv6PathUnconfirmed is returned when an IPv6 punch succeeded but the
+// path failed to carry the handshake after it
+var errIPv6PathUnconfirmed = errors.New("IPv6 path to the peer not confirmed")
+
 // HolePunchResult represents the result of a hole punching attempt
 type HolePunchResult struct {
 	Success    bool
@@ -29,6 +70,26 @@ type HolePunchConfig struct {
 	Timeout        time.Duration // Hole punching timeout
 	RetryCount     int           // Number of retry attempts
 	IsInitiator    bool          // Whether we initiate the connection
+	LocalPort      int           // Fixed local port to bind, 0 binds the STUN-discovered port
+	Strategies     []string      // Strategies to run in order, see holePunchStrategies
+	Clock          Clock         // Time source of sends, delays and timeouts, the real clock when nil
+}
+
+// clock returns the time source of hole punching with config
+func (c HolePunchConfig) clock() Clock {
+	if c.Clock == nil {
+		return realClock{}
+	}
+	return c.Clock
+}
+
+// localBindAddr returns the address strategies bind to: the STUN address, or
+// the same IP with the fixed local port when one is configured
+func (c HolePunchConfig) localBindAddr() string {
+	if c.LocalPort > 0 {
+		return net.JoinHostPort(extractIP(c.LocalSTUNAddr), strconv.Itoa(c.LocalPort))
+	}
+	return c.LocalSTUNAddr
 }
 
 // performUDPHolePunching attempts UDP hole punching using multiple strategies
@@ -38,7 +99,7 @@ func performUDPHolePunching(ctx context.Context, config HolePunchConfig) (*HoleP
 	log.Printf("   Local Private: %s, Remote Private: %s", config.LocalPrivateAddr, config.RemotePrivateAddr)
 
 	// Strategy 1: Try direct connection to STUN addresses (most common)
-	if result := tryDirectConnection(ctx, config.LocalSTUNAddr, config.RemoteSTUNAddr, config.Timeout); result.Success {
+	if result := tryDirectConnection(ctx, config.localBindAddr(), config.RemoteSTUNAddr, config.Timeout); result.Success {
 		log.Printf("✅ Hole punching successful via STUN addresses")
 		return result, nil
 	}
@@ -158,7 +219,7 @@ func trySimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePu
 
 	// Create connection using same local port as STUN discovery
 	localIP := extractIP(config.LocalSTUNAddr)
-	localPort := extractPort(config.LocalSTUNAddr)
+	localPort := extractPort(config.localBindAddr())
 	localAddr := net.JoinHostPort(localIP, localPort)
 	
 	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
@@ -166,10 +227,10 @@ func trySimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePu
 		return &HolePunchResult{Success: false, Error: fmt.Errorf("invalid local address: %w", err)}
 	}
 
-	conn, err := net.ListenUDP("udp", localUDPAddr)
+	conn, err := listenUDPOnBindInterface(localUDPAddr)
 	if err != nil {
 		// Try with system-assigned port if specific port fails
-		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: localUDPAddr.IP})
+		conn, err = listenUDPOnBindInterface(&net.UDPAddr{IP: localUDPAddr.IP})
 		if err != nil {
 			return &HolePunchResult{Success: false, Error: fmt.Errorf("failed to listen UDP: %w", err)}
 		}
@@ -185,10 +246,10 @@ func trySimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePu
 	go func() {
 		defer wg.Done()
 		
-		ticker := time.NewTicker(100 * time.Millisecond)
+		ticker := config.clock().NewTicker(100 * time.Millisecond)
 		defer ticker.Stop()
 		
-		timeout := time.After(config.Timeout)
+		timeout := config.clock().After(config.Timeout)
 		message := []byte("SIMULTANEOUS_CONNECT")
 		
 		for {
@@ -197,7 +258,7 @@ func trySimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePu
 				return
 			case <-timeout:
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				conn.WriteToUDP(message, remoteUDPAddr)
 			}
 		}
@@ -244,7 +305,7 @@ func trySimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePu
 
 	select {
 	case <-done:
-	case <-time.After(config.Timeout):
+	case <-config.clock().After(config.Timeout):
 	case <-ctx.Done():
 	}
 
@@ -296,8 +357,12 @@ func tryPortPrediction(ctx context.Context, config HolePunchConfig) *HolePunchRe
 	return &HolePunchResult{Success: false, Error: fmt.Errorf("port prediction failed")}
 }
 
-// getLocalInterfaceIP gets the local interface IP address
+// getLocalInterfaceIP gets the local interface IP address: the address of
+// the bindInterface, or of the interface the default route uses
 func getLocalInterfaceIP() (string, error) {
+	if bindIP != nil {
+		return bindIP.String(), nil
+	}
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		return "", err
@@ -311,7 +376,7 @@ func getLocalInterfaceIP() (string, error) {
 // createReusePortUDPConn creates a UDP connection with port reuse enabled
 func createReusePortUDPConn(addr *net.UDPAddr) (*net.UDPConn, error) {
 	// First try regular UDP listen
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := listenUDPOnBindInterface(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -341,15 +406,70 @@ type SynchronizedHolePunch struct {
 }
 
 // establishP2PConnection creates a P2P connection using improved hole punching
-func establishP2PConnection(ctx context.Context, localInfo, remoteInfo *NetworkInfo, isInitiator bool) (*net.UDPConn, error) {
+// and returns the punched socket together with the peer address it reached.
+// A failed punch is retried holePunchRetries times from fresh ports swapped
+// through the signaling server; label names the punch identically on both
+// peers so they meet in the same exchange. A punch over IPv6 whose path
+// carries no data once punched falls back to IPv4 addresses swapped the
+// same way, and retries stay on IPv4.
+func establishP2PConnection(ctx context.Context, localInfo, remoteInfo *NetworkInfo, isInitiator bool, label string) (*net.UDPConn, *net.UDPAddr, error) {
+	// A startup budget bounds punching too; callers relay when it runs out
+	punchCtx, cancel := startupStageContext(ctx)
+	defer cancel()
+
+	conn, peerAddr, err := punchP2PLimited(ctx, punchCtx, localInfo, remoteInfo, isInitiator, label)
+	ex := punchExchangeFrom(ctx)
+	network := "udp"
+	if errors.Is(err, errIPv6PathUnconfirmed) && ex != nil && punchCtx.Err() == nil {
+		log.Printf("🔁 %v, falling back to IPv4", err)
+		network = "udp4"
+		v4Label := label + "-v4"
+		localInfo, remoteInfo, err = ex.refresh(punchCtx, network, v4Label, 1, localInfo, remoteInfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("IPv4 fallback: %w", err)
+		}
+		conn, peerAddr, err = punchP2PLimited(ctx, punchCtx, localInfo, remoteInfo, isInitiator, label)
+		ex.clear(v4Label, 1)
+	}
+	for attempt := 1; err != nil && ex != nil && attempt <= holePunchRetries && punchCtx.Err() == nil; attempt++ {
+		log.Printf("🔁 Hole punching failed (%v), retry %d/%d from a fresh port", err, attempt, holePunchRetries)
+		localInfo, remoteInfo, err = ex.refresh(punchCtx, network, label, attempt, localInfo, remoteInfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("hole punching retry %d: %w", attempt, err)
+		}
+		conn, peerAddr, err = punchP2PLimited(ctx, punchCtx, localInfo, remoteInfo, isInitiator, label)
+		ex.clear(label, attempt)
+	}
+	return conn, peerAddr, err
+}
+
+// punchP2PLimited makes one hole punching attempt once maxConcurrentPunches
+// lets it start. The slot is held only while punching, not while a retry
+// swaps fresh addresses with the peer.
+func punchP2PLimited(ctx, punchCtx context.Context, localInfo, remoteInfo *NetworkInfo, isInitiator bool, label string) (*net.UDPConn, *net.UDPAddr, error) {
+	release, err := acquirePunchSlot(punchCtx, label)
+	if err != nil {
+		return nil, nil, fmt.Errorf("waiting to punch for %s: %w", label, err)
+	}
+	defer release()
+	return punchP2P(ctx, punchCtx, localInfo, remoteInfo, isInitiator)
+}
+
+// punchP2P makes one hole punching attempt between the given addresses,
+// bounded by punchCtx
+func punchP2P(ctx, punchCtx context.Context, localInfo, remoteInfo *NetworkInfo, isInitiator bool) (*net.UDPConn, *net.UDPAddr, error) {
 	config := HolePunchConfig{
 		LocalSTUNAddr:     localInfo.PublicAddr,
 		RemoteSTUNAddr:    remoteInfo.PublicAddr,
 		LocalPrivateAddr:  localInfo.PrivateAddr,
 		RemotePrivateAddr: remoteInfo.PrivateAddr,
-		Timeout:           15 * time.Second, // Increased timeout for better success
+		Timeout:           stageTimeout(punchCtx, 15*time.Second), // Increased timeout for better success
 		RetryCount:        5,                // More retries
 		IsInitiator:       isInitiator,
+		Strategies:        holePunchStrategies,
+	}
+	if localInfo.HolePunchPortFixed {
+		config.LocalPort = localInfo.HolePunchPort
 	}
 
 	// Improved timing coordination
@@ -360,69 +480,140 @@ func establishP2PConnection(ctx context.Context, localInfo, remoteInfo *NetworkI
 		// Non-initiator waits slightly longer for better coordination
 		delay := 800 * time.Millisecond
 		log.Printf("⏳ Non-initiator waiting %v for coordination", delay)
-		time.Sleep(delay)
+		config.clock().Sleep(delay)
 	}
 
 	// Use synchronized hole punching for better success rate
-	result, err := performSynchronizedHolePunching(ctx, config)
+	result, err := performSynchronizedHolePunching(punchCtx, config)
+	if err == nil && !result.Success {
+		traceEvent("holepunch_failed", "%v", result.Error)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("synchronized hole punching failed: %w", err)
+		return nil, nil, fmt.Errorf("synchronized hole punching failed: %w", err)
 	}
 
 	if !result.Success {
-		return nil, fmt.Errorf("hole punching unsuccessful: %v", result.Error)
+		if punchCtx.Err() != nil && ctx.Err() == nil {
+			return nil, nil, fmt.Errorf("startup timeout reached during hole punching")
+		}
+		return nil, nil, fmt.Errorf("hole punching unsuccessful: %w", result.Error)
+	}
+
+	peerAddr, err := net.ResolveUDPAddr("udp", result.RemoteAddr)
+	if err != nil {
+		result.Conn.Close()
+		return nil, nil, fmt.Errorf("invalid peer address %q: %w", result.RemoteAddr, err)
+	}
+
+	// Forwarding starts only once both sides saw the path work both ways.
+	// IPv6 paths must be confirmed: misrouted IPv6 often lets the punch
+	// through yet drops the data after it.
+	if err := confirmP2PPath(punchCtx, result.Conn, peerAddr, isInitiator); err != nil {
+		if punchCtx.Err() != nil {
+			result.Conn.Close()
+			return nil, nil, err
+		}
+		if peerAddr.IP.To4() == nil {
+			result.Conn.Close()
+			return nil, nil, fmt.Errorf("%w: %v", errIPv6PathUnconfirmed, err)
+		}
+		log.Printf("⚠️  P2P path not confirmed (%v), peer may predate the handshake; continuing", err)
 	}
 
 	log.Printf("🎉 P2P connection established: %s <-> %s", result.LocalAddr, result.RemoteAddr)
-	return result.Conn, nil
+	traceEvent("connection_established", "p2p %s <-> %s", result.LocalAddr, result.RemoteAddr)
+	return result.Conn, peerAddr, nil
 }
 
-// performSynchronizedHolePunching performs hole punching with better timing
+// performSynchronizedHolePunching performs hole punching with better timing,
+// running config.Strategies in order until one succeeds
 func performSynchronizedHolePunching(ctx context.Context, config HolePunchConfig) (*HolePunchResult, error) {
 	log.Printf("🚀 Starting synchronized UDP hole punching - Initiator: %v", config.IsInitiator)
 	log.Printf("   Local STUN: %s, Remote STUN: %s", config.LocalSTUNAddr, config.RemoteSTUNAddr)
 	log.Printf("   Local Private: %s, Remote Private: %s", config.LocalPrivateAddr, config.RemotePrivateAddr)
 
-	// Strategy 1: Try LAN direct connection first (fastest)
-	if config.LocalPrivateAddr != "" && config.RemotePrivateAddr != "" {
-		if result := tryDirectConnection(ctx, config.LocalPrivateAddr, config.RemotePrivateAddr, 2*time.Second); result.Success {
-			log.Printf("✅ LAN direct connection successful")
-			return result, nil
-		}
-	}
-
-	// Strategy 2: Enhanced simultaneous connect with better timing
-	if result := tryEnhancedSimultaneousConnect(ctx, config); result.Success {
-		log.Printf("✅ Enhanced simultaneous connect successful")
-		return result, nil
+	strategies := config.Strategies
+	if len(strategies) == 0 {
+		strategies = defaultHolePunchStrategies
 	}
-
-	// Strategy 3: Try direct STUN addresses with retry
-	for attempt := 0; attempt < config.RetryCount; attempt++ {
-		log.Printf("🔄 Attempt %d/%d: Trying STUN addresses", attempt+1, config.RetryCount)
-		if result := tryDirectConnection(ctx, config.LocalSTUNAddr, config.RemoteSTUNAddr, 3*time.Second); result.Success {
-			log.Printf("✅ STUN direct connection successful on attempt %d", attempt+1)
+	var attempts []punchAttempt
+	for _, strategy := range strategies {
+		if ctx.Err() != nil {
+			break
+		}
+		result := runHolePunchStrategy(ctx, strategy, config)
+		if result != nil && result.Success {
 			return result, nil
 		}
-		
-		// Progressive delay between attempts
-		if attempt < config.RetryCount-1 {
-			time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+		attempt := punchAttempt{strategy: strategy}
+		if result != nil {
+			attempt.err = result.Error
 		}
-	}
-
-	// Strategy 4: Port prediction for symmetric NAT
-	if result := tryPortPrediction(ctx, config); result.Success {
-		log.Printf("✅ Port prediction successful")
-		return result, nil
+		attempts = append(attempts, attempt)
 	}
 
 	return &HolePunchResult{
 		Success: false,
-		Error:   fmt.Errorf("all synchronized hole punching strategies failed"),
+		Error:   &punchStrategiesError{attempts: attempts},
 	}, nil
 }
 
+// runHolePunchStrategy runs one named strategy, returning nil when it does
+// not apply
+func runHolePunchStrategy(ctx context.Context, strategy string, config HolePunchConfig) *HolePunchResult {
+	switch strategy {
+	case HolePunchStrategyLAN:
+		// LAN direct connection (fastest)
+		if config.LocalPrivateAddr == "" || config.RemotePrivateAddr == "" {
+			return nil
+		}
+		traceEvent("holepunch_attempt", "lan direct %s -> %s", config.LocalPrivateAddr, config.RemotePrivateAddr)
+		result := tryDirectConnection(ctx, config.LocalPrivateAddr, config.RemotePrivateAddr, 2*time.Second)
+		if result.Success {
+			log.Printf("✅ LAN direct connection successful")
+		}
+		return result
+
+	case HolePunchStrategySimultaneous:
+		// Enhanced simultaneous connect with better timing
+		traceEvent("holepunch_attempt", "simultaneous connect to %s", config.RemoteSTUNAddr)
+		result := tryEnhancedSimultaneousConnect(ctx, config)
+		if result.Success {
+			log.Printf("✅ Enhanced simultaneous connect successful")
+		}
+		return result
+
+	case HolePunchStrategyDirect:
+		// Direct STUN addresses with retry
+		var result *HolePunchResult
+		for attempt := 0; attempt < config.RetryCount; attempt++ {
+			log.Printf("🔄 Attempt %d/%d: Trying STUN addresses", attempt+1, config.RetryCount)
+			traceEvent("holepunch_attempt", "stun direct to %s, attempt %d/%d", config.RemoteSTUNAddr, attempt+1, config.RetryCount)
+			result = tryDirectConnection(ctx, config.localBindAddr(), config.RemoteSTUNAddr, 3*time.Second)
+			if result.Success {
+				log.Printf("✅ STUN direct connection successful on attempt %d", attempt+1)
+				return result
+			}
+
+			// Progressive delay between attempts
+			if attempt < config.RetryCount-1 {
+				config.clock().Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+			}
+		}
+		return result
+
+	case HolePunchStrategyPortPrediction:
+		// Port prediction for symmetric NAT
+		traceEvent("holepunch_attempt", "port prediction around %s", config.RemoteSTUNAddr)
+		result := tryPortPrediction(ctx, config)
+		if result.Success {
+			log.Printf("✅ Port prediction successful")
+		}
+		return result
+	}
+	return nil
+}
+
 // tryEnhancedSimultaneousConnect improved simultaneous connect with better coordination
 func tryEnhancedSimultaneousConnect(ctx context.Context, config HolePunchConfig) *HolePunchResult {
 	log.Printf("🔄 Trying enhanced simultaneous connect")
@@ -446,8 +637,8 @@ func tryEnhancedSimultaneousConnect(ctx context.Context, config HolePunchConfig)
 		Port: 0, // Let system assign port initially
 	}
 
-	// Try to use STUN port for consistency
-	if stunPort := extractPort(config.LocalSTUNAddr); stunPort != "" {
+	// Try to use STUN port (or the fixed hole punch port) for consistency
+	if stunPort := extractPort(config.localBindAddr()); stunPort != "" {
 		if port, err := strconv.Atoi(stunPort); err == nil {
 			localBindAddr.Port = port
 		}
@@ -477,13 +668,13 @@ func tryEnhancedSimultaneousConnect(ctx context.Context, config HolePunchConfig)
 		
 		// Staggered start based on role
 		if !config.IsInitiator {
-			time.Sleep(100 * time.Millisecond) // Small offset for coordination
+			config.clock().Sleep(100 * time.Millisecond) // Small offset for coordination
 		}
 		
-		ticker := time.NewTicker(50 * time.Millisecond) // Faster sending rate
+		ticker := config.clock().NewTicker(50 * time.Millisecond) // Faster sending rate
 		defer ticker.Stop()
 		
-		timeout := time.After(config.Timeout)
+		timeout := config.clock().After(config.Timeout)
 		message := []byte(fmt.Sprintf("ENHANCED_HOLE_PUNCH_%v", config.IsInitiator))
 		
 		for {
@@ -494,7 +685,7 @@ func tryEnhancedSimultaneousConnect(ctx context.Context, config HolePunchConfig)
 				return
 			case <-success:
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				conn.WriteToUDP(message, remoteUDPAddr)
 			}
 		}
@@ -545,7 +736,7 @@ func tryEnhancedSimultaneousConnect(ctx context.Context, config HolePunchConfig)
 
 	select {
 	case <-done:
-	case <-time.After(config.Timeout):
+	case <-config.clock().After(config.Timeout):
 	case <-ctx.Done():
 	}
 
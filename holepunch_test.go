@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+	mutex   sync.Mutex
+}
+
+// fakeWaiter is a pending After, Sleep or ticker of a fakeClock
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // Ticker interval, 0 for a one-shot waiter
+	c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.add(d, 0).c }
+
+func (c *fakeClock) Sleep(d time.Duration) { <-c.After(d) }
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker { return fakeTicker{c, c.add(d, d)} }
+
+// remove drops w from the pending waiters
+func (c *fakeClock) remove(w *fakeWaiter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, pending := range c.waiters {
+		if pending == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock by d, firing every waiter due by then. Like
+// time.Ticker, a ticker whose last tick was not received drops the next.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+// waitForWaiters waits until n waiters are pending on the clock
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		c.mutex.Lock()
+		pending := len(c.waiters)
+		c.mutex.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters on the clock, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeTicker is a Ticker of a fakeClock
+type fakeTicker struct {
+	clock  *fakeClock
+	waiter *fakeWaiter
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.waiter.c }
+
+func (t fakeTicker) Stop() { t.clock.remove(t.waiter) }
+
+// punchPeer is the remote side of a hole punch: a loopback socket that
+// counts the probes it receives
+func punchPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expectProbes reads want probes from peer, failing on any more
+func expectProbes(t *testing.T, peer *net.UDPConn, want int) *net.UDPAddr {
+	t.Helper()
+	buf := make([]byte, 1024)
+	var from *net.UDPAddr
+	for i := 0; i < want; i++ {
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d probes: %v", i, want, err)
+		}
+		if string(buf[:n]) != "SIMULTANEOUS_CONNECT" {
+			t.Fatalf("probe %q", buf[:n])
+		}
+		from = addr
+	}
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := peer.ReadFromUDP(buf); err == nil {
+		t.Fatalf("more than %d probes sent", want)
+	}
+	return from
+}
+
+func TestSimultaneousConnectPacesProbes(t *testing.T) {
+	clock := newFakeClock()
+	peer := punchPeer(t)
+	config := HolePunchConfig{
+		LocalSTUNAddr:  "127.0.0.1:0",
+		RemoteSTUNAddr: peer.LocalAddr().String(),
+		Timeout:        time.Hour, // Only the fake clock can reach it
+		Clock:          clock,
+	}
+
+	results := make(chan *HolePunchResult, 1)
+	go func() { results <- trySimultaneousConnect(context.Background(), config) }()
+
+	// The sender's ticker and timeout, and the overall timeout
+	clock.waitForWaiters(t, 3)
+	expectProbes(t, peer, 0)
+	for tick := 1; tick <= 3; tick++ {
+		clock.Advance(100 * time.Millisecond)
+		expectProbes(t, peer, 1)
+	}
+	// Less than an interval sends nothing
+	clock.Advance(99 * time.Millisecond)
+	expectProbes(t, peer, 0)
+
+	clock.Advance(time.Hour)
+	select {
+	case result := <-results:
+		if result.Success {
+			t.Errorf("unanswered punch succeeded: %+v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("simultaneous connect still running after its timeout on the clock")
+	}
+}
+
+func TestSimultaneousConnectAnswered(t *testing.T) {
+	clock := newFakeClock()
+	peer := punchPeer(t)
+	config := HolePunchConfig{
+		LocalSTUNAddr:  "127.0.0.1:0",
+		RemoteSTUNAddr: peer.LocalAddr().String(),
+		Timeout:        time.Hour,
+		Clock:          clock,
+	}
+
+	results := make(chan *HolePunchResult, 1)
+	go func() { results <- trySimultaneousConnect(context.Background(), config) }()
+
+	clock.waitForWaiters(t, 3)
+	clock.Advance(100 * time.Millisecond)
+	from := expectProbes(t, peer, 1)
+	peer.WriteToUDP([]byte("SIMULTANEOUS_CONNECT"), from)
+
+	// The listener takes the answer off the socket in real time; the
+	// sender stops at the timeout on the clock
+	time.Sleep(50 * time.Millisecond)
+	clock.Advance(time.Hour)
+	select {
+	case result := <-results:
+		if !result.Success || result.RemoteAddr != peer.LocalAddr().String() {
+			t.Fatalf("got %+v, want success from %s", result, peer.LocalAddr())
+		}
+		result.Conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("simultaneous connect still running after its timeout on the clock")
+	}
+}
@@ -0,0 +1,84 @@
+// Package main - Typed callbacks for mapping connection changes
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionResult is how a mapping forwards traffic
+type ConnectionResult struct {
+	State string    // MappingStateConnected for punched, LAN and direct paths, MappingStateRelay when relayed
+	Since time.Time // When the mapping reached the state
+}
+
+// Registered hooks and the connection each mapping reported last, keyed by
+// "protocol:port" as in the readiness report
+var (
+	connectedHooks    []func(mapping string, result ConnectionResult)
+	disconnectedHooks []func(mapping string, lost ConnectionResult)
+	errorHooks        []func(mapping string, err error)
+	connections       = make(map[string]ConnectionResult)
+	hooksMutex        sync.Mutex
+)
+
+// OnConnected registers fn to be called whenever a mapping starts
+// forwarding, and again when it moves between a direct path and the relay
+func OnConnected(fn func(mapping string, result ConnectionResult)) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	connectedHooks = append(connectedHooks, fn)
+}
+
+// OnDisconnected registers fn to be called when a forwarding mapping stops,
+// e.g. because its hole-punched path was lost, with the connection it lost
+func OnDisconnected(fn func(mapping string, lost ConnectionResult)) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	disconnectedHooks = append(disconnectedHooks, fn)
+}
+
+// OnError registers fn to be called when a mapping fails for good, such as
+// when the server cannot allocate it
+func OnError(fn func(mapping string, err error)) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	errorHooks = append(errorHooks, fn)
+}
+
+// runMappingHooks calls the hooks for a mapping that changed to state; err
+// is the reason of a failure. Hooks run on the caller's goroutine and must
+// not block.
+func runMappingHooks(mapping, state string, err error) {
+	hooksMutex.Lock()
+	previous, wasConnected := connections[mapping]
+	var calls []func()
+	switch state {
+	case MappingStateConnected, MappingStateRelay:
+		if wasConnected && previous.State == state {
+			break
+		}
+		result := ConnectionResult{State: state, Since: time.Now()}
+		connections[mapping] = result
+		for _, fn := range connectedHooks {
+			calls = append(calls, func() { fn(mapping, result) })
+		}
+	default:
+		if wasConnected {
+			delete(connections, mapping)
+			for _, fn := range disconnectedHooks {
+				calls = append(calls, func() { fn(mapping, previous) })
+			}
+		}
+		if state == MappingStateFailed && err != nil {
+			for _, fn := range errorHooks {
+				calls = append(calls, func() { fn(mapping, err) })
+			}
+		}
+	}
+	hooksMutex.Unlock()
+
+	for _, call := range calls {
+		call()
+	}
+}
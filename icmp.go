@@ -0,0 +1,396 @@
+// Package main - ICMP echo forwarding for reachability checks
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ICMP mappings ("icmp:localPort:0") let the client ping hosts on the
+// server's network. They travel like UDP mappings: the client forwards
+// datagrams from its local port, and on the server a gateway on 127.0.0.1
+// turns each one into an ICMP echo request and answers with the outcome.
+// Sending ICMP needs a raw socket, so the server must run as root (or with
+// CAP_NET_RAW on Linux, Administrator on Windows).
+//
+// Request datagram: target IPv4 (4 bytes, 0.0.0.0 for the mapping's single
+// target) and a sequence number (2 bytes). Reply datagram: the same six
+// bytes, a status byte and the round trip to the target in microseconds
+// (4 bytes).
+
+const (
+	icmpRequestSize = 6
+	icmpReplySize   = 11
+	// icmpEchoTimeout is how long the gateway waits for an echo reply
+	icmpEchoTimeout = 2 * time.Second
+)
+
+// ICMP gateway reply statuses
+const (
+	icmpStatusReply       byte = 0 // Target answered
+	icmpStatusTimeout     byte = 1 // No answer within icmpEchoTimeout
+	icmpStatusForbidden   byte = 2 // Target outside the mapping's serviceTarget or the server's icmpTargets
+	icmpStatusUnavailable byte = 3 // Server cannot send ICMP (no raw socket privilege)
+)
+
+// icmpStatusText describes a gateway status for the ping command
+var icmpStatusText = map[byte]string{
+	icmpStatusTimeout:     "timeout",
+	icmpStatusForbidden:   "target not allowed by the mapping's serviceTarget or the server's icmpTargets",
+	icmpStatusUnavailable: "server cannot send ICMP (needs root or CAP_NET_RAW)",
+}
+
+// parseICMPTarget parses the serviceTarget of an ICMP mapping: an IPv4
+// address, an IPv4 CIDR range, or "gateway"
+func parseICMPTarget(target string) (*net.IPNet, error) {
+	if target == GatewayServiceHost {
+		gateway, err := resolveGatewayHost()
+		if err != nil {
+			return nil, err
+		}
+		target = gateway
+	}
+	cidr := target
+	if !strings.Contains(cidr, "/") {
+		cidr += "/32"
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid ICMP serviceTarget %q: want an IPv4 address, IPv4 CIDR or 'gateway'", target)
+	}
+	return ipNet, nil
+}
+
+// validateICMPMapping checks the options of an ICMP mapping
+func validateICMPMapping(mapping PortMapping) error {
+	if mapping.ServiceTarget == "" {
+		return errors.New("ICMP mappings need a serviceTarget naming the hosts to ping")
+	}
+	if mapping.ServiceTarget != GatewayServiceHost {
+		if _, err := parseICMPTarget(mapping.ServiceTarget); err != nil {
+			return err
+		}
+	}
+	if mapping.DualPath || mapping.HealthCheck != nil {
+		return errors.New("dualPath and healthCheck are not supported on ICMP mappings")
+	}
+	return nil
+}
+
+// validateICMPTargets checks the server's icmpTargets entries. "gateway" is
+// resolved when a mapping starts.
+func validateICMPTargets(entries []string) error {
+	for _, entry := range entries {
+		if entry == GatewayServiceHost {
+			continue
+		}
+		if _, err := parseICMPTarget(entry); err != nil {
+			return fmt.Errorf("invalid icmpTargets entry %q: want an IPv4 address, IPv4 CIDR or 'gateway'", entry)
+		}
+	}
+	return nil
+}
+
+// checkICMPMapping returns an error for an ICMP mapping a client sent when
+// the server allows no ICMP targets
+func checkICMPMapping(mapping PortMapping, icmpTargets []string) error {
+	if len(icmpTargets) == 0 {
+		return errors.New("server allows no ICMP targets (icmpTargets is not set)")
+	}
+	if mapping.ServiceTarget == "" {
+		return errors.New("ICMP mappings need a serviceTarget naming the hosts to ping")
+	}
+	return nil
+}
+
+// icmpPending is an echo request waiting for its reply
+type icmpPending struct {
+	client    *net.UDPAddr
+	target    net.IP
+	clientSeq uint16
+	sent      time.Time
+}
+
+// ICMPGateway answers ping requests from the tunnel by sending ICMP echo
+// requests to hosts within both the client's target and the server's allowed
+// ranges
+type ICMPGateway struct {
+	udp     *net.UDPConn
+	raw     net.PacketConn // nil without raw socket privilege
+	target  *net.IPNet     // Mapping's serviceTarget, as the client asked
+	allowed []*net.IPNet   // Server's icmpTargets
+	id      uint16
+	nextSeq uint16
+	pending map[uint16]icmpPending
+	logger  *Logger
+	mutex   sync.Mutex
+}
+
+// startICMPGateway starts the gateway of an ICMP mapping and returns the
+// mapping pointed at it, so it is forwarded as a UDP mapping whose service
+// is the gateway. Only hosts within icmpTargets, the server's setting, are
+// pinged. Other mappings are returned unchanged.
+func startICMPGateway(ctx context.Context, logger *Logger, mapping PortMapping, icmpTargets []string) PortMapping {
+	if mapping.Protocol != "icmp" {
+		return mapping
+	}
+
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		logger.Errorf("❌ ICMP gateway not started: %v", err)
+		return mapping
+	}
+	gw := &ICMPGateway{udp: udp, pending: make(map[uint16]icmpPending), logger: logger}
+	id := make([]byte, 2)
+	rand.Read(id)
+	gw.id = binary.BigEndian.Uint16(id)
+
+	if gw.target, err = parseICMPTarget(mapping.ServiceTarget); err != nil {
+		logger.Errorf("❌ ICMP mapping %s: %v; requests will be refused", mapping, err)
+	}
+	for _, entry := range icmpTargets {
+		allowed, err := parseICMPTarget(entry)
+		if err != nil {
+			logger.Errorf("❌ icmpTargets entry %s not used: %v", entry, err)
+			continue
+		}
+		gw.allowed = append(gw.allowed, allowed)
+	}
+	if gw.raw, err = net.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+		logger.Errorf("❌ ICMP forwarding needs a raw socket (run as root or grant CAP_NET_RAW): %v", err)
+		gw.raw = nil
+	} else {
+		go gw.readReplies()
+	}
+	go gw.serve()
+	go gw.expire(ctx)
+	go func() {
+		<-ctx.Done()
+		gw.udp.Close()
+		if gw.raw != nil {
+			gw.raw.Close()
+		}
+	}()
+
+	logger.Infof("📡 ICMP gateway for %s on %s", mapping.ServiceTarget, udp.LocalAddr())
+	mapping.ServiceTarget = udp.LocalAddr().String()
+	return mapping
+}
+
+// serve turns request datagrams into echo requests
+func (gw *ICMPGateway) serve() {
+	buf := make([]byte, UDPBufferSize)
+	for {
+		n, client, err := gw.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < icmpRequestSize {
+			continue
+		}
+		target := net.IP(append([]byte(nil), buf[:4]...))
+		clientSeq := binary.BigEndian.Uint16(buf[4:6])
+		if target.Equal(net.IPv4zero) && gw.target != nil {
+			if ones, bits := gw.target.Mask.Size(); ones == bits {
+				target = gw.target.IP
+			}
+		}
+
+		switch {
+		case !gw.permits(target):
+			gw.reply(client, target, clientSeq, icmpStatusForbidden, 0)
+		case gw.raw == nil:
+			gw.reply(client, target, clientSeq, icmpStatusUnavailable, 0)
+		default:
+			gw.sendEcho(client, target, clientSeq)
+		}
+	}
+}
+
+// permits reports whether target is within the mapping's serviceTarget and
+// one of the server's icmpTargets
+func (gw *ICMPGateway) permits(target net.IP) bool {
+	if gw.target == nil || !gw.target.Contains(target) {
+		return false
+	}
+	for _, allowed := range gw.allowed {
+		if allowed.Contains(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendEcho sends an echo request to target on behalf of client
+func (gw *ICMPGateway) sendEcho(client *net.UDPAddr, target net.IP, clientSeq uint16) {
+	gw.mutex.Lock()
+	gw.nextSeq++
+	seq := gw.nextSeq
+	gw.pending[seq] = icmpPending{client: client, target: target, clientSeq: clientSeq, sent: time.Now()}
+	gw.mutex.Unlock()
+
+	if _, err := gw.raw.WriteTo(icmpEchoRequest(gw.id, seq), &net.IPAddr{IP: target}); err != nil {
+		gw.logger.Debugf("ICMP echo to %s failed: %v", target, err)
+	}
+}
+
+// readReplies matches echo replies to pending requests
+func (gw *ICMPGateway) readReplies() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := gw.raw.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id, seq, ok := parseICMPEchoReply(buf[:n])
+		if !ok || id != gw.id {
+			continue // Another process' ping, or not an echo reply
+		}
+
+		gw.mutex.Lock()
+		p, found := gw.pending[seq]
+		if found && addr.(*net.IPAddr).IP.Equal(p.target) {
+			delete(gw.pending, seq)
+		} else {
+			found = false
+		}
+		gw.mutex.Unlock()
+		if found {
+			gw.reply(p.client, p.target, p.clientSeq, icmpStatusReply, time.Since(p.sent))
+		}
+	}
+}
+
+// expire answers requests whose echo reply did not arrive in time
+func (gw *ICMPGateway) expire(ctx context.Context) {
+	ticker := time.NewTicker(icmpEchoTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var expired []icmpPending
+		gw.mutex.Lock()
+		for seq, p := range gw.pending {
+			if time.Since(p.sent) > icmpEchoTimeout {
+				expired = append(expired, p)
+				delete(gw.pending, seq)
+			}
+		}
+		gw.mutex.Unlock()
+		for _, p := range expired {
+			gw.reply(p.client, p.target, p.clientSeq, icmpStatusTimeout, 0)
+		}
+	}
+}
+
+// reply sends the outcome of a request back through the tunnel
+func (gw *ICMPGateway) reply(client *net.UDPAddr, target net.IP, clientSeq uint16, status byte, rtt time.Duration) {
+	msg := make([]byte, icmpReplySize)
+	if ip4 := target.To4(); ip4 != nil {
+		copy(msg[:4], ip4)
+	}
+	binary.BigEndian.PutUint16(msg[4:6], clientSeq)
+	msg[6] = status
+	binary.BigEndian.PutUint32(msg[7:11], uint32(rtt.Microseconds()))
+	gw.udp.WriteToUDP(msg, client)
+}
+
+// icmpEchoRequest builds an ICMPv4 echo request
+func icmpEchoRequest(id, seq uint16) []byte {
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 0, 's', 't', 'u', 'n', 'f', 'w', 'd', 0}
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+	return msg
+}
+
+// parseICMPEchoReply returns the identifier and sequence of an ICMPv4 echo
+// reply
+func parseICMPEchoReply(msg []byte) (uint16, uint16, bool) {
+	if len(msg) < 8 || msg[0] != 0 || msg[1] != 0 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(msg[4:6]), binary.BigEndian.Uint16(msg[6:8]), true
+}
+
+// icmpChecksum computes the Internet checksum of msg
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pingThroughMapping pings host through the ICMP mapping on localPort and
+// prints one line per request, like ping. An empty host pings the
+// mapping's single target.
+func pingThroughMapping(w io.Writer, localPort int, host string, count int) {
+	target := net.IPv4zero
+	if host != "" {
+		if target = net.ParseIP(host).To4(); target == nil {
+			fmt.Fprintf(w, "❌ Invalid IPv4 address: %s\n", host)
+			return
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort})
+	if err != nil {
+		fmt.Fprintf(w, "❌ %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	received := 0
+	buf := make([]byte, 64)
+	for seq := 1; seq <= count; seq++ {
+		req := make([]byte, icmpRequestSize)
+		copy(req, target)
+		binary.BigEndian.PutUint16(req[4:6], uint16(seq))
+		start := time.Now()
+		conn.Write(req)
+
+		conn.SetReadDeadline(start.Add(icmpEchoTimeout + 2*time.Second))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				fmt.Fprintf(w, "  seq=%d no answer from the tunnel\n", seq)
+				break
+			}
+			if n < icmpReplySize || binary.BigEndian.Uint16(buf[4:6]) != uint16(seq) {
+				continue // Late reply to an earlier request
+			}
+			from := net.IP(buf[:4])
+			if status := buf[6]; status != icmpStatusReply {
+				fmt.Fprintf(w, "  seq=%d %s: %s\n", seq, from, icmpStatusText[status])
+				break
+			}
+			received++
+			rtt := time.Duration(binary.BigEndian.Uint32(buf[7:11])) * time.Microsecond
+			fmt.Fprintf(w, "  seq=%d reply from %s: target rtt %v, through tunnel %v\n",
+				seq, from, rtt, time.Since(start).Round(time.Microsecond))
+			break
+		}
+		if seq < count {
+			time.Sleep(time.Until(start.Add(time.Second)))
+		}
+	}
+	fmt.Fprintf(w, "📡 %d requests, %d replies\n", count, received)
+}
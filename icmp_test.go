@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// pingGateway sends one request for target to the gateway mapping points at
+// and returns the reply status
+func pingGateway(t *testing.T, mapping PortMapping, target net.IP) byte {
+	t.Helper()
+	gateway, err := net.ResolveUDPAddr("udp4", mapping.ServiceTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, icmpRequestSize)
+	copy(req, target.To4())
+	binary.BigEndian.PutUint16(req[4:6], 1)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(icmpEchoTimeout + 2*time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply for %s: %v", target, err)
+	}
+	if n < icmpReplySize {
+		t.Fatalf("reply of %d bytes", n)
+	}
+	return buf[6]
+}
+
+func TestICMPGatewayUsesServerTargets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client asks for all of 127.0.0.0/8, the server allows one host
+	mapping := PortMapping{Protocol: "icmp", LocalPort: 7000, ServiceTarget: "127.0.0.0/8"}
+	mapping = startICMPGateway(ctx, defaultLogger, mapping, []string{"127.0.0.1"})
+
+	if status := pingGateway(t, mapping, net.IPv4(127, 0, 0, 2)); status != icmpStatusForbidden {
+		t.Errorf("target outside icmpTargets got status %d, want %d", status, icmpStatusForbidden)
+	}
+	if status := pingGateway(t, mapping, net.IPv4(127, 0, 0, 1)); status == icmpStatusForbidden {
+		t.Error("target within icmpTargets refused")
+	}
+}
+
+func TestICMPGatewayWithoutServerTargets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mapping := PortMapping{Protocol: "icmp", LocalPort: 7000, ServiceTarget: "127.0.0.1"}
+	mapping = startICMPGateway(ctx, defaultLogger, mapping, nil)
+	if status := pingGateway(t, mapping, net.IPv4(127, 0, 0, 1)); status != icmpStatusForbidden {
+		t.Errorf("got status %d without icmpTargets, want %d", status, icmpStatusForbidden)
+	}
+}
+
+func TestRefuseICMPMappingsWithoutTargets(t *testing.T) {
+	mappings := []PortMapping{{Protocol: "icmp", LocalPort: 7000, ServiceTarget: "192.168.1.0/24"}}
+
+	accepted, refused := refuseServiceTargets(mappings, Configuration{})
+	if len(accepted) != 0 || len(refused) != 1 {
+		t.Fatalf("without icmpTargets: accepted %v, refused %v", accepted, refused)
+	}
+
+	accepted, refused = refuseServiceTargets(mappings, Configuration{ICMPTargets: []string{"192.168.1.0/24"}})
+	if len(accepted) != 1 || len(refused) != 0 {
+		t.Errorf("with icmpTargets: accepted %v, refused %v", accepted, refused)
+	}
+}
+
+func TestValidateICMPTargets(t *testing.T) {
+	if err := validateICMPTargets([]string{"10.0.0.1", "192.168.0.0/16", "gateway"}); err != nil {
+		t.Errorf("valid icmpTargets refused: %v", err)
+	}
+	for _, entry := range []string{"db.internal", "::1", "10.0.0.0/33"} {
+		if err := validateICMPTargets([]string{entry}); err == nil {
+			t.Errorf("validateICMPTargets(%q) accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package main - Reordering jitter buffer for hole-punched UDP mappings
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultJitterDepth    = 8
+	defaultJitterMaxDelay = 50 * time.Millisecond
+	jitterSeqSize         = 4
+	jitterQueueSize       = 256
+)
+
+// JitterBufferConfig configures receive-side reordering of a UDP mapping
+type JitterBufferConfig struct {
+	Depth    int      `json:"depth,omitempty" yaml:"depth,omitempty"`       // Packets held waiting for a gap, default 8
+	MaxDelay Duration `json:"maxDelay,omitempty" yaml:"maxDelay,omitempty"` // Longest a packet waits for a gap, default 50ms
+}
+
+// Validate checks the jitter buffer limits
+func (jc *JitterBufferConfig) Validate() error {
+	if jc.Depth < 0 || jc.MaxDelay < 0 {
+		return errors.New("jitterBuffer depth and maxDelay must not be negative")
+	}
+	return nil
+}
+
+// JitterBuffer releases sequenced packets in order. A missing packet is
+// waited for until depth packets are queued behind it or the oldest queued
+// packet has waited maxDelay; it is then skipped.
+type JitterBuffer struct {
+	depth    int
+	maxDelay time.Duration
+	deliver  func([]byte)
+	started  bool
+	next     uint32
+	pending  map[uint32]jitterPacket
+	timer    *time.Timer
+	stopped  bool
+	mutex    sync.Mutex
+}
+
+// jitterPacket is a queued out-of-order packet
+type jitterPacket struct {
+	data    []byte
+	arrived time.Time
+}
+
+// NewJitterBuffer creates a buffer handing packets to deliver in order
+func NewJitterBuffer(config JitterBufferConfig, deliver func([]byte)) *JitterBuffer {
+	jb := &JitterBuffer{
+		depth:    config.Depth,
+		maxDelay: time.Duration(config.MaxDelay),
+		deliver:  deliver,
+		pending:  make(map[uint32]jitterPacket),
+	}
+	if jb.depth <= 0 {
+		jb.depth = defaultJitterDepth
+	}
+	if jb.maxDelay <= 0 {
+		jb.maxDelay = defaultJitterMaxDelay
+	}
+	return jb
+}
+
+// seqBefore reports whether sequence a comes before b, allowing for wraparound
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// Push queues a packet; late and duplicate packets are dropped
+func (jb *JitterBuffer) Push(seq uint32, data []byte) {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	if jb.stopped {
+		return
+	}
+	if !jb.started {
+		jb.started = true
+		jb.next = seq
+	}
+	if seqBefore(seq, jb.next) {
+		return
+	}
+	if _, dup := jb.pending[seq]; dup {
+		return
+	}
+
+	jb.pending[seq] = jitterPacket{data: append([]byte(nil), data...), arrived: time.Now()}
+	jb.release()
+	for len(jb.pending) > jb.depth {
+		jb.skipGap()
+	}
+	jb.armTimer()
+}
+
+// Stop drops queued packets and stops the delay timer
+func (jb *JitterBuffer) Stop() {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+	jb.stopped = true
+	jb.pending = nil
+	if jb.timer != nil {
+		jb.timer.Stop()
+	}
+}
+
+// release delivers queued packets from next onward until a gap
+func (jb *JitterBuffer) release() {
+	for {
+		packet, ok := jb.pending[jb.next]
+		if !ok {
+			return
+		}
+		delete(jb.pending, jb.next)
+		jb.next++
+		jb.deliver(packet.data)
+	}
+}
+
+// skipGap gives up on the missing packets before the oldest queued one
+func (jb *JitterBuffer) skipGap() {
+	if len(jb.pending) == 0 {
+		return
+	}
+	seqs := make([]uint32, 0, len(jb.pending))
+	for seq := range jb.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqBefore(seqs[i], seqs[j]) })
+	jb.next = seqs[0]
+	jb.release()
+}
+
+// armTimer schedules a gap skip for when the oldest queued packet has
+// waited maxDelay
+func (jb *JitterBuffer) armTimer() {
+	if len(jb.pending) == 0 || jb.timer != nil {
+		return
+	}
+	oldest := time.Now()
+	for _, packet := range jb.pending {
+		if packet.arrived.Before(oldest) {
+			oldest = packet.arrived
+		}
+	}
+	jb.timer = time.AfterFunc(jb.maxDelay-time.Since(oldest), func() {
+		jb.mutex.Lock()
+		defer jb.mutex.Unlock()
+		jb.timer = nil
+		if jb.stopped {
+			return
+		}
+		jb.skipGap()
+		jb.armTimer()
+	})
+}
+
+// sequencedConn carries datagrams with a trailing sequence number over a
+// connected UDP socket and reorders what it receives through a jitter buffer.
+// Both peers of a mapping must use it.
+type sequencedConn struct {
+	net.Conn
+	sendSeq      atomic.Uint32
+	jitter       *JitterBuffer
+	packets      chan []byte
+	readErr      error
+	readDeadline atomic.Value // time.Time
+	closed       chan struct{}
+	closing      sync.Once
+}
+
+// newSequencedConn wraps conn and starts reading from it
+func newSequencedConn(conn net.Conn, config JitterBufferConfig) *sequencedConn {
+	sc := &sequencedConn{
+		Conn:    conn,
+		packets: make(chan []byte, jitterQueueSize),
+		closed:  make(chan struct{}),
+	}
+	sc.readDeadline.Store(time.Time{})
+	sc.jitter = NewJitterBuffer(config, func(data []byte) {
+		select {
+		case sc.packets <- data:
+		default: // Reader fell behind; drop like a full socket buffer would
+		}
+	})
+	go sc.readLoop()
+	return sc
+}
+
+// readLoop feeds received datagrams into the jitter buffer
+func (sc *sequencedConn) readLoop() {
+	defer close(sc.packets)
+	buf := make([]byte, UDPBufferSize+jitterSeqSize)
+	for {
+		n, err := sc.Conn.Read(buf)
+		if err != nil {
+			sc.readErr = err
+			sc.jitter.Stop()
+			return
+		}
+		if n < jitterSeqSize {
+			continue
+		}
+		seq := binary.BigEndian.Uint32(buf[n-jitterSeqSize : n])
+		sc.jitter.Push(seq, buf[:n-jitterSeqSize])
+	}
+}
+
+// Read returns the next in-order datagram
+func (sc *sequencedConn) Read(p []byte) (int, error) {
+	var timeout <-chan time.Time
+	if deadline := sc.readDeadline.Load().(time.Time); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data, ok := <-sc.packets:
+		if !ok {
+			return 0, sc.readErr
+		}
+		return copy(p, data), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-sc.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// Write sends p with the next sequence number appended
+func (sc *sequencedConn) Write(p []byte) (int, error) {
+	frame := make([]byte, len(p)+jitterSeqSize)
+	copy(frame, p)
+	binary.BigEndian.PutUint32(frame[len(p):], sc.sendSeq.Add(1)-1)
+	if _, err := sc.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadDeadline applies to Read, not to the underlying socket
+func (sc *sequencedConn) SetReadDeadline(t time.Time) error {
+	sc.readDeadline.Store(t)
+	return nil
+}
+
+// SetDeadline sets the read deadline and the socket's write deadline
+func (sc *sequencedConn) SetDeadline(t time.Time) error {
+	sc.readDeadline.Store(t)
+	return sc.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the socket and stops the jitter buffer
+func (sc *sequencedConn) Close() error {
+	sc.closing.Do(func() { close(sc.closed) })
+	return sc.Conn.Close()
+}
@@ -0,0 +1,90 @@
+// Package main - Keepalives detecting dead hole-punched UDP paths
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// keepaliveInterval is how often a ping is sent over a punched path
+	keepaliveInterval = 5 * time.Second
+	// keepaliveMissedPongs unanswered pings in a row mark the path lost
+	keepaliveMissedPongs = 3
+)
+
+// errP2PPathLost is returned by hole-punched forwarders whose path stopped
+// answering keepalives, so they punch again
+var errP2PPathLost = errors.New("hole-punched path lost")
+
+// pathHealth holds the HealthStatus of each hole-punched UDP path by
+// mapping key
+var pathHealth sync.Map
+
+// setPathHealth records the health of a mapping's punched path
+func setPathHealth(mapping string, status HealthStatus) {
+	pathHealth.Store(mapping, status)
+}
+
+// handleKeepalive answers a ping with a pong and records pongs; it reports
+// whether frame was a keepalive frame
+func (pc *peerConn) handleKeepalive(frame []byte) bool {
+	frameType, nonce, ok := parseHandshakeFrame(frame)
+	if !ok {
+		return false
+	}
+	switch frameType {
+	case handshakePing:
+		pc.UDPConn.WriteToUDP(handshakeFrame(handshakePong, nonce), pc.peer)
+	case handshakePong:
+		pc.lastPong.Store(time.Now().UnixNano())
+	default:
+		return false
+	}
+	return true
+}
+
+// watchPath pings the peer every keepaliveInterval until ctx is done. Once
+// the peer has answered a ping, keepaliveMissedPongs missed pongs in a row
+// emit EventTypeConnectionLost, mark the path unhealthy and return
+// errP2PPathLost. Peers that never answer predate keepalives and are not
+// monitored.
+func (pc *peerConn) watchPath(ctx context.Context, mapping string) error {
+	setPathHealth(mapping, HealthStatusHealthy)
+	ping := handshakeFrame(handshakePing, make([]byte, 8))
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	lastPong := pc.lastPong.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if pong := pc.lastPong.Load(); pong != lastPong {
+			lastPong, missed = pong, 0
+		} else if lastPong != 0 {
+			missed++
+		}
+		if missed >= keepaliveMissedPongs {
+			lastActivity := time.Unix(0, pc.lastActivity.Load())
+			setPathHealth(mapping, HealthStatusUnhealthy)
+			readiness.SetMapping(mapping, MappingStateConnecting)
+			emitEvent(Event{
+				Type:         EventTypeConnectionLost,
+				Mapping:      mapping,
+				LastActivity: lastActivity,
+				Detail: fmt.Sprintf("P2P path to %s lost: %d keepalives unanswered, last datagram %v ago",
+					pc.peer, missed, time.Since(lastActivity).Round(time.Second)),
+			})
+			return errP2PPathLost
+		}
+		pc.UDPConn.WriteToUDP(ping, pc.peer)
+	}
+}
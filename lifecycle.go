@@ -0,0 +1,110 @@
+// Package main - Component lifecycle supervision
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Component is a unit of the forwarder with its own start and stop hooks.
+// Either hook may be nil.
+type Component struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Supervisor starts registered components in order and stops them in reverse
+// order, so a component is always stopped before the ones it depends on
+type Supervisor struct {
+	components []Component
+	started    []Component
+	mutex      sync.Mutex
+}
+
+// NewSupervisor creates an empty supervisor
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Register adds a component. Components must be registered after their dependencies.
+func (s *Supervisor) Register(c Component) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.components = append(s.components, c)
+}
+
+// Start starts all components in registration order. If one fails, the
+// components already started are stopped again before the error is returned.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	components := s.components
+	s.mutex.Unlock()
+
+	for _, c := range components {
+		if c.Start != nil {
+			if err := c.Start(ctx); err != nil {
+				stopErr := s.Shutdown(ctx)
+				return errors.Join(fmt.Errorf("start %s: %w", c.Name, err), stopErr)
+			}
+		}
+		s.mutex.Lock()
+		s.started = append(s.started, c)
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// Shutdown stops started components in reverse order within the deadline of
+// ctx and returns all stop errors joined together
+func (s *Supervisor) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	started := s.started
+	s.started = nil
+	s.mutex.Unlock()
+
+	var errs []error
+	for i := len(started) - 1; i >= 0; i-- {
+		c := started[i]
+		if c.Stop == nil {
+			continue
+		}
+		log.Printf("Stopping %s...", c.Name)
+		if err := c.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runComponent wraps a blocking run function as a component. Stop cancels the
+// run context and waits for run to return or for the shutdown deadline.
+func runComponent(name string, run func(ctx context.Context)) Component {
+	var cancel context.CancelFunc
+	done := make(chan struct{})
+
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var runCtx context.Context
+			runCtx, cancel = context.WithCancel(context.Background())
+			go func() {
+				defer close(done)
+				run(runCtx)
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
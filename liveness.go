@@ -0,0 +1,168 @@
+// Package main - Server heartbeats and the client's server liveness monitor
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// serverHeartbeatInterval is how often the server refreshes its presence,
+// each refresh carrying the next heartbeat
+const serverHeartbeatInterval = 30 * time.Second
+
+// serverLivenessBeats is how many heartbeat intervals a client waits for the
+// next beat before it considers the server frozen, unless
+// serverLivenessTimeout is set
+const serverLivenessBeats = 3
+
+// Heartbeat is the liveness of a server: the sequence grows with every
+// presence refresh of a running server, while the data the signaling server
+// keeps for a frozen one stays the same until its TTL drops it
+type Heartbeat struct {
+	Seq      uint64   `json:"seq"`
+	Time     int64    `json:"time"`     // Unix milliseconds of the beat by the server's clock
+	Interval Duration `json:"interval"` // Time between beats
+}
+
+// stampHeartbeat returns serverData carrying heartbeat seq
+func stampHeartbeat(serverData string, seq uint64) (string, error) {
+	data, err := parseServerRegistrationData(serverData)
+	if err != nil {
+		return "", err
+	}
+	data.Heartbeat = &Heartbeat{Seq: seq, Time: time.Now().UnixMilli(), Interval: Duration(serverHeartbeatInterval)}
+	stamped, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal server registration data: %w", err)
+	}
+	return string(stamped), nil
+}
+
+// serverAnnouncement is the server registration data a server last posted
+// to its room. The first allocation, mapping updates, heartbeats and the
+// migrate hint all post through it one at a time, so a heartbeat restamps
+// the latest allocation and never brings back one an update replaced.
+type serverAnnouncement struct {
+	post      func(data string) error
+	data      string
+	heartbeat uint64 // Sequence of the next beat
+	mutex     sync.Mutex
+}
+
+// newServerAnnouncement returns an announcement posting with post
+func newServerAnnouncement(post func(data string) error) *serverAnnouncement {
+	return &serverAnnouncement{post: post}
+}
+
+// Post posts data as the new allocation, stamped with the next heartbeat,
+// and keeps it for later beats once the post succeeded
+func (a *serverAnnouncement) Post(data string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.postLocked(data)
+}
+
+// Beat posts the latest allocation again with the next heartbeat, carrying
+// hint from now on unless it is nil
+func (a *serverAnnouncement) Beat(hint *MigrateHint) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	data := a.data
+	if hint != nil {
+		if hinted, err := withMigrateHint(data, hint); err == nil {
+			data = hinted
+		}
+	}
+	return a.postLocked(data)
+}
+
+// postLocked posts data with the next heartbeat; the caller holds the mutex
+func (a *serverAnnouncement) postLocked(data string) error {
+	stamped := data
+	if s, err := stampHeartbeat(data, a.heartbeat); err == nil {
+		stamped = s
+	}
+	a.heartbeat++
+	if err := a.post(stamped); err != nil {
+		return err
+	}
+	a.data = data
+	return nil
+}
+
+// serverHealth is the health of a server whose last heartbeat arrived age
+// ago: 1 while beats are on time, halving with every interval they are late
+func serverHealth(age, interval time.Duration) float64 {
+	if age <= interval {
+		return 1
+	}
+	return math.Exp2(-float64(age-interval) / float64(interval))
+}
+
+// monitorServerLiveness polls the server's presence in room until ctx is
+// cancelled, starting from the heartbeat of its allocation, and calls
+// onFrozen with the server data last read once no new heartbeat arrived for
+// timeout, or for serverLivenessBeats intervals when timeout is 0. Beats are
+// timed by the client's clock, so clock skew between the hosts does not
+// matter. Polls the signaling server does not answer are not held against
+// the server, and servers that predate heartbeats are not monitored. A
+// server that posts a migrate hint ends monitoring with onMigrate instead.
+func monitorServerLiveness(ctx context.Context, signalingClient *SignalingClient, url, room string, first *Heartbeat, timeout time.Duration, onFrozen, onMigrate func(serverData string)) {
+	if first == nil {
+		return
+	}
+	logger := defaultLogger.WithComponent("liveness")
+	last, lastBeat := first, time.Now()
+	late := false
+	for {
+		interval := serverHeartbeatInterval
+		if last.Interval > 0 {
+			interval = time.Duration(last.Interval)
+		}
+		if !sleepContext(ctx, interval/3) {
+			return
+		}
+
+		body, reachable, err := signalingClient.getPeerData(url, "server", room)
+		if err != nil || !reachable || len(body) == 0 {
+			continue
+		}
+		data, err := parseServerRegistrationData(string(body))
+		if err != nil || data.Heartbeat == nil {
+			continue
+		}
+		if data.Migrate != nil {
+			onMigrate(string(body))
+			return
+		}
+		now := time.Now()
+		if data.Heartbeat.Seq != last.Seq {
+			if late {
+				logger.Infof("💓 Server heartbeat %d arrived, server alive again", data.Heartbeat.Seq)
+			}
+			last, lastBeat, late = data.Heartbeat, now, false
+			continue
+		}
+
+		limit := timeout
+		if limit == 0 {
+			limit = serverLivenessBeats * interval
+		}
+		age := now.Sub(lastBeat)
+		if age >= limit {
+			logger.Warnf("💔 No server heartbeat for %v (last %d, sent %s), server considered frozen",
+				age.Round(time.Second), last.Seq, time.UnixMilli(last.Time).Format(time.RFC3339))
+			onFrozen(string(body))
+			return
+		}
+		// Warn once a whole beat is missed
+		if health := serverHealth(age, interval); health <= 0.5 && !late {
+			late = true
+			logger.Warnf("💔 Server heartbeat late: last %d seen %v ago, health %.0f%%", last.Seq, age.Round(time.Second), health*100)
+		}
+	}
+}
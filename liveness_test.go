@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// allocationData returns server data allocating port for an update
+func allocationData(t *testing.T, port int, updateID string) string {
+	t.Helper()
+	info := &NetworkInfo{PrivateAddr: "127.0.0.1", PublicAddr: "127.0.0.1:1"}
+	mappings := []ServerPortMapping{{ClientMapping: PortMapping{Protocol: "tcp", LocalPort: 8080, RemotePort: 80}, AllocatedPort: port}}
+	data, err := formatServerRegistrationData(info, mappings, nil, "", nil, updateID, "registration", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestServerAnnouncementBeatsLatestAllocation(t *testing.T) {
+	var posted []*ServerRegistrationData
+	var failPosts bool
+	announcement := newServerAnnouncement(func(data string) error {
+		if failPosts {
+			return errors.New("signaling down")
+		}
+		parsed, err := parseServerRegistrationData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posted = append(posted, parsed)
+		return nil
+	})
+	last := func() *ServerRegistrationData { return posted[len(posted)-1] }
+
+	announcement.Post(allocationData(t, 40000, ""))
+	announcement.Beat(nil)
+	announcement.Post(allocationData(t, 40001, "update-1"))
+
+	// A heartbeat after a mapping update carries the update's allocation
+	announcement.Beat(nil)
+	if got := last(); got.AckedUpdateID != "update-1" || got.PortMappings[0].AllocatedPort != 40001 {
+		t.Errorf("heartbeat posted update %q with port %d, want update-1 with 40001", got.AckedUpdateID, got.PortMappings[0].AllocatedPort)
+	}
+	for i, data := range posted {
+		if data.Heartbeat == nil || data.Heartbeat.Seq != uint64(i) {
+			t.Errorf("post %d carries heartbeat %+v, want seq %d", i, data.Heartbeat, i)
+		}
+	}
+
+	// An update that failed to post is not beaten later
+	failPosts = true
+	if err := announcement.Post(allocationData(t, 40002, "update-2")); err == nil {
+		t.Fatal("failed post reported success")
+	}
+	failPosts = false
+	announcement.Beat(nil)
+	if got := last(); got.AckedUpdateID != "update-1" {
+		t.Errorf("heartbeat after a failed update posted %q, want update-1", got.AckedUpdateID)
+	}
+
+	// The migrate hint stays on later beats
+	announcement.Beat(&MigrateHint{Room: "next"})
+	announcement.Beat(nil)
+	if got := last(); got.Migrate == nil || got.Migrate.Room != "next" || got.AckedUpdateID != "update-1" {
+		t.Errorf("beat after the hint posted migrate %+v for update %q", got.Migrate, got.AckedUpdateID)
+	}
+}
+
+func TestServerAnnouncementConcurrentUpdates(t *testing.T) {
+	var mutex sync.Mutex
+	var lastPosted string
+	announcement := newServerAnnouncement(func(data string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		lastPosted = data
+		return nil
+	})
+	announcement.Post(allocationData(t, 40000, ""))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			announcement.Beat(nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 50; i++ {
+			announcement.Post(allocationData(t, 40000+i, "update"))
+		}
+	}()
+	wg.Wait()
+
+	// Whichever post came last, it is of the final allocation
+	data, err := parseServerRegistrationData(lastPosted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.PortMappings[0].AllocatedPort != 40050 || data.Heartbeat.Seq != 100 {
+		t.Errorf("last post allocates %d with heartbeat %d, want 40050 with 100", data.PortMappings[0].AllocatedPort, data.Heartbeat.Seq)
+	}
+}
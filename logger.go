@@ -0,0 +1,225 @@
+// Package main - Leveled, component-scoped logging
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// LogLevel controls which messages a Logger writes
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLogLevel parses "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info", "":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// Logger writes messages at or above its level, prefixed with its component
+// and fields. Derived loggers are cheap and share only their level, so
+// SetLevel on a root logger reaches every logger derived from it.
+type Logger struct {
+	level     *atomic.Int32
+	component string
+	fields    map[string]interface{}
+}
+
+// NewLogger creates a root logger with the given level
+func NewLogger(level LogLevel) *Logger {
+	l := &Logger{level: new(atomic.Int32)}
+	l.level.Store(int32(level))
+	return l
+}
+
+// WithComponent returns a copy of the logger tagged with a component name
+func (l *Logger) WithComponent(component string) *Logger {
+	clone := *l
+	clone.component = component
+	return &clone
+}
+
+// WithFields returns a copy of the logger with extra key/value fields
+func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
+	clone := *l
+	clone.fields = make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		clone.fields[k] = v
+	}
+	for k, v := range fields {
+		clone.fields[k] = v
+	}
+	return &clone
+}
+
+// WithLevel returns a copy of the logger with a level of its own, which
+// SetLevel on the logger it derives from leaves alone
+func (l *Logger) WithLevel(level LogLevel) *Logger {
+	clone := *l
+	clone.level = new(atomic.Int32)
+	clone.level.Store(int32(level))
+	return &clone
+}
+
+// Level returns the logger's level
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
+// SetLevel changes the level of the logger and of the loggers derived from
+// it that have no level of their own
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// Debugf logs at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+
+// Infof logs at info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+
+// Warnf logs at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args...)
+}
+
+// Errorf logs at error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
+
+// logf writes the message if level is enabled
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	log.Print(l.prefix() + fmt.Sprintf(format, args...))
+}
+
+// prefix renders the component and fields in a stable order
+func (l *Logger) prefix() string {
+	var b strings.Builder
+	if l.component != "" {
+		b.WriteString("[" + l.component + "] ")
+	}
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%v ", k, l.fields[k])
+	}
+	return b.String()
+}
+
+// defaultLogger is the process-wide root logger
+var defaultLogger = NewLogger(LogLevelInfo)
+
+// mappingLogger returns a logger scoped to a mapping, honouring its
+// logLevel and quiet overrides
+func mappingLogger(mapping PortMapping) *Logger {
+	logger := defaultLogger.WithComponent("mapping").WithFields(map[string]interface{}{
+		"mapping": mapping.String(),
+	})
+	if mapping.LogLevel != "" {
+		if level, err := ParseLogLevel(mapping.LogLevel); err == nil {
+			logger = logger.WithLevel(level)
+		}
+	}
+	if mapping.Quiet && logger.Level() < LogLevelWarn {
+		logger = logger.WithLevel(LogLevelWarn)
+	}
+	return logger
+}
+
+// asciiWriter strips emoji and other non-ASCII symbols from log output for
+// terminals and log aggregators that cannot handle them
+type asciiWriter struct {
+	w io.Writer
+}
+
+// Write writes p without its non-ASCII runes
+func (a asciiWriter) Write(p []byte) (int, error) {
+	if _, err := a.w.Write(stripNonASCII(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// stripNonASCII drops non-ASCII runes along with the space that separated a
+// dropped symbol from the text, so "🚀 Starting" becomes "Starting"
+func stripNonASCII(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	dropped := false
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		p = p[size:]
+		if r >= utf8.RuneSelf {
+			dropped = true
+			continue
+		}
+		if dropped && r == ' ' && (len(out) == 0 || out[len(out)-1] == ' ') {
+			continue
+		}
+		dropped = false
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// enableASCIILogs strips emoji from everything written through the log package,
+// which includes all Logger output
+func enableASCIILogs() {
+	log.SetOutput(asciiWriter{w: os.Stderr})
+}
+
+// cycleLogLevel makes the default logger one level more verbose, wrapping
+// from debug back to error, and returns the new level
+func cycleLogLevel() LogLevel {
+	level := defaultLogger.Level() - 1
+	if level < LogLevelDebug {
+		level = LogLevelError
+	}
+	defaultLogger.SetLevel(level)
+	return level
+}
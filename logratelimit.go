@@ -0,0 +1,89 @@
+// Package main - Rate-limited logging of repetitive errors
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLogSummaryInterval is how often repeats of a rate-limited error
+// are summarized unless logSummaryInterval is set
+const defaultLogSummaryInterval = 30 * time.Second
+
+// logSummaryInterval is the period of rate-limited error summaries
+var logSummaryInterval = defaultLogSummaryInterval
+
+// repeatedError counts the repeats of one rate-limited error since it was
+// last logged
+type repeatedError struct {
+	logger  *Logger
+	message string
+	repeats int
+}
+
+// repeatedErrors holds the rate-limited errors by signature
+var repeatedErrors = struct {
+	entries map[string]*repeatedError
+	mutex   sync.Mutex
+}{entries: make(map[string]*repeatedError)}
+
+// LimitedErrorf logs at error level like Errorf, for errors that repeat at
+// the rate of connections or datagrams. The first occurrence of an error
+// signature is logged; later ones are counted and summarized once per
+// logSummaryInterval, and an error that stopped repeating is logged in full
+// again the next time it occurs. The signature is the logger's prefix, the
+// format and the error arguments, so one error hitting many clients, whose
+// addresses are other arguments, is counted together.
+func (l *Logger) LimitedErrorf(format string, args ...interface{}) {
+	if LogLevelError < l.Level() {
+		return
+	}
+	key := errorSignature(l.prefix(), format, args)
+
+	repeatedErrors.mutex.Lock()
+	if entry, ok := repeatedErrors.entries[key]; ok {
+		entry.repeats++
+		repeatedErrors.mutex.Unlock()
+		return
+	}
+	entry := &repeatedError{logger: l, message: fmt.Sprintf(format, args...)}
+	repeatedErrors.entries[key] = entry
+	repeatedErrors.mutex.Unlock()
+
+	l.logf(LogLevelError, "%s", entry.message)
+	time.AfterFunc(logSummaryInterval, func() { summarizeRepeats(key, entry) })
+}
+
+// summarizeRepeats logs how often an error repeated in the last interval,
+// and forgets it when it did not
+func summarizeRepeats(key string, entry *repeatedError) {
+	repeatedErrors.mutex.Lock()
+	repeats := entry.repeats
+	entry.repeats = 0
+	if repeats == 0 {
+		delete(repeatedErrors.entries, key)
+	}
+	repeatedErrors.mutex.Unlock()
+
+	if repeats == 0 {
+		return
+	}
+	entry.logger.logf(LogLevelError, "🔁 Repeated %d times in the last %v: %s", repeats, logSummaryInterval, entry.message)
+	time.AfterFunc(logSummaryInterval, func() { summarizeRepeats(key, entry) })
+}
+
+// errorSignature identifies an error message by prefix, format and the
+// errors among args
+func errorSignature(prefix, format string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(format)
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			b.WriteString("\x00" + err.Error())
+		}
+	}
+	return b.String()
+}
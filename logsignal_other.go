@@ -0,0 +1,7 @@
+//go:build !unix
+
+// Package main - Runtime log level changes fallback
+package main
+
+// watchLogLevelSignals does nothing where SIGUSR1 and SIGUSR2 do not exist
+func watchLogLevelSignals(configured LogLevel) {}
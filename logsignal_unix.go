@@ -0,0 +1,30 @@
+//go:build unix
+
+// Package main - Runtime log level changes with SIGUSR1 and SIGUSR2
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignals makes the default logger more verbose on each
+// SIGUSR1, cycling through the levels, and resets it to configured on
+// SIGUSR2, so debug logs of a running process can be captured without
+// restarting its tunnels
+func watchLogLevelSignals(configured LogLevel) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGUSR2 {
+				defaultLogger.SetLevel(configured)
+				log.Printf("🔈 Log level reset to %s", configured)
+				continue
+			}
+			log.Printf("🔊 Log level raised to %s", cycleLogLevel())
+		}
+	}()
+}
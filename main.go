@@ -4,80 +4,265 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yml", "Path to the configuration file (default: config.yml)")
+	benchmark := flag.Bool("benchmark", false, "Self-test throughput of every mapping once established (run on both sides)")
+	benchmarkSize := flag.Int("benchmark-size", 10, "Megabytes transferred per mapping in benchmark mode")
+	noInteractive := flag.Bool("no-interactive", false, "Do not read mapping or connection commands from stdin (for scripts and containers)")
+	duration := flag.Duration("duration", 0, "Stop cleanly after this long, e.g. 10m (default: run until interrupted)")
+	profileConnection := flag.String("profile-connection", "", "Write a JSON timeline of the connection negotiation to this file and exit after the first forwarded byte")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration (defaults applied, secrets redacted) as YAML and exit")
+	checkNAT := flag.Bool("check-nat", false, "Detect this host's NAT type, print advice on connecting through it and exit")
 	flag.Parse()
 
+	if *checkNAT {
+		os.Exit(runNATCheck(os.Stdout, *configPath))
+	}
+
 	// Use default config.yml if no config specified and it exists
 	if *configPath == "config.yml" {
 		if _, err := os.Stat("config.yml"); os.IsNotExist(err) {
-			log.Fatal("No configuration file found. Please create config.yml or specify --config flag.")
+			fatalf(ExitConfig, "No configuration file found. Please create config.yml or specify --config flag.")
 		}
 	}
 
 	config, err := parseConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatalf(ExitConfig, "Failed to load config: %v", err)
+	}
+	if config.ASCIILogs {
+		enableASCIILogs()
+	}
+	level, err := ParseLogLevel(config.LogLevel)
+	if err != nil {
+		fatalf(ExitConfig, "Config error: 'logLevel': %v", err)
 	}
+	defaultLogger = NewLogger(level)
+
+	if config.STUNServer == "" {
+		// Provide a default STUN server if not specified
+		config.STUNServer = "stun.l.google.com:19302"
+	}
+	if config.STUNServerIP != "" {
+		if err := globalSTUNResolver.Pin(config.STUNServer, config.STUNServerIP); err != nil {
+			fatalf(ExitConfig, "Config error: 'stunServerIp': %v", err)
+		}
+	}
+	globalSTUNResolver.SetTTL(time.Duration(config.STUNDNSTTL))
+	maxConnLifetime = time.Duration(config.MaxConnLifetime)
+	stunVerbose = config.STUNVerbose
+	dualStackNATDetection = config.DualStackNATDetection
+	forceSTUNRefresh = config.ForceSTUNRefresh
+	if config.TCPNoDelay != nil {
+		tcpSocketOptions.NoDelay = *config.TCPNoDelay
+	}
+	if config.TCPKeepAlive != nil {
+		tcpSocketOptions.KeepAlive = *config.TCPKeepAlive
+	}
+	if config.LogSummaryInterval < 0 {
+		fatalf(ExitConfig, "Config error: 'logSummaryInterval' must not be negative")
+	}
+	if config.LogSummaryInterval > 0 {
+		logSummaryInterval = time.Duration(config.LogSummaryInterval)
+	}
+	if config.StartupTimeout < 0 {
+		fatalf(ExitConfig, "Config error: 'startupTimeout' must not be negative")
+	}
+	if config.ConnectTimeout < 0 {
+		fatalf(ExitConfig, "Config error: 'connectTimeout' must be positive")
+	}
+	if config.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(config.ConnectTimeout)
+	}
+	if config.AffinityWindow < 0 {
+		fatalf(ExitConfig, "Config error: 'affinityWindow' must not be negative")
+	}
+	if config.PeerWaitTimeout != nil && *config.PeerWaitTimeout < 0 {
+		fatalf(ExitConfig, "Config error: 'peerWaitTimeout' must not be negative")
+	}
+	if config.ServerLivenessTimeout < 0 {
+		fatalf(ExitConfig, "Config error: 'serverLivenessTimeout' must not be negative")
+	}
+	if config.ServerFullRetry < 0 {
+		fatalf(ExitConfig, "Config error: 'serverFullRetry' must not be negative")
+	}
+	if config.LocalDialRetries < 0 {
+		fatalf(ExitConfig, "Config error: 'localDialRetries' must not be negative")
+	}
+	localDialRetries = config.LocalDialRetries
+	if config.LocalDialBackoff < 0 {
+		fatalf(ExitConfig, "Config error: 'localDialBackoff' must not be negative")
+	}
+	if config.LocalDialBackoff > 0 {
+		localDialBackoff = time.Duration(config.LocalDialBackoff)
+	}
+	if config.ServiceFallbackDelay < 0 {
+		fatalf(ExitConfig, "Config error: 'serviceFallbackDelay' must not be negative")
+	}
+	if config.ServiceFallbackDelay > 0 {
+		serviceFallbackDelay = time.Duration(config.ServiceFallbackDelay)
+	}
+	if config.AllocationConcurrency < 0 {
+		fatalf(ExitConfig, "Config error: 'allocationConcurrency' must not be negative")
+	}
+	if config.UDPQueueDepth < 0 {
+		fatalf(ExitConfig, "Config error: 'udpQueueDepth' must not be negative")
+	}
+	if config.UDPQueueDepth > 0 {
+		udpQueueDepth = config.UDPQueueDepth
+	}
+	switch config.SignalingAuthFailurePolicy {
+	case "", SignalingAuthAbort, SignalingAuthRetry:
+	default:
+		fatalf(ExitConfig, "Config error: 'signalingAuthFailurePolicy' must be %q or %q", SignalingAuthAbort, SignalingAuthRetry)
+	}
+	if _, err := signalingTLSConfig(config); err != nil {
+		fatalf(ExitConfig, "Config error: %v", err)
+	}
+	switch config.UDPQueuePolicy {
+	case "":
+	case UDPQueueDropNewest, UDPQueueDropOldest:
+		udpQueuePolicy = config.UDPQueuePolicy
+	default:
+		fatalf(ExitConfig, "Config error: 'udpQueuePolicy' must be %q or %q", UDPQueueDropNewest, UDPQueueDropOldest)
+	}
+	if config.UDPSourcePool != "" {
+		pool, err := newSourceAddrPool(config.UDPSourcePool)
+		if err != nil {
+			fatalf(ExitConfig, "Config error: %v", err)
+		}
+		udpSourcePool = pool
+	}
+	if err := validateHolePunchStrategies(config.HolePunchStrategies); err != nil {
+		fatalf(ExitConfig, "Config error: 'holePunchStrategies': %v", err)
+	}
+	if len(config.HolePunchStrategies) > 0 {
+		holePunchStrategies = config.HolePunchStrategies
+	}
+	if config.HolePunchRetries < 0 {
+		fatalf(ExitConfig, "Config error: 'holePunchRetries' must not be negative")
+	}
+	holePunchRetries = config.HolePunchRetries
+	if config.MaxConcurrentPunches < 0 {
+		fatalf(ExitConfig, "Config error: 'maxConcurrentPunches' must not be negative")
+	}
+	setMaxConcurrentPunches(config.MaxConcurrentPunches)
+	if config.TCPKeepAliveInterval < 0 {
+		fatalf(ExitConfig, "Config error: 'tcpKeepAliveInterval' must not be negative")
+	}
+	if config.TCPKeepAliveInterval > 0 {
+		tcpSocketOptions.KeepAliveInterval = time.Duration(config.TCPKeepAliveInterval)
+	}
+	if config.TCPSocketBufferSize < 0 {
+		fatalf(ExitConfig, "Config error: 'tcpSocketBufferSize' must not be negative")
+	}
+	if config.TCPSocketBufferSize > 0 {
+		tcpSocketOptions.BufferSize = config.TCPSocketBufferSize
+		checkTCPSocketBufferSize(config.TCPSocketBufferSize)
+	}
+	if *benchmark {
+		if *benchmarkSize <= 0 {
+			fatalf(ExitConfig, "-benchmark-size must be positive")
+		}
+		benchmarkSizeMB = *benchmarkSize
+	}
+
+	config.NoInteractive = *noInteractive
+	if *duration < 0 {
+		fatalf(ExitConfig, "-duration must not be negative")
+	}
+	config.Duration = *duration
 
 	// Validate configuration
-	if config.Mode != "client" && config.Mode != "server" {
-		log.Fatal("Config error: 'mode' must be 'client' or 'server'")
+	tunnels := config.tunnels()
+	if len(tunnels) > 1 {
+		// Tunnels cannot share the mapping CLI on stdin
+		for i := range tunnels {
+			tunnels[i].Config.NoInteractive = true
+		}
 	}
-	if config.SignalingURL == "" {
-		log.Fatal("Config error: 'signalingUrl' is required")
+	for i := range tunnels {
+		if err := validateTunnelConfig(&tunnels[i].Config); err != nil {
+			if len(config.Tunnels) > 0 {
+				fatalf(ExitConfig, "Config error: tunnel %q: %v", tunnels[i].Name, err)
+			}
+			fatalf(ExitConfig, "Config error: %v", err)
+		}
 	}
-	if config.RoomID == "" {
-		log.Fatal("Config error: 'roomId' is required")
+	if err := validateTunnels(tunnels); err != nil {
+		fatalf(ExitConfig, "Config error: 'tunnels': %v", err)
 	}
-	// Only client needs mappings
-	if config.Mode == "client" && len(config.Mappings) == 0 {
-		log.Fatal("Config error: client mode requires at least one port 'mapping'")
+	if len(tunnels) > 1 && config.ControlListen != "" {
+		fatalf(ExitConfig, "Config error: 'controlListen' cannot be shared by several tunnels")
 	}
-	// Server ignores mappings
-	if config.Mode == "server" {
-		config.Mappings = nil // Clear any mappings for server
+	if *printConfig {
+		if err := printEffectiveConfig(os.Stdout, config, tunnels); err != nil {
+			fatalf(ExitRuntime, "Failed to print config: %v", err)
+		}
+		return
 	}
-	if config.STUNServer == "" {
-		// Provide a default STUN server if not specified
-		config.STUNServer = "stun.l.google.com:19302"
+	if err := selectBindInterface(config.BindInterface, config.STUNServer); err != nil {
+		fatalf(ExitConfig, "Config error: %v", err)
+	}
+
+	if *profileConnection != "" {
+		connectionTrace = NewConnectionTrace(*profileConnection)
+		connectionTrace.Record("start", tunnels[0].Config.Mode+" mode")
 	}
 
-	runForwarder(config)
+	runForwarder(config, tunnels)
 }
 
 // parseConfig parses configuration from file
 func parseConfig(configPath string) (Configuration, error) {
 	var config Configuration
+	if err := decodeConfigFile(configPath, &config); err != nil {
+		return config, err
+	}
+
+	// Expand ${env:VAR} and ${file:/path} references before validation
+	if err := resolveSecrets(&config); err != nil {
+		return config, err
+	}
+
+	// Mappings from a separate file follow the inline ones
+	if config.MappingsFile != "" {
+		config.MappingsFile = resolveMappingsFile(configPath, config.MappingsFile)
+		fromFile, err := loadMappingsFile(config.MappingsFile)
+		if err != nil {
+			return config, err
+		}
+		config.inlineMappings = config.Mappings
+		config.Mappings = mergeMappings(config.Mappings, fromFile)
+	}
 	
+	return config, nil
+}
+
+// decodeConfigFile reads a YAML or JSON file, by extension, into v
+func decodeConfigFile(path string, v interface{}) error {
 	// Read the configuration file
-	configFile, err := os.ReadFile(configPath)
+	configFile, err := os.ReadFile(path)
 	if err != nil {
-		return config, err
+		return err
 	}
 
 	// Parse based on file extension
-	ext := strings.ToLower(filepath.Ext(configPath))
+	ext := strings.ToLower(filepath.Ext(path))
 	switch ext {
 	case ".yml", ".yaml":
-		if err := yaml.Unmarshal(configFile, &config); err != nil {
-			return config, err
-		}
+		return yaml.Unmarshal(configFile, v)
 	case ".json":
-		if err := json.Unmarshal(configFile, &config); err != nil {
-			return config, err
-		}
+		return json.Unmarshal(configFile, v)
 	default:
-		return config, os.ErrInvalid
+		return os.ErrInvalid
 	}
-	
-	return config, nil
 }
\ No newline at end of file
@@ -5,18 +5,26 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// mappingAllocationTimeout bounds the wait for the server to allocate an update
+const mappingAllocationTimeout = 20 * time.Second
+
 // MappingUpdater handles dynamic mapping updates for client
 type MappingUpdater struct {
 	config          Configuration
 	signalingClient *SignalingClient
 	roomKey         string
 	currentMappings []PortMapping
+	onAllocation    func(*ServerRegistrationData) // Called with the server's allocation after each update
+	mutex           sync.Mutex                    // Serializes commands from stdin, the control socket and file watchers
 }
 
 // NewMappingUpdater creates a new mapping updater
@@ -29,14 +37,46 @@ func NewMappingUpdater(config Configuration, signalingClient *SignalingClient, r
 	}
 }
 
+// OnAllocation sets a function called with the server's allocation after
+// each mapping update, so the client can start forwarding new mappings
+func (mu *MappingUpdater) OnAllocation(fn func(*ServerRegistrationData)) {
+	mu.onAllocation = fn
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal. The null
+// device is a character device too, so it is ruled out explicitly.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+		return false
+	}
+	return true
+}
+
 // StartInteractiveUpdater starts an interactive CLI for mapping updates
 func (mu *MappingUpdater) StartInteractiveUpdater(ctx context.Context) {
+	// Without a terminal (systemd, containers) stdin is /dev/null or closed
+	// and there is nobody to type commands; forwarders keep running regardless
+	if !stdinIsTerminal() {
+		log.Printf("ℹ️  stdin is not a terminal, interactive mapping updater disabled (use -no-interactive to skip this check)")
+		return
+	}
+
 	log.Printf("🎛️  Interactive mapping updater started")
 	log.Printf("Commands:")
 	log.Printf("  add <protocol:localPort:remotePort> - Add new mapping")
 	log.Printf("  remove <index> - Remove mapping by index")
 	log.Printf("  list - Show current mappings")
 	log.Printf("  update - Send current mappings to server")
+	log.Printf("  paths - Show active paths of dual path and hole-punched mappings")
+	log.Printf("  stats - Show forwarding statistics")
+	log.Printf("  stats reset [mapping] - Clear the throughput samples of a mapping, or of all")
+	log.Printf("  conns - List active connections")
+	log.Printf("  kill <connId> - Close one active connection")
+	log.Printf("  ping <localPort> [host] [count] - Ping through an ICMP mapping")
 	log.Printf("  help - Show this help")
 	log.Printf("  quit - Exit updater")
 	
@@ -64,142 +104,266 @@ func (mu *MappingUpdater) StartInteractiveUpdater(ctx context.Context) {
 			continue
 		}
 		
-		command := strings.ToLower(parts[0])
-		
-		switch command {
-		case "add":
-			if len(parts) != 2 {
-				fmt.Println("Usage: add <protocol:localPort:remotePort>")
-				continue
-			}
-			mu.addMapping(parts[1])
-			
-		case "remove":
-			if len(parts) != 2 {
-				fmt.Println("Usage: remove <index>")
-				continue
-			}
-			mu.removeMapping(parts[1])
-			
-		case "list":
-			mu.listMappings()
-			
-		case "update":
-			mu.sendMappingUpdate()
-			
-		case "help":
-			fmt.Println("Commands:")
-			fmt.Println("  add <protocol:localPort:remotePort> - Add new mapping")
-			fmt.Println("  remove <index> - Remove mapping by index")
-			fmt.Println("  list - Show current mappings")
-			fmt.Println("  update - Send current mappings to server")
-			fmt.Println("  help - Show this help")
-			fmt.Println("  quit - Exit updater")
-			
-		case "quit", "exit":
+		if mu.runCommand(os.Stdout, parts) {
 			log.Printf("Exiting mapping updater...")
 			return
-			
-		default:
-			fmt.Printf("Unknown command: %s. Type 'help' for available commands.\n", command)
 		}
 	}
 }
 
+// runCommand executes one mapping CLI command, writing its output to w, and
+// reports whether it was quit. Commands from stdin and the control socket
+// run one at a time.
+func (mu *MappingUpdater) runCommand(w io.Writer, parts []string) bool {
+	mu.mutex.Lock()
+	defer mu.mutex.Unlock()
+
+	command := strings.ToLower(parts[0])
+	switch command {
+	case "add":
+		if len(parts) != 2 {
+			fmt.Fprintln(w, "Usage: add <protocol:localPort:remotePort>")
+			return false
+		}
+		mu.addMapping(w, parts[1])
+
+	case "remove":
+		if len(parts) != 2 {
+			fmt.Fprintln(w, "Usage: remove <index>")
+			return false
+		}
+		mu.removeMapping(w, parts[1])
+
+	case "list":
+		mu.listMappings(w)
+
+	case "update":
+		mu.sendMappingUpdate(w)
+
+	case "paths":
+		mu.listPaths(w)
+
+	case "stats":
+		runStatsCommand(w, parts)
+
+	case "conns":
+		printConnections(w)
+
+	case "kill":
+		if len(parts) != 2 {
+			fmt.Fprintln(w, "Usage: kill <connId>")
+			return false
+		}
+		killConnection(w, parts[1])
+
+	case "ping":
+		mu.ping(w, parts[1:])
+
+	case "help":
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "  add <protocol:localPort:remotePort> - Add new mapping")
+		fmt.Fprintln(w, "  remove <index> - Remove mapping by index")
+		fmt.Fprintln(w, "  list - Show current mappings")
+		fmt.Fprintln(w, "  update - Send current mappings to server")
+		fmt.Fprintln(w, "  paths - Show active paths of dual path and hole-punched mappings")
+		fmt.Fprintln(w, "  stats - Show forwarding statistics")
+		fmt.Fprintln(w, "  stats reset [mapping] - Clear the throughput samples of a mapping, or of all")
+		fmt.Fprintln(w, "  conns - List active connections")
+		fmt.Fprintln(w, "  kill <connId> - Close one active connection")
+		fmt.Fprintln(w, "  ping <localPort> [host] [count] - Ping through an ICMP mapping")
+		fmt.Fprintln(w, "  help - Show this help")
+		fmt.Fprintln(w, "  quit - Exit updater")
+
+	case "quit", "exit":
+		return true
+
+	default:
+		fmt.Fprintf(w, "Unknown command: %s. Type 'help' for available commands.\n", command)
+	}
+	return false
+}
+
 // addMapping adds a new mapping
-func (mu *MappingUpdater) addMapping(mappingStr string) {
+func (mu *MappingUpdater) addMapping(w io.Writer, mappingStr string) {
 	var mapping PortMapping
 	err := mapping.parseFromString(mappingStr)
 	if err != nil {
-		fmt.Printf("❌ Invalid mapping format: %v\n", err)
+		fmt.Fprintf(w, "❌ Invalid mapping format: %v\n", err)
+		return
+	}
+	if mapping.Protocol == "icmp" {
+		fmt.Fprintf(w, "❌ ICMP mappings need a serviceTarget, add them to the configuration instead\n")
 		return
 	}
 	
 	// Check for duplicates
 	for _, existing := range mu.currentMappings {
-		if existing.Protocol == mapping.Protocol && existing.LocalPort == mapping.LocalPort {
-			fmt.Printf("❌ Mapping with same protocol and local port already exists\n")
+		if existing.transport() == mapping.transport() && existing.LocalPort == mapping.LocalPort {
+			fmt.Fprintf(w, "❌ Mapping with same protocol and local port already exists\n")
 			return
 		}
 	}
 	
 	mu.currentMappings = append(mu.currentMappings, mapping)
-	fmt.Printf("✅ Added mapping: %s %d->%d\n", mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
+	fmt.Fprintf(w, "✅ Added mapping: %s %d->%d\n", mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
+	if warning := swappedPortsWarning(mapping); warning != "" {
+		fmt.Fprintf(w, "⚠️  %s\n", warning)
+	}
+}
+
+// ping handles the ping command: ping <localPort> [host] [count]
+func (mu *MappingUpdater) ping(w io.Writer, args []string) {
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Fprintln(w, "Usage: ping <localPort> [host] [count]")
+		return
+	}
+	localPort, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(w, "❌ Invalid port: %s\n", args[0])
+		return
+	}
+	isICMP := false
+	for _, mapping := range mu.currentMappings {
+		if mapping.Protocol == "icmp" && mapping.LocalPort == localPort {
+			isICMP = true
+		}
+	}
+	if !isICMP {
+		fmt.Fprintf(w, "❌ No ICMP mapping on local port %d\n", localPort)
+		return
+	}
+
+	host, count := "", 4
+	if len(args) > 1 {
+		host = args[1]
+	}
+	if len(args) > 2 {
+		if count, err = strconv.Atoi(args[2]); err != nil || count < 1 {
+			fmt.Fprintf(w, "❌ Invalid count: %s\n", args[2])
+			return
+		}
+	}
+	pingThroughMapping(w, localPort, host, count)
 }
 
 // removeMapping removes a mapping by index
-func (mu *MappingUpdater) removeMapping(indexStr string) {
+func (mu *MappingUpdater) removeMapping(w io.Writer, indexStr string) {
 	var index int
 	_, err := fmt.Sscanf(indexStr, "%d", &index)
 	if err != nil {
-		fmt.Printf("❌ Invalid index: %s\n", indexStr)
+		fmt.Fprintf(w, "❌ Invalid index: %s\n", indexStr)
 		return
 	}
 	
 	if index < 0 || index >= len(mu.currentMappings) {
-		fmt.Printf("❌ Index out of range: %d (valid range: 0-%d)\n", index, len(mu.currentMappings)-1)
+		fmt.Fprintf(w, "❌ Index out of range: %d (valid range: 0-%d)\n", index, len(mu.currentMappings)-1)
 		return
 	}
 	
 	removed := mu.currentMappings[index]
 	mu.currentMappings = append(mu.currentMappings[:index], mu.currentMappings[index+1:]...)
-	fmt.Printf("✅ Removed mapping: %s %d->%d\n", removed.Protocol, removed.LocalPort, removed.RemotePort)
+	fmt.Fprintf(w, "✅ Removed mapping: %s %d->%d\n", removed.Protocol, removed.LocalPort, removed.RemotePort)
 }
 
 // listMappings shows current mappings
-func (mu *MappingUpdater) listMappings() {
+func (mu *MappingUpdater) listMappings(w io.Writer) {
 	if len(mu.currentMappings) == 0 {
-		fmt.Println("📝 No mappings configured")
+		fmt.Fprintln(w, "📝 No mappings configured")
 		return
 	}
 	
-	fmt.Printf("📝 Current mappings (%d):\n", len(mu.currentMappings))
+	fmt.Fprintf(w, "📝 Current mappings (%d):\n", len(mu.currentMappings))
 	for i, mapping := range mu.currentMappings {
-		fmt.Printf("  [%d] %s %d->%d\n", i, mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
+		fmt.Fprintf(w, "  [%d] %s %d->%d\n", i, mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
+	}
+}
+
+// listPaths shows the active path of each dual path mapping
+func (mu *MappingUpdater) listPaths(w io.Writer) {
+	count := 0
+	activePaths.Range(func(key, value interface{}) bool {
+		name, addr := value.(*PathSelector).Active()
+		fmt.Fprintf(w, "  %s: %s (%s)\n", key, name, addr)
+		count++
+		return true
+	})
+	pathHealth.Range(func(key, value interface{}) bool {
+		fmt.Fprintf(w, "  %s: hole-punched path %s\n", key, value.(HealthStatus))
+		count++
+		return true
+	})
+	if count == 0 {
+		fmt.Fprintln(w, "📝 No dual path or hole-punched mappings active")
 	}
 }
 
 // sendMappingUpdate sends current mappings to server
-func (mu *MappingUpdater) sendMappingUpdate() {
-	fmt.Printf("📤 Sending %d mappings to server...\n", len(mu.currentMappings))
+func (mu *MappingUpdater) sendMappingUpdate(w io.Writer) {
+	fmt.Fprintf(w, "📤 Sending %d mappings to server...\n", len(mu.currentMappings))
 	
-	// Convert mappings to string format
+	// Convert mappings to string format; aliases are not allocated
+	primaries, aliases := coalesceMappings(mu.currentMappings)
 	var mappingStrings []string
-	for _, mapping := range mu.currentMappings {
-		mappingStr := fmt.Sprintf("%s:%d:%d", mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
-		mappingStrings = append(mappingStrings, mappingStr)
+	for _, mapping := range primaries {
+		mappingStrings = append(mappingStrings, mapping.String())
 	}
 	
-	err := mu.signalingClient.UpdateMappings(mu.config.SignalingURL, mu.roomKey, mappingStrings)
+	updateID, err := mu.signalingClient.UpdateMappings(mu.config.SignalingURL, mu.roomKey, mappingStrings)
 	if err != nil {
-		fmt.Printf("❌ Failed to send mapping update: %v\n", err)
+		fmt.Fprintf(w, "❌ Failed to send mapping update: %v\n", err)
 		return
 	}
 	
-	fmt.Printf("✅ Mapping update sent successfully\n")
-	
-	// Wait a moment for server to process and then check for new allocations
-	time.Sleep(2 * time.Second)
+	fmt.Fprintf(w, "✅ Mapping update sent successfully\n")
 	
-	serverData, err := mu.signalingClient.WaitForPeerData(context.Background(), mu.config.SignalingURL, 
-		peerRole(mu.config.Mode), mu.roomKey, 5*time.Second)
+	serverRegistration, err := mu.waitForAllocation(updateID)
 	if err != nil {
-		fmt.Printf("⚠️  Could not retrieve updated server data: %v\n", err)
+		fmt.Fprintf(w, "⚠️  Could not retrieve updated server data: %v\n", err)
 		return
 	}
-	
-	serverRegistration, err := parseServerRegistrationData(serverData)
-	if err != nil {
-		fmt.Printf("⚠️  Could not parse updated server data: %v\n", err)
-		return
+	serverRegistration.PortMappings = expandAliases(serverRegistration.PortMappings, aliases)
+	if rejection := serverRegistration.Error; rejection != nil {
+		fmt.Fprintf(w, "🚫 Server refused the update: %s (%s)\n", rejection.Message, rejection.Code)
 	}
 	
-	fmt.Printf("🎯 Server allocated new ports:\n")
+	fmt.Fprintf(w, "🎯 Server allocated new ports:\n")
 	for _, portMapping := range serverRegistration.PortMappings {
 		mapping := portMapping.ClientMapping
-		fmt.Printf("  %s %d->%d allocated port: %d\n", 
+		fmt.Fprintf(w, "  %s %d->%d allocated port: %d\n", 
 			mapping.Protocol, mapping.LocalPort, mapping.RemotePort, portMapping.AllocatedPort)
 	}
+	for _, failure := range serverRegistration.FailedMappings {
+		fmt.Fprintf(w, "  ❌ %s not allocated: %s\n", failure.Mapping, failure.Error)
+	}
+
+	if mu.onAllocation != nil {
+		mu.onAllocation(serverRegistration)
+	}
+}
+
+// waitForAllocation polls the server's data until it acknowledges updateID
+func (mu *MappingUpdater) waitForAllocation(updateID string) (*ServerRegistrationData, error) {
+	deadline := time.Now().Add(mappingAllocationTimeout)
+	for {
+		// Give the server a moment to notice and process the update
+		time.Sleep(2 * time.Second)
+
+		serverData, err := mu.signalingClient.WaitForPeerData(context.Background(), mu.config.SignalingURL, 
+			peerRole(mu.config.Mode), mu.roomKey, 5*time.Second)
+		if err == nil {
+			serverRegistration, parseErr := parseServerRegistrationData(serverData)
+			if parseErr == nil && serverRegistration.AckedUpdateID == updateID {
+				return serverRegistration, nil
+			}
+			err = parseErr
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("server did not acknowledge update %s within %v", updateID, mappingAllocationTimeout)
+			}
+			return nil, err
+		}
+	}
 }
 
 // AutoUpdateFromConfig automatically updates mappings from config file changes
@@ -237,14 +401,17 @@ func (mu *MappingUpdater) AutoUpdateFromConfig(ctx context.Context, configPath s
 				}
 				
 				// Check if mappings actually changed
+				mu.mutex.Lock()
 				if mappingsEqual(mu.currentMappings, newConfig.Mappings) {
+					mu.mutex.Unlock()
 					continue
 				}
 				
 				mu.currentMappings = newConfig.Mappings
 				log.Printf("🔄 Detected %d mapping changes, updating server...", len(mu.currentMappings))
 				
-				mu.sendMappingUpdate()
+				mu.sendMappingUpdate(os.Stdout)
+				mu.mutex.Unlock()
 			}
 		}
 	}
@@ -259,7 +426,8 @@ func mappingsEqual(a, b []PortMapping) bool {
 	for i := range a {
 		if a[i].Protocol != b[i].Protocol || 
 		   a[i].LocalPort != b[i].LocalPort || 
-		   a[i].RemotePort != b[i].RemotePort {
+		   a[i].RemotePort != b[i].RemotePort ||
+		   a[i].Service != b[i].Service {
 			return false
 		}
 	}
@@ -0,0 +1,115 @@
+// Package main - Mappings kept in a separate file referenced by the config
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// mappingsFileContent is the layout of a mappingsFile: a 'mappings' list as
+// in the main configuration
+type mappingsFileContent struct {
+	Mappings []PortMapping `json:"mappings" yaml:"mappings"`
+}
+
+// resolveMappingsFile makes the mappingsFile path relative to the directory
+// of the configuration file that references it
+func resolveMappingsFile(configPath, mappingsFile string) string {
+	if mappingsFile == "" || filepath.IsAbs(mappingsFile) {
+		return mappingsFile
+	}
+	return filepath.Join(filepath.Dir(configPath), mappingsFile)
+}
+
+// loadMappingsFile reads the mappings of a mappingsFile with the parser of
+// the main configuration
+func loadMappingsFile(path string) ([]PortMapping, error) {
+	var content mappingsFileContent
+	if err := decodeConfigFile(path, &content); err != nil {
+		return nil, fmt.Errorf("mappingsFile %s: %w", path, err)
+	}
+	if err := resolveSecretsIn(reflect.ValueOf(&content).Elem(), "mappingsFile"); err != nil {
+		return nil, err
+	}
+	for _, mapping := range content.Mappings {
+		if len(mapping.Peers) > 0 {
+			return nil, fmt.Errorf("mappingsFile %s: mapping %s: 'peers' is only supported in the main configuration", path, mapping)
+		}
+	}
+	return content.Mappings, nil
+}
+
+// mergeMappings appends the mappings of the mappingsFile to the inline ones
+func mergeMappings(inline, fromFile []PortMapping) []PortMapping {
+	merged := make([]PortMapping, 0, len(inline)+len(fromFile))
+	merged = append(merged, inline...)
+	return append(merged, fromFile...)
+}
+
+// validateUniqueMappings rejects two mappings of one protocol on the same
+// local port, which the merge of inline and file mappings can produce
+func validateUniqueMappings(mappings []PortMapping) error {
+	seen := make(map[string]bool, len(mappings))
+	for _, mapping := range mappings {
+		key := mappingStateKey(mapping.transport(), mapping.LocalPort)
+		if seen[key] {
+			return fmt.Errorf("duplicate mapping for local port %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// WatchMappingsFile reloads the mappingsFile when it changes and sends the
+// merged set to the server. Mappings changed through the mapping CLI are
+// replaced by the reloaded set.
+func (mu *MappingUpdater) WatchMappingsFile(ctx context.Context, path string, inline []PortMapping) {
+	log.Printf("👀 Watching mappings file %s", path)
+
+	var lastModTime time.Time
+	if stat, err := os.Stat(path); err == nil {
+		lastModTime = stat.ModTime()
+	}
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil || !stat.ModTime().After(lastModTime) {
+			continue
+		}
+		lastModTime = stat.ModTime()
+
+		fromFile, err := loadMappingsFile(path)
+		if err != nil {
+			log.Printf("❌ Failed to reload mappings: %v", err)
+			continue
+		}
+		merged := mergeMappings(inline, fromFile)
+		if err := validateMappings(merged); err != nil {
+			log.Printf("❌ Reloaded mappings rejected: %v", err)
+			continue
+		}
+		mu.mutex.Lock()
+		if mappingsEqual(mu.currentMappings, merged) {
+			mu.mutex.Unlock()
+			continue
+		}
+
+		mu.currentMappings = merged
+		log.Printf("📄 Mappings file changed, sending %d mappings to the server...", len(merged))
+		mu.sendMappingUpdate(os.Stdout)
+		mu.mutex.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+// Package main - NAT check command with advice for the detected NAT
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// natAdvice is what a NAT type means for connecting, and what to change
+type natAdvice struct {
+	summary         string
+	recommendations []string
+}
+
+// natAdvices map each NAT type to guidance for users
+var natAdvices = map[NATType]natAdvice{
+	NATTypeNone: {
+		summary: "No NAT: this host is reachable on its public address, direct connections should work",
+		recommendations: []string{
+			"Make sure a host firewall lets in the UDP and TCP ports the server allocates",
+			"Set 'natType: none' to skip detection at startup",
+		},
+	},
+	NATTypeFullCone: {
+		summary: "Full cone NAT: direct connections should work with any peer",
+		recommendations: []string{
+			"Nothing to change; hole punching works even with a symmetric NAT on the other side",
+			"Set 'natType: fullCone' to skip detection at startup",
+		},
+	},
+	NATTypeRestrictedCone: {
+		summary: "Restricted cone NAT: hole punching should work unless the peer is behind a symmetric NAT",
+		recommendations: []string{
+			"Run --check-nat on the peer too; if it reports a symmetric NAT, expect the relay",
+			"Set 'natType: restrictedCone' to skip detection at startup",
+		},
+	},
+	NATTypePortRestricted: {
+		summary: "Port-restricted cone NAT: hole punching works with cone NAT peers but fails with a symmetric one",
+		recommendations: []string{
+			"Run --check-nat on the peer too; if it reports a symmetric NAT, expect the relay",
+			"Setting 'holePunchRetries' lets a failed punch retry from fresh ports before relaying",
+		},
+	},
+	NATTypeSymmetric: {
+		summary: "Symmetric NAT detected: hole punching is unlikely, configure a relay",
+		recommendations: []string{
+			"Mappings fall back to the relay, which needs the server's allocated ports reachable: run the server on a host with a public address or forward its ports",
+			"If both hosts share a VPN, 'transport: direct' connects over it without punching",
+			"Keep 'portPrediction' in 'holePunchStrategies' for a chance against NATs that allocate ports in sequence",
+			"Set 'natType: symmetric' to skip detection and punching at startup",
+		},
+	},
+}
+
+// natConfidence rates how far a classification can be trusted, from how
+// many of the detection's tests answered
+func natConfidence(result *STUNResult) (string, string) {
+	switch result.NATType {
+	case NATTypeNone:
+		return "high", "the public address is the local one"
+	case NATTypeSymmetric:
+		return "high", "two probes from one port were mapped to different ports"
+	case NATTypeFullCone:
+		return "medium", "two STUN servers saw the same mapping; inbound filtering is not tested"
+	}
+	if len(result.Mappings) < 2 {
+		return "low", "only one STUN probe answered, so the type is assumed"
+	}
+	if len(result.Mappings) > 2 && extractPort(result.Mappings[0]) != extractPort(result.Mappings[2]) {
+		return "low", "the mapping changed between STUN servers, which behaves like a symmetric NAT towards some peers"
+	}
+	return "low", "the mapping is stable, but restricted and port-restricted filtering cannot be told apart"
+}
+
+// writeNATReport prints a detection result with its confidence and advice
+func writeNATReport(w io.Writer, result *STUNResult) {
+	confidence, reason := natConfidence(result)
+	advice, ok := natAdvices[result.NATType]
+	if !ok {
+		advice = natAdvice{
+			summary:         "NAT type unknown: detection could not classify this network",
+			recommendations: []string{"Try another 'stunServer'; mappings fall back to the relay if punching fails"},
+		}
+	}
+	fmt.Fprintf(w, "NAT type:       %s\n", result.NATType)
+	fmt.Fprintf(w, "Public address: %s\n", result.PublicAddr)
+	fmt.Fprintf(w, "Local address:  %s\n", result.LocalAddr)
+	fmt.Fprintf(w, "Hole punching:  %s\n", map[bool]string{true: "likely", false: "unlikely"}[result.CanHolePunch])
+	fmt.Fprintf(w, "Confidence:     %s (%s)\n", confidence, reason)
+	fmt.Fprintf(w, "\n%s\n", advice.summary)
+	for _, recommendation := range advice.recommendations {
+		fmt.Fprintf(w, "  - %s\n", recommendation)
+	}
+	if result.IPv6 != nil {
+		fmt.Fprintf(w, "\nIPv6 NAT type:  %s (%s)\n", result.IPv6.NATType, result.IPv6.PublicAddr)
+	}
+}
+
+// runNATCheck detects the NAT with the STUN settings of the config at
+// configPath, if there is one, prints advice to w and returns the exit code
+func runNATCheck(w io.Writer, configPath string) int {
+	var config Configuration
+	if _, err := os.Stat(configPath); err == nil {
+		if config, err = parseConfig(configPath); err != nil {
+			fatalf(ExitConfig, "Failed to load config: %v", err)
+		}
+	}
+	if config.STUNServer == "" {
+		config.STUNServer = "stun.l.google.com:19302"
+	}
+	if config.STUNServerIP != "" {
+		if err := globalSTUNResolver.Pin(config.STUNServer, config.STUNServerIP); err != nil {
+			fatalf(ExitConfig, "Config error: 'stunServerIp': %v", err)
+		}
+	}
+	if err := selectBindInterface(config.BindInterface, config.STUNServer); err != nil {
+		fatalf(ExitConfig, "Config error: %v", err)
+	}
+	dualStackNATDetection = true
+
+	result, err := discoverNATType(config.STUNServer, secondarySTUNServer(config.STUNServer))
+	if err != nil {
+		fmt.Fprintf(w, "NAT detection failed: %v\n", err)
+		fmt.Fprintf(w, "  - Check that outbound UDP to %s is allowed, or try another 'stunServer'\n", config.STUNServer)
+		return ExitNetwork
+	}
+	writeNATReport(w, result)
+	return ExitOK
+}
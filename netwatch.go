@@ -0,0 +1,96 @@
+// Package main - Local interface change detection and connection migration
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// interfaceWatchInterval is how often local interfaces are polled
+const interfaceWatchInterval = 5 * time.Second
+
+// interfaceFingerprint summarises the IPv4 addresses of all up, non-loopback
+// interfaces. IPv6 is ignored so temporary address rotation does not count
+// as a change.
+func interfaceFingerprint() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var entries []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			entries = append(entries, iface.Name+"="+ipNet.IP.String())
+		}
+	}
+
+	sort.Strings(entries)
+	return strings.Join(entries, ","), nil
+}
+
+// watchInterfaces polls the local interfaces until ctx is cancelled and calls
+// onChange the first time they differ from when watching started
+func watchInterfaces(ctx context.Context, interval time.Duration, onChange func(previous, current string)) {
+	initial, err := interfaceFingerprint()
+	if err != nil {
+		log.Printf("⚠️  Interface watch disabled: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := interfaceFingerprint()
+		if err != nil || current == initial {
+			continue
+		}
+		onChange(initial, current)
+		return
+	}
+}
+
+// runWithInterfaceMigration runs session until ctx is cancelled. When the
+// local interfaces change the session is cancelled and started again, so it
+// re-runs discovery and re-registers with the new network info. Each session
+// gets the server data the previous one used, to tell it apart from the fresh
+// allocation.
+func runWithInterfaceMigration(ctx context.Context, session func(ctx context.Context, staleServerData string) string) {
+	staleServerData := ""
+	for {
+		sessionCtx, cancel := context.WithCancel(ctx)
+		go watchInterfaces(sessionCtx, interfaceWatchInterval, func(previous, current string) {
+			log.Printf("🔀 Local interfaces changed (%s -> %s), migrating connections", previous, current)
+			cancel()
+		})
+
+		staleServerData = session(sessionCtx, staleServerData)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Package main - Client-to-client topology with the signaling server as coordinator
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// PeerSideA initiates hole punching in peer mode
+	PeerSideA = "a"
+	// PeerSideB waits for side A during hole punching
+	PeerSideB = "b"
+)
+
+// peerSlots returns the signaling roles a peer posts to and reads from. The
+// coordinator only knows "client" and "server" slots, so side A uses the
+// client slot and side B the server slot.
+func peerSlots(side string) (string, string) {
+	if side == PeerSideA {
+		return "client", "server"
+	}
+	return "server", "client"
+}
+
+// validatePeerMappings checks that peer mode mappings can be carried over the
+// peer UDP mux, which identifies mappings by their remote port
+func validatePeerMappings(mappings []PortMapping) error {
+	seen := make(map[int]bool)
+	for _, mapping := range mappings {
+		if mapping.Protocol != "udp" {
+			return fmt.Errorf("mapping %s: peer mode carries udp mappings only, as the punched path has no reliable transport for %s; forward it through a client and server tunnel instead", mapping, mapping.Protocol)
+		}
+		if mapping.Service != "" {
+			return fmt.Errorf("mapping %s: peer mode does not support @service remotes", mapping)
+		}
+		if seen[mapping.RemotePort] {
+			return fmt.Errorf("mapping %s: remote port %d used twice", mapping, mapping.RemotePort)
+		}
+		seen[mapping.RemotePort] = true
+	}
+	return nil
+}
+
+// handlePeerMode runs one side of a client-to-client tunnel. Both peers post
+// their network info and mappings to the coordinator, then hole punch directly
+// to each other; side A is the initiator. Each side listens on the local port
+// of its own mappings and serves the remote port of the other side's mappings
+// from its local services.
+func handlePeerMode(ctx context.Context, config Configuration, signalingClient *SignalingClient) {
+	log.Printf("[%s] Starting peer mode as side %s with %d mappings", config.Mode, config.PeerSide, len(config.Mappings))
+
+	if err := signalingClient.Ping(ctx, config.SignalingURL); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		fatalf(ExitSignaling, "Signaling preflight failed: %v", err)
+	}
+
+	networkInfo, err := discoverNetworkInfo(config)
+	if err != nil {
+		fatalf(ExitNetwork, "Failed to discover network info: %v", err)
+	}
+
+	roomKey := config.RoomID + "-peer"
+	ownSlot, peerSlot := peerSlots(config.PeerSide)
+	ctx = withPunchExchange(ctx, newPunchExchange(signalingClient, config, ownSlot, peerSlot))
+
+	peerData, err := formatClientRegistrationData(networkInfo, config.Mappings, config, nil, "")
+	if err != nil {
+		fatalf(ExitRuntime, "Failed to format peer registration data: %v", err)
+	}
+	if err := signalingClient.PostSignal(config.SignalingURL, ownSlot, roomKey, peerData); err != nil {
+		fatalf(ExitSignaling, "Failed to post peer registration data: %v", err)
+	}
+
+	log.Printf("Waiting for the other peer to register...")
+	rawPeerData, err := signalingClient.WaitForPeerData(ctx, config.SignalingURL, peerSlot, roomKey, 60*time.Second)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		fatalf(ExitSignaling, "Failed to get peer registration data: %v", err)
+	}
+
+	peerRegistration, err := parseClientRegistrationData(rawPeerData)
+	if err != nil {
+		fatalf(ExitSignaling, "Peer registration parsing failed: %v", err)
+	}
+	logPeerDiagnostics(defaultLogger.WithComponent("peer"), "Peer", peerRegistration.Diagnostics)
+
+	var peerMappings []PortMapping
+	for _, mappingStr := range peerRegistration.Mappings {
+		var mapping PortMapping
+		if err := mapping.parseFromString(mappingStr); err != nil {
+			fatalf(ExitSignaling, "Failed to parse peer mapping string %q: %v", mappingStr, err)
+		}
+		peerMappings = append(peerMappings, peerRegistration.mappingDetails(mapping))
+	}
+	if err := validatePeerMappings(peerMappings); err != nil {
+		fatalf(ExitConfig, "Peer sent unusable mappings: %v", err)
+	}
+
+	log.Printf("Peer registered with %d mappings, hole punching (initiator: side %s)", len(peerMappings), PeerSideA)
+
+	for _, mapping := range config.Mappings {
+		readiness.SetMapping(forwardedPortKey(mapping), MappingStateConnecting)
+	}
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, networkInfo, &peerRegistration.NetworkInfo, config.PeerSide == PeerSideA, "peer")
+	if err != nil {
+		fatalf(ExitNetwork, "Failed to establish peer connection: %v", err)
+	}
+	defer p2pConn.Close()
+	for _, mapping := range config.Mappings {
+		readiness.SetMapping(forwardedPortKey(mapping), MappingStateConnected)
+	}
+
+	logger := defaultLogger.WithComponent("peer")
+	if err := runUDPMuxPeer(ctx, logger, p2pConn, peerAddr, config.Mappings, peerMappings, config.UDPFin); err != nil {
+		fatalf(ExitRuntime, "Peer forwarding failed: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePeerMappings(t *testing.T) {
+	if err := validatePeerMappings([]PortMapping{
+		{Protocol: "udp", LocalPort: 5353, RemotePort: 53},
+		{Protocol: "udp", LocalPort: 6000, RemotePort: 5000},
+	}); err != nil {
+		t.Errorf("udp mappings refused: %v", err)
+	}
+
+	err := validatePeerMappings([]PortMapping{{Protocol: "tcp", LocalPort: 8080, RemotePort: 80}})
+	if err == nil || !strings.Contains(err.Error(), "peer mode carries udp mappings only") {
+		t.Errorf("tcp mapping: got %v, want the peer mode restriction", err)
+	}
+
+	err = validatePeerMappings([]PortMapping{
+		{Protocol: "udp", LocalPort: 1, RemotePort: 53},
+		{Protocol: "udp", LocalPort: 2, RemotePort: 53},
+	})
+	if err == nil || !strings.Contains(err.Error(), "used twice") {
+		t.Errorf("shared remote port: got %v", err)
+	}
+}
+
+func TestPeerTunnelRefusesTCP(t *testing.T) {
+	config := Configuration{
+		Mode:         "peer",
+		PeerSide:     PeerSideA,
+		SignalingURL: "https://example.com/index.php",
+		RoomID:       "room",
+		Mappings:     []PortMapping{{Protocol: "tcp", LocalPort: 8080, RemotePort: 80}},
+	}
+	if err := validateTunnelConfig(&config); err == nil || !strings.Contains(err.Error(), "peer mode carries udp mappings only") {
+		t.Errorf("peer tunnel with a tcp mapping: got %v", err)
+	}
+}
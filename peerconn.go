@@ -0,0 +1,76 @@
+// Package main - Hole-punched UDP sockets bound to the punched peer
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// peerConn is a hole-punched UDP socket that only talks to the peer the
+// punch was completed with. Datagrams from any other source (port scans,
+// spoofed traffic, stray punch packets of other sessions) are dropped and
+// counted instead of being forwarded to the local service.
+type peerConn struct {
+	*net.UDPConn
+	peer    *net.UDPAddr
+	logger  *Logger
+	dropped atomic.Int64
+
+	lastActivity atomic.Int64 // UnixNano of the last datagram from the peer
+	lastPong     atomic.Int64 // UnixNano of the last keepalive pong
+}
+
+// newPeerConn binds a punched socket to peer
+func newPeerConn(conn *net.UDPConn, peer *net.UDPAddr, logger *Logger) *peerConn {
+	pc := &peerConn{UDPConn: conn, peer: peer, logger: logger}
+	pc.lastActivity.Store(time.Now().UnixNano())
+	return pc
+}
+
+// samePeer reports whether addr is the punched peer, treating IPv4 and
+// IPv4-mapped IPv6 forms of an address as equal
+func samePeer(addr, peer *net.UDPAddr) bool {
+	return addr != nil && addr.Port == peer.Port && addr.IP.Equal(peer.IP)
+}
+
+// Read returns the next datagram from the peer, dropping any other source
+func (pc *peerConn) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := pc.UDPConn.ReadFromUDP(p)
+		if err != nil {
+			return n, err
+		}
+		if !samePeer(addr, pc.peer) {
+			pc.dropForeign(addr)
+			continue
+		}
+		pc.lastActivity.Store(time.Now().UnixNano())
+		// Keepalives and late handshake retransmissions are not data
+		if !isHandshakeFrame(p[:n]) {
+			return n, nil
+		}
+		pc.handleKeepalive(p[:n])
+	}
+}
+
+// dropForeign counts a datagram from a source other than the peer, warning
+// about the first one and at debug level after that
+func (pc *peerConn) dropForeign(addr *net.UDPAddr) {
+	globalStats.UDPForeignDropped.Add(1)
+	if pc.dropped.Add(1) == 1 {
+		pc.logger.Warnf("⚠️  Dropping UDP datagrams from %s: not the punched peer %s", addr, pc.peer)
+	} else {
+		pc.logger.Debugf("Dropped UDP datagram from %s", addr)
+	}
+}
+
+// Write sends p to the peer
+func (pc *peerConn) Write(p []byte) (int, error) {
+	return pc.UDPConn.WriteToUDP(p, pc.peer)
+}
+
+// RemoteAddr returns the peer's address
+func (pc *peerConn) RemoteAddr() net.Addr {
+	return pc.peer
+}
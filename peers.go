@@ -0,0 +1,274 @@
+// Package main - Mappings forwarded through several server peers with failover
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Failover policies of a mapping with peers, set with peerFailover
+const (
+	PeerFailoverPreferFirst = "preferFirst" // First healthy peer in list order, failing back once it recovers
+	PeerFailoverSticky      = "sticky"      // The active peer until it fails
+)
+
+// peerCheckInterval is how often the health of a mapping's peers is checked
+const peerCheckInterval = time.Second
+
+// validatePeers checks the peers and peerFailover options of a mapping
+func validatePeers(mapping PortMapping) error {
+	switch mapping.PeerFailover {
+	case "", PeerFailoverPreferFirst, PeerFailoverSticky:
+	default:
+		return fmt.Errorf("'peerFailover' must be %q or %q", PeerFailoverPreferFirst, PeerFailoverSticky)
+	}
+	if len(mapping.Peers) == 0 {
+		if mapping.PeerFailover != "" {
+			return fmt.Errorf("'peerFailover' requires 'peers'")
+		}
+		return nil
+	}
+	if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+		return fmt.Errorf("'peers' applies to TCP and UDP mappings only")
+	}
+	if mapping.DualPath {
+		return fmt.Errorf("'peers' cannot be combined with 'dualPath'")
+	}
+	seen := make(map[string]bool, len(mapping.Peers))
+	for _, room := range mapping.Peers {
+		if room == "" || seen[room] {
+			return fmt.Errorf("'peers' must list distinct, non-empty room IDs")
+		}
+		seen[room] = true
+	}
+	return nil
+}
+
+// peerLeg is the forward of a mapping through one peer: a copy of the
+// mapping registered in the peer's room, listening on an internal port
+type peerLeg struct {
+	room string
+	port int
+}
+
+// PeerSelector forwards a mapping's local port to the leg of its active
+// peer, switching when the active peer's leg is no longer connected
+type PeerSelector struct {
+	mapping PortMapping
+	legs    []peerLeg
+	policy  string
+	active  int // Index into legs, -1 until a leg connects
+	healthy bool
+	mutex   sync.RWMutex
+}
+
+// legKey is the readiness key of a leg's internal port
+func (ps *PeerSelector) legKey(leg peerLeg) string {
+	return mappingStateKey(ps.mapping.transport(), leg.port)
+}
+
+// legHealthy reports whether a leg is connected or relayed
+func (ps *PeerSelector) legHealthy(leg peerLeg) bool {
+	state := readiness.Mapping(ps.legKey(leg))
+	return state == MappingStateConnected || state == MappingStateRelay
+}
+
+// Target returns the address of the active peer's leg, the first leg while
+// none connected yet
+func (ps *PeerSelector) Target() (string, int) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return "127.0.0.1", ps.legs[max(ps.active, 0)].port
+}
+
+// check picks the active peer under the failover policy and records the
+// mapping as connected while any peer is
+func (ps *PeerSelector) check() {
+	healthy := make([]bool, len(ps.legs))
+	next := -1
+	for i, leg := range ps.legs {
+		healthy[i] = ps.legHealthy(leg)
+		if healthy[i] && next < 0 {
+			next = i
+		}
+	}
+
+	ps.mutex.Lock()
+	previous := ps.active
+	if ps.policy == PeerFailoverSticky && previous >= 0 && healthy[previous] {
+		next = previous
+	}
+	if next < 0 {
+		next = previous // Keep the last peer until one comes back
+	}
+	ps.active = next
+	wasHealthy := ps.healthy
+	ps.healthy = next >= 0 && healthy[next]
+	ps.mutex.Unlock()
+
+	if next != previous {
+		if previous < 0 {
+			log.Printf("🔀 Mapping %s forwarding through peer %s", ps.mapping, ps.legs[next].room)
+		} else {
+			log.Printf("🔀 Mapping %s switched from peer %s to peer %s", ps.mapping, ps.legs[previous].room, ps.legs[next].room)
+		}
+	}
+	if ps.healthy != wasHealthy {
+		state := MappingStateConnecting
+		if ps.healthy {
+			state = MappingStateConnected
+		} else {
+			log.Printf("⚠️  Mapping %s has no connected peer", ps.mapping)
+		}
+		readiness.SetMapping(forwardedPortKey(ps.mapping), state)
+	}
+}
+
+// Run forwards the mapping's local port to the active peer until ctx is
+// cancelled, checking the peers meanwhile
+func (ps *PeerSelector) Run(ctx context.Context) {
+	readiness.SetMapping(forwardedPortKey(ps.mapping), MappingStateConnecting)
+	ps.check()
+	go func() {
+		ticker := time.NewTicker(peerCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ps.check()
+			}
+		}
+	}()
+
+	logger := mappingLogger(ps.mapping)
+	if ps.mapping.Protocol == "tcp" {
+		runTCPClientToTarget(ctx, logger, ps.mapping.LocalPort, ps.Target, false, false, ps.mapping.dialTimeout())
+	} else {
+		runUDPClientToTarget(ctx, logger, ps.mapping.LocalPort, ps.Target, "", ps.mapping.udpSessionTimeout())
+	}
+}
+
+// freeLocalPort returns a port free for network on this host
+func freeLocalPort(network string) (int, error) {
+	if network == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// expandPeerMappings replaces each client mapping with peers by a leg per
+// peer room, run by the tunnel of that room, which is added when the
+// configuration has none, and returns the selectors forwarding the
+// mappings' local ports to their legs. Tunnels left without mappings are
+// dropped.
+func expandPeerMappings(tunnels []tunnel) ([]tunnel, []*PeerSelector, error) {
+	result := append([]tunnel(nil), tunnels...)
+	expanded := make(map[int]bool)
+	var selectors []*PeerSelector
+	for i := range tunnels {
+		var kept []PortMapping
+		legsHere := make(map[string]PortMapping)
+		for _, mapping := range result[i].Config.Mappings {
+			if len(mapping.Peers) == 0 {
+				kept = append(kept, mapping)
+				continue
+			}
+			expanded[i] = true
+			selector := &PeerSelector{mapping: mapping, policy: mapping.PeerFailover, active: -1}
+			for _, room := range mapping.Peers {
+				port, err := freeLocalPort(mapping.transport())
+				if err != nil {
+					return nil, nil, fmt.Errorf("mapping %s: no internal port for peer %s: %w", mapping, room, err)
+				}
+				leg := mapping
+				leg.Peers = nil
+				leg.PeerFailover = ""
+				leg.LocalPort = port
+				selector.legs = append(selector.legs, peerLeg{room: room, port: port})
+				readiness.SetBacking(selector.legKey(selector.legs[len(selector.legs)-1]))
+
+				j := peerTunnel(&result, result[i], room)
+				if j == i {
+					kept = append(kept, leg)
+					legsHere[mapping.String()] = leg
+				} else {
+					result[j].Config.Mappings = append(result[j].Config.Mappings, leg)
+					if result[j].Config.MappingsFile != "" {
+						result[j].Config.inlineMappings = append(result[j].Config.inlineMappings, leg)
+					}
+				}
+			}
+			log.Printf("🛡️  Mapping %s forwards through peers %v (%s)", mapping, mapping.Peers, selector.policyName())
+			selectors = append(selectors, selector)
+		}
+		result[i].Config.Mappings = kept
+		result[i].Config.inlineMappings = replacePeerMappings(result[i].Config.inlineMappings, legsHere)
+	}
+
+	var run []tunnel
+	for i, t := range result {
+		if expanded[i] && len(t.Config.Mappings) == 0 {
+			continue
+		}
+		run = append(run, t)
+	}
+	return run, selectors, nil
+}
+
+// peerTunnel returns the index of the client tunnel registering in room on
+// from's signaling server, adding one configured like from if there is none
+func peerTunnel(tunnels *[]tunnel, from tunnel, room string) int {
+	for i, t := range *tunnels {
+		if t.Config.Mode == "client" && t.Config.RoomID == room && t.Config.SignalingURL == from.Config.SignalingURL {
+			return i
+		}
+	}
+	config := from.Config
+	config.RoomID = room
+	config.Mappings = nil
+	config.inlineMappings = nil
+	config.MappingsFile = ""
+	config.StateFile = "" // The state file belongs to the configured tunnel
+	config.NoInteractive = true
+	*tunnels = append(*tunnels, tunnel{Name: room, Config: config})
+	return len(*tunnels) - 1
+}
+
+// replacePeerMappings replaces the mappings with peers among inline
+// mappings by their leg in the same tunnel, if any, so a mappingsFile
+// reload keeps the legs and never registers a mapping with peers as is
+func replacePeerMappings(mappings []PortMapping, legs map[string]PortMapping) []PortMapping {
+	var result []PortMapping
+	for _, mapping := range mappings {
+		if len(mapping.Peers) == 0 {
+			result = append(result, mapping)
+		} else if leg, ok := legs[mapping.String()]; ok {
+			result = append(result, leg)
+		}
+	}
+	return result
+}
+
+// policyName returns the failover policy in effect
+func (ps *PeerSelector) policyName() string {
+	if ps.policy == "" {
+		return PeerFailoverPreferFirst
+	}
+	return ps.policy
+}
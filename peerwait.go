@@ -0,0 +1,33 @@
+// Package main - How long each side waits for the other to register
+package main
+
+import "time"
+
+// defaultClientWaitTimeout is how long the server waits for a client to
+// register unless peerWaitTimeout is set
+const defaultClientWaitTimeout = 60 * time.Second
+
+// peerWaitPoll is how long each wait for peer data lasts when waiting
+// indefinitely, so the wait reports that it is still going
+const peerWaitPoll = 60 * time.Second
+
+// peerWait returns the configured peerWaitTimeout; set is false when it is
+// unset and the caller's default applies. A set timeout of 0 waits
+// indefinitely.
+func (c Configuration) peerWait() (timeout time.Duration, set bool) {
+	if c.PeerWaitTimeout == nil {
+		return 0, false
+	}
+	return time.Duration(*c.PeerWaitTimeout), true
+}
+
+// peerWaitOver reports whether a wait for the peer started at start should
+// give up after attempt: once peerWaitTimeout has passed, never with a
+// timeout of 0, and after defaultAttempts when it is unset
+func (c Configuration) peerWaitOver(start time.Time, attempt, defaultAttempts int) bool {
+	timeout, set := c.peerWait()
+	if !set {
+		return attempt >= defaultAttempts
+	}
+	return timeout > 0 && time.Since(start) >= timeout
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+// Package main - Finding the process holding a port through /proc
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListenState is the st column of a listening socket in /proc/net/tcp
+const tcpListenState = "0A"
+
+// portHolder returns the process holding protocol port, "" when it cannot
+// be found, e.g. because the holder belongs to another user
+func portHolder(protocol string, port int) string {
+	inodes := socketInodes(protocol, port)
+	if len(inodes) == 0 {
+		return ""
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return ""
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !inodes[link] {
+				continue
+			}
+			comm, _ := os.ReadFile(filepath.Join("/proc", proc.Name(), "comm"))
+			return fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid)
+		}
+	}
+	return ""
+}
+
+// socketInodes returns the inodes of the sockets bound to protocol port, as
+// fd link targets "socket:[inode]". TCP sockets count only when listening.
+func socketInodes(protocol string, port int) map[string]bool {
+	inodes := make(map[string]bool)
+	suffix := fmt.Sprintf(":%04X", port)
+	for _, table := range []string{protocol, protocol + "6"} {
+		file, err := os.Open(filepath.Join("/proc/net", table))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // Header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || !strings.HasSuffix(fields[1], suffix) {
+				continue
+			}
+			if protocol == "tcp" && fields[3] != tcpListenState {
+				continue
+			}
+			inodes["socket:["+fields[9]+"]"] = true
+		}
+		file.Close()
+	}
+	return inodes
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+// Package main - Finding the process holding a port with lsof
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// portHolder returns the process holding protocol port as lsof reports it,
+// "" where lsof is missing or finds none
+func portHolder(protocol string, port int) string {
+	args := []string{"-nP", "-F", "pc", "-i", fmt.Sprintf("%s:%d", strings.ToUpper(protocol), port)}
+	if protocol == "tcp" {
+		args = append(args, "-sTCP:LISTEN")
+	}
+	out, err := exec.Command("lsof", args...).Output()
+	if err != nil {
+		return ""
+	}
+	// Fields come one per line, tagged by their first character
+	var pid int
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p"):
+			pid, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "c") && pid > 0:
+			return fmt.Sprintf("%s (pid %d)", line[1:], pid)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+// Package main - Reporting local ports held by another process
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrPortInUse is returned when a forwarder's port is bound by another
+// socket. Holder names the process holding it where the platform tells,
+// e.g. "nginx (pid 812)".
+type ErrPortInUse struct {
+	Protocol string
+	Port     int
+	Holder   string
+	Err      error
+}
+
+// Error describes the port and its holder
+func (e *ErrPortInUse) Error() string {
+	if e.Holder != "" {
+		return fmt.Sprintf("%s port %d is already in use by %s", e.Protocol, e.Port, e.Holder)
+	}
+	return fmt.Sprintf("%s port %d is already in use", e.Protocol, e.Port)
+}
+
+// Unwrap returns the bind error
+func (e *ErrPortInUse) Unwrap() error {
+	return e.Err
+}
+
+// portInUse turns an EADDRINUSE from binding protocol port into an
+// ErrPortInUse naming the holder; other errors are returned as they are
+func portInUse(err error, protocol string, port int) error {
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		return err
+	}
+	return &ErrPortInUse{Protocol: protocol, Port: port, Holder: portHolder(protocol, port), Err: err}
+}
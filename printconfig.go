@@ -0,0 +1,110 @@
+// Package main - Printing the effective configuration for -print-config
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// effectiveConfig returns config with the defaults the process applies made
+// explicit, so the printed configuration shows the values actually in use.
+// It runs after main has applied the configuration to the globals.
+func effectiveConfig(config Configuration) Configuration {
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.STUNDNSTTL == 0 {
+		config.STUNDNSTTL = Duration(defaultSTUNDNSTTL)
+	}
+	config.ConnectTimeout = Duration(connectTimeout)
+	config.LogSummaryInterval = Duration(logSummaryInterval)
+	if config.AllocationConcurrency == 0 {
+		config.AllocationConcurrency = defaultAllocationConcurrency
+	}
+	config.LocalDialBackoff = Duration(localDialBackoff)
+	config.ServiceFallbackDelay = Duration(serviceFallbackDelay)
+	if config.AffinityWindow == 0 {
+		config.AffinityWindow = Duration(defaultAffinityWindow)
+	}
+	config.UDPQueueDepth = udpQueueDepth
+	config.UDPQueuePolicy = udpQueuePolicy
+	config.HolePunchStrategies = holePunchStrategies
+	if config.MaxSignalingResponseSize <= 0 {
+		config.MaxSignalingResponseSize = defaultMaxSignalingResponseSize
+	}
+	if config.SignalingAuthFailurePolicy == "" {
+		config.SignalingAuthFailurePolicy = SignalingAuthAbort
+	}
+	noDelay, keepAlive := tcpSocketOptions.NoDelay, tcpSocketOptions.KeepAlive
+	config.TCPNoDelay = &noDelay
+	config.TCPKeepAlive = &keepAlive
+	config.TCPKeepAliveInterval = Duration(tcpSocketOptions.KeepAliveInterval)
+	for i := range config.Mappings {
+		if config.Mappings[i].ConnectTimeout == 0 {
+			config.Mappings[i].ConnectTimeout = Duration(connectTimeout)
+		}
+		if config.Mappings[i].transport() == "udp" {
+			config.Mappings[i].UDPResponseTimeout = Duration(config.Mappings[i].udpSessionTimeout())
+			if config.Mappings[i].UDPSessionKey == "" {
+				config.Mappings[i].UDPSessionKey = UDPSessionKeyFull5Tuple
+			}
+		}
+	}
+	return config
+}
+
+// redactedConfig converts config to a generic YAML value with secrets
+// redacted: sensitive keys and URL query strings as in debug logs, and the
+// room ID shortened as it grants access to the room
+func redactedConfig(config Configuration) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	redactValue(value)
+	if roomID, ok := value["roomId"].(string); ok && roomID != "" {
+		value["roomId"] = redactSecret(roomID)
+	}
+	return value, nil
+}
+
+// printEffectiveConfig writes the resolved configuration as YAML: secret
+// references expanded, the mappingsFile merged, defaults filled in and, for
+// a 'tunnels' list, every tunnel with the settings it inherits
+func printEffectiveConfig(w io.Writer, config Configuration, tunnels []tunnel) error {
+	var output interface{}
+	if len(config.Tunnels) == 0 {
+		config, err := redactedConfig(effectiveConfig(tunnels[0].Config))
+		if err != nil {
+			return err
+		}
+		output = config
+	} else {
+		list := make([]map[string]interface{}, 0, len(tunnels))
+		for _, t := range tunnels {
+			config, err := redactedConfig(effectiveConfig(t.Config))
+			if err != nil {
+				return fmt.Errorf("tunnel %q: %w", t.Name, err)
+			}
+			config["name"] = t.Name
+			if t.Name == t.Config.RoomID {
+				config["name"] = config["roomId"] // Defaulted to the room ID
+			}
+			list = append(list, config)
+		}
+		output = map[string]interface{}{"tunnels": list}
+	}
+
+	data, err := yaml.Marshal(output)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
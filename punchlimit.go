@@ -0,0 +1,41 @@
+// Package main - Limit on concurrent hole punching attempts
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// punchSlots holds a token for each hole punching attempt in flight, nil
+// when maxConcurrentPunches leaves them unlimited
+var punchSlots chan struct{}
+
+// setMaxConcurrentPunches limits the hole punching attempts in flight at
+// once to limit, 0 leaving them unlimited
+func setMaxConcurrentPunches(limit int) {
+	if limit == 0 {
+		punchSlots = nil
+		return
+	}
+	punchSlots = make(chan struct{}, limit)
+}
+
+// acquirePunchSlot waits until another hole punching attempt may start and
+// returns the function that ends it, or ctx's error if ctx ends first
+func acquirePunchSlot(ctx context.Context, label string) (func(), error) {
+	slots := punchSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("⏳ Hole punching for %s waits for one of %d punches in flight", label, cap(slots))
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
@@ -0,0 +1,142 @@
+// Package main - Hole punching retries from fresh NAT mappings
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// punchExchangeTimeout bounds the wait for the peer's fresh addresses
+const punchExchangeTimeout = 30 * time.Second
+
+// holePunchRetries is how many times a failed punch is retried from a fresh
+// local port before falling back to the relay
+var holePunchRetries int
+
+// punchExchangeKey carries the punchExchange of a tunnel in a context
+type punchExchangeKey struct{}
+
+// punchExchange swaps fresh hole punching addresses with the peer through
+// the signaling server, in a room of its own per punch and retry
+type punchExchange struct {
+	client     *SignalingClient
+	url        string
+	room       string
+	role       string // Our slot in the exchange rooms
+	peerRole   string // The peer's slot
+	stunServer string
+}
+
+// withPunchExchange lets hole punching under ctx retry through ex
+func withPunchExchange(ctx context.Context, ex *punchExchange) context.Context {
+	return context.WithValue(ctx, punchExchangeKey{}, ex)
+}
+
+// punchExchangeFrom returns the punchExchange carried by ctx, nil if there
+// is none
+func punchExchangeFrom(ctx context.Context) *punchExchange {
+	ex, _ := ctx.Value(punchExchangeKey{}).(*punchExchange)
+	return ex
+}
+
+// punchAddrs are the addresses peers swap before a retry
+type punchAddrs struct {
+	PublicAddr  string `json:"publicAddr"`
+	PrivateAddr string `json:"privateAddr"`
+}
+
+// newPunchExchange returns the exchange of a tunnel in config's room, where
+// we post in role and the peer in peerRole
+func newPunchExchange(client *SignalingClient, config Configuration, role, peerRole string) *punchExchange {
+	return &punchExchange{
+		client:     client,
+		url:        config.SignalingURL,
+		room:       config.RoomID,
+		role:       role,
+		peerRole:   peerRole,
+		stunServer: config.STUNServer,
+	}
+}
+
+// udpPunchLabel names the punch of a UDP mapping by its allocated port,
+// which both peers know
+func udpPunchLabel(allocatedPort int) string {
+	return "udp" + strconv.Itoa(allocatedPort)
+}
+
+// exchangeRoom is the signaling room of one retry of the punch named label
+func (ex *punchExchange) exchangeRoom(label string, attempt int) string {
+	return fmt.Sprintf("%s-punch-%s-%d", ex.room, label, attempt)
+}
+
+// refresh discovers a fresh reflexive address from a new local port on
+// network, "udp4" to stay off IPv6, and swaps it with the peer's for retry
+// attempt of the punch named label. Both
+// peers post before waiting, so they punch from their fresh addresses at
+// about the same time.
+func (ex *punchExchange) refresh(ctx context.Context, network, label string, attempt int, localInfo, remoteInfo *NetworkInfo) (*NetworkInfo, *NetworkInfo, error) {
+	local, err := freshPunchInfo(localInfo, network, ex.stunServer)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(punchAddrs{PublicAddr: local.PublicAddr, PrivateAddr: local.PrivateAddr})
+	if err != nil {
+		return nil, nil, err
+	}
+	room := ex.exchangeRoom(label, attempt)
+	if err := ex.client.PostSignal(ex.url, ex.role, room, string(data)); err != nil {
+		return nil, nil, err
+	}
+	raw, err := ex.client.WaitForPeerData(ctx, ex.url, ex.peerRole, room, punchExchangeTimeout)
+	if err != nil {
+		ex.clear(label, attempt)
+		return nil, nil, fmt.Errorf("peer did not send fresh addresses: %w", err)
+	}
+	var addrs punchAddrs
+	if err := json.Unmarshal([]byte(raw), &addrs); err != nil || addrs.PublicAddr == "" {
+		ex.clear(label, attempt)
+		return nil, nil, fmt.Errorf("invalid fresh addresses from peer: %q", raw)
+	}
+
+	remote := *remoteInfo
+	remote.PublicAddr = addrs.PublicAddr
+	remote.PrivateAddr = addrs.PrivateAddr
+	defaultLogger.WithComponent("holepunch").Infof("🔁 Retry %d: punching from %s to the peer's fresh address %s",
+		attempt, local.PublicAddr, remote.PublicAddr)
+	return local, &remote, nil
+}
+
+// clear empties our slot of a retry's room once the retry is over, so a
+// later punch reusing the room never reads stale addresses
+func (ex *punchExchange) clear(label string, attempt int) {
+	ex.client.PostSignal(ex.url, ex.role, ex.exchangeRoom(label, attempt), "")
+}
+
+// freshPunchInfo returns localInfo with the reflexive address of a new
+// local port, which gets a NAT mapping the failed attempts never touched.
+// The port is released again and bound by the punch right after.
+func freshPunchInfo(localInfo *NetworkInfo, network, stunServer string) (*NetworkInfo, error) {
+	localAddr := ""
+	if network == "udp4" {
+		localAddr = "0.0.0.0:0"
+	}
+	conn, err := createHolePunchingConn(localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a fresh port: %w", err)
+	}
+	defer conn.Close()
+
+	publicAddr, err := performSTUNDiscoveryOnConnWithNetwork(conn, network, stunServer)
+	if err != nil {
+		return nil, fmt.Errorf("STUN discovery from a fresh port failed: %w", err)
+	}
+	info := *localInfo
+	info.PublicAddr = publicAddr
+	info.HolePunchPort = conn.LocalAddr().(*net.UDPAddr).Port
+	info.HolePunchPortFixed = true
+	return &info, nil
+}
@@ -0,0 +1,297 @@
+// Package main - QUIC transport for TCP mappings over the hole-punched path
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// TransportQUIC carries TCP mappings as QUIC streams over a punched socket
+	TransportQUIC = "quic"
+
+	quicALPN            = "stun-forward"
+	quicKeepAlivePeriod = 15 * time.Second
+	quicMaxIdleTimeout  = 60 * time.Second
+)
+
+// quicConfig returns the QUIC settings shared by both peers. Keep-alives hold
+// the NAT mapping of the punched socket open while streams are idle.
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: quicKeepAlivePeriod,
+		MaxIdleTimeout:  quicMaxIdleTimeout,
+	}
+}
+
+// quicIdentity is the server's ephemeral TLS certificate. Its fingerprint is
+// sent to the client through signaling so the client can pin it.
+type quicIdentity struct {
+	certificate tls.Certificate
+	fingerprint string
+}
+
+// newQUICIdentity generates a self-signed certificate for one server run
+func newQUICIdentity() (*quicIdentity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &quicIdentity{
+		certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		fingerprint: certFingerprint(der),
+	}, nil
+}
+
+// certFingerprint returns the hex SHA-256 of a DER certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// quicClientTLSConfig trusts only the certificate with the given fingerprint
+func quicClientTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		NextProtos:         []string{quicALPN},
+		InsecureSkipVerify: true, // Replaced by the fingerprint pin below
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || certFingerprint(rawCerts[0]) != fingerprint {
+				return errors.New("server certificate does not match signaled fingerprint")
+			}
+			return nil
+		},
+	}
+}
+
+// writeStreamHeader identifies the mapping a stream belongs to by its
+// server-allocated port
+func writeStreamHeader(w io.Writer, mappingID uint16) error {
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], mappingID)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// readStreamHeader reads the mapping ID written by writeStreamHeader
+func readStreamHeader(r io.Reader) (uint16, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(header[:]), nil
+}
+
+// quicStreamConn carries a QUIC stream as a net.Conn, so streams go through
+// proxyTCPConn like any other forwarded connection
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// newQUICStreamConn wraps stream, a stream of conn
+func newQUICStreamConn(conn *quic.Conn, stream *quic.Stream) *quicStreamConn {
+	return &quicStreamConn{Stream: stream, conn: conn}
+}
+
+// Close ends both directions of the stream
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// CloseWrite ends the sending direction, leaving the stream readable
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// runQUICClientWithHolePunching punches a P2P socket, dials the server over
+// QUIC and carries every TCP mapping as QUIC streams
+func runQUICClientWithHolePunching(ctx context.Context, logger *Logger, mappings []ServerPortMapping, fingerprint string, clientInfo, serverInfo *NetworkInfo) error {
+	if fingerprint == "" {
+		return errors.New("server did not offer a QUIC transport")
+	}
+
+	p2pConn, peerAddr, err := establishP2PConnection(ctx, clientInfo, serverInfo, true, TransportQUIC)
+	if err != nil {
+		return fmt.Errorf("failed to establish P2P connection: %w", err)
+	}
+	transport := &quic.Transport{Conn: p2pConn}
+	defer transport.Close()
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, err := transport.Dial(dialCtx, peerAddr, quicClientTLSConfig(fingerprint), quicConfig())
+	cancel()
+	if err != nil {
+		return fmt.Errorf("QUIC handshake failed: %w", err)
+	}
+	defer conn.CloseWithError(0, "shutdown")
+
+	listeners := make([]net.Listener, 0, len(mappings))
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for _, pm := range mappings {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(pm.ClientMapping.LocalPort))
+		if err != nil {
+			return fmt.Errorf("failed to listen on local port %d: %w", pm.ClientMapping.LocalPort, portInUse(err, "tcp", pm.ClientMapping.LocalPort))
+		}
+		listeners = append(listeners, ln)
+	}
+
+	logger.Infof("✅ QUIC transport established with %s, carrying %d TCP mappings", peerAddr, len(mappings))
+	setMappingStates(mappings, false, MappingStateConnected)
+
+	for i, pm := range mappings {
+		go acceptQUICStreams(ctx, mappingLogger(pm.ClientMapping), listeners[i], conn, pm)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-conn.Context().Done():
+		return fmt.Errorf("QUIC connection lost: %w", context.Cause(conn.Context()))
+	}
+}
+
+// acceptQUICStreams opens a QUIC stream of the mapping pm for every local
+// connection on ln
+func acceptQUICStreams(ctx context.Context, logger *Logger, ln net.Listener, conn *quic.Conn, pm ServerPortMapping) {
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(local net.Conn) {
+			stream, err := conn.OpenStreamSync(ctx)
+			if err != nil {
+				logger.LimitedErrorf("Failed to open QUIC stream: %v", err)
+				local.Close()
+				return
+			}
+			if err := writeStreamHeader(stream, uint16(pm.AllocatedPort)); err != nil {
+				logger.Errorf("Failed to write QUIC stream header: %v", err)
+				local.Close()
+				stream.Close()
+				return
+			}
+			mapping := mappingStateKey("tcp", pm.ClientMapping.LocalPort)
+			proxyTCPConn(ctx, logger, mapping, local, newQUICStreamConn(conn, stream), "client->server", "server->client")
+		}(local)
+	}
+}
+
+// runQUICServerWithHolePunching punches a P2P socket, accepts the client's
+// QUIC connection on it and opens a connection to the local service for
+// every stream
+func runQUICServerWithHolePunching(ctx context.Context, logger *Logger, mappings []ServerPortMapping, identity *quicIdentity, clientInfo, serverInfo *NetworkInfo) error {
+	services := make(map[uint16]ServerPortMapping, len(mappings))
+	targets := make(map[uint16]*ServiceTarget, len(mappings))
+	for _, pm := range mappings {
+		services[uint16(pm.AllocatedPort)] = pm
+		targets[uint16(pm.AllocatedPort)] = newServiceTarget(pm.ClientMapping)
+	}
+
+	defer func() {
+		for _, target := range targets {
+			target.Close()
+		}
+	}()
+
+	p2pConn, _, err := establishP2PConnection(ctx, serverInfo, clientInfo, false, TransportQUIC)
+	if err != nil {
+		return fmt.Errorf("failed to establish P2P connection: %w", err)
+	}
+	transport := &quic.Transport{Conn: p2pConn}
+	defer transport.Close()
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{identity.certificate},
+		NextProtos:   []string{quicALPN},
+	}
+	ln, err := transport.Listen(tlsConfig, quicConfig())
+	if err != nil {
+		return fmt.Errorf("failed to listen for QUIC: %w", err)
+	}
+	defer ln.Close()
+
+	acceptCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	conn, err := ln.Accept(acceptCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("no QUIC connection from client: %w", err)
+	}
+	defer conn.CloseWithError(0, "shutdown")
+
+	logger.Infof("✅ QUIC transport established with %s, serving %d TCP mappings", conn.RemoteAddr(), len(mappings))
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("QUIC connection lost: %w", err)
+		}
+
+		go serveQUICStream(ctx, logger, conn, stream, services, targets)
+	}
+}
+
+// serveQUICStream forwards a stream the client opened to the service of the
+// mapping named in its header
+func serveQUICStream(ctx context.Context, logger *Logger, conn *quic.Conn, stream *quic.Stream, services map[uint16]ServerPortMapping, targets map[uint16]*ServiceTarget) {
+	mappingID, err := readStreamHeader(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	pm, ok := services[mappingID]
+	if !ok {
+		logger.Warnf("QUIC stream for unknown mapping %d", mappingID)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+
+	mappingLog := mappingLogger(pm.ClientMapping)
+	local, err := targets[mappingID].Dial("tcp")
+	if err != nil {
+		mappingLog.Errorf("QUIC stream dial local service error: %v", err)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+	mapping := mappingStateKey("tcp", pm.AllocatedPort)
+	proxyTCPConn(ctx, mappingLog, mapping, newQUICStreamConn(conn, stream), local, "client->local", "local->client")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicLoopback connects a client to a server QUIC connection over loopback,
+// with the server serving the streams of mappings
+func quicLoopback(t *testing.T, ctx context.Context, mappings []ServerPortMapping) *quic.Conn {
+	t.Helper()
+	identity, err := newQUICIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{identity.certificate}, NextProtos: []string{quicALPN}}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	services := make(map[uint16]ServerPortMapping)
+	targets := make(map[uint16]*ServiceTarget)
+	for _, pm := range mappings {
+		services[uint16(pm.AllocatedPort)] = pm
+		targets[uint16(pm.AllocatedPort)] = newServiceTarget(pm.ClientMapping)
+	}
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+		for {
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go serveQUICStream(ctx, defaultLogger, conn, stream, services, targets)
+		}
+	}()
+
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), quicClientTLSConfig(identity.fingerprint), quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "done") })
+	return conn
+}
+
+func TestQUICStreamsAccounted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localPort := freeTCPPort(t)
+	pm := ServerPortMapping{
+		ClientMapping: PortMapping{Protocol: "tcp", LocalPort: localPort, RemotePort: startTCPEcho(t)},
+		AllocatedPort: 40000 + localPort%20000,
+	}
+	conn := quicLoopback(t, ctx, []ServerPortMapping{pm})
+	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptQUICStreams(ctx, defaultLogger, ln, conn, pm)
+
+	// One stream warms up the QUIC connection's own goroutines
+	roundTrip := func(i int) {
+		c := dialRetry(t, "127.0.0.1:"+strconv.Itoa(localPort))
+		defer c.Close()
+		msg := "stream " + strconv.Itoa(i)
+		c.Write([]byte(msg))
+		c.(*net.TCPConn).CloseWrite()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(c)
+		if err != nil || string(got) != msg {
+			t.Fatalf("stream %d echoed %q, %v", i, got, err)
+		}
+	}
+	roundTrip(0)
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+	accepted := globalStats.TCPAccepted.Load()
+
+	// An open stream is listed on both ends
+	open := dialRetry(t, "127.0.0.1:"+strconv.Itoa(localPort))
+	open.Write([]byte("x"))
+	open.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(open, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, serverKey := mappingStateKey("tcp", localPort), mappingStateKey("tcp", pm.AllocatedPort)
+	listed := map[string]bool{}
+	for _, c := range activeConns.List() {
+		listed[c.Mapping] = true
+	}
+	if !listed[clientKey] || !listed[serverKey] {
+		t.Errorf("active connections list %v, want %s and %s", listed, clientKey, serverKey)
+	}
+	open.Close()
+
+	for i := 1; i <= 10; i++ {
+		roundTrip(i)
+	}
+	if got := globalStats.TCPAccepted.Load() - accepted; got != 22 {
+		t.Errorf("TCPAccepted grew by %d for 11 streams, want 22", got)
+	}
+
+	// Finished streams leave no goroutines behind
+	waitGoroutines(t, baseline)
+	deadline := time.Now().Add(3 * time.Second)
+	for globalStats.TCPActive.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active := globalStats.TCPActive.Load(); active != 0 {
+		t.Errorf("TCPActive = %d after every stream ended", active)
+	}
+}
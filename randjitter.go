@@ -0,0 +1,42 @@
+// Package main - Randomness of timing jitter, seedable in tests
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Jitter spreads the durations of timers, backoffs and keepalives so that
+// many peers do not fire in lockstep. Each user holds its own instance,
+// time-seeded by default; tests give it NewJitter with a fixed seed, so the
+// spread durations and the timing asserted on them repeat exactly.
+type Jitter interface {
+	// Spread returns d moved by a random amount of up to fraction of d,
+	// either way
+	Spread(d time.Duration, fraction float64) time.Duration
+}
+
+// randJitter is a Jitter drawing from its own seeded source
+type randJitter struct {
+	rng   *rand.Rand
+	mutex sync.Mutex // rand.Rand is not safe for concurrent use
+}
+
+// NewJitter returns a Jitter whose sequence is fixed by seed
+func NewJitter(seed int64) Jitter {
+	return &randJitter{rng: rand.New(rand.NewSource(seed))}
+}
+
+// newJitter returns a time-seeded Jitter
+func newJitter() Jitter {
+	return NewJitter(time.Now().UnixNano())
+}
+
+// Spread returns d moved by up to fraction of d either way, never negative
+func (j *randJitter) Spread(d time.Duration, fraction float64) time.Duration {
+	j.mutex.Lock()
+	offset := (j.rng.Float64()*2 - 1) * fraction * float64(d)
+	j.mutex.Unlock()
+	return max(d+time.Duration(offset), 0)
+}
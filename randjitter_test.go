@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJitterSeedPinsSequence(t *testing.T) {
+	// math/rand keeps the sequence of a seeded source stable across releases
+	want := []time.Duration{949211345, 826400199, 1041637540, 883527482, 817527384}
+	jitter := NewJitter(42)
+	for i, w := range want {
+		if got := jitter.Spread(time.Second, signalingAuthJitter); got != w {
+			t.Errorf("draw %d of seed 42 = %d, want %d", i, got, w)
+		}
+	}
+
+	a, b := NewJitter(7), NewJitter(7)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Spread(time.Minute, 0.5), b.Spread(time.Minute, 0.5); x != y {
+			t.Fatalf("draw %d differs between jitters of one seed: %v, %v", i, x, y)
+		}
+	}
+}
+
+func TestSignalingAuthJitterSpread(t *testing.T) {
+	jitter := NewJitter(1)
+	low, high := time.Second, time.Second
+	for i := 0; i < 10000; i++ {
+		d := jitter.Spread(time.Second, signalingAuthJitter)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("spread %v outside 20%% of 1s", d)
+		}
+		low, high = min(low, d), max(high, d)
+	}
+	// The spread reaches close to both ends
+	if low > 810*time.Millisecond || high < 1190*time.Millisecond {
+		t.Errorf("spread covered %v to %v, want close to 800ms to 1.2s", low, high)
+	}
+
+	if d := jitter.Spread(time.Second, 2); d < 0 {
+		t.Errorf("spread beyond d itself went negative: %v", d)
+	}
+}
+
+// recordingJitter records the durations it is asked to spread and spreads
+// them to nothing, so retries do not wait
+type recordingJitter struct {
+	calls    []time.Duration
+	fraction float64
+}
+
+func (j *recordingJitter) Spread(d time.Duration, fraction float64) time.Duration {
+	j.calls = append(j.calls, d)
+	j.fraction = fraction
+	return 0
+}
+
+func TestSignalingAuthRetryUsesJitter(t *testing.T) {
+	var refusals atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refusals.Add(1) <= 3 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	config := Configuration{SignalingURL: server.URL, SignalingAuthFailurePolicy: SignalingAuthRetry}
+	client := NewSignalingClient(config)
+	jitter := &recordingJitter{}
+	client.jitter = jitter
+	if err := client.PostSignal(server.URL, "client", "room", "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(jitter.calls) != len(want) {
+		t.Fatalf("spread %v, want %v", jitter.calls, want)
+	}
+	for i := range want {
+		if jitter.calls[i] != want[i] {
+			t.Errorf("resend %d spread %v, want %v", i, jitter.calls[i], want[i])
+		}
+	}
+	if jitter.fraction != signalingAuthJitter {
+		t.Errorf("spread by %v, want signalingAuthJitter %v", jitter.fraction, signalingAuthJitter)
+	}
+}
@@ -0,0 +1,75 @@
+// Package main - Redaction of secrets in debug logs
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// redactedValue replaces secret values in logs
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeyParts mark JSON keys whose values are never logged
+var sensitiveKeyParts = []string{"token", "psk", "secret", "password", "passwd", "auth", "credential", "privatekey"}
+
+// isSensitiveKey reports whether a JSON key names a secret
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecret keeps only enough of a secret such as the room key to tell
+// rooms apart in logs
+func redactSecret(s string) string {
+	if len(s) <= 4 {
+		return redactedValue
+	}
+	return s[:2] + "…" + redactedValue
+}
+
+// redactPayload returns a signaling payload safe to log: JSON payloads have
+// sensitive fields and URL query strings replaced, anything else is reduced
+// to its length
+func redactPayload(data string) string {
+	var payload interface{}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		if strings.Contains(data, "|") && !strings.HasPrefix(data, "{") {
+			return data // Legacy "public|private" network info holds no secrets
+		}
+		return "[unparsed payload]"
+	}
+	redacted, err := json.Marshal(redactValue(payload))
+	if err != nil {
+		return "[unparsed payload]"
+	}
+	return string(redacted)
+}
+
+// redactValue walks a decoded JSON value, redacting sensitive fields
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if isSensitiveKey(key) {
+				value[key] = redactedValue
+				continue
+			}
+			value[key] = redactValue(field)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(item)
+		}
+	case string:
+		// Credentials in URLs, e.g. ?token=..., are dropped with the query
+		if i := strings.Index(value, "?"); i >= 0 && strings.Contains(value, "://") {
+			return value[:i] + "?" + redactedValue
+		}
+	}
+	return v
+}
@@ -0,0 +1,376 @@
+// Package main - Framing of multiple sessions over one relay connection
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relay frame layout (sessions share one relay connection):
+//
+//	0      1      2                           6              8
+//	+------+------+---------------------------+--------------+-------------
+//	| 0xA8 | type | session ID                | length       | payload ...
+//	+------+------+---------------------------+--------------+-------------
+//
+// The session ID is chosen by the side that opens the session with an open
+// frame. Data frames carry one write or datagram of the session, so datagram
+// boundaries survive the relay. An end frame half-closes the session: its
+// sender sends no more data but still reads. A close frame ends the session
+// on both sides; data for a session that is not open is answered with one.
+// Open, end and close frames have no payload. The length makes frames
+// self-delimiting on stream connections; on datagram connections it must
+// match the rest of the datagram.
+//
+// Only relayed connections are framed, and only for mappings with relayMux:
+// QUIC streams and hole-punched paths carry one session per socket and stay
+// frame-free.
+const (
+	relayFrameMagic     byte = 0xA8
+	relayFrameData      byte = 1
+	relayFrameClose     byte = 2
+	relayFrameOpen      byte = 3
+	relayFrameEnd       byte = 4
+	relayHeaderSize          = 8
+	relayMaxPayloadSize      = 0xFFFF
+)
+
+// errNotRelayFrame is returned for data that does not start with a relay
+// frame header
+var errNotRelayFrame = errors.New("not a relay frame")
+
+// errRelayClosed is read from sessions whose relay connection ended
+var errRelayClosed = errors.New("relay connection closed")
+
+// relayFrame is one decoded frame
+type relayFrame struct {
+	frameType byte
+	sessionID uint32
+	payload   []byte
+}
+
+// encodeRelayFrame writes a frame into buf and returns the encoded slice
+func encodeRelayFrame(buf []byte, frameType byte, sessionID uint32, payload []byte) ([]byte, error) {
+	if len(payload) > relayMaxPayloadSize || relayHeaderSize+len(payload) > len(buf) {
+		return nil, fmt.Errorf("relay payload of %d bytes too large", len(payload))
+	}
+	buf[0] = relayFrameMagic
+	buf[1] = frameType
+	binary.BigEndian.PutUint32(buf[2:6], sessionID)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(payload)))
+	n := copy(buf[relayHeaderSize:], payload)
+	return buf[:relayHeaderSize+n], nil
+}
+
+// decodeRelayFrame decodes a frame received as one datagram. The payload
+// shares frame's memory.
+func decodeRelayFrame(frame []byte) (relayFrame, error) {
+	if len(frame) < relayHeaderSize || frame[0] != relayFrameMagic {
+		return relayFrame{}, errNotRelayFrame
+	}
+	length := int(binary.BigEndian.Uint16(frame[6:8]))
+	if length != len(frame)-relayHeaderSize {
+		return relayFrame{}, fmt.Errorf("relay frame length %d does not match its %d payload bytes", length, len(frame)-relayHeaderSize)
+	}
+	return relayFrame{
+		frameType: frame[1],
+		sessionID: binary.BigEndian.Uint32(frame[2:6]),
+		payload:   frame[relayHeaderSize:],
+	}, nil
+}
+
+// readRelayFrame reads the next frame from a stream into buf, which must
+// hold relayHeaderSize+relayMaxPayloadSize bytes. The payload shares buf's
+// memory until the next read.
+func readRelayFrame(r io.Reader, buf []byte) (relayFrame, error) {
+	if _, err := io.ReadFull(r, buf[:relayHeaderSize]); err != nil {
+		return relayFrame{}, err
+	}
+	if buf[0] != relayFrameMagic {
+		return relayFrame{}, errNotRelayFrame
+	}
+	length := int(binary.BigEndian.Uint16(buf[6:8]))
+	if _, err := io.ReadFull(r, buf[relayHeaderSize:relayHeaderSize+length]); err != nil {
+		return relayFrame{}, err
+	}
+	return decodeRelayFrame(buf[:relayHeaderSize+length])
+}
+
+// relayDemux carries sessions over one framed relay connection. Sessions
+// the other side opens are handed to accept; open starts one from this side.
+// Payloads are handed to a session as it reads them, so a session that stops
+// reading holds up the others until it is closed.
+type relayDemux struct {
+	conn     net.Conn               // Framed relay connection
+	accept   func(session net.Conn) // Serves a session the other side opened, nil to refuse them
+	logger   *Logger
+	sessions map[uint32]*relaySession
+	nextID   uint32
+	mutex    sync.Mutex
+	writeMu  sync.Mutex    // Keeps frames of concurrent sessions whole
+	done     chan struct{} // Closed once run returned
+}
+
+// newRelayDemux returns a demultiplexer of conn whose incoming sessions are
+// served by accept, each in a goroutine of its own
+func newRelayDemux(conn net.Conn, logger *Logger, accept func(session net.Conn)) *relayDemux {
+	return &relayDemux{
+		conn:     conn,
+		accept:   accept,
+		logger:   logger,
+		sessions: make(map[uint32]*relaySession),
+		done:     make(chan struct{}),
+	}
+}
+
+// run dispatches frames until the relay connection fails or ctx is
+// cancelled, then closes every session
+func (d *relayDemux) run(ctx context.Context) error {
+	defer close(d.done)
+	defer d.closeAll()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-d.done:
+		}
+		d.conn.Close()
+	}()
+
+	buf := make([]byte, relayHeaderSize+relayMaxPayloadSize)
+	for {
+		frame, err := readRelayFrame(d.conn, buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		d.mutex.Lock()
+		session := d.sessions[frame.sessionID]
+		d.mutex.Unlock()
+		switch frame.frameType {
+		case relayFrameOpen:
+			if session != nil || d.accept == nil {
+				d.send(relayFrameClose, frame.sessionID, nil)
+				continue
+			}
+			session = d.newSession(frame.sessionID)
+			go d.accept(session)
+		case relayFrameData:
+			if session == nil {
+				d.send(relayFrameClose, frame.sessionID, nil)
+				continue
+			}
+			// Fails only once the session closed itself
+			session.inWriter.Write(frame.payload)
+		case relayFrameEnd:
+			if session != nil {
+				session.inWriter.Close()
+			}
+		case relayFrameClose:
+			if session != nil && d.remove(session) {
+				session.inWriter.CloseWithError(io.EOF)
+			}
+		}
+	}
+}
+
+// Done returns a channel closed once the relay connection ended
+func (d *relayDemux) Done() <-chan struct{} {
+	return d.done
+}
+
+// open starts a session from this side
+func (d *relayDemux) open() (net.Conn, error) {
+	d.mutex.Lock()
+	d.nextID++
+	id := d.nextID
+	d.mutex.Unlock()
+
+	session := d.newSession(id)
+	if err := d.send(relayFrameOpen, id, nil); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// newSession registers the session id
+func (d *relayDemux) newSession(id uint32) *relaySession {
+	reader, writer := io.Pipe()
+	session := &relaySession{demux: d, id: id, in: reader, inWriter: writer}
+	d.mutex.Lock()
+	d.sessions[id] = session
+	d.mutex.Unlock()
+	return session
+}
+
+// remove unregisters a session, reporting false when it was gone already
+func (d *relayDemux) remove(session *relaySession) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.sessions[session.id] != session {
+		return false
+	}
+	delete(d.sessions, session.id)
+	return true
+}
+
+// send writes one frame to the relay connection
+func (d *relayDemux) send(frameType byte, sessionID uint32, payload []byte) error {
+	buf := make([]byte, relayHeaderSize+len(payload))
+	frame, err := encodeRelayFrame(buf, frameType, sessionID, payload)
+	if err != nil {
+		return err
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, err = d.conn.Write(frame)
+	return err
+}
+
+// closeAll closes every session
+func (d *relayDemux) closeAll() {
+	d.mutex.Lock()
+	sessions := d.sessions
+	d.sessions = make(map[uint32]*relaySession)
+	d.mutex.Unlock()
+	for _, session := range sessions {
+		session.inWriter.CloseWithError(errRelayClosed)
+	}
+}
+
+// relaySession is one session of a relay connection, used like the TCP
+// connection it stands for
+type relaySession struct {
+	demux    *relayDemux
+	id       uint32
+	in       *io.PipeReader // Payloads the other side sent
+	inWriter *io.PipeWriter
+}
+
+// Read reads what the other side sent, returning io.EOF once it ended the
+// session
+func (s *relaySession) Read(p []byte) (int, error) {
+	n, err := s.in.Read(p)
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// Write sends p to the other side in frames of up to relayMaxPayloadSize
+func (s *relaySession) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.demux.mutex.Lock()
+		open := s.demux.sessions[s.id] == s
+		s.demux.mutex.Unlock()
+		if !open {
+			return written, net.ErrClosed
+		}
+		n := min(len(p)-written, relayMaxPayloadSize)
+		if err := s.demux.send(relayFrameData, s.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the other side no more data follows, so it sees the end
+// of the stream while still sending
+func (s *relaySession) CloseWrite() error {
+	return s.demux.send(relayFrameEnd, s.id, nil)
+}
+
+// Close ends the session on both sides
+func (s *relaySession) Close() error {
+	if !s.demux.remove(s) {
+		return nil
+	}
+	// Also unblocks a payload waiting to be read
+	s.in.CloseWithError(net.ErrClosed)
+	return s.demux.send(relayFrameClose, s.id, nil)
+}
+
+// LocalAddr returns the local address of the relay connection
+func (s *relaySession) LocalAddr() net.Addr { return s.demux.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the relay connection
+func (s *relaySession) RemoteAddr() net.Addr { return s.demux.conn.RemoteAddr() }
+
+// SetDeadline is not supported on relay sessions
+func (s *relaySession) SetDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// SetReadDeadline is not supported on relay sessions
+func (s *relaySession) SetReadDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// SetWriteDeadline is not supported on relay sessions
+func (s *relaySession) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// relayMuxClient carries the connections accepted on a relayMux mapping's
+// local port as sessions of one relay connection to the server, dialed for
+// the first connection and again once it failed
+type relayMuxClient struct {
+	dial   func() (net.Conn, error)
+	logger *Logger
+	demux  *relayDemux
+	mutex  sync.Mutex
+}
+
+// open returns a new session to the server
+func (c *relayMuxClient) open(ctx context.Context) (net.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.demux != nil {
+		select {
+		case <-c.demux.Done():
+			c.demux = nil
+		default:
+		}
+	}
+	if c.demux == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		applyTCPSocketOptions(conn)
+		c.demux = newRelayDemux(conn, c.logger, nil)
+		go func(demux *relayDemux) {
+			if err := demux.run(ctx); err != nil {
+				c.logger.LimitedErrorf("Relay connection failed: %v", err)
+			}
+		}(c.demux)
+	}
+	return c.demux.open()
+}
+
+// serveRelayMux serves the sessions of a relay connection a client opened to
+// a relayMux mapping, forwarding each one to service
+func serveRelayMux(ctx context.Context, logger *Logger, mapping string, conn net.Conn, service *ServiceTarget) {
+	applyTCPSocketOptions(conn)
+	demux := newRelayDemux(conn, logger, func(session net.Conn) {
+		if serverDrain.Draining() {
+			session.Close()
+			return
+		}
+		local, err := service.Dial("tcp")
+		if err != nil {
+			logger.LimitedErrorf("TCP server dial local service error: %v", err)
+			session.Close()
+			return
+		}
+		proxyTCPConn(ctx, logger, mapping, session, local, "client->local", "local->client")
+	})
+	if err := demux.run(ctx); err != nil {
+		logger.LimitedErrorf("Relay connection from %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
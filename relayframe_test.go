@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRelayFrameRoundTrip(t *testing.T) {
+	payload := []byte("hello relay")
+	buf := make([]byte, relayHeaderSize+relayMaxPayloadSize)
+	encoded, err := encodeRelayFrame(buf, relayFrameData, 0xDEADBEEF, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) != relayHeaderSize+len(payload) {
+		t.Fatalf("encoded %d bytes, want %d", len(encoded), relayHeaderSize+len(payload))
+	}
+
+	frame, err := decodeRelayFrame(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.frameType != relayFrameData || frame.sessionID != 0xDEADBEEF || !bytes.Equal(frame.payload, payload) {
+		t.Errorf("decoded %+v", frame)
+	}
+
+	// Streams carry frames back to back
+	var stream bytes.Buffer
+	stream.Write(encoded)
+	closing, _ := encodeRelayFrame(make([]byte, relayHeaderSize), relayFrameClose, 7, nil)
+	stream.Write(closing)
+	for _, want := range []relayFrame{{relayFrameData, 0xDEADBEEF, payload}, {relayFrameClose, 7, nil}} {
+		frame, err := readRelayFrame(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.frameType != want.frameType || frame.sessionID != want.sessionID || !bytes.Equal(frame.payload, want.payload) {
+			t.Errorf("read %+v, want %+v", frame, want)
+		}
+	}
+}
+
+func TestRelayFrameTooLarge(t *testing.T) {
+	buf := make([]byte, relayHeaderSize+relayMaxPayloadSize+1)
+	if _, err := encodeRelayFrame(buf, relayFrameData, 1, make([]byte, relayMaxPayloadSize+1)); err == nil {
+		t.Error("payload beyond relayMaxPayloadSize encoded")
+	}
+	if _, err := encodeRelayFrame(make([]byte, relayHeaderSize+2), relayFrameData, 1, []byte("abc")); err == nil {
+		t.Error("frame larger than its buffer encoded")
+	}
+}
+
+func TestRelayFrameTruncated(t *testing.T) {
+	buf := make([]byte, relayHeaderSize+relayMaxPayloadSize)
+	encoded, _ := encodeRelayFrame(buf, relayFrameData, 1, []byte("payload"))
+	encoded = append([]byte(nil), encoded...)
+
+	if _, err := decodeRelayFrame(encoded[:relayHeaderSize-1]); !errors.Is(err, errNotRelayFrame) {
+		t.Errorf("short header: got %v, want errNotRelayFrame", err)
+	}
+	if _, err := decodeRelayFrame(encoded[:len(encoded)-1]); err == nil {
+		t.Error("datagram shorter than its length decoded")
+	}
+	garbage := append([]byte{0x00}, encoded[1:]...)
+	if _, err := decodeRelayFrame(garbage); !errors.Is(err, errNotRelayFrame) {
+		t.Errorf("bad magic: got %v, want errNotRelayFrame", err)
+	}
+
+	readBuf := make([]byte, relayHeaderSize+relayMaxPayloadSize)
+	if _, err := readRelayFrame(bytes.NewReader(encoded[:len(encoded)-3]), readBuf); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("stream cut in the payload: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := readRelayFrame(bytes.NewReader(encoded[:3]), readBuf); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("stream cut in the header: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// echoSessions serves every session by echoing what it reads, prefixed
+// with tag, until the client half-closes
+func echoSessions(tag string) func(net.Conn) {
+	return func(session net.Conn) {
+		defer session.Close()
+		data, err := io.ReadAll(session)
+		if err != nil {
+			return
+		}
+		session.Write(append([]byte(tag), data...))
+	}
+}
+
+func TestRelayDemuxTwoSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientEnd, serverEnd := net.Pipe()
+	server := newRelayDemux(serverEnd, defaultLogger, echoSessions("echo:"))
+	client := newRelayDemux(clientEnd, defaultLogger, nil)
+	go server.run(ctx)
+	go client.run(ctx)
+
+	first, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interleave the writes of both sessions
+	first.Write([]byte("one-"))
+	second.Write([]byte("two-"))
+	first.Write([]byte("a"))
+	second.Write([]byte("b"))
+	first.(*relaySession).CloseWrite()
+	second.(*relaySession).CloseWrite()
+
+	// Sessions are read concurrently, as the forwarders do: an unread
+	// payload holds up the relay connection
+	results := make(chan string, 2)
+	for _, session := range []net.Conn{first, second} {
+		go func(session net.Conn) {
+			defer session.Close()
+			got, err := io.ReadAll(session)
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- string(got)
+		}(session)
+	}
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["echo:one-a"] || !got["echo:two-b"] {
+		t.Errorf("sessions read %v, want echo:one-a and echo:two-b", got)
+	}
+}
+
+func TestRelayDemuxRefusesUnknownSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientEnd, serverEnd := net.Pipe()
+	client := newRelayDemux(clientEnd, defaultLogger, nil)
+	go client.run(ctx)
+
+	// The client accepts no sessions and answers data of unknown ones with
+	// a close frame
+	buf := make([]byte, relayHeaderSize+relayMaxPayloadSize)
+	for _, frameType := range []byte{relayFrameOpen, relayFrameData} {
+		frame, _ := encodeRelayFrame(make([]byte, relayHeaderSize+1), frameType, 42, []byte("x")[:min(int(frameType-relayFrameOpen), 1)])
+		go serverEnd.Write(frame)
+		reply, err := readRelayFrame(serverEnd, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.frameType != relayFrameClose || reply.sessionID != 42 {
+			t.Errorf("frame type %d answered with %+v, want a close of session 42", frameType, reply)
+		}
+	}
+}
+
+func TestRelayDemuxEndsSessionsWithConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientEnd, serverEnd := net.Pipe()
+	client := newRelayDemux(clientEnd, defaultLogger, nil)
+	go client.run(ctx)
+	go io.Copy(io.Discard, serverEnd)
+
+	session, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEnd.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("demux still running after its connection closed")
+	}
+	if _, err := session.Read(make([]byte, 1)); !errors.Is(err, errRelayClosed) {
+		t.Errorf("read after the relay closed: got %v, want errRelayClosed", err)
+	}
+	if _, err := session.Write([]byte("x")); err == nil {
+		t.Error("write after the relay closed succeeded")
+	}
+}
+
+func TestRelayMuxForwarding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Echo service behind the server
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	serverLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPort := serverLn.Addr().(*net.TCPAddr).Port
+	service := newServiceTarget(PortMapping{Protocol: "tcp", RemotePort: echo.Addr().(*net.TCPAddr).Port})
+	go serveTCPServer(ctx, defaultLogger, serverLn, service, false, true)
+
+	localPort := freeTCPPort(t)
+	go runTCPClient(ctx, defaultLogger, localPort, "127.0.0.1", serverPort, false, true, time.Second)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn := dialRetry(t, "127.0.0.1:"+strconv.Itoa(localPort))
+		defer conn.Close()
+		conn.Write([]byte("message " + strconv.Itoa(i)))
+		conns = append(conns, conn)
+	}
+
+	// Every local connection is a session of one relay connection
+	deadline := time.Now().Add(3 * time.Second)
+	for len(serverSessions(serverPort)) < len(conns) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessions := serverSessions(serverPort)
+	if len(sessions) != len(conns) {
+		t.Fatalf("server forwards %d sessions, want %d", len(sessions), len(conns))
+	}
+	for _, remote := range sessions[1:] {
+		if remote != sessions[0] {
+			t.Errorf("sessions arrived from %v, want one relay connection", sessions)
+			break
+		}
+	}
+
+	for i, conn := range conns {
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "message " + strconv.Itoa(i); string(got) != want {
+			t.Errorf("connection %d read %q, want %q", i, got, want)
+		}
+	}
+}
+
+// serverSessions returns the client address of each connection the server
+// forwards from port
+func serverSessions(port int) []string {
+	var remotes []string
+	for _, conn := range activeConns.List() {
+		if conn.Mapping == mappingStateKey("tcp", port) {
+			remotes = append(remotes, conn.Remote)
+		}
+	}
+	return remotes
+}
+
+// freeTCPPort returns a loopback TCP port that was free a moment ago
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// dialRetry dials addr until a listener accepts
+func dialRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,76 @@
+// Package main - Explanation of why a mapping falls back to relay
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// punchAttempt records how one hole punching strategy ended
+type punchAttempt struct {
+	strategy string
+	err      error // Nil when the strategy did not apply
+}
+
+// punchStrategiesError is returned when every hole punching strategy
+// failed, keeping what each one ran into
+type punchStrategiesError struct {
+	attempts []punchAttempt
+}
+
+// Error returns the error message
+func (e *punchStrategiesError) Error() string {
+	return "all synchronized hole punching strategies failed"
+}
+
+// outcomes describes each strategy's outcome in the order they ran
+func (e *punchStrategiesError) outcomes() string {
+	if len(e.attempts) == 0 {
+		return "no strategy ran"
+	}
+	outcomes := make([]string, 0, len(e.attempts))
+	for _, attempt := range e.attempts {
+		if attempt.err == nil {
+			outcomes = append(outcomes, attempt.strategy+": not applicable")
+			continue
+		}
+		outcomes = append(outcomes, fmt.Sprintf("%s: %v", attempt.strategy, attempt.err))
+	}
+	return strings.Join(outcomes, ", ")
+}
+
+// natDescription describes one side's NAT as seen by STUN
+func natDescription(side string, info *NetworkInfo) string {
+	if info == nil || info.STUNResult == nil {
+		return side + " NAT unknown (no STUN result)"
+	}
+	punch := "can hole punch"
+	if !info.STUNResult.CanHolePunch {
+		punch = "cannot hole punch"
+	}
+	return fmt.Sprintf("%s NAT %s (%s)", side, info.STUNResult.NATType, punch)
+}
+
+// relayExplanation explains why a mapping is relayed, combining both peers'
+// NAT types with what hole punching ran into. err is nil when punching was
+// not tried because a NAT rules it out.
+func relayExplanation(localInfo, remoteInfo *NetworkInfo, err error) string {
+	var b strings.Builder
+	b.WriteString("Relaying: ")
+	b.WriteString(natDescription("local", localInfo))
+	b.WriteString(", ")
+	b.WriteString(natDescription("server", remoteInfo))
+	if err == nil {
+		b.WriteString("; hole punching not tried")
+		return b.String()
+	}
+
+	var strategies *punchStrategiesError
+	if errors.As(err, &strategies) {
+		fmt.Fprintf(&b, "; hole punching failed: %s", strategies.outcomes())
+	} else {
+		fmt.Fprintf(&b, "; hole punching failed: %v", err)
+	}
+	return b.String()
+}
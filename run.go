@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -23,97 +24,268 @@ func peerRole(mode string) string {
 	return "client"
 }
 
-// runForwarder starts the P2P port forwarding system
-func runForwarder(config Configuration) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	
+// shutdownTimeout bounds how long components get to stop on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// runForwarder starts the P2P port forwarding system with every tunnel of
+// the configuration
+func runForwarder(config Configuration, tunnels []tunnel) {
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	
+	watchLogLevelSignals(defaultLogger.Level())
+
+	// Components are stopped in reverse order: the mode runner (forwarders and
+	// watchers) stops before the signaling client it posts through is closed
+	supervisor := NewSupervisor()
+	if config.StatusListen != "" {
+		// Registered first so it is stopped last and answers during shutdown
+		supervisor.Register(statusServerComponent(config.StatusListen))
+	}
+	// Mappings with peers forward through a tunnel per peer room
+	tunnels, selectors, err := expandPeerMappings(tunnels)
+	if err != nil {
+		fatalf(ExitBind, "Failed to set up peer failover: %v", err)
+	}
+	if len(tunnels) > 1 {
+		log.Printf("🚇 Running %d tunnels", len(tunnels))
+	}
+	for _, t := range tunnels {
+		suffix := ""
+		if len(tunnels) > 1 {
+			suffix = fmt.Sprintf(" [%s]", t.Name)
+		}
+		registerTunnel(supervisor, t.Config, suffix)
+	}
+	for _, selector := range selectors {
+		supervisor.Register(runComponent("peer failover "+selector.mapping.String(), selector.Run))
+	}
+	supervisor.Register(runComponent("traffic sampler", trafficSamples.Run))
+
+	if err := supervisor.Start(context.Background()); err != nil {
+		fatalf(exitCodeOf(err), "Failed to start: %v", err)
+	}
+
+	// Time-boxed runs stop on their own
+	var runDeadline <-chan time.Time
+	if config.Duration > 0 {
+		runDeadline = time.After(config.Duration)
+	}
+
+	// Wait for shutdown signal, or for the profiled connection to carry data,
+	// beating for the liveness endpoint meanwhile
+	beat := time.NewTicker(livenessBeatInterval)
+	defer beat.Stop()
+wait:
+	for {
+		select {
+		case <-sigChan:
+			log.Println("Received shutdown signal, stopping...")
+			break wait
+		case <-traceDone():
+			log.Println("Connection profile complete, stopping...")
+			break wait
+		case <-drainDone():
+			log.Println("Drain complete, stopping...")
+			break wait
+		case <-runDeadline:
+			log.Printf("Run duration %v elapsed, stopping...", config.Duration)
+			break wait
+		case <-beat.C:
+			readiness.Beat()
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := supervisor.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+}
+
+// registerTunnel registers the components running one tunnel; suffix tells
+// the tunnels apart in component names
+func registerTunnel(supervisor *Supervisor, config Configuration, suffix string) {
+	signalingClient := NewSignalingClient(config)
+	supervisor.Register(Component{
+		Name: "signaling client" + suffix,
+		Stop: func(ctx context.Context) error {
+			signalingClient.Close()
+			return nil
+		},
+	})
+
 	if config.Mode == "client" {
+		// A stable identity lets the server hand a reconnecting client its
+		// previous allocations
+		config.ClientID = clientIdentity(config)
+
 		// Client mode: register once and handle all mappings
-		go handleClientMode(ctx, config)
+		supervisor.Register(runComponent("client mode"+suffix, func(ctx context.Context) {
+			if !config.InterfaceWatch {
+				// Sessions end early when the server freezes, and the
+				// client re-registers
+				staleServerData := ""
+				for ctx.Err() == nil {
+					staleServerData = handleClientMode(ctx, config, signalingClient, staleServerData)
+					staleServerData = followMigration(&config, staleServerData)
+				}
+				return
+			}
+			runWithInterfaceMigration(ctx, func(ctx context.Context, staleServerData string) string {
+				staleServerData = handleClientMode(ctx, config, signalingClient, staleServerData)
+				return followMigration(&config, staleServerData)
+			})
+		}))
+	} else if config.Mode == "peer" {
+		// Peer mode: rendezvous through the signaling server, then punch directly
+		supervisor.Register(runComponent("peer mode"+suffix, func(ctx context.Context) {
+			handlePeerMode(ctx, config, signalingClient)
+		}))
 	} else {
 		// Server mode: continuous polling for connections
-		go handleServerMode(ctx, config)
+		supervisor.Register(runComponent("server mode"+suffix, func(ctx context.Context) {
+			handleServerMode(ctx, config, signalingClient)
+		}))
 	}
-	
-	// Wait for shutdown signal
-	<-sigChan
-	log.Println("\\nReceived shutdown signal, stopping...")
-	cancel()
-	
-	// Give goroutines a moment to clean up
-	time.Sleep(500 * time.Millisecond)
 }
 
-// handleClientMode handles client mode - register once and handle all mappings
-func handleClientMode(ctx context.Context, config Configuration) {
+// handleClientMode handles client mode - register once and handle all mappings.
+// Server data answering an earlier registration, such as staleServerData,
+// is treated as not ready yet; the data used is returned so a later
+// re-registration can skip it. The session ends with ctx, or early when the
+// server's heartbeats stop.
+func handleClientMode(ctx context.Context, config Configuration, signalingClient *SignalingClient, staleServerData string) string {
 	log.Printf("[%s] Starting client mode with %d mappings", config.Mode, len(config.Mappings))
+	ctx, endSession := context.WithCancel(ctx)
+	defer endSession()
+	ctx = withPunchExchange(ctx, newPunchExchange(signalingClient, config, config.Mode, peerRole(config.Mode)))
 
-	// Discover our network information
-	networkInfo, err := discoverNetworkInfo(config.STUNServer)
-	if err != nil {
-		log.Fatalf("Failed to discover network info: %v", err)
+	// With a startupTimeout all setup stages share one budget: waits end when
+	// it is spent, and the initial forwarders, started with startCtx, stop
+	// hole punching and fall back to relay
+	startCtx := ctx
+	if config.StartupTimeout > 0 {
+		startCtx = withStartupDeadline(ctx, time.Now().Add(time.Duration(config.StartupTimeout)))
+	}
+	setupCtx, cancelSetup := startupStageContext(startCtx)
+	defer cancelSetup()
+
+	// setupStopped reports whether the client is shutting down, and fails
+	// the run if the startup budget ran out during stage
+	setupStopped := func(stage string) bool {
+		if ctx.Err() != nil {
+			return true
+		}
+		if setupCtx.Err() != nil {
+			fatalf(ExitRuntime, "❌ Startup timeout %v elapsed %s", time.Duration(config.StartupTimeout), stage)
+		}
+		return false
+	}
+
+	// Fail fast on a wrong signalingUrl before the slower STUN discovery
+	if err := signalingClient.Ping(setupCtx, config.SignalingURL); err != nil {
+		if setupStopped("during the signaling preflight") {
+			return staleServerData
+		}
+		fatalf(ExitSignaling, "Signaling preflight failed: %v", err)
+	}
+
+	// A saved session lets the client keep its hole punching port, and so
+	// its NAT mapping, and ask the server for the same ports
+	var savedState *ClientState
+	if config.StateFile != "" {
+		savedState = loadClientState(config.StateFile, config)
+		if savedState != nil && config.HolePunchLocalPort == 0 {
+			config.HolePunchLocalPort = savedState.HolePunchPort
+		}
 	}
 
-	// Create signaling client
-	signalingClient := NewSignalingClient()
-	defer signalingClient.Close()
+	// Discover our network information; a re-registration starts over and
+	// is not ready until every mapping is connected or relayed again. Other
+	// tunnels' mappings keep their states.
+	for _, mapping := range config.Mappings {
+		readiness.SetMapping(forwardedPortKey(mapping), MappingStateConnecting)
+	}
+	networkInfo, err := discoverNetworkInfoWithin(setupCtx, config)
+	if err != nil {
+		if setupStopped("during network discovery") {
+			return staleServerData
+		}
+		fatalf(ExitNetwork, "Failed to discover network info: %v", err)
+	}
 
 	// For client, we use server's room key format
 	roomKey := config.RoomID + "-server"
 	
-	// Format client registration data including mappings
-	clientData, err := formatClientRegistrationData(networkInfo, config.Mappings)
+	// Format client registration data including mappings; TCP mappings
+	// sharing a remote target share one allocation. The registration ID
+	// tells the allocation answering this registration from earlier ones.
+	registered, aliases := coalesceMappings(config.Mappings)
+	registrationID := newUpdateID()
+	clientData, err := formatClientRegistrationData(networkInfo, registered, config, savedState.requestedPorts(), registrationID)
 	if err != nil {
-		log.Fatalf("Failed to format client registration data: %v", err)
+		fatalf(ExitRuntime, "Failed to format client registration data: %v", err)
 	}
 	
-	// Debug: Print what client is sending
-	log.Printf("DEBUG: Client mode: %s", config.Mode)
-	log.Printf("DEBUG: Room key: %s", roomKey)
-	log.Printf("DEBUG: Sending client registration data: %q", clientData)
-	log.Printf("DEBUG: Data length: %d", len(clientData))
+	// Debug: Print what client is sending, without its secrets
+	debugLogger := defaultLogger.WithComponent("client")
+	debugLogger.Debugf("Client mode: %s", config.Mode)
+	debugLogger.Debugf("Room key: %s", redactSecret(roomKey))
+	debugLogger.Debugf("Sending client registration data: %s", redactPayload(clientData))
+	debugLogger.Debugf("Data length: %d", len(clientData))
 	
 	// Post our network info and mappings to signaling server
 	err = signalingClient.PostSignal(config.SignalingURL, config.Mode, roomKey, clientData)
 	if err != nil {
-		log.Fatalf("Failed to post signal: %v", err)
+		fatalf(ExitSignaling, "Failed to post signal: %v", err)
 	}
 
 	// Wait for server registration data with retry mechanism
 	var serverData *ServerRegistrationData
+	var rawServerData string
 	maxRetries := 5
 	retryDelay := 2 * time.Second
+	const allocationStage = "waiting for the server's port allocation"
 	
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Waiting for server port allocation data (attempt %d/%d)...", attempt, maxRetries)
+	// With peerWaitTimeout the client waits for a server that is not up
+	// yet until it passes, or indefinitely when it is 0
+	waitStart := time.Now()
+	parseFailures := 0
+	for attempt := 1; ; attempt++ {
+		log.Printf("Waiting for server port allocation data (attempt %d)...", attempt)
 		
-		serverRegistrationData, err := signalingClient.WaitForPeerData(ctx, config.SignalingURL, 
+		serverRegistrationData, err := signalingClient.WaitForPeerData(setupCtx, config.SignalingURL, 
 			peerRole(config.Mode), roomKey, 15*time.Second)
 		if err != nil {
+			if setupStopped(allocationStage) {
+				return staleServerData
+			}
 			log.Printf("Attempt %d failed to get server data: %v", attempt, err)
-			if attempt == maxRetries {
-				log.Fatalf("Failed to get server registration data after %d attempts", maxRetries)
+			if config.peerWaitOver(waitStart, attempt, maxRetries) {
+				fatalf(ExitSignaling, "Failed to get server registration data after %d attempts", attempt)
+			}
+			if !sleepContext(setupCtx, retryDelay) {
+				setupStopped(allocationStage)
+				return staleServerData
 			}
-			time.Sleep(retryDelay)
 			continue
 		}
 
 		// Debug: Print raw server registration data
-		log.Printf("DEBUG: Received raw server data (attempt %d): %q", attempt, serverRegistrationData)
-		log.Printf("DEBUG: Server data length: %d", len(serverRegistrationData))
+		debugLogger.Debugf("Received server data (attempt %d): %s", attempt, redactPayload(serverRegistrationData))
+		debugLogger.Debugf("Server data length: %d", len(serverRegistrationData))
 		
 		// Check if it's old format (server hasn't finished port allocation yet)
 		if strings.Contains(serverRegistrationData, "|") && !strings.HasPrefix(serverRegistrationData, "{") {
 			log.Printf("Server still sending initial data, port allocation not ready yet (attempt %d)", attempt)
-			if attempt == maxRetries {
-				log.Fatalf("Server never sent port allocation data after %d attempts", maxRetries)
+			if config.peerWaitOver(waitStart, attempt, maxRetries) {
+				fatalf(ExitSignaling, "Server never sent port allocation data after %d attempts", attempt)
+			}
+			if !sleepContext(setupCtx, retryDelay) {
+				setupStopped(allocationStage)
+				return staleServerData
 			}
-			time.Sleep(retryDelay)
 			continue
 		}
 		
@@ -121,48 +293,234 @@ func handleClientMode(ctx context.Context, config Configuration) {
 		serverData, err = parseServerRegistrationData(serverRegistrationData)
 		if err != nil {
 			log.Printf("Failed to parse server data (attempt %d): %v", attempt, err)
-			log.Printf("Raw server data was: %q", serverRegistrationData)
-			if attempt == maxRetries {
-				log.Fatalf("Failed to parse server registration data after %d attempts", maxRetries)
+			log.Printf("Server data was: %s", redactPayload(serverRegistrationData))
+			parseFailures++
+			if parseFailures == maxRetries {
+				fatalf(ExitSignaling, "Failed to parse server registration data after %d attempts", maxRetries)
+			}
+			if !sleepContext(setupCtx, retryDelay) {
+				setupStopped(allocationStage)
+				return staleServerData
+			}
+			continue
+		}
+
+		// An allocation answering an earlier registration is not ready
+		// either, however recent its heartbeat
+		if staleAllocation(serverData, registrationID, staleServerData) {
+			log.Printf("Server still sending the allocation of an earlier registration, port allocation not ready yet (attempt %d)", attempt)
+			if config.peerWaitOver(waitStart, attempt, maxRetries) {
+				fatalf(ExitSignaling, "Server never answered this registration after %d attempts", attempt)
+			}
+			if !sleepContext(setupCtx, retryDelay) {
+				setupStopped(allocationStage)
+				return staleServerData
 			}
-			time.Sleep(retryDelay)
 			continue
 		}
 		
+		// A draining server is about to be replaced; wait for the new one
+		if serverData.Migrate != nil {
+			log.Printf("🚚 Server is draining for maintenance, waiting for its replacement (attempt %d)", attempt)
+			if !sleepContext(setupCtx, retryDelay) {
+				setupStopped(allocationStage)
+				return staleServerData
+			}
+			continue
+		}
+
+		// A full server refuses the registration; the next one skips this
+		// refusal
+		if serverData.Error != nil {
+			refusedRegistration(ctx, config, serverData.Error)
+			return serverRegistrationData
+		}
+
 		// Success!
 		log.Printf("Successfully received server port allocation data on attempt %d", attempt)
+		logPeerDiagnostics(debugLogger, "Server", serverData.Diagnostics)
+		rawServerData = serverRegistrationData
 		break
 	}
 
 	log.Printf("Received server port allocations for %d mappings", len(serverData.PortMappings))
+	reportServiceMappings(config.Mappings, serverData)
+	reportFailedMappings(config.Mappings, serverData)
+	reportFailedAliases(serverData.FailedMappings, aliases)
+	// Aliases forward through their primary's allocation
+	serverData.PortMappings = expandAliases(serverData.PortMappings, aliases)
+	reportUnsupportedProtocols(config.Mappings, serverData.Capabilities)
+	checkDirectPath(networkInfo, &serverData.NetworkInfo, serverData.PortMappings)
+	features := negotiateFeatures(config, serverData)
+	var state *ClientState
+	if config.StateFile != "" {
+		savedState.compare(serverData)
+		state = newClientState(config, networkInfo, serverData)
+		saveClientState(config.StateFile, state)
+	}
+	if len(serverData.PortMappings) == 0 {
+		log.Printf("📭 0 mappings, awaiting updates: add mappings in the mapping CLI and send them with 'update'")
+	}
 	
+	// Forwarders are tracked so shutdown waits for them before returning
+	var wg sync.WaitGroup
+
 	// Start port forwarding for each mapping with allocated ports
+	var muxMappings, quicMappings []ServerPortMapping
 	for _, portMapping := range serverData.PortMappings {
 		clientMapping := portMapping.ClientMapping
 		allocatedPort := portMapping.AllocatedPort
+
+		// TCP mappings become streams of one QUIC connection when enabled
+		if features.quic && canQUIC(clientMapping, networkInfo, &serverData.NetworkInfo) {
+			quicMappings = append(quicMappings, portMapping)
+			continue
+		}
+		
+		// Hole-punched UDP mappings share one multiplexed socket when enabled
+		if features.udpMux && canMuxUDP(clientMapping, networkInfo, &serverData.NetworkInfo) {
+			muxMappings = append(muxMappings, portMapping)
+			continue
+		}
 		
 		log.Printf("Server allocated port %d for client mapping %d->%d", 
 			allocatedPort, clientMapping.LocalPort, clientMapping.RemotePort)
 		
-		go handlePortMappingWithAllocatedPort(ctx, config, clientMapping, allocatedPort, 
-			networkInfo, &serverData.NetworkInfo)
+		wg.Add(1)
+		go func(clientMapping PortMapping, allocatedPort int) {
+			defer wg.Done()
+			handlePortMappingWithAllocatedPort(startCtx, config, clientMapping, allocatedPort,
+				networkInfo, &serverData.NetworkInfo)
+		}(clientMapping, allocatedPort)
+	}
+
+	if len(muxMappings) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := defaultLogger.WithComponent("udp-mux")
+			err := runUDPMuxClientWithHolePunching(startCtx, logger, muxMappings, features.udpFin, networkInfo, &serverData.NetworkInfo)
+			if err != nil {
+				logger.Warnf("❌ %s", relayExplanation(networkInfo, &serverData.NetworkInfo, err))
+				runUDPRelayClients(ctx, muxMappings, &serverData.NetworkInfo)
+			}
+		}()
+	}
+
+	if len(quicMappings) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := defaultLogger.WithComponent("quic")
+			err := runQUICClientWithHolePunching(startCtx, logger, quicMappings, serverData.QUICFingerprint, networkInfo, &serverData.NetworkInfo)
+			if err != nil {
+				logger.Errorf("❌ QUIC transport failed: %v, falling back to TCP relay", err)
+				for _, pm := range quicMappings {
+					wg.Add(1)
+					go func(pm ServerPortMapping) {
+						defer wg.Done()
+						handlePortMappingWithAllocatedPort(startCtx, config, pm.ClientMapping, pm.AllocatedPort,
+							networkInfo, &serverData.NetworkInfo)
+					}(pm)
+				}
+			}
+		}()
 	}
 
 	// Start mapping updater for dynamic configuration changes
 	mappingUpdater := NewMappingUpdater(config, signalingClient, roomKey, config.Mappings)
+	if config.ControlListen != "" {
+		ln, err := listenControl(config.ControlListen)
+		if err != nil {
+			log.Printf("⚠️  Control socket unavailable: %v", err)
+		} else {
+			// Closed on return too, so a re-registration can bind it again
+			defer ln.Close()
+			go serveControl(ctx, ln, mappingUpdater.runCommand)
+		}
+	}
+
+	// Mappings added through updates start forwarding once the server has
+	// allocated them; local ports already forwarded keep their forwarders
+	started := make(map[string]bool)
+	for _, pm := range serverData.PortMappings {
+		started[forwardedPortKey(pm.ClientMapping)] = true
+	}
+	mappingUpdater.OnAllocation(func(updated *ServerRegistrationData) {
+		for _, pm := range updated.PortMappings {
+			key := forwardedPortKey(pm.ClientMapping)
+			if started[key] || ctx.Err() != nil {
+				continue
+			}
+			started[key] = true
+			log.Printf("➕ Starting forwarder for added mapping %s (allocated port %d)", pm.ClientMapping, pm.AllocatedPort)
+			wg.Add(1)
+			go func(pm ServerPortMapping) {
+				defer wg.Done()
+				handlePortMappingWithAllocatedPort(ctx, config, pm.ClientMapping, pm.AllocatedPort,
+					networkInfo, &updated.NetworkInfo)
+			}(pm)
+		}
+	})
 	
-	// Option 1: Interactive CLI updater (comment out if not needed)
-	go mappingUpdater.StartInteractiveUpdater(ctx)
-	
-	// Option 2: Auto-update from config file changes (comment out if not needed)
-	// go mappingUpdater.AutoUpdateFromConfig(ctx, configPath)
-	
-	log.Printf("💡 Client ready! You can use the mapping CLI to add/remove port mappings dynamically.")
-	log.Printf("   Type 'help' in the mapping> prompt for available commands.")
+	if benchmarkSizeMB > 0 {
+		go runBenchmarks(ctx, serverData.PortMappings)
+	}
+
+	// The mappings file is watched even without the interactive CLI, so
+	// automation can regenerate it
+	if config.MappingsFile != "" {
+		go mappingUpdater.WatchMappingsFile(ctx, config.MappingsFile, config.inlineMappings)
+	}
+
+	if config.NoInteractive {
+		log.Printf("💡 Client ready! Forwarding %d mappings (non-interactive)", len(serverData.PortMappings))
+	} else {
+		// Option 1: Interactive CLI updater (comment out if not needed)
+		go mappingUpdater.StartInteractiveUpdater(ctx)
+
+		// Option 2: Auto-update from config file changes (comment out if not needed)
+		// go mappingUpdater.AutoUpdateFromConfig(ctx, configPath)
+
+		log.Printf("💡 Client ready! You can use the mapping CLI to add/remove port mappings dynamically.")
+		log.Printf("   Type 'help' in the mapping> prompt for available commands.")
+	}
 	
+	// A frozen server keeps its presence until the signaling server's TTL
+	// drops it; re-register once its heartbeats stop instead
+	frozen := make(chan string, 1)
+	go monitorServerLiveness(ctx, signalingClient, config.SignalingURL, roomKey, serverData.Heartbeat, time.Duration(config.ServerLivenessTimeout), func(serverData string) {
+		log.Printf("🔌 Server stopped responding, re-registering")
+		frozen <- serverData
+		endSession()
+	}, func(serverData string) {
+		log.Printf("🚚 Server is draining for maintenance, re-registering")
+		frozen <- serverData
+		endSession()
+	})
+
 	// Keep client alive
 	<-ctx.Done()
 	log.Printf("Client shutting down...")
+	if state != nil {
+		// Connection types are known by now; record them before forwarders
+		// reset the readiness states
+		state.recordConnections(config.Mappings)
+		saveClientState(config.StateFile, state)
+	}
+	wg.Wait()
+	select {
+	case serverData := <-frozen:
+		// The frozen server's data is not an allocation for the new session
+		return serverData
+	default:
+	}
+	return rawServerData
+}
+
+// forwardedPortKey identifies the local listener of a mapping
+func forwardedPortKey(mapping PortMapping) string {
+	return mappingStateKey(mapping.transport(), mapping.LocalPort)
 }
 
 // handlePortMappingWithAllocatedPort handles a single port mapping with enhanced P2P connection
@@ -171,6 +529,29 @@ func handlePortMappingWithAllocatedPort(ctx context.Context, config Configuratio
 	log.Printf("[%s] Starting enhanced port forward: %s %d -> allocated port %d", 
 		config.Mode, mapping.Protocol, mapping.LocalPort, allocatedPort)
 	
+	logger := mappingLogger(mapping)
+	stateKey := forwardedPortKey(mapping)
+
+	// Dual path mappings keep both LAN and WAN targets and fail over between them
+	if mapping.DualPath {
+		readiness.SetMapping(stateKey, MappingStateConnected)
+		runDualPathMapping(ctx, mapping, allocatedPort, serverInfo)
+		return
+	}
+
+	// A VPN between the peers beats any path over the Internet
+	if useDirectPath(clientInfo, serverInfo) {
+		host := serverInfo.DirectAddr
+		log.Printf("🔗 Using direct connection to %s", net.JoinHostPort(host, strconv.Itoa(allocatedPort)))
+		readiness.SetMapping(stateKey, MappingStateConnected)
+		if mapping.Protocol == "tcp" {
+			runTCPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.Compress, mapping.RelayMux, mapping.dialTimeout())
+		} else {
+			runUDPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.SourcePort, mapping.udpSessionTimeout())
+		}
+		return
+	}
+
 	// Determine best connection method
 	isLAN := detectLANConnection(clientInfo, serverInfo)
 	
@@ -178,44 +559,164 @@ func handlePortMappingWithAllocatedPort(ctx context.Context, config Configuratio
 		// Use direct LAN connection
 		targetAddr := extractIP(serverInfo.PrivateAddr) + ":" + strconv.Itoa(allocatedPort)
 		log.Printf("🏠 Using direct LAN connection to %s", targetAddr)
+		readiness.SetMapping(stateKey, MappingStateConnected)
 		
 		host, portStr, _ := net.SplitHostPort(targetAddr)
 		port, _ := strconv.Atoi(portStr)
 		
 		if mapping.Protocol == "tcp" {
-			runTCPClient(ctx, mapping.LocalPort, host, port)
+			runTCPClient(ctx, logger, mapping.LocalPort, host, port, mapping.Compress, mapping.RelayMux, mapping.dialTimeout())
 		} else {
-			runUDPClient(ctx, mapping.LocalPort, host, port)
+			runUDPClient(ctx, logger, mapping.LocalPort, host, port, mapping.SourcePort, mapping.udpSessionTimeout())
+		}
+		return
+	}
+
+	// A server without NAT is reachable as is; punching would only add delay
+	if serverDirectlyReachable(serverInfo) {
+		host := extractIP(serverInfo.PublicAddr)
+		log.Printf("⚡ Server has no NAT, fast path: dialing %s:%d directly without hole punching", host, allocatedPort)
+		readiness.SetMapping(stateKey, MappingStateConnected)
+		if mapping.Protocol == "tcp" {
+			runTCPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.Compress, mapping.RelayMux, mapping.dialTimeout())
+		} else {
+			runUDPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.SourcePort, mapping.udpSessionTimeout())
 		}
 		return
 	}
 
 	// For WAN connections, use hole punching for UDP or enhanced TCP
-	if mapping.Protocol == "udp" {
+	if mapping.transport() == "udp" {
 		log.Printf("🎯 Attempting UDP hole punching for mapping %d->%d", mapping.LocalPort, allocatedPort)
 		
 		// Try hole punching first
-		if clientInfo.STUNResult != nil && serverInfo.STUNResult != nil && 
-		   clientInfo.STUNResult.CanHolePunch && serverInfo.STUNResult.CanHolePunch {
-			
-			err := runUDPClientWithHolePunching(ctx, mapping.LocalPort, allocatedPort, clientInfo, serverInfo)
+		if canHolePunch(clientInfo, serverInfo) {
+			readiness.SetMapping(stateKey, MappingStateConnecting)
+			err := runUDPClientWithHolePunching(ctx, logger, mapping.LocalPort, allocatedPort, mapping.JitterBuffer, time.Duration(mapping.UDPCoalesceDelay), clientInfo, serverInfo)
 			if err != nil {
-				log.Printf("❌ UDP hole punching failed: %v, falling back to relay", err)
+				logger.Warnf("❌ %s", relayExplanation(clientInfo, serverInfo, err))
 				// Fallback to traditional relay
+				readiness.SetMapping(stateKey, MappingStateRelay)
 				host := extractIP(serverInfo.PublicAddr)
-				runUDPClient(ctx, mapping.LocalPort, host, allocatedPort)
+				runUDPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.SourcePort, mapping.udpSessionTimeout())
 			}
 		} else {
-			log.Printf("⚠️  Hole punching not possible, using relay connection")
+			logger.Warnf("⚠️  %s", relayExplanation(clientInfo, serverInfo, nil))
+			readiness.SetMapping(stateKey, MappingStateRelay)
 			host := extractIP(serverInfo.PublicAddr)
-			runUDPClient(ctx, mapping.LocalPort, host, allocatedPort)
+			runUDPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.SourcePort, mapping.udpSessionTimeout())
 		}
 	} else {
 		// TCP - use traditional connection for now (TCP hole punching is complex)
 		host := extractIP(serverInfo.PublicAddr)
 		log.Printf("🌐 Using TCP relay connection to %s:%d", host, allocatedPort)
-		runTCPClient(ctx, mapping.LocalPort, host, allocatedPort)
+		readiness.SetMapping(stateKey, MappingStateRelay)
+		runTCPClient(ctx, logger, mapping.LocalPort, host, allocatedPort, mapping.Compress, mapping.RelayMux, mapping.dialTimeout())
+	}
+}
+
+// canMuxUDP reports whether a mapping would use UDP hole punching and can
+// therefore be carried over the shared multiplexed socket
+func canMuxUDP(mapping PortMapping, localInfo, remoteInfo *NetworkInfo) bool {
+	if mapping.Protocol != "udp" || mapping.DualPath || mapping.JitterBuffer != nil || mapping.UDPCoalesceDelay > 0 {
+		return false
 	}
+	return canHolePunch(localInfo, remoteInfo) && !detectLANConnection(localInfo, remoteInfo)
+}
+
+// canQUIC reports whether a TCP mapping can be carried over the QUIC
+// transport on a hole-punched socket
+func canQUIC(mapping PortMapping, localInfo, remoteInfo *NetworkInfo) bool {
+	if mapping.Protocol != "tcp" || mapping.DualPath {
+		return false
+	}
+	return canHolePunch(localInfo, remoteInfo) && !detectLANConnection(localInfo, remoteInfo)
+}
+
+// canHolePunch reports whether both peers' NAT types allow hole punching
+func canHolePunch(localInfo, remoteInfo *NetworkInfo) bool {
+	return localInfo.STUNResult != nil && remoteInfo.STUNResult != nil &&
+		localInfo.STUNResult.CanHolePunch && remoteInfo.STUNResult.CanHolePunch
+}
+
+// udpRelayed reports whether the server relays a UDP mapping through its
+// allocated port instead of hole punching it (dual path mappings always relay,
+// and so does a server without NAT, which clients dial directly)
+func udpRelayed(mapping PortMapping, serverInfo, clientInfo *NetworkInfo) bool {
+	return detectLANConnection(serverInfo, clientInfo) || mapping.DualPath || !canHolePunch(serverInfo, clientInfo) ||
+		serverDirectlyReachable(serverInfo)
+}
+
+// serverDirectlyReachable reports whether STUN found the server to be on a
+// public address without NAT
+func serverDirectlyReachable(serverInfo *NetworkInfo) bool {
+	return serverInfo.STUNResult != nil && serverInfo.STUNResult.NATType == NATTypeNone
+}
+
+// serverListeners holds listeners bound before the port allocation is
+// posted, so they already accept by the time the client learns the ports
+type serverListeners struct {
+	tcp map[int]net.Listener
+	udp map[int]*net.UDPConn
+}
+
+// bindServerListener binds the allocated port of a TCP mapping or of a UDP
+// mapping that will be relayed; hole-punched UDP mappings need neither
+func bindServerListener(pm ServerPortMapping, serverInfo, clientInfo *NetworkInfo) (net.Listener, *net.UDPConn, error) {
+	port := pm.AllocatedPort
+	if pm.ClientMapping.Protocol == "tcp" {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to bind TCP port %d: %w", port, portInUse(err, "tcp", port))
+		}
+		return ln, nil, nil
+	}
+	if udpRelayed(pm.ClientMapping, serverInfo, clientInfo) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to bind UDP port %d: %w", port, portInUse(err, "udp", port))
+		}
+		return nil, conn, nil
+	}
+	return nil, nil, nil
+}
+
+// Close closes every bound listener
+func (sl *serverListeners) Close() {
+	for _, ln := range sl.tcp {
+		ln.Close()
+	}
+	for _, conn := range sl.udp {
+		conn.Close()
+	}
+}
+
+// runUDPRelayClients relays each UDP mapping individually via the server's public address
+func runUDPRelayClients(ctx context.Context, mappings []ServerPortMapping, serverInfo *NetworkInfo) {
+	var wg sync.WaitGroup
+	host := extractIP(serverInfo.PublicAddr)
+	setMappingStates(mappings, false, MappingStateRelay)
+	for _, pm := range mappings {
+		wg.Add(1)
+		go func(pm ServerPortMapping) {
+			defer wg.Done()
+			runUDPClient(ctx, mappingLogger(pm.ClientMapping), pm.ClientMapping.LocalPort, host, pm.AllocatedPort, pm.ClientMapping.SourcePort, pm.ClientMapping.udpSessionTimeout())
+		}(pm)
+	}
+	wg.Wait()
+}
+
+// runUDPRelayServers serves each UDP mapping individually on its allocated port
+func runUDPRelayServers(ctx context.Context, mappings []ServerPortMapping) {
+	var wg sync.WaitGroup
+	for _, pm := range mappings {
+		wg.Add(1)
+		go func(pm ServerPortMapping) {
+			defer wg.Done()
+			runUDPServerOnPort(ctx, mappingLogger(pm.ClientMapping), pm.AllocatedPort, newServiceTarget(pm.ClientMapping))
+		}(pm)
+	}
+	wg.Wait()
 }
 
 // parseNetworkInfo parses network info from signaling data
@@ -273,54 +774,103 @@ func allocatePortForMapping(ctx context.Context, mapping PortMapping) (int, erro
 }
 
 // handleServerMode handles server mode - dynamic port allocation and forwarding
-func handleServerMode(ctx context.Context, config Configuration) {
+func handleServerMode(ctx context.Context, config Configuration, signalingClient *SignalingClient) {
 	log.Printf("[%s] Starting server mode, ready to accept connections", config.Mode)
+	ctx = withPunchExchange(ctx, newPunchExchange(signalingClient, config, config.Mode, peerRole(config.Mode)))
+
+	// Fail fast on a wrong signalingUrl before the slower STUN discovery
+	if err := signalingClient.Ping(ctx, config.SignalingURL); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		fatalf(ExitSignaling, "Signaling preflight failed: %v", err)
+	}
 
 	// Discover network information
-	networkInfo, err := discoverNetworkInfo(config.STUNServer)
+	networkInfo, err := discoverNetworkInfo(config)
 	if err != nil {
-		log.Fatalf("Failed to discover network info: %v", err)
+		fatalf(ExitNetwork, "Failed to discover network info: %v", err)
 	}
 
-	// Create signaling client
-	signalingClient := NewSignalingClient()
-	defer signalingClient.Close()
+	// Dual path clients probe the LAN path here rather than at a mapping's
+	// port, where a probe would open a connection to its service
+	if port, err := startPathProbeResponder(ctx, extractIP(networkInfo.PrivateAddr)); err != nil {
+		log.Printf("⚠️  LAN path probe responder unavailable: %v", err)
+	} else {
+		networkInfo.ProbePort = port
+	}
 
 	// Don't post initial data - wait for client first to avoid overwriting
 	roomKey := config.RoomID + "-server"
 	
-	// Debug: Print server setup
-	log.Printf("DEBUG: Server mode: %s", config.Mode)
-	log.Printf("DEBUG: Room key: %s", roomKey)
+	// Debug: Print server setup, without its secrets
+	debugLogger := defaultLogger.WithComponent("server")
+	debugLogger.Debugf("Server mode: %s", config.Mode)
+	debugLogger.Debugf("Room key: %s", redactSecret(roomKey))
 	
+	// Forwarded connections can be listed and killed from stdin
+	if !config.NoInteractive {
+		go StartConnectionConsole(ctx)
+	}
+	if config.ControlListen != "" {
+		ln, err := listenControl(config.ControlListen)
+		if err != nil {
+			log.Printf("⚠️  Control socket unavailable: %v", err)
+		} else {
+			defer ln.Close()
+			go serveControl(ctx, ln, runConnectionCommand)
+		}
+	}
+
 	log.Printf("Server waiting for client connections...")
 	log.Printf("Waiting for client to register with mapping configuration...")
 
-	// Wait for client registration data (including mappings)
-	clientRegistrationData, err := signalingClient.WaitForPeerData(ctx, config.SignalingURL, 
-		"client", roomKey, 60*time.Second)
+	// Wait for client registration data (including mappings), for as long
+	// as it takes with a peerWaitTimeout of 0
+	waitTimeout, set := config.peerWait()
+	if !set {
+		waitTimeout = defaultClientWaitTimeout
+	}
+	waitStart := time.Now()
+	var clientRegistrationData string
+	for {
+		wait := waitTimeout
+		if wait == 0 {
+			wait = peerWaitPoll
+		}
+		clientRegistrationData, err = signalingClient.WaitForPeerData(ctx, config.SignalingURL, 
+			"client", roomKey, wait)
+		if err == nil || ctx.Err() != nil || waitTimeout > 0 {
+			break
+		}
+		log.Printf("⏳ No client after %v, still waiting...", time.Since(waitStart).Round(time.Second))
+	}
 	if err != nil {
-		log.Fatalf("Failed to get client registration data: %v", err)
+		if ctx.Err() != nil {
+			return
+		}
+		fatalf(ExitSignaling, "Failed to get client registration data: %v", err)
 	}
 
-	// Debug: Print raw client registration data
-	log.Printf("DEBUG: Received raw client data: %q", clientRegistrationData)
-	log.Printf("DEBUG: Client data length: %d", len(clientRegistrationData))
+	// Debug: Print client registration data
+	debugLogger.Debugf("Received client data: %s", redactPayload(clientRegistrationData))
+	debugLogger.Debugf("Client data length: %d", len(clientRegistrationData))
 	
 	// Parse client registration data
 	clientData, err := parseClientRegistrationData(clientRegistrationData)
 	if err != nil {
 		log.Printf("ERROR: Failed to parse client registration data: %v", err)
-		log.Printf("ERROR: Raw data was: %q", clientRegistrationData)
+		log.Printf("ERROR: Data was: %s", redactPayload(clientRegistrationData))
 		
 		// Try to detect if it's old format (network info string)
 		if strings.Contains(clientRegistrationData, "|") && !strings.HasPrefix(clientRegistrationData, "{") {
 			log.Printf("ERROR: Detected old network info format. Client might be using old version.")
 		}
-		log.Fatalf("Client registration parsing failed")
+		fatalf(ExitSignaling, "Client registration parsing failed")
 	}
 
 	log.Printf("Received client registration with %d mappings", len(clientData.Mappings))
+	logPeerDiagnostics(debugLogger, "Client", clientData.Diagnostics)
 	
 	// Parse mapping strings back to PortMapping structs
 	var parsedMappings []PortMapping
@@ -328,108 +878,204 @@ func handleServerMode(ctx context.Context, config Configuration) {
 		var mapping PortMapping
 		err := mapping.parseFromString(mappingStr)
 		if err != nil {
-			log.Fatalf("Failed to parse mapping string %q: %v", mappingStr, err)
+			fatalf(ExitSignaling, "Failed to parse mapping string %q: %v", mappingStr, err)
+		}
+		mapping, err = resolveServiceMapping(clientData.mappingDetails(mapping), config.Services)
+		if err != nil {
+			log.Printf("❌ Skipping mapping %s: %v", mappingStr, err)
+			continue
 		}
 		parsedMappings = append(parsedMappings, mapping)
 	}
 	
-	// Allocate dynamic ports for each mapping
-	var portMappings []ServerPortMapping
-	for _, mapping := range parsedMappings {
-		allocatedPort, err := allocatePortForMapping(ctx, mapping)
+	// Allocate dynamic ports for each mapping, binding listeners before
+	// posting the allocation so the client never sees a port that is not
+	// accepting yet. Mappings that fail, or whose serviceTarget the server
+	// does not allow, are reported to the client. The allocations are kept
+	// for the client's ID should it re-register.
+	affinity := newAffinityCache(time.Duration(config.AffinityWindow))
+	parsedMappings, refused := refuseServiceTargets(parsedMappings, config)
+	portMappings, listeners, failures := allocateMappings(ctx, parsedMappings, clientData.RequestedPorts, config.AllocationConcurrency, networkInfo, &clientData.NetworkInfo)
+	failures = append(refused, failures...)
+	affinity.record(clientData.ClientID, portMappings, listeners)
+
+	// Offer a QUIC transport for TCP mappings when the client asks for it
+	var quicID *quicIdentity
+	quicFingerprint := ""
+	if clientData.Transport == TransportQUIC {
+		quicID, err = newQUICIdentity()
 		if err != nil {
-			log.Fatalf("Failed to allocate port for mapping %+v: %v", mapping, err)
-		}
-		
-		portMapping := ServerPortMapping{
-			ClientMapping: mapping,
-			AllocatedPort: allocatedPort,
+			log.Printf("⚠️  Failed to create QUIC identity, TCP mappings will use relay: %v", err)
+		} else {
+			quicFingerprint = quicID.fingerprint
 		}
-		portMappings = append(portMappings, portMapping)
-		
-		log.Printf("Allocated %s port %d for client mapping %d->%d", 
-			mapping.Protocol, allocatedPort, mapping.LocalPort, mapping.RemotePort)
 	}
 
 	// Send port allocation results back to client
-	serverData, err := formatServerRegistrationData(networkInfo, portMappings)
+	serverData, err := formatServerRegistrationData(networkInfo, portMappings, failures, quicFingerprint, config.Services, "", clientData.RegistrationID, localDiagnostics(config, networkInfo))
 	if err != nil {
-		log.Fatalf("Failed to format server registration data: %v", err)
+		fatalf(ExitRuntime, "Failed to format server registration data: %v", err)
 	}
 	
 	// Debug: Print what server is sending as final registration
-	log.Printf("DEBUG: Sending final server registration data: %q", serverData)
-	log.Printf("DEBUG: Final data length: %d", len(serverData))
+	debugLogger.Debugf("Sending final server registration data: %s", redactPayload(serverData))
+	debugLogger.Debugf("Final data length: %d", len(serverData))
 	
-	err = signalingClient.PostSignal(config.SignalingURL, config.Mode, roomKey, serverData)
+	// The first heartbeat tells the client how often to expect the next.
+	// Later beats restamp whatever allocation was posted last.
+	announcement := newServerAnnouncement(func(data string) error {
+		return signalingClient.PostSignal(config.SignalingURL, config.Mode, roomKey, data)
+	})
+	err = announcement.Post(serverData)
 	if err != nil {
-		log.Fatalf("Failed to post server registration data: %v", err)
+		fatalf(ExitSignaling, "Failed to post server registration data: %v", err)
 	}
 	
 	log.Printf("Server port allocation data sent to signaling server")
 
+	// Forwarders and the watcher are tracked so shutdown waits for them
+	var wg sync.WaitGroup
+
 	// Start port listeners for each allocated port with hole punching support
+	var muxMappings, quicMappings []ServerPortMapping
 	for _, portMapping := range portMappings {
 		mapping := portMapping.ClientMapping
 		allocatedPort := portMapping.AllocatedPort
+		logger := mappingLogger(mapping)
+		mappingCtx := affinity.forwarderContext(ctx, clientData.ClientID, mapping)
+		mapping = startICMPGateway(mappingCtx, logger, mapping, config.ICMPTargets)
 		
-		log.Printf("Starting %s server on allocated port %d -> local service 127.0.0.1:%d", 
-			mapping.Protocol, allocatedPort, mapping.RemotePort)
+		log.Printf("Starting %s server on allocated port %d -> service %s", 
+			mapping.Protocol, allocatedPort, newServiceTarget(mapping))
+		checkGatewayTarget(logger, mapping)
+		startHealthCheck(mappingCtx, mapping, allocatedPort)
+		startBenchmarkSink(mappingCtx, mapping)
+
+		// QUIC mappings keep their TCP listener as the client's fallback
+		if quicID != nil && canQUIC(mapping, networkInfo, &clientData.NetworkInfo) {
+			quicMappings = append(quicMappings, portMapping)
+		}
 		
+		if clientData.UDPMux && canMuxUDP(mapping, networkInfo, &clientData.NetworkInfo) {
+			muxMappings = append(muxMappings, portMapping)
+			continue
+		}
+
 		if mapping.Protocol == "tcp" {
-			go runTCPServerOnPort(ctx, allocatedPort, mapping.RemotePort)
+			wg.Add(1)
+			go func(ln net.Listener, service *ServiceTarget) {
+				defer wg.Done()
+				serveTCPServer(mappingCtx, logger, ln, service, mapping.Compress, mapping.RelayMux)
+			}(listeners.tcp[allocatedPort], newServiceTarget(mapping))
 		} else {
 			// Check if hole punching is possible for UDP
-			isLAN := detectLANConnection(networkInfo, &clientData.NetworkInfo)
-			if !isLAN && networkInfo.STUNResult != nil && clientData.NetworkInfo.STUNResult != nil &&
-			   networkInfo.STUNResult.CanHolePunch && clientData.NetworkInfo.STUNResult.CanHolePunch {
+			if !udpRelayed(mapping, networkInfo, &clientData.NetworkInfo) {
 				
 				log.Printf("🎯 Using UDP hole punching for port %d", allocatedPort)
-				go func(port, service int, client, server *NetworkInfo) {
-					err := runUDPServerWithHolePunching(ctx, port, service, client, server)
+				wg.Add(1)
+				go func(port int, service *ServiceTarget, client, server *NetworkInfo) {
+					defer wg.Done()
+					err := runUDPServerWithHolePunching(mappingCtx, logger, port, service, mapping.JitterBuffer, time.Duration(mapping.UDPCoalesceDelay), client, server)
 					if err != nil {
 						log.Printf("❌ UDP hole punching failed for port %d: %v, falling back to relay", port, err)
-						runUDPServerOnPort(ctx, port, service)
+						runUDPServerOnPort(mappingCtx, logger, port, service)
 					}
-				}(allocatedPort, mapping.RemotePort, &clientData.NetworkInfo, networkInfo)
+				}(allocatedPort, newServiceTarget(mapping), &clientData.NetworkInfo, networkInfo)
 			} else {
 				log.Printf("⚠️  Using UDP relay for port %d (hole punching not available)", allocatedPort)
-				go runUDPServerOnPort(ctx, allocatedPort, mapping.RemotePort)
+				wg.Add(1)
+				go func(conn *net.UDPConn, service *ServiceTarget) {
+					defer wg.Done()
+					serveUDPServer(mappingCtx, logger, conn, service)
+				}(listeners.udp[allocatedPort], newServiceTarget(mapping))
 			}
 		}
 	}
 
-	log.Printf("Server ready! All %d port listeners started.", len(portMappings))
+	if len(muxMappings) > 0 {
+		log.Printf("🎯 Using multiplexed UDP hole punching for %d mappings", len(muxMappings))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := defaultLogger.WithComponent("udp-mux")
+			err := runUDPMuxServerWithHolePunching(ctx, logger, muxMappings, clientData.UDPFin, &clientData.NetworkInfo, networkInfo)
+			if err != nil {
+				logger.Errorf("❌ Multiplexed UDP hole punching failed: %v, falling back to relay", err)
+				runUDPRelayServers(ctx, muxMappings)
+			}
+		}()
+	}
+
+	if len(quicMappings) > 0 {
+		log.Printf("🎯 Offering QUIC transport for %d TCP mappings", len(quicMappings))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := defaultLogger.WithComponent("quic")
+			err := runQUICServerWithHolePunching(ctx, logger, quicMappings, quicID, &clientData.NetworkInfo, networkInfo)
+			if err != nil {
+				logger.Errorf("❌ QUIC transport failed: %v, TCP mappings remain on their listeners", err)
+			}
+		}()
+	}
+
+	if len(portMappings) == 0 {
+		log.Printf("📭 Client registered 0 mappings, awaiting updates")
+	} else {
+		log.Printf("Server ready! All %d port listeners started.", len(portMappings))
+	}
 	log.Printf("Press Ctrl+C to stop the server")
 
 	// Start mapping updates watcher
-	go signalingClient.WatchMappingUpdates(ctx, config.SignalingURL, roomKey, func(newClientData string) {
-		handleMappingUpdate(ctx, config, newClientData, networkInfo, signalingClient, roomKey)
-	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		signalingClient.WatchMappingUpdates(ctx, config.SignalingURL, roomKey, func(newClientData string) {
+			handleMappingUpdate(ctx, config, newClientData, networkInfo, announcement, affinity, &wg)
+		})
+	}()
 
-	// Keep server alive and periodically refresh presence
-	ticker := time.NewTicker(30 * time.Second)
+	// Keep server alive and periodically refresh presence, each refresh
+	// beating for the client's liveness monitor
+	ticker := time.NewTicker(serverHeartbeatInterval)
 	defer ticker.Stop()
+	drainStarted := serverDrain.Started()
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Server shutting down...")
+			wg.Wait()
 			return
+		case <-drainStarted:
+			// Clients re-register on the hint, which later refreshes keep
+			drainStarted = nil
+			err := announcement.Beat(serverDrain.Hint())
+			if err != nil {
+				log.Printf("⚠️  Failed to post the migrate hint: %v", err)
+			} else {
+				log.Printf("🚚 Migrate hint posted, clients will re-register")
+			}
 		case <-ticker.C:
 			// Refresh server registration data
-			err := signalingClient.PostSignal(config.SignalingURL, config.Mode, roomKey, serverData)
+			err := announcement.Beat(nil)
 			if err != nil {
 				log.Printf("Warning: Failed to refresh server presence: %v", err)
 			} else {
-				log.Printf("Server presence refreshed with %d port mappings", len(portMappings))
+				log.Printf("Server presence refreshed")
 			}
 		}
 	}
 }
 
-// handleMappingUpdate processes mapping updates from client
-func handleMappingUpdate(ctx context.Context, config Configuration, newClientData string, networkInfo *NetworkInfo, signalingClient *SignalingClient, roomKey string) {
+// handleMappingUpdate processes mapping updates from client, and
+// re-registrations of a reconnecting client, which keep what affinity holds
+// for the client. The new allocation is posted through announcement.
+func handleMappingUpdate(ctx context.Context, config Configuration, newClientData string, networkInfo *NetworkInfo, announcement *serverAnnouncement, affinity *affinityCache, wg *sync.WaitGroup) {
+	if serverDrain.Draining() {
+		log.Printf("🚚 Ignoring client registration while draining")
+		return
+	}
 	log.Printf("🔄 Processing mapping update from client...")
 	
 	// Parse new client registration data
@@ -450,78 +1096,92 @@ func handleMappingUpdate(ctx context.Context, config Configuration, newClientDat
 			log.Printf("❌ Failed to parse updated mapping %q: %v", mappingStr, err)
 			continue
 		}
-		newMappings = append(newMappings, mapping)
-	}
-	
-	// Allocate ports for new mappings
-	var newPortMappings []ServerPortMapping
-	for _, mapping := range newMappings {
-		allocatedPort, err := allocatePortForMapping(ctx, mapping)
+		mapping, err = resolveServiceMapping(newClientRegistration.mappingDetails(mapping), config.Services)
 		if err != nil {
-			log.Printf("❌ Failed to allocate port for updated mapping %+v: %v", mapping, err)
+			log.Printf("❌ Skipping updated mapping %s: %v", mappingStr, err)
 			continue
 		}
-		
-		portMapping := ServerPortMapping{
-			ClientMapping: mapping,
-			AllocatedPort: allocatedPort,
-		}
-		newPortMappings = append(newPortMappings, portMapping)
-		
-		log.Printf("🔄 Reallocated %s port %d for client mapping %d->%d", 
-			mapping.Protocol, allocatedPort, mapping.LocalPort, mapping.RemotePort)
+		newMappings = append(newMappings, mapping)
 	}
 	
+	// Allocate ports and bind listeners for new mappings, as on initial
+	// registration; mappings the client already had keep their allocation
+	newMappings, refused := refuseServiceTargets(newMappings, config)
+	listedMappings := newMappings
+	kept, newMappings, requestedPorts := affinity.reclaim(newClientRegistration.ClientID, newMappings, newClientRegistration.RequestedPorts, networkInfo, &newClientRegistration.NetworkInfo)
+	newPortMappings, listeners, failures := allocateMappings(ctx, newMappings, requestedPorts, config.AllocationConcurrency, networkInfo, &newClientRegistration.NetworkInfo)
+	failures = append(refused, failures...)
+
 	// Send updated port allocation back to client
-	updatedServerData, err := formatServerRegistrationData(networkInfo, newPortMappings)
+	updatedServerData, err := formatServerRegistrationData(networkInfo, append(kept, newPortMappings...), failures, "", config.Services, newClientRegistration.UpdateID, newClientRegistration.RegistrationID, localDiagnostics(config, networkInfo))
 	if err != nil {
 		log.Printf("❌ Failed to format updated server registration data: %v", err)
+		listeners.Close()
 		return
 	}
 	
-	err = signalingClient.PostSignal(config.SignalingURL, config.Mode, roomKey, updatedServerData)
+	err = announcement.Post(updatedServerData)
 	if err != nil {
 		log.Printf("❌ Failed to post updated server data: %v", err)
+		listeners.Close()
 		return
 	}
 	
-	log.Printf("✅ Successfully processed mapping update - %d new port allocations", len(newPortMappings))
+	// Mappings the client removed stop forwarding and free their ports
+	affinity.remove(newClientRegistration.ClientID, listedMappings)
+	affinity.record(newClientRegistration.ClientID, newPortMappings, listeners)
+	log.Printf("✅ Successfully processed mapping update - %d new port allocations, %d kept", len(newPortMappings), len(kept))
 	
 	// Start new port listeners
 	for _, portMapping := range newPortMappings {
 		mapping := portMapping.ClientMapping
 		allocatedPort := portMapping.AllocatedPort
+		logger := mappingLogger(mapping)
+		mappingCtx := affinity.forwarderContext(ctx, newClientRegistration.ClientID, mapping)
+		mapping = startICMPGateway(mappingCtx, logger, mapping, config.ICMPTargets)
 		
-		log.Printf("🚀 Starting updated %s server on port %d -> local service %d", 
-			mapping.Protocol, allocatedPort, mapping.RemotePort)
+		log.Printf("🚀 Starting updated %s server on port %d -> service %s", 
+			mapping.Protocol, allocatedPort, newServiceTarget(mapping))
+		checkGatewayTarget(logger, mapping)
+		startHealthCheck(mappingCtx, mapping, allocatedPort)
+		startBenchmarkSink(mappingCtx, mapping)
 		
 		if mapping.Protocol == "tcp" {
-			go runTCPServerOnPort(ctx, allocatedPort, mapping.RemotePort)
+			wg.Add(1)
+			go func(ln net.Listener, service *ServiceTarget) {
+				defer wg.Done()
+				serveTCPServer(mappingCtx, logger, ln, service, mapping.Compress, mapping.RelayMux)
+			}(listeners.tcp[allocatedPort], newServiceTarget(mapping))
 		} else {
 			// Apply same hole punching logic as initial setup
-			isLAN := detectLANConnection(networkInfo, &newClientRegistration.NetworkInfo)
-			if !isLAN && networkInfo.STUNResult != nil && newClientRegistration.NetworkInfo.STUNResult != nil &&
-			   networkInfo.STUNResult.CanHolePunch && newClientRegistration.NetworkInfo.STUNResult.CanHolePunch {
+			if !udpRelayed(mapping, networkInfo, &newClientRegistration.NetworkInfo) {
 				
 				log.Printf("🎯 Using UDP hole punching for updated port %d", allocatedPort)
-				go func(port, service int, client, server *NetworkInfo) {
-					err := runUDPServerWithHolePunching(ctx, port, service, client, server)
+				wg.Add(1)
+				go func(port int, service *ServiceTarget, client, server *NetworkInfo) {
+					defer wg.Done()
+					err := runUDPServerWithHolePunching(mappingCtx, logger, port, service, mapping.JitterBuffer, time.Duration(mapping.UDPCoalesceDelay), client, server)
 					if err != nil {
 						log.Printf("❌ UDP hole punching failed for updated port %d: %v, falling back to relay", port, err)
-						runUDPServerOnPort(ctx, port, service)
+						runUDPServerOnPort(mappingCtx, logger, port, service)
 					}
-				}(allocatedPort, mapping.RemotePort, &newClientRegistration.NetworkInfo, networkInfo)
+				}(allocatedPort, newServiceTarget(mapping), &newClientRegistration.NetworkInfo, networkInfo)
 			} else {
 				log.Printf("⚠️  Using UDP relay for updated port %d", allocatedPort)
-				go runUDPServerOnPort(ctx, allocatedPort, mapping.RemotePort)
+				wg.Add(1)
+				go func(conn *net.UDPConn, service *ServiceTarget) {
+					defer wg.Done()
+					serveUDPServer(mappingCtx, logger, conn, service)
+				}(listeners.udp[allocatedPort], newServiceTarget(mapping))
 			}
 		}
 	}
 }
 
 // discoverNetworkInfo discovers both public and private network information with NAT detection
-func discoverNetworkInfo(stunServer string) (*NetworkInfo, error) {
+func discoverNetworkInfo(config Configuration) (*NetworkInfo, error) {
 	info := &NetworkInfo{}
+	stunServer := config.STUNServer
 
 	// Get private IP
 	privateIP, err := getPrivateIP()
@@ -531,13 +1191,34 @@ func discoverNetworkInfo(stunServer string) (*NetworkInfo, error) {
 		info.PrivateAddr = privateIP
 	}
 
-	// Enhanced STUN discovery with NAT type detection
-	secondarySTUN := "stun.cloudflare.com:3478" // Use Cloudflare as secondary
-	if stunServer == secondarySTUN {
-		secondarySTUN = "stun.l.google.com:19302" // Fallback to Google
+	// The server always publishes its VPN address; a client does when it
+	// asks for the direct transport, and then needs neither STUN nor a
+	// hole punching port
+	if config.DirectAddr != "" && (config.Mode == "server" || config.Transport == TransportDirect) {
+		info.DirectAddr = config.DirectAddr
 	}
+	if config.Mode == "client" && config.Transport == TransportDirect {
+		info.STUNResult = &STUNResult{LocalAddr: info.PrivateAddr, NATType: NATTypeUnknown}
+		log.Printf("🔍 Direct transport: skipping STUN, private %s, direct %s", info.PrivateAddr, info.DirectAddr)
+		readiness.SetDiscovered()
+		return info, nil
+	}
+
+	// Enhanced STUN discovery with NAT type detection
+	secondarySTUN := secondarySTUNServer(stunServer)
 
-	stunResult, err := discoverNATType(stunServer, secondarySTUN)
+	var stunResult *STUNResult
+	if config.NATType != "" {
+		// A NAT type known from the config only needs the public address
+		natType, _ := parseNATType(config.NATType)
+		stunResult, err = knownNATType(stunServer, natType)
+	} else {
+		traceEvent("stun_start", "primary %s, secondary %s", stunServer, secondarySTUN)
+		stunResult, err = discoverNATType(stunServer, secondarySTUN)
+		if err != nil {
+			traceEvent("stun_end", "NAT detection failed: %v", err)
+		}
+	}
 	if err != nil {
 		// Fallback to basic STUN discovery
 		log.Printf("NAT detection failed, falling back to basic STUN: %v", err)
@@ -555,6 +1236,7 @@ func discoverNetworkInfo(stunServer string) (*NetworkInfo, error) {
 	} else {
 		info.PublicAddr = stunResult.PublicAddr
 		info.STUNResult = stunResult
+		traceEvent("stun_end", "public %s", stunResult.PublicAddr)
 		
 		// Allocate dedicated hole punching port
 		holePunchConn, err := createHolePunchingConn("")
@@ -566,18 +1248,58 @@ func discoverNetworkInfo(stunServer string) (*NetworkInfo, error) {
 		}
 	}
 
+	if config.HolePunchLocalPort > 0 {
+		bindFixedHolePunchPort(info, config.HolePunchLocalPort, stunServer)
+	}
+
+	traceEvent("nat_classified", "%s, can hole punch: %v", info.STUNResult.NATType, info.STUNResult.CanHolePunch)
+
 	log.Printf("🔍 Network Discovery Results:")
 	log.Printf("   Private: %s", info.PrivateAddr)
 	log.Printf("   Public: %s", info.PublicAddr)
 	log.Printf("   NAT Type: %s", info.STUNResult.NATType)
 	log.Printf("   Can Hole Punch: %v", info.STUNResult.CanHolePunch)
+	if v6 := info.STUNResult.IPv6; v6 != nil {
+		log.Printf("   IPv6: public %s, NAT Type %s, Can Hole Punch %v", v6.PublicAddr, v6.NATType, v6.CanHolePunch)
+	}
 	log.Printf("   Hole Punch Port: %d", info.HolePunchPort)
 
+	readiness.SetDiscovered()
 	return info, nil
 }
 
-// getPrivateIP gets the local private IP address
+// bindFixedHolePunchPort switches hole punching to a fixed local port and
+// discovers that port's reflexive address, so the NAT mapping peers punch
+// towards stays the same across restarts. Busy ports keep the ephemeral port.
+func bindFixedHolePunchPort(info *NetworkInfo, port int, stunServer string) {
+	conn, err := createHolePunchingConn(net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		log.Printf("⚠️  Hole punch port %d unavailable, using ephemeral port: %v", port, err)
+		return
+	}
+	defer conn.Close()
+
+	publicAddr, err := performSTUNDiscoveryOnConn(conn, stunServer)
+	if err != nil {
+		log.Printf("⚠️  STUN discovery from hole punch port %d failed, using ephemeral port: %v", port, err)
+		return
+	}
+
+	info.PublicAddr = publicAddr
+	info.HolePunchPort = port
+	info.HolePunchPortFixed = true
+	if info.STUNResult != nil {
+		info.STUNResult.PublicAddr = publicAddr
+	}
+	log.Printf("📌 Hole punching bound to fixed port %d (public %s)", port, publicAddr)
+}
+
+// getPrivateIP gets the local private IP address, which is the address of
+// the bindInterface when one is set
 func getPrivateIP() (string, error) {
+	if bindIP != nil {
+		return bindIP.String(), nil
+	}
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		return "", err
@@ -590,8 +1312,8 @@ func getPrivateIP() (string, error) {
 
 // isLANAddress checks if two addresses are in the same LAN using multiple strategies
 func isLANAddress(addr1, addr2 string) bool {
-	ip1 := net.ParseIP(extractIP(addr1))
-	ip2 := net.ParseIP(extractIP(addr2))
+	ip1 := normalizeIP(net.ParseIP(extractIP(addr1)))
+	ip2 := normalizeIP(net.ParseIP(extractIP(addr2)))
 	
 	if ip1 == nil || ip2 == nil {
 		return false
@@ -678,16 +1400,32 @@ func detectLANConnection(clientInfo, serverInfo *NetworkInfo) bool {
 	return false
 }
 
-// extractIP extracts IP from "ip:port" format
+// extractIP extracts IP from "ip:port" format. IPv4-mapped IPv6 addresses
+// (::ffff:192.168.1.1) are returned in IPv4 form so they compare equal to
+// the same address reported by an IPv4 socket.
 func extractIP(addr string) string {
-	if host, _, err := net.SplitHostPort(addr); err == nil {
-		return host
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if ip := normalizeIP(net.ParseIP(host)); ip != nil && ip.To4() != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// normalizeIP returns IPv4 addresses, including IPv4-mapped IPv6 ones, in
+// their 4-byte form so range and subnet checks treat them alike
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
-	return addr
+	return ip
 }
 
 // isPrivateIP checks if IP is in private ranges
 func isPrivateIP(ip net.IP) bool {
+	ip = normalizeIP(ip)
 	private := []string{
 		"10.0.0.0/8",
 		"172.16.0.0/12", 
@@ -714,17 +1452,25 @@ func formatNetworkInfo(info *NetworkInfo) string {
 }
 
 // formatClientRegistrationData formats client registration data including mappings
-func formatClientRegistrationData(info *NetworkInfo, mappings []PortMapping) (string, error) {
+func formatClientRegistrationData(info *NetworkInfo, mappings []PortMapping, config Configuration, requestedPorts map[string]int, registrationID string) (string, error) {
 	// Convert PortMapping structs to string format
 	var mappingStrings []string
 	for _, mapping := range mappings {
-		mappingStr := fmt.Sprintf("%s:%d:%d", mapping.Protocol, mapping.LocalPort, mapping.RemotePort)
-		mappingStrings = append(mappingStrings, mappingStr)
+		mappingStrings = append(mappingStrings, mapping.String())
 	}
 	
 	clientData := ClientRegistrationData{
 		NetworkInfo: *info,
 		Mappings:    mappingStrings,
+		UDPMux:      config.UDPMux,
+		UDPFin:      config.UDPFin,
+		Transport:   config.Transport,
+
+		MappingDetails: mappings,
+		RequestedPorts: requestedPorts,
+		ClientID:       config.ClientID,
+		RegistrationID: registrationID,
+		Diagnostics:    localDiagnostics(config, info),
 	}
 	
 	jsonData, err := json.Marshal(clientData)
@@ -736,6 +1482,9 @@ func formatClientRegistrationData(info *NetworkInfo, mappings []PortMapping) (st
 
 // parseClientRegistrationData parses client registration data from JSON
 func parseClientRegistrationData(data string) (*ClientRegistrationData, error) {
+	if err := checkJSON([]byte(data)); err != nil {
+		return nil, err
+	}
 	var clientData ClientRegistrationData
 	err := json.Unmarshal([]byte(data), &clientData)
 	if err != nil {
@@ -745,10 +1494,19 @@ func parseClientRegistrationData(data string) (*ClientRegistrationData, error) {
 }
 
 // formatServerRegistrationData formats server registration data including port mappings
-func formatServerRegistrationData(info *NetworkInfo, portMappings []ServerPortMapping) (string, error) {
+// and, when the server is out of ports for all of them, the refusal
+func formatServerRegistrationData(info *NetworkInfo, portMappings []ServerPortMapping, failures []MappingFailure, quicFingerprint string, services map[string]int, ackedUpdateID, ackedRegistrationID string, diagnostics *Diagnostics) (string, error) {
 	serverData := ServerRegistrationData{
-		NetworkInfo:  *info,
-		PortMappings: portMappings,
+		NetworkInfo:         *info,
+		PortMappings:        portMappings,
+		FailedMappings:      failures,
+		QUICFingerprint:     quicFingerprint,
+		Services:            services,
+		AckedUpdateID:       ackedUpdateID,
+		AckedRegistrationID: ackedRegistrationID,
+		Capabilities:        serverCapabilities(),
+		Diagnostics:         diagnostics,
+		Error:               capacityRejection(portMappings, failures),
 	}
 	
 	jsonData, err := json.Marshal(serverData)
@@ -758,8 +1516,30 @@ func formatServerRegistrationData(info *NetworkInfo, portMappings []ServerPortMa
 	return string(jsonData), nil
 }
 
+// staleAllocation reports whether serverData answers an earlier client
+// registration than the one identified by registrationID. Servers that echo
+// no registration ID are judged by comparing the allocation with stale, the
+// server data the previous session used, heartbeats aside.
+func staleAllocation(serverData *ServerRegistrationData, registrationID, stale string) bool {
+	if serverData.AckedRegistrationID != "" {
+		return serverData.AckedRegistrationID != registrationID
+	}
+	previous, err := parseServerRegistrationData(stale)
+	if err != nil {
+		return false
+	}
+	current := *serverData
+	current.Heartbeat, previous.Heartbeat = nil, nil
+	currentJSON, _ := json.Marshal(current)
+	previousJSON, _ := json.Marshal(previous)
+	return string(currentJSON) == string(previousJSON)
+}
+
 // parseServerRegistrationData parses server registration data from JSON
 func parseServerRegistrationData(data string) (*ServerRegistrationData, error) {
+	if err := checkJSON([]byte(data)); err != nil {
+		return nil, err
+	}
 	var serverData ServerRegistrationData
 	err := json.Unmarshal([]byte(data), &serverData)
 	if err != nil {
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSignaling is a signaling server that hands every posted server
+// registration to onPost before answering it
+func fakeSignaling(t *testing.T, onPost func(*ServerRegistrationData)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var signal SignalingData
+		if err := json.NewDecoder(r.Body).Decode(&signal); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := parseServerRegistrationData(signal.Data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		onPost(data)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// postMappingUpdate runs the server's handling of a client registering
+// mappings, posting the allocation to signalingURL
+func postMappingUpdate(t *testing.T, ctx context.Context, signalingURL, clientID string, affinity *affinityCache, wg *sync.WaitGroup, mappings ...PortMapping) {
+	t.Helper()
+	config := Configuration{Mode: "server", SignalingURL: signalingURL, ClientID: clientID}
+	clientInfo := &NetworkInfo{PrivateAddr: "127.0.0.1", PublicAddr: "127.0.0.1:1"}
+	clientData, err := formatClientRegistrationData(clientInfo, mappings, config, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInfo := &NetworkInfo{PrivateAddr: "127.0.0.1", PublicAddr: "127.0.0.1:1"}
+	signalingClient := NewSignalingClient(config)
+	announcement := newServerAnnouncement(func(data string) error {
+		return signalingClient.PostSignal(signalingURL, config.Mode, "room-server", data)
+	})
+	handleMappingUpdate(ctx, config, clientData, serverInfo, announcement, affinity, wg)
+}
+
+func TestServerListensBeforePostingAllocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// Checked while the signaling server holds the post, so before the
+	// client could learn the ports
+	accepting := make(map[int]bool)
+	var posted []ServerPortMapping
+	signaling := fakeSignaling(t, func(data *ServerRegistrationData) {
+		posted = data.PortMappings
+		for _, pm := range data.PortMappings {
+			addr := "127.0.0.1:" + strconv.Itoa(pm.AllocatedPort)
+			if pm.ClientMapping.Protocol == "tcp" {
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err == nil {
+					conn.Close()
+				}
+				accepting[pm.AllocatedPort] = err == nil
+				continue
+			}
+			// A bound UDP port cannot be bound again
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: pm.AllocatedPort})
+			if err == nil {
+				conn.Close()
+			}
+			accepting[pm.AllocatedPort] = err != nil
+		}
+	})
+
+	postMappingUpdate(t, ctx, signaling.URL, "", newAffinityCache(0), &wg,
+		PortMapping{Protocol: "tcp", LocalPort: 18080, RemotePort: 1},
+		PortMapping{Protocol: "udp", LocalPort: 18053, RemotePort: 2})
+
+	if len(posted) != 2 {
+		t.Fatalf("posted %d allocations, want 2", len(posted))
+	}
+	for _, pm := range posted {
+		if !accepting[pm.AllocatedPort] {
+			t.Errorf("%s port %d was not bound when the allocation was posted", pm.ClientMapping.Protocol, pm.AllocatedPort)
+		}
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.5:80", "192.168.1.5"},
+		{"192.168.1.5", "192.168.1.5"},
+		{"[::ffff:192.168.1.5]:80", "192.168.1.5"},
+		{"::ffff:192.168.1.5", "192.168.1.5"},
+		{"[::ffff:c0a8:105]:80", "192.168.1.5"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"example.com:80", "example.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := extractIP(tt.addr); got != tt.want {
+			t.Errorf("extractIP(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want net.IP
+	}{
+		{net.ParseIP("::ffff:192.168.1.5"), net.IP{192, 168, 1, 5}},
+		{net.ParseIP("192.168.1.5"), net.IP{192, 168, 1, 5}},
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1")},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.ip); !bytes.Equal(got, tt.want) {
+			t.Errorf("normalizeIP(%v) = %v (%d bytes), want %v (%d bytes)", tt.ip, got, len(got), tt.want, len(tt.want))
+		}
+	}
+}
+
+func TestIsLANAddressMappedIPv4(t *testing.T) {
+	tests := []struct {
+		addr1, addr2 string
+		want         bool
+	}{
+		{"[::ffff:192.168.1.5]:80", "192.168.1.9:4000", true},
+		{"192.168.1.5:80", "[::ffff:192.168.1.9]:4000", true},
+		{"[::ffff:192.168.1.5]:80", "[::ffff:192.168.7.9]:4000", true},
+		{"::ffff:10.1.2.3", "10.200.0.1", true},
+		{"[::ffff:172.16.0.1]:1", "172.31.255.1:1", true},
+		{"[::ffff:192.168.1.5]:80", "10.0.0.1:80", false},
+		{"[::ffff:8.8.8.8]:53", "8.8.8.9:53", false},
+		{"[::ffff:192.168.1.5]:80", "[fd00::1]:80", false},
+		{"[::ffff:192.168.1.5]:80", "", false},
+	}
+	for _, tt := range tests {
+		if got := isLANAddress(tt.addr1, tt.addr2); got != tt.want {
+			t.Errorf("isLANAddress(%q, %q) = %v, want %v", tt.addr1, tt.addr2, got, tt.want)
+		}
+	}
+}
+
+func TestStaleAllocation(t *testing.T) {
+	info := &NetworkInfo{PrivateAddr: "127.0.0.1", PublicAddr: "127.0.0.1:1"}
+	mappings := []ServerPortMapping{{ClientMapping: PortMapping{Protocol: "tcp", LocalPort: 8080, RemotePort: 80}, AllocatedPort: 40000}}
+	allocation := func(registrationID string, seq uint64) (string, *ServerRegistrationData) {
+		raw, err := formatServerRegistrationData(info, mappings, nil, "", nil, "", registrationID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw, err = stampHeartbeat(raw, seq); err != nil {
+			t.Fatal(err)
+		}
+		data, err := parseServerRegistrationData(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw, data
+	}
+
+	// Servers echoing registration IDs answer this registration or not
+	previous, _ := allocation("first", 0)
+	_, restamped := allocation("first", 7)
+	if !staleAllocation(restamped, "second", previous) {
+		t.Error("restamped allocation of an earlier registration accepted")
+	}
+	_, answer := allocation("second", 8)
+	if staleAllocation(answer, "second", previous) {
+		t.Error("allocation answering this registration refused")
+	}
+
+	// Older servers echo nothing; their allocation is compared without the
+	// heartbeat
+	previous, _ = allocation("", 0)
+	_, restamped = allocation("", 7)
+	if !staleAllocation(restamped, "second", previous) {
+		t.Error("restamped previous allocation of an older server accepted")
+	}
+	if staleAllocation(restamped, "second", "") {
+		t.Error("allocation refused on a first registration")
+	}
+	mappings[0].AllocatedPort = 40001
+	_, moved := allocation("", 7)
+	if staleAllocation(moved, "second", previous) {
+		t.Error("new allocation of an older server refused")
+	}
+}
@@ -0,0 +1,190 @@
+// Package main - Recent throughput samples per mapping
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sampleInterval is the span of one throughput sample
+	sampleInterval = time.Second
+	// sampleWindow is how many samples are kept per mapping
+	sampleWindow = 60
+	// maxSampledMappings bounds the mappings with samples, so memory stays
+	// bounded however many mappings there are
+	maxSampledMappings = 256
+)
+
+// Sample is the traffic of one mapping during one sampleInterval
+type Sample struct {
+	Time     time.Time `json:"time"`     // End of the interval
+	BytesIn  int64     `json:"bytesIn"`  // Bytes received from the side that opened the connections
+	BytesOut int64     `json:"bytesOut"` // Bytes sent back to it
+	Conns    int       `json:"conns"`    // Connections and sessions open at the end of the interval
+}
+
+// sampleRing holds the latest samples of a mapping
+type sampleRing struct {
+	samples [sampleWindow]Sample
+	next    int // Index the next sample is written at
+	count   int
+	idle    int // Samples in a row without traffic or connections
+}
+
+// add appends s, overwriting the oldest sample once the ring is full
+func (r *sampleRing) add(s Sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % sampleWindow
+	r.count = min(r.count+1, sampleWindow)
+	if s.BytesIn == 0 && s.BytesOut == 0 && s.Conns == 0 {
+		r.idle++
+	} else {
+		r.idle = 0
+	}
+}
+
+// list returns the samples oldest first
+func (r *sampleRing) list() []Sample {
+	samples := make([]Sample, 0, r.count)
+	for i := r.count; i > 0; i-- {
+		samples = append(samples, r.samples[(r.next-i+sampleWindow)%sampleWindow])
+	}
+	return samples
+}
+
+// TrafficSampler keeps the latest throughput samples of each mapping, taken
+// every sampleInterval from the byte counters of the connection registry,
+// so it covers what the conns command lists. A mapping gets a ring once it
+// carries traffic and loses it after a whole window idle; beyond
+// maxSampledMappings further mappings are not sampled.
+type TrafficSampler struct {
+	rings map[string]*sampleRing
+	mutex sync.Mutex
+}
+
+// trafficSamples is the process-wide throughput history
+var trafficSamples = &TrafficSampler{rings: make(map[string]*sampleRing)}
+
+// Run samples every sampleInterval until ctx is done
+func (s *TrafficSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sample(now)
+		}
+	}
+}
+
+// sample adds one sample to the ring of every sampled mapping
+func (s *TrafficSampler) sample(now time.Time) {
+	traffic := activeConns.takeEnded()
+	conns := make(map[string]int)
+	for _, conn := range activeConns.List() {
+		in, out := conn.unsampled()
+		count := traffic[conn.Mapping]
+		count.in += in
+		count.out += out
+		traffic[conn.Mapping] = count
+		conns[conn.Mapping]++
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range traffic {
+		if s.rings[key] == nil && len(s.rings) < maxSampledMappings {
+			s.rings[key] = &sampleRing{}
+		}
+	}
+	for key, ring := range s.rings {
+		count := traffic[key]
+		ring.add(Sample{Time: now, BytesIn: count.in, BytesOut: count.out, Conns: conns[key]})
+		if ring.idle >= sampleWindow {
+			delete(s.rings, key)
+		}
+	}
+}
+
+// Samples returns the latest samples of the mapping keyed mappingKey, as in
+// /readyz, oldest first; nil when it has none
+func (s *TrafficSampler) Samples(mappingKey string) []Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ring := s.rings[mappingKey]
+	if ring == nil {
+		return nil
+	}
+	return ring.list()
+}
+
+// All returns the latest samples of every sampled mapping
+func (s *TrafficSampler) All() map[string][]Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := make(map[string][]Sample, len(s.rings))
+	for key, ring := range s.rings {
+		all[key] = ring.list()
+	}
+	return all
+}
+
+// Reset clears the samples of the mapping keyed mappingKey, or of every
+// mapping when mappingKey is empty, and returns how many mappings it cleared
+func (s *TrafficSampler) Reset(mappingKey string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mappingKey != "" {
+		if s.rings[mappingKey] == nil {
+			return 0
+		}
+		delete(s.rings, mappingKey)
+		return 1
+	}
+	cleared := len(s.rings)
+	clear(s.rings)
+	return cleared
+}
+
+// runStatsCommand handles the console stats command: the statistics and
+// each sampled mapping's throughput over the window, or with "reset" the
+// clearing of samples
+func runStatsCommand(w io.Writer, parts []string) {
+	if len(parts) > 1 {
+		if parts[1] != "reset" || len(parts) > 3 {
+			fmt.Fprintln(w, "Usage: stats [reset [mapping]]")
+			return
+		}
+		mappingKey := ""
+		if len(parts) == 3 {
+			mappingKey = parts[2]
+		}
+		fmt.Fprintf(w, "🧹 Cleared the samples of %d mappings\n", trafficSamples.Reset(mappingKey))
+		return
+	}
+
+	fmt.Fprintf(w, "📊 %s\n", &globalStats)
+	all := trafficSamples.All()
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var in, out, peak int64
+		for _, sample := range all[key] {
+			in += sample.BytesIn
+			out += sample.BytesOut
+			peak = max(peak, sample.BytesIn+sample.BytesOut)
+		}
+		span := time.Duration(len(all[key])) * sampleInterval
+		fmt.Fprintf(w, "  %s: %d bytes in, %d bytes out over the last %v, peak %d bytes/s\n", key, in, out, span, peak)
+	}
+}
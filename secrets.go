@@ -0,0 +1,97 @@
+// Package main - Secret references in configuration values
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// secretRefPattern matches ${env:VAR} and ${file:/path} references
+var secretRefPattern = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+// resolveSecretRef returns the value a single reference points to. File
+// contents have their trailing newline trimmed, as secret files usually end
+// with one.
+func resolveSecretRef(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	default:
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+}
+
+// expandSecretRefs replaces every reference in s with the value it points to
+func expandSecretRefs(s string) (string, error) {
+	var firstErr error
+	expanded := secretRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		match := secretRefPattern.FindStringSubmatch(ref)
+		value, err := resolveSecretRef(match[1], match[2])
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", ref, err)
+		}
+		return value
+	})
+	return expanded, firstErr
+}
+
+// resolveSecrets expands secret references in every string value of the
+// configuration, including those of mappings, so secrets such as tokens
+// embedded in the signaling URL can stay out of the config file
+func resolveSecrets(config *Configuration) error {
+	return resolveSecretsIn(reflect.ValueOf(config).Elem(), "")
+}
+
+// resolveSecretsIn walks v and expands references in settable strings
+func resolveSecretsIn(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !v.CanSet() || !strings.Contains(v.String(), "${") {
+			return nil
+		}
+		expanded, err := expandSecretRefs(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(expanded)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveSecretsIn(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = t.Field(i).Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := resolveSecretsIn(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveSecretsIn(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
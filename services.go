@@ -0,0 +1,71 @@
+// Package main - Named services advertised by the server
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// serviceNames lists advertised service names in sorted order for messages
+func serviceNames(services map[string]int) string {
+	if len(services) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validateServices checks the server's advertised services
+func validateServices(services map[string]int) error {
+	for name, port := range services {
+		if name == "" || strings.ContainsAny(name, ":@") {
+			return fmt.Errorf("invalid service name %q", name)
+		}
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("service %s: invalid port %d", name, port)
+		}
+	}
+	return nil
+}
+
+// resolveServiceMapping points a mapping that names a service at the port
+// the server advertises for it. Mappings with a numeric remote port are
+// returned unchanged.
+func resolveServiceMapping(mapping PortMapping, services map[string]int) (PortMapping, error) {
+	if mapping.Service == "" {
+		return mapping, nil
+	}
+	port, ok := services[mapping.Service]
+	if !ok {
+		return mapping, fmt.Errorf("unknown service @%s (advertised: %s)", mapping.Service, serviceNames(services))
+	}
+	mapping.RemotePort = port
+	return mapping, nil
+}
+
+// reportServiceMappings logs which service mappings the server resolved and
+// warns about those it left out
+func reportServiceMappings(mappings []PortMapping, serverData *ServerRegistrationData) {
+	for _, mapping := range mappings {
+		if mapping.Service == "" {
+			continue
+		}
+		found := false
+		for _, pm := range serverData.PortMappings {
+			if pm.ClientMapping.String() == mapping.String() {
+				log.Printf("🏷️  Service @%s resolved to server port %d", mapping.Service, pm.ClientMapping.RemotePort)
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("⚠️  Mapping %s not allocated: server advertises %s", mapping, serviceNames(serverData.Services))
+		}
+	}
+}
@@ -0,0 +1,422 @@
+// Package main - Server-side service targets
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceResolveTTL is how long resolved service addresses are reused
+const serviceResolveTTL = 30 * time.Second
+
+// defaultLocalDialBackoff is the wait before the first retry of a failed
+// service dial unless localDialBackoff is set
+const defaultLocalDialBackoff = 200 * time.Millisecond
+
+// localDialRetries is how often a failed dial to the local service is
+// retried, doubling localDialBackoff each time, so a connection arriving
+// while the service restarts is held until it is back. Zero gives up at
+// once.
+var localDialRetries int
+
+// localDialBackoff is the wait before the first retry of a service dial
+var localDialBackoff = defaultLocalDialBackoff
+
+// defaultServiceFallbackDelay is the head start of the first address family
+// unless serviceFallbackDelay is set, the same as net.Dialer's
+const defaultServiceFallbackDelay = 300 * time.Millisecond
+
+// serviceFallbackDelay is how long a TCP dial to a service resolving to both
+// IPv6 and IPv4 addresses tries the family of the first address alone
+// before racing the other family, so a family that is down cannot stall
+// forwarding (RFC 6555 happy eyeballs)
+var serviceFallbackDelay = defaultServiceFallbackDelay
+
+// ServiceTarget is where the server forwards a mapping's traffic: the local
+// service on 127.0.0.1:remotePort, or a serviceTarget host resolved on the
+// server at connection time. The host "gateway" is the server's default
+// gateway, looked up in its routing table.
+type ServiceTarget struct {
+	host          string
+	port          string
+	addrs         []string
+	expires       time.Time
+	poolSize      int            // Pre-dialed TCP connections, 0 disables the pool
+	pool          *LocalConnPool // Started on the first TCP dial
+	timeout       time.Duration  // Dial timeout of the mapping
+	sourcePort    string         // Mapping's sourcePort setting for UDP relay sessions
+	udpTimeout    time.Duration  // Idle timeout of UDP relay sessions
+	udpSessionKey string         // Mapping's udpSessionKey setting for UDP relay sessions
+	mutex         sync.Mutex
+}
+
+// newServiceTarget returns the target of a mapping
+func newServiceTarget(mapping PortMapping) *ServiceTarget {
+	target := &ServiceTarget{host: "127.0.0.1", port: strconv.Itoa(mapping.RemotePort), timeout: mapping.dialTimeout(), sourcePort: mapping.SourcePort, udpTimeout: mapping.udpSessionTimeout(), udpSessionKey: mapping.UDPSessionKey}
+	if mapping.ServiceTarget == GatewayServiceHost {
+		target.host = GatewayServiceHost
+	} else if mapping.ServiceTarget != "" {
+		if host, port, err := net.SplitHostPort(mapping.ServiceTarget); err == nil {
+			target.host, target.port = host, port
+		}
+	}
+	if mapping.LocalConnPool && mapping.Protocol == "tcp" {
+		target.poolSize = mapping.LocalConnPoolSize
+		if target.poolSize <= 0 {
+			target.poolSize = defaultLocalConnPoolSize
+		}
+	}
+	return target
+}
+
+// validateServiceTarget checks that a serviceTarget is a host:port, or
+// "gateway" to use the remote port on the server's default gateway
+func validateServiceTarget(target string) error {
+	if target == GatewayServiceHost {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid serviceTarget %q: %w", target, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid serviceTarget %q: missing host", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid serviceTarget %q: bad port", target)
+	}
+	return nil
+}
+
+// splitAllowedTarget splits a serviceTargets entry into its host, a name,
+// IP address or CIDR range, and its port, empty when every port is allowed
+func splitAllowedTarget(entry string) (host, port string) {
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"), ""
+	}
+	if port == "*" {
+		port = ""
+	}
+	return host, port
+}
+
+// validateServiceTargets checks the server's serviceTargets entries
+func validateServiceTargets(entries []string) error {
+	for _, entry := range entries {
+		host, port := splitAllowedTarget(entry)
+		if host == "" {
+			return fmt.Errorf("invalid serviceTargets entry %q: missing host", entry)
+		}
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid serviceTargets entry %q: bad port", entry)
+		}
+	}
+	return nil
+}
+
+// allowsTarget reports whether the serviceTargets entry allows host:port. A
+// name matches itself only, so a name resolving into an allowed range is
+// still refused.
+func allowsTarget(entry, host, port string) bool {
+	allowedHost, allowedPort := splitAllowedTarget(entry)
+	if allowedPort != "" && allowedPort != port {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if _, ipNet, err := net.ParseCIDR(allowedHost); err == nil {
+		return ip != nil && ipNet.Contains(ip)
+	}
+	if allowedIP := net.ParseIP(allowedHost); allowedIP != nil {
+		return ip != nil && allowedIP.Equal(ip)
+	}
+	return strings.EqualFold(allowedHost, host)
+}
+
+// checkServiceTarget returns an error unless the serviceTarget of a mapping
+// a client sent is listed in the server's serviceTargets, since the server
+// would otherwise dial any host the client names. Mappings without one
+// reach the server's own 127.0.0.1 and are always allowed.
+func checkServiceTarget(mapping PortMapping, allowed []string) error {
+	if mapping.ServiceTarget == "" || mapping.Protocol == "icmp" {
+		return nil
+	}
+	if err := validateServiceTarget(mapping.ServiceTarget); err != nil {
+		return err
+	}
+	target := newServiceTarget(mapping)
+	for _, entry := range allowed {
+		if allowsTarget(entry, target.host, target.port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("serviceTarget %s is not allowed by the server's serviceTargets", target)
+}
+
+// refuseServiceTargets splits off the mappings whose serviceTarget the
+// server does not allow, and ICMP mappings when it allows no ICMP targets,
+// returning them as failures for the client
+func refuseServiceTargets(mappings []PortMapping, config Configuration) ([]PortMapping, []MappingFailure) {
+	var accepted []PortMapping
+	var refused []MappingFailure
+	for _, mapping := range mappings {
+		err := checkServiceTarget(mapping, config.ServiceTargets)
+		if err == nil && mapping.Protocol == "icmp" {
+			err = checkICMPMapping(mapping, config.ICMPTargets)
+		}
+		if err != nil {
+			log.Printf("🚫 Refusing mapping %s: %v", mapping, err)
+			refused = append(refused, MappingFailure{Mapping: mapping.String(), Error: err.Error()})
+			continue
+		}
+		accepted = append(accepted, mapping)
+	}
+	return accepted, refused
+}
+
+// String returns the target as host:port
+func (t *ServiceTarget) String() string {
+	return net.JoinHostPort(t.host, t.port)
+}
+
+// isLoopback reports whether the target is on this host's loopback
+// interface
+func (t *ServiceTarget) isLoopback() bool {
+	if strings.EqualFold(t.host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(t.host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// resolve returns the target's addresses, from cache unless refresh is set
+// or the cache expired
+func (t *ServiceTarget) resolve(refresh bool) ([]string, error) {
+	if net.ParseIP(t.host) != nil {
+		return []string{t.String()}, nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !refresh && len(t.addrs) > 0 && time.Now().Before(t.expires) {
+		return t.addrs, nil
+	}
+
+	var ips []string
+	if t.host == GatewayServiceHost {
+		gateway, err := resolveGatewayHost()
+		if err != nil {
+			return nil, err
+		}
+		ips = []string{gateway}
+	} else {
+		var err error
+		ips, err = net.LookupHost(t.host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve service %s: %w", t.host, err)
+		}
+	}
+	t.addrs = t.addrs[:0]
+	for _, ip := range ips {
+		t.addrs = append(t.addrs, net.JoinHostPort(ip, t.port))
+	}
+	t.expires = time.Now().Add(serviceResolveTTL)
+	return t.addrs, nil
+}
+
+// Dial connects to the target, retrying a failed dial localDialRetries
+// times with backoff
+func (t *ServiceTarget) Dial(network string) (net.Conn, error) {
+	conn, err := t.dialPooled(network)
+	backoff := localDialBackoff
+	for attempt := 1; err != nil && attempt <= localDialRetries; attempt++ {
+		defaultLogger.WithComponent("service").Debugf("Dial to %s failed, retry %d/%d in %v: %v", t, attempt, localDialRetries, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		conn, err = t.dialPooled(network)
+	}
+	return conn, err
+}
+
+// dialPooled connects to the target, taking TCP connections from the pool
+// when the mapping enables one
+func (t *ServiceTarget) dialPooled(network string) (net.Conn, error) {
+	if network != "tcp" || t.poolSize == 0 {
+		return t.dial(network)
+	}
+
+	t.mutex.Lock()
+	if t.pool == nil {
+		t.pool = NewLocalConnPool(t, t.poolSize)
+	}
+	pool := t.pool
+	t.mutex.Unlock()
+	return pool.Get()
+}
+
+// Close stops the target's connection pool, if one was started
+func (t *ServiceTarget) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pool != nil {
+		t.pool.Close()
+		t.pool = nil
+	}
+}
+
+// dial connects to the target directly. If every cached address fails the
+// name is resolved again, since the service may have moved.
+func (t *ServiceTarget) dial(network string) (net.Conn, error) {
+	addrs, err := t.resolve(false)
+	if err == nil {
+		if conn, err := dialFirst(network, addrs, t.timeout); err == nil {
+			return conn, nil
+		}
+	}
+
+	addrs, err = t.resolve(true)
+	if err != nil {
+		return nil, err
+	}
+	return dialFirst(network, addrs, t.timeout)
+}
+
+// checkGatewayTarget resolves a gateway target when its mapping starts, so
+// the gateway in use is logged and a missing default route is reported early
+func checkGatewayTarget(logger *Logger, mapping PortMapping) {
+	if mapping.ServiceTarget != GatewayServiceHost {
+		return
+	}
+	if _, err := newServiceTarget(mapping).resolve(false); err != nil {
+		logger.Warnf("⚠️  Gateway service target unavailable: %v", err)
+	}
+}
+
+// Addr returns the first resolved address of the target, or the unresolved
+// host:port if resolution fails
+func (t *ServiceTarget) Addr() string {
+	addrs, err := t.resolve(false)
+	if err != nil {
+		return t.String()
+	}
+	return addrs[0]
+}
+
+// UDPAddr returns the first resolved address of the target
+func (t *ServiceTarget) UDPAddr() (*net.UDPAddr, error) {
+	addrs, err := t.resolve(false)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addrs[0])
+}
+
+// dialFirst dials addrs in order and returns the first connection made.
+// TCP dials to addresses of both families race the families, giving the
+// first address's family a head start of serviceFallbackDelay.
+func dialFirst(network string, addrs []string, timeout time.Duration) (net.Conn, error) {
+	primaries, fallbacks := splitAddrFamilies(addrs)
+	if network != "tcp" || len(fallbacks) == 0 {
+		return dialSerial(context.Background(), network, addrs, timeout)
+	}
+	return dialParallel(network, primaries, fallbacks, timeout)
+}
+
+// splitAddrFamilies splits addrs into those of the first address's family
+// and those of the other family, keeping their order
+func splitAddrFamilies(addrs []string) (primaries, fallbacks []string) {
+	isIPv4 := func(addr string) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		return ip == nil || ip.To4() != nil
+	}
+	for _, addr := range addrs {
+		if len(primaries) == 0 || isIPv4(addr) == isIPv4(primaries[0]) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial dials addrs in order until one connects or ctx is done
+func dialSerial(ctx context.Context, network string, addrs []string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialParallel dials primaries, and fallbacks once serviceFallbackDelay
+// passed or the primaries failed, returning the first connection made. The
+// losing dial is cancelled, and a connection it made anyway is closed.
+func dialParallel(network string, primaries, fallbacks []string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	race := func(addrs []string) {
+		conn, err := dialSerial(ctx, network, addrs, timeout)
+		results <- dialResult{conn, err}
+	}
+	go race(primaries)
+	fallback := time.NewTimer(serviceFallbackDelay)
+	defer fallback.Stop()
+
+	pending, fallbackStarted := 1, false
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-fallback.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestCheckServiceTarget(t *testing.T) {
+	allowed := []string{"db.internal:5432", "10.0.0.0/24", "192.168.1.9:*", "[fd00::/64]:443", "gateway:80"}
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"", true},
+		{"db.internal:5432", true},
+		{"DB.internal:5432", true},
+		{"db.internal:5433", false},
+		{"10.0.0.7:22", true},
+		{"10.0.1.7:22", false},
+		{"192.168.1.9:8080", true},
+		{"[fd00::1]:443", true},
+		{"[fd00::1]:80", false},
+		{"gateway:80", true},
+		{"gateway:443", false},
+		{"169.254.169.254:80", false},
+		{"localhost:22", false},
+	}
+	for _, tt := range tests {
+		mapping := PortMapping{Protocol: "tcp", LocalPort: 1000, RemotePort: 2000, ServiceTarget: tt.target}
+		err := checkServiceTarget(mapping, allowed)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkServiceTarget(%q) = %v, want allowed %v", tt.target, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckServiceTargetGatewayPort(t *testing.T) {
+	// A bare "gateway" target dials the mapping's remote port
+	mapping := PortMapping{Protocol: "tcp", LocalPort: 1000, RemotePort: 80, ServiceTarget: GatewayServiceHost}
+	if err := checkServiceTarget(mapping, []string{"gateway:80"}); err != nil {
+		t.Errorf("gateway on port 80 refused: %v", err)
+	}
+	mapping.RemotePort = 22
+	if err := checkServiceTarget(mapping, []string{"gateway:80"}); err == nil {
+		t.Error("gateway on port 22 allowed by gateway:80")
+	}
+}
+
+func TestRefuseServiceTargets(t *testing.T) {
+	mappings := []PortMapping{
+		{Protocol: "tcp", LocalPort: 1, RemotePort: 22},
+		{Protocol: "tcp", LocalPort: 2, RemotePort: 5432, ServiceTarget: "db.internal:5432"},
+		{Protocol: "udp", LocalPort: 3, RemotePort: 53, ServiceTarget: "10.9.9.9:53"},
+	}
+
+	accepted, refused := refuseServiceTargets(mappings, Configuration{})
+	if len(accepted) != 1 || accepted[0].RemotePort != 22 {
+		t.Errorf("without serviceTargets accepted %v, want only the local mapping", accepted)
+	}
+	if len(refused) != 2 {
+		t.Fatalf("without serviceTargets refused %d mappings, want 2", len(refused))
+	}
+	if refused[0].Mapping != mappings[1].String() || refused[0].Error == "" {
+		t.Errorf("refused[0] = %+v, want mapping %s with an error", refused[0], mappings[1])
+	}
+
+	accepted, refused = refuseServiceTargets(mappings, Configuration{ServiceTargets: []string{"db.internal"}})
+	if len(accepted) != 2 || len(refused) != 1 || refused[0].Mapping != mappings[2].String() {
+		t.Errorf("with db.internal allowed: accepted %v, refused %v", accepted, refused)
+	}
+}
+
+func TestValidateServiceTargets(t *testing.T) {
+	for _, entry := range []string{"db:5432", "db", "db:*", "10.0.0.0/8", "10.0.0.0/8:443", "[::1]:22", "::1", "gateway"} {
+		if err := validateServiceTargets([]string{entry}); err != nil {
+			t.Errorf("validateServiceTargets(%q) = %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"", ":22", "db:0", "db:http", "db:70000"} {
+		if err := validateServiceTargets([]string{entry}); err == nil {
+			t.Errorf("validateServiceTargets(%q) accepted", entry)
+		}
+	}
+}
@@ -4,39 +4,243 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// defaultMaxSignalingResponseSize caps signaling response bodies unless configured
+const defaultMaxSignalingResponseSize = 4 << 20 // 4MB
+
+// ErrResponseTooLarge is returned when a signaling response exceeds the size limit
+var ErrResponseTooLarge = errors.New("signaling response too large")
+
+// ErrNotJSON is returned for signaling data that is not JSON, typically an
+// HTML page from a captive portal or proxy, or a signalingUrl that points
+// at the wrong page but still answers 200
+var ErrNotJSON = errors.New("signaling endpoint returned a non-JSON body")
+
+// bodySnippetLength is how much of a non-JSON body errors quote
+const bodySnippetLength = 80
+
+// checkJSON returns ErrNotJSON, quoting the start of body, unless body
+// starts like a JSON object
+func checkJSON(body []byte) error {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return nil
+	}
+	return fmt.Errorf("%w, check that signalingUrl points at the signaling server; body starts with %q",
+		ErrNotJSON, bodySnippet(trimmed))
+}
+
+// bodySnippet returns the start of body with whitespace collapsed
+func bodySnippet(body []byte) string {
+	snippet := []rune(strings.Join(strings.Fields(string(body)), " "))
+	if len(snippet) > bodySnippetLength {
+		return string(snippet[:bodySnippetLength]) + "..."
+	}
+	return string(snippet)
+}
+
+// Signaling auth failure policies, set with signalingAuthFailurePolicy
+const (
+	SignalingAuthAbort = "abort" // Exit on the first 401 or 403
+	SignalingAuthRetry = "retry" // Resend refused requests until they are accepted
+)
+
+// maxSignalingAuthBackoff caps the wait between resends of a refused or
+// rate-limited request, unless the server asks for longer with Retry-After
+const maxSignalingAuthBackoff = 30 * time.Second
+
+// signalingAuthJitter is the fraction by which resends of refused and
+// rate-limited requests are spread, so clients refused together do not
+// resend together
+const signalingAuthJitter = 0.2
+
 // SignalingClient handles communication with signaling server
 type SignalingClient struct {
-	client *http.Client
+	client            *http.Client
+	maxResponseSize   int64
+	pool              *signalingPool // Failover servers, nil with a single signalingUrl
+	authFailurePolicy string         // What a 401 or 403 does, abort unless retry
+	jitter            Jitter         // Spreads resends of refused requests
 }
 
 // NewSignalingClient creates a new signaling client
-func NewSignalingClient() *SignalingClient {
+func NewSignalingClient(config Configuration) *SignalingClient {
+	maxResponseSize := config.MaxSignalingResponseSize
+	if maxResponseSize <= 0 {
+		maxResponseSize = defaultMaxSignalingResponseSize
+	}
+	tlsConfig, _ := signalingTLSConfig(config) // Checked at startup
+	if config.SignalingInsecureSkipVerify {
+		log.Printf("⚠️  ⚠️  signalingInsecureSkipVerify is set: signaling server certificates are NOT verified, so anyone on the path can read and alter the rendezvous, room IDs and credentials included. Trust the server's CA with signalingCACert instead")
+	}
 	return &SignalingClient{
+		maxResponseSize:   maxResponseSize,
+		pool:              newSignalingPool(config.SignalingURL, config.SignalingURLs),
+		authFailurePolicy: config.SignalingAuthFailurePolicy,
+		jitter:            newJitter(),
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
 				MaxIdleConns:        10,
 				MaxIdleConnsPerHost: 2,
 				IdleConnTimeout:     30 * time.Second,
+				TLSClientConfig:     tlsConfig,
 			},
 		},
 	}
 }
 
-// PostSignal sends signal data to signaling server
+// signalingAuthRefused reports whether a signaling response refuses our
+// credentials
+func signalingAuthRefused(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+// authRefused handles a refusal of our credentials by the signaling server
+// at host: the abort policy exits with ExitSignaling, since retrying cannot
+// fix bad credentials; the retry policy logs it and returns
+func (c *SignalingClient) authRefused(host, status string) {
+	if c.authFailurePolicy != SignalingAuthRetry {
+		fatalf(ExitSignaling, "❌ Signaling server %s refused access (%s); check its credentials, or set signalingAuthFailurePolicy: retry to wait for a fix", host, status)
+	}
+	defaultLogger.WithComponent("signaling").LimitedErrorf("Signaling server %s refused access (%s), retrying", host, status)
+}
+
+// do sends req, handing responses that refuse our credentials to
+// authRefused. Under the retry policy a refused request is resent with
+// backoff until the server accepts it or req's context ends. A rate-limited
+// request (429) is resent the same way under either policy, since the limit
+// is per public address and clients behind one NAT share it; the wait is at
+// least what the server's Retry-After asks for.
+func (c *SignalingClient) do(req *http.Request) (*http.Response, error) {
+	backoff := time.Second
+	for {
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return resp, err
+		}
+		rateLimited := resp.StatusCode == http.StatusTooManyRequests
+		if !rateLimited && !signalingAuthRefused(resp) {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		wait := c.jitter.Spread(backoff, signalingAuthJitter)
+		if rateLimited {
+			wait = max(wait, retryAfter(resp.Header.Get("Retry-After"), time.Now()))
+			defaultLogger.WithComponent("signaling").LimitedErrorf("Signaling server %s is rate limiting requests (%s), retrying in %v", req.URL.Host, resp.Status, wait.Round(time.Millisecond))
+		} else {
+			c.authRefused(req.URL.Host, resp.Status)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff = min(backoff*2, maxSignalingAuthBackoff)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryAfter returns the wait a Retry-After header value asks for, given in
+// seconds or as an HTTP date; zero when there is none
+func retryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
+
+// signalingPingTimeout bounds the startup reachability check
+const signalingPingTimeout = 5 * time.Second
+
+// Ping checks that a signaling server answers at url, using the cheap
+// OPTIONS request the server handles without touching any room
+func (c *SignalingClient) Ping(ctx context.Context, url string) error {
+	return c.failover(url, func(url string) error {
+		return c.ping(ctx, url)
+	})
+}
+
+// ping checks one signaling server
+func (c *SignalingClient) ping(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, signalingPingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid signaling URL %q: %w", url, err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("signaling server unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	// Under the retry policy a refusal still shows the server is reachable
+	if signalingAuthRefused(resp) {
+		c.authRefused(req.URL.Host, resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("signaling URL %s not found (404), check the path", url)
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("signaling server error: %s", resp.Status)
+	}
+	return nil
+}
+
+// get sends a GET request for url through do
+func (c *SignalingClient) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// PostSignal sends signal data to signaling server, and to every failover
+// server so the peer finds it whichever one it reads from
 func (c *SignalingClient) PostSignal(url, role, room, data string) error {
 	// Debug: Print what's being sent to signaling server
-	log.Printf("DEBUG: PostSignal - URL: %s, Role: %s, Room: %s, DataLen: %d", url, role, room, len(data))
-	
+	defaultLogger.WithComponent("signaling").Debugf("PostSignal - URL: %s, Role: %s, Room: %s, DataLen: %d",
+		redactValue(url), role, redactSecret(room), len(data))
+
+	err := c.replicate(url, func(url string) error {
+		return c.postSignal(url, role, room, data)
+	})
+	if err != nil {
+		return err
+	}
+	traceEvent("signaling_post", "role %s, room %s, %d bytes", role, room, len(data))
+	return nil
+}
+
+// postSignal sends signal data to one signaling server
+func (c *SignalingClient) postSignal(url, role, room, data string) error {
 	body, err := json.Marshal(SignalingData{Role: role, Room: room, Data: data})
 	if err != nil {
 		return fmt.Errorf("json marshal error: %w", err)
@@ -48,19 +252,31 @@ func (c *SignalingClient) PostSignal(url, role, room, data string) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("http request error: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
+		body, _ := c.readBody(resp.Body)
 		return fmt.Errorf("non-200 response (%d): %s", resp.StatusCode, string(body))
 	}
 	return nil
 }
 
+// readBody reads a response body, rejecting bodies larger than the configured limit
+func (c *SignalingClient) readBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, c.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.maxResponseSize {
+		return data[:c.maxResponseSize], fmt.Errorf("%w: exceeds %d bytes", ErrResponseTooLarge, c.maxResponseSize)
+	}
+	return data, nil
+}
+
 // WaitForPeerData waits for peer data with exponential backoff
 func (c *SignalingClient) WaitForPeerData(ctx context.Context, url, peerRole, room string, timeout time.Duration) (string, error) {
 	deadline := time.Now().Add(timeout)
@@ -76,8 +292,11 @@ func (c *SignalingClient) WaitForPeerData(ctx context.Context, url, peerRole, ro
 		}
 
 		attempt++
-		resp, err := c.client.Get(fmt.Sprintf("%s?role=%s&room=%s", url, peerRole, room))
-		if err != nil {
+		body, reachable, err := c.getPeerData(url, peerRole, room)
+		if errors.Is(err, ErrResponseTooLarge) {
+			return "", err
+		}
+		if !reachable {
 			// 网络错误，使用指数退避
 			time.Sleep(backoff)
 			if backoff < maxBackoff {
@@ -85,19 +304,9 @@ func (c *SignalingClient) WaitForPeerData(ctx context.Context, url, peerRole, ro
 			}
 			continue
 		}
-
-		if resp.StatusCode == 200 {
-			body, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			if err != nil {
-				time.Sleep(backoff)
-				continue
-			}
-			if len(body) > 0 {
-				return string(body), nil
-			}
-		} else {
-			resp.Body.Close()
+		if len(body) > 0 {
+			traceEvent("peer_data_received", "role %s, room %s, %d bytes, attempt %d", peerRole, room, len(body), attempt)
+			return string(body), nil
 		}
 
 		// 成功请求但无数据，使用较短的等待时间
@@ -120,13 +329,81 @@ func (c *SignalingClient) WaitForPeerData(ctx context.Context, url, peerRole, ro
 	return "", errors.New("timeout waiting for peer data")
 }
 
-// UpdateMappings sends updated mappings to signaling server
-func (c *SignalingClient) UpdateMappings(url, room string, mappings []string) error {
+// getPeerData reads peer data from the signaling servers for url in order,
+// returning the first non-empty data. reachable is false if no server
+// answered.
+func (c *SignalingClient) getPeerData(url, peerRole, room string) (body []byte, reachable bool, err error) {
+	for _, ep := range c.endpoints(url) {
+		resp, err := c.get(fmt.Sprintf("%s?role=%s&room=%s", ep.url, peerRole, room))
+		c.record(ep, err)
+		if err != nil {
+			continue
+		}
+		reachable = true
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			continue
+		}
+		data, err := c.readBody(resp.Body)
+		resp.Body.Close()
+		if errors.Is(err, ErrResponseTooLarge) {
+			return nil, true, err
+		}
+		if err == nil && len(data) > 0 {
+			return data, true, nil
+		}
+	}
+	return nil, reachable, nil
+}
+
+// mappingUpdateAttempts is how often a mapping update is sent before giving
+// up. Retries reuse the update ID, so an update that reached the signaling
+// server before a timeout is not applied twice.
+const mappingUpdateAttempts = 3
+
+// newUpdateID returns a random ID identifying one mapping update
+func newUpdateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// UpdateMappings sends updated mappings to signaling server and its failover
+// servers, returning the update ID the server acknowledges once it has
+// allocated them
+func (c *SignalingClient) UpdateMappings(url, room string, mappings []string) (string, error) {
 	log.Printf("📤 Updating mappings to signaling server: %v", mappings)
-	
+
+	updateID := newUpdateID()
+	var err error
+	for attempt := 1; attempt <= mappingUpdateAttempts; attempt++ {
+		err = c.replicate(url, func(url string) error {
+			return c.updateMappings(url, room, updateID, mappings)
+		})
+		if err == nil {
+			break
+		}
+		if attempt < mappingUpdateAttempts {
+			log.Printf("⚠️  Mapping update %s failed (attempt %d): %v, retrying", updateID, attempt, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("✅ Mappings updated successfully (update %s)", updateID)
+	return updateID, nil
+}
+
+// updateMappings sends updated mappings to one signaling server. The
+// signaling server ignores an update ID it has already applied.
+func (c *SignalingClient) updateMappings(url, room, updateID string, mappings []string) error {
 	body, err := json.Marshal(map[string]interface{}{
-		"room":     room,
-		"mappings": mappings,
+		"room":      room,
+		"mappings":  mappings,
+		"update_id": updateID,
 	})
 	if err != nil {
 		return fmt.Errorf("json marshal error: %w", err)
@@ -138,59 +415,79 @@ func (c *SignalingClient) UpdateMappings(url, room string, mappings []string) er
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("http request error: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
+		body, _ := c.readBody(resp.Body)
 		return fmt.Errorf("non-200 response (%d): %s", resp.StatusCode, string(body))
 	}
-	
-	log.Printf("✅ Mappings updated successfully")
 	return nil
 }
 
-// CheckMappingUpdates checks for mapping updates from client (for server)
-func (c *SignalingClient) CheckMappingUpdates(ctx context.Context, url, room string, lastMappingVersion int) (bool, string, error) {
+// MappingUpdateInfo is the signaling server's answer to an update check
+type MappingUpdateInfo struct {
+	HasUpdate  bool   `json:"has_update"`
+	Version    int    `json:"version"`
+	ClientData string `json:"client_data"`
+}
+
+// CheckMappingUpdates checks for mapping updates from client (for server),
+// failing over between signaling servers
+func (c *SignalingClient) CheckMappingUpdates(ctx context.Context, url, room string, lastMappingVersion int) (*MappingUpdateInfo, error) {
+	var info *MappingUpdateInfo
+	err := c.failover(url, func(url string) error {
+		var err error
+		info, err = c.checkMappingUpdates(url, room, lastMappingVersion)
+		return err
+	})
+	return info, err
+}
+
+// checkMappingUpdates checks one signaling server for mapping updates
+func (c *SignalingClient) checkMappingUpdates(url, room string, lastMappingVersion int) (*MappingUpdateInfo, error) {
 	reqURL := fmt.Sprintf("%s?room=%s&role=client&check_updates=true&last_mapping_version=%d", 
 		url, room, lastMappingVersion)
 	
-	resp, err := c.client.Get(reqURL)
+	resp, err := c.get(reqURL)
 	if err != nil {
-		return false, "", fmt.Errorf("http request error: %w", err)
+		return nil, fmt.Errorf("http request error: %w", err)
 	}
 	defer resp.Body.Close()
 
+	info := &MappingUpdateInfo{}
 	if resp.StatusCode == 200 {
-		body, err := io.ReadAll(resp.Body)
+		body, err := c.readBody(resp.Body)
 		if err != nil {
-			return false, "", fmt.Errorf("read response error: %w", err)
+			return nil, fmt.Errorf("read response error: %w", err)
 		}
 		
-		var updateInfo map[string]interface{}
-		if err := json.Unmarshal(body, &updateInfo); err != nil {
-			return false, "", fmt.Errorf("json unmarshal error: %w", err)
+		if err := checkJSON(body); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, info); err != nil {
+			return nil, fmt.Errorf("json unmarshal error: %w", err)
 		}
-		
-		hasUpdate, _ := updateInfo["has_update"].(bool)
-		clientData, _ := updateInfo["client_data"].(string)
-		
-		return hasUpdate, clientData, nil
 	}
 	
-	return false, "", nil
+	return info, nil
 }
 
-// WatchMappingUpdates continuously watches for mapping updates
+// WatchMappingUpdates continuously watches for mapping updates. Each update
+// is handed to callback once, identified by the update ID the client sent;
+// the client data present when watching starts is the registration that was
+// already allocated and is skipped.
 func (c *SignalingClient) WatchMappingUpdates(ctx context.Context, url, room string, callback func(string)) {
 	lastMappingVersion := 0
+	lastUpdateID := ""
+	first := true
 	ticker := time.NewTicker(2 * time.Second) // Check every 2 seconds
 	defer ticker.Stop()
 	
-	log.Printf("👀 Starting mapping updates watcher for room: %s", room)
+	log.Printf("👀 Starting mapping updates watcher for room: %s", redactSecret(room))
 	
 	for {
 		select {
@@ -198,16 +495,33 @@ func (c *SignalingClient) WatchMappingUpdates(ctx context.Context, url, room str
 			log.Printf("Mapping updates watcher stopped")
 			return
 		case <-ticker.C:
-			hasUpdate, clientData, err := c.CheckMappingUpdates(ctx, url, room, lastMappingVersion)
+			info, err := c.CheckMappingUpdates(ctx, url, room, lastMappingVersion)
 			if err != nil {
 				log.Printf("Error checking mapping updates: %v", err)
 				continue
 			}
-			
-			if hasUpdate && clientData != "" {
-				log.Printf("🔄 Detected mapping updates from client")
-				callback(clientData)
-				lastMappingVersion = int(time.Now().Unix()) // Update to prevent re-processing
+			if info.Version > lastMappingVersion {
+				lastMappingVersion = info.Version
+			}
+			initial := first
+			first = false
+			if !info.HasUpdate || info.ClientData == "" {
+				continue
+			}
+
+			updateID := ""
+			if clientData, err := parseClientRegistrationData(info.ClientData); err == nil {
+				updateID = clientData.UpdateID
+			}
+			switch {
+			case updateID == "" && initial:
+				// The registration this server already allocated
+			case updateID != "" && updateID == lastUpdateID:
+				log.Printf("🔁 Ignoring repeated mapping update %s", updateID)
+			default:
+				log.Printf("🔄 Detected mapping updates from client (update %s)", updateID)
+				callback(info.ClientData)
+				lastUpdateID = updateID
 			}
 		}
 	}
@@ -0,0 +1,188 @@
+<?php
+// Concurrency check for signaling_server_enhanced.php: hammers several rooms
+// with presence POSTs, mapping PUTs and GET polls at once, then checks that
+// no update was lost and no poll saw a half-written room.
+//
+//   php signaling/race_check.php                      # runs its own server
+//   php signaling/race_check.php --url=https://example.com/signaling_server_enhanced.php
+//   php signaling/race_check.php --requests=200 --rooms=5
+//
+// Without --url the script serves signaling_server_enhanced.php with PHP's
+// built-in server, running several workers (PHP 7.4 or later) with the rate
+// limits raised. Against a deployed server, raise STUN_FORWARD_RATE_LIMIT
+// and STUN_FORWARD_RATE_BURST there first, or the hammering is answered with
+// HTTP 429. Needs the curl extension. Exits 0 when every update survived, 1
+// otherwise; with the lock_room() calls of the server removed it reports
+// the updates lost to the race.
+
+$options = getopt('', ['url:', 'requests:', 'rooms:']);
+$requests = intval($options['requests'] ?? 50);
+$roomCount = max(1, intval($options['rooms'] ?? 3));
+$url = $options['url'] ?? null;
+$server = null;
+
+if ($url === null) {
+    $port = free_port();
+    $env = array_merge(getenv(), [
+        'PHP_CLI_SERVER_WORKERS' => '8',
+        'STUN_FORWARD_RATE_LIMIT' => '1000000',
+        'STUN_FORWARD_RATE_BURST' => '1000000',
+    ]);
+    $server = proc_open(
+        [PHP_BINARY, '-S', "127.0.0.1:$port", '-t', __DIR__],
+        [0 => ['file', '/dev/null', 'r'], 1 => ['file', '/dev/null', 'w'], 2 => ['file', '/dev/null', 'w']],
+        $pipes, __DIR__, $env
+    );
+    if (!is_resource($server)) {
+        fail("could not start the built-in server");
+    }
+    register_shutdown_function(function () use ($server) {
+        proc_terminate($server);
+    });
+    $url = "http://127.0.0.1:$port/signaling_server_enhanced.php";
+    wait_for_server($url);
+}
+
+$rooms = [];
+for ($r = 0; $r < $roomCount; $r++) {
+    $rooms[] = 'race-check-' . bin2hex(random_bytes(4));
+}
+echo "Hammering $roomCount rooms at $url with $requests POSTs, $requests PUTs and $requests GETs each\n";
+
+// The clients register first, so mapping PUTs have an entry to update
+foreach ($rooms as $room) {
+    [$status, $body] = send('POST', $url, ['room' => $room, 'role' => 'client', 'data' => json_encode(['networkInfo' => [], 'mappings' => ['tcp:1000:80']])]);
+    if ($status !== 200) {
+        fail("client registration in $room answered $status: $body");
+    }
+}
+
+$batch = [];
+foreach ($rooms as $room) {
+    for ($i = 0; $i < $requests; $i++) {
+        $batch[] = ['POST', $url, ['room' => $room, 'role' => 'server', 'data' => json_encode(['seq' => $i])]];
+        $batch[] = ['PUT', $url, ['room' => $room, 'mappings' => ["tcp:" . (2000 + $i) . ":80"], 'update_id' => "update-$i"]];
+        $batch[] = ['GET', $url . '?' . http_build_query(['room' => $room, 'role' => 'client']), null];
+    }
+}
+shuffle($batch);
+
+$errors = [];
+foreach (send_all($batch) as $i => [$status, $body]) {
+    [$method] = $batch[$i];
+    if ($status !== 200) {
+        $errors[] = "$method answered $status: $body";
+        continue;
+    }
+    if ($method === 'GET' && !is_array(json_decode($body, true))) {
+        $errors[] = "GET read a broken room: $body";
+    }
+}
+
+foreach ($rooms as $room) {
+    // Every POST and PUT bumped the room version once: 1 on creation, 1 for
+    // the client registration, 2 per round and 1 for this last POST
+    [$status, $body] = send('POST', $url, ['room' => $room, 'role' => 'server', 'data' => json_encode(['seq' => 'last'])]);
+    $result = json_decode($body, true);
+    $wantVersion = 2 + 2 * $requests + 1;
+    $version = $result['room_version'] ?? 0;
+    if ($status !== 200 || $version !== $wantVersion) {
+        $errors[] = "$room: room version $version after all updates, want $wantVersion: " . ($wantVersion - $version) . " updates lost";
+    }
+    if (($result['participant_version'] ?? null) !== $requests + 1) {
+        $errors[] = "$room: server data version " . ($result['participant_version'] ?? 'missing') . ", want " . ($requests + 1);
+    }
+
+    // The client entry holds the mappings and update ID of one and the same PUT
+    [$status, $body] = send('GET', $url . '?' . http_build_query(['room' => $room, 'role' => 'client']), null);
+    $client = json_decode($body, true);
+    $port = intval(explode(':', $client['mappings'][0] ?? '')[1] ?? 0);
+    if (($client['updateId'] ?? null) !== 'update-' . ($port - 2000)) {
+        $errors[] = "$room: client entry mixes updates: mappings " . json_encode($client['mappings'] ?? null) . ", update ID " . json_encode($client['updateId'] ?? null);
+    }
+
+    [$status] = send('DELETE', $url . '?' . http_build_query(['room' => $room]), null);
+    if ($status !== 200) {
+        $errors[] = "$room: DELETE answered $status";
+    }
+}
+
+if ($errors) {
+    foreach (array_slice($errors, 0, 20) as $error) {
+        echo "FAIL: $error\n";
+    }
+    exit(1);
+}
+echo "PASS: no update lost\n";
+exit(0);
+
+function fail($message) {
+    echo "FAIL: $message\n";
+    exit(1);
+}
+
+function free_port() {
+    $socket = stream_socket_server('tcp://127.0.0.1:0');
+    $name = stream_socket_get_name($socket, false);
+    fclose($socket);
+    return intval(substr(strrchr($name, ':'), 1));
+}
+
+function wait_for_server($url) {
+    for ($i = 0; $i < 50; $i++) {
+        [$status] = send('GET', $url, null);
+        if ($status > 0) {
+            return;
+        }
+        usleep(100000);
+    }
+    fail("built-in server did not come up");
+}
+
+function request_handle($method, $url, $payload) {
+    $ch = curl_init($url);
+    curl_setopt($ch, CURLOPT_CUSTOMREQUEST, $method);
+    curl_setopt($ch, CURLOPT_RETURNTRANSFER, true);
+    curl_setopt($ch, CURLOPT_TIMEOUT, 30);
+    if ($payload !== null) {
+        curl_setopt($ch, CURLOPT_POSTFIELDS, json_encode($payload));
+        curl_setopt($ch, CURLOPT_HTTPHEADER, ['Content-Type: application/json']);
+    }
+    return $ch;
+}
+
+function send($method, $url, $payload) {
+    $ch = request_handle($method, $url, $payload);
+    $body = curl_exec($ch);
+    $status = curl_getinfo($ch, CURLINFO_HTTP_CODE);
+    curl_close($ch);
+    return [$status, (string)$body];
+}
+
+// Sends every request of batch at once and returns the status and body of
+// each, in batch order
+function send_all($batch) {
+    $multi = curl_multi_init();
+    // Enough at once to race, few enough for the built-in server's backlog
+    curl_multi_setopt($multi, CURLMOPT_MAX_TOTAL_CONNECTIONS, 32);
+    $handles = [];
+    foreach ($batch as $i => [$method, $url, $payload]) {
+        $handles[$i] = request_handle($method, $url, $payload);
+        curl_multi_add_handle($multi, $handles[$i]);
+    }
+    do {
+        $status = curl_multi_exec($multi, $running);
+        if ($running) {
+            curl_multi_select($multi);
+        }
+    } while ($running && $status === CURLM_OK);
+
+    $results = [];
+    foreach ($handles as $i => $ch) {
+        $results[$i] = [curl_getinfo($ch, CURLINFO_HTTP_CODE), (string)curl_multi_getcontent($ch)];
+        curl_multi_remove_handle($multi, $ch);
+        curl_close($ch);
+    }
+    curl_multi_close($multi);
+    return $results;
+}
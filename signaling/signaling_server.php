@@ -5,6 +5,7 @@ error_reporting(E_ALL);
 // Simple in-memory store using a file.
 // For a real application, use Redis, Memcached, or a database.
 $storageFile = '/tmp/stun_forward_session.json';
+$storageLockFile = '/tmp/stun_forward_session.lock';
 
 function get_store() {
     global $storageFile;
@@ -15,9 +16,26 @@ function get_store() {
     return json_decode($data, true) ?: [];
 }
 
+// Replace the store file in one step, so GETs reading it without the lock
+// never see a half-written store
 function save_store($store) {
     global $storageFile;
-    file_put_contents($storageFile, json_encode($store));
+    $tmp = $storageFile . '.' . getmypid() . '.tmp';
+    file_put_contents($tmp, json_encode($store));
+    rename($tmp, $storageFile);
+}
+
+// Make concurrent requests take turns on the store until this one exits, so
+// a POST never saves over another room's data it read before it changed
+function lock_store() {
+    global $storageLockFile;
+    static $fp = null;
+    if ($fp === null) {
+        $fp = fopen($storageLockFile, 'c');
+        if ($fp) {
+            flock($fp, LOCK_EX); // Released when the request exits
+        }
+    }
 }
 
 header("Content-Type: application/json");
@@ -40,6 +58,7 @@ if ($_SERVER['REQUEST_METHOD'] === 'POST') {
         exit;
     }
 
+    lock_store();
     $store = get_store();
     if (!isset($store[$data['room']])) {
         $store[$data['room']] = [];
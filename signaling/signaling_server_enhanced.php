@@ -3,116 +3,281 @@ ini_set('display_errors', 1);
 error_reporting(E_ALL);
 
 // Enhanced signaling server with mapping sync and auto-cleanup
-$storageFile = '/tmp/stun_forward_enhanced.json';
+$storageDir = '/tmp/stun_forward_enhanced'; // One file and one lock file per room
 $ROOM_EXPIRY_MINUTES = 5; // Auto cleanup after 5 minutes of inactivity
+$ACTIVITY_TOUCH_SECONDS = 60; // GET polls refresh room activity at most this often
+$CLEANUP_INTERVAL_SECONDS = 30; // Expired rooms are looked for at most this often
 
-function get_store() {
-    global $storageFile;
-    if (!file_exists($storageFile)) {
-        return [];
+// Abuse limits, overridable through environment variables
+$rateLimitFile = '/tmp/stun_forward_ratelimit.json';
+$RATE_LIMIT_PER_SECOND = floatval(getenv('STUN_FORWARD_RATE_LIMIT') ?: 5);   // Token refill rate per client IP
+$RATE_LIMIT_BURST = floatval(getenv('STUN_FORWARD_RATE_BURST') ?: 20);       // Token bucket size per client IP
+$MAX_PAYLOAD_BYTES = intval(getenv('STUN_FORWARD_MAX_PAYLOAD') ?: 65536);     // Largest accepted request body
+$MAX_DATA_LENGTH = intval(getenv('STUN_FORWARD_MAX_DATA') ?: 32768);          // Largest stored participant data
+$MAX_ROOMS = intval(getenv('STUN_FORWARD_MAX_ROOMS') ?: 1000);                // Most rooms stored at once
+
+// Room locks this request holds, by room ID
+$roomLocks = [];
+
+// Path of a room's file with the given extension. Room IDs are hashed, so
+// any ID is a safe file name.
+function room_path($room_id, $ext) {
+    global $storageDir;
+    if (!is_dir($storageDir)) {
+        @mkdir($storageDir, 0700, true);
     }
-    $data = file_get_contents($storageFile);
-    return json_decode($data, true) ?: [];
+    return $storageDir . '/' . sha1($room_id) . '.' . $ext;
 }
 
-function save_store($store) {
-    global $storageFile;
-    file_put_contents($storageFile, json_encode($store, JSON_PRETTY_PRINT));
+function get_room($room_id) {
+    $path = room_path($room_id, 'json');
+    if (!file_exists($path)) {
+        return null;
+    }
+    $room = json_decode((string)@file_get_contents($path), true);
+    return is_array($room) ? $room : null;
 }
 
-function cleanup_expired_rooms() {
-    global $ROOM_EXPIRY_MINUTES;
-    $store = get_store();
-    $current_time = time();
-    $expired_rooms = [];
-    
-    foreach ($store as $room_id => $room_data) {
-        if (isset($room_data['last_activity'])) {
-            $inactive_minutes = ($current_time - $room_data['last_activity']) / 60;
-            if ($inactive_minutes > $ROOM_EXPIRY_MINUTES) {
-                $expired_rooms[] = $room_id;
-            }
+// Replace the room file in one step, so requests reading it without the
+// lock never see a half-written room
+function save_room($room_id, $room) {
+    $path = room_path($room_id, 'json');
+    $tmp = $path . '.' . getmypid() . '.tmp';
+    file_put_contents($tmp, json_encode($room, JSON_PRETTY_PRINT));
+    rename($tmp, $path);
+}
+
+// Delete a room the caller holds the lock of, its lock file included
+function delete_room($room_id) {
+    @unlink(room_path($room_id, 'json'));
+    @unlink(room_path($room_id, 'lock'));
+    unlock_room($room_id);
+}
+
+function count_rooms() {
+    global $storageDir;
+    return count(glob($storageDir . '/*.json') ?: []);
+}
+
+// Make concurrent requests on one room take turns until this one exits or
+// unlocks the room. A mutating request reads, changes and saves the room,
+// so two interleaved requests would lose the changes of the one saving
+// first, such as a mapping PUT racing a presence refresh. Each room has its
+// own lock file, so requests on other rooms do not wait. GET polls only
+// take the lock on the rare occasions they refresh room activity. Without
+// $wait a room locked by another request is not waited for.
+function lock_room($room_id, $wait = true) {
+    global $roomLocks;
+    if (isset($roomLocks[$room_id])) {
+        return true;
+    }
+    $path = room_path($room_id, 'lock');
+    for ($attempt = 0; $attempt < 10; $attempt++) {
+        $fp = fopen($path, 'c');
+        if (!$fp) {
+            return false;
+        }
+        if (!flock($fp, $wait ? LOCK_EX : LOCK_EX | LOCK_NB)) {
+            fclose($fp);
+            return false;
+        }
+        // Deleting a room unlinks its lock file; a lock on the unlinked file
+        // guards nothing, so take the new one
+        clearstatcache(true, $path);
+        $stat = @stat($path);
+        if ($stat !== false && $stat['ino'] === fstat($fp)['ino']) {
+            $roomLocks[$room_id] = $fp;
+            return true;
         }
+        fclose($fp);
     }
-    
-    foreach ($expired_rooms as $room_id) {
-        unset($store[$room_id]);
-        error_log("Cleaned up expired room: $room_id");
+    return false;
+}
+
+function unlock_room($room_id) {
+    global $roomLocks;
+    if (isset($roomLocks[$room_id])) {
+        fclose($roomLocks[$room_id]);
+        unset($roomLocks[$room_id]);
     }
-    
-    if (!empty($expired_rooms)) {
-        save_store($store);
+}
+
+// Answers 503 when a room's lock cannot be taken
+function lock_room_or_fail($room_id) {
+    if (!lock_room($room_id)) {
+        http_response_code(503);
+        echo json_encode(["error" => "Room storage unavailable"]);
+        exit;
     }
-    
-    return count($expired_rooms);
 }
 
+// Take one token from the client's bucket, returning false when it is empty
+function rate_limit_allow($client_ip) {
+    global $rateLimitFile, $RATE_LIMIT_PER_SECOND, $RATE_LIMIT_BURST;
+
+    $fp = fopen($rateLimitFile, 'c+');
+    if (!$fp) {
+        return true; // Fail open rather than locking everyone out
+    }
+    flock($fp, LOCK_EX);
+
+    $buckets = json_decode(stream_get_contents($fp), true) ?: [];
+    $now = microtime(true);
+
+    // Drop buckets that have refilled completely
+    foreach ($buckets as $ip => $bucket) {
+        if ($now - $bucket['updated'] > $RATE_LIMIT_BURST / $RATE_LIMIT_PER_SECOND) {
+            unset($buckets[$ip]);
+        }
+    }
+
+    $bucket = $buckets[$client_ip] ?? ['tokens' => $RATE_LIMIT_BURST, 'updated' => $now];
+    $bucket['tokens'] = min($RATE_LIMIT_BURST, $bucket['tokens'] + ($now - $bucket['updated']) * $RATE_LIMIT_PER_SECOND);
+    $bucket['updated'] = $now;
+
+    $allowed = $bucket['tokens'] >= 1;
+    if ($allowed) {
+        $bucket['tokens'] -= 1;
+    }
+    $buckets[$client_ip] = $bucket;
+
+    ftruncate($fp, 0);
+    rewind($fp);
+    fwrite($fp, json_encode($buckets));
+    flock($fp, LOCK_UN);
+    fclose($fp);
+
+    return $allowed;
+}
+
+// Answers 429, telling the client with Retry-After how many seconds to wait
+// before resending
+function reject_too_many($message, $retry_after) {
+    http_response_code(429);
+    header("Retry-After: " . max(1, intval(ceil($retry_after))));
+    echo json_encode(["error" => $message]);
+    exit;
+}
+
+// Delete rooms idle for longer than $ROOM_EXPIRY_MINUTES, looking at most
+// once per $CLEANUP_INTERVAL_SECONDS. A room file is rewritten on every
+// change and activity touch, so its modification time finds the candidates
+// without reading them; a room busy with another request is skipped.
+function cleanup_expired_rooms() {
+    global $storageDir, $ROOM_EXPIRY_MINUTES, $CLEANUP_INTERVAL_SECONDS;
+    $marker = $storageDir . '/cleanup';
+    if (file_exists($marker) && time() - filemtime($marker) < $CLEANUP_INTERVAL_SECONDS) {
+        return 0;
+    }
+    @touch($marker);
+
+    $expiry = $ROOM_EXPIRY_MINUTES * 60;
+    $cleaned = 0;
+    foreach (glob($storageDir . '/*.json') ?: [] as $path) {
+        $mtime = @filemtime($path);
+        if ($mtime === false || time() - $mtime <= $expiry) {
+            continue;
+        }
+        $room = json_decode((string)@file_get_contents($path), true);
+        if (!is_array($room) || !isset($room['room_id'])) {
+            continue;
+        }
+        $room_id = $room['room_id'];
+        if (!lock_room($room_id, false)) {
+            continue;
+        }
+        // Read again under the lock, the room may have been touched since
+        $room = get_room($room_id);
+        if ($room !== null && time() - ($room['last_activity'] ?? 0) > $expiry) {
+            delete_room($room_id);
+            error_log("Cleaned up expired room: $room_id");
+            $cleaned++;
+        } else {
+            unlock_room($room_id);
+        }
+    }
+    return $cleaned;
+}
+
+// Refresh a room's activity, creating it if needed; the caller holds the
+// room's lock
 function touch_room_activity($room_id) {
-    $store = get_store();
-    if (!isset($store[$room_id])) {
-        $store[$room_id] = [
+    $room = get_room($room_id);
+    if ($room === null) {
+        $room = [
+            'room_id' => $room_id,
             'created_at' => time(),
             'version' => 1,
             'participants' => []
         ];
     }
     
-    $store[$room_id]['last_activity'] = time();
-    save_store($store);
-    return $store;
+    $room['last_activity'] = time();
+    save_room($room_id, $room);
+    return $room;
 }
 
+// Store a participant's data; the caller holds the room's lock
 function update_participant_data($room_id, $role, $data) {
-    $store = touch_room_activity($room_id);
+    $room = touch_room_activity($room_id);
     
     // Parse the data to handle mapping updates
     $parsed_data = json_decode($data, true);
     
-    if (!isset($store[$room_id]['participants'][$role])) {
-        $store[$room_id]['participants'][$role] = [
+    if (!isset($room['participants'][$role])) {
+        $room['participants'][$role] = [
             'first_seen' => time(),
             'version' => 1,
             'data' => $data
         ];
     } else {
-        $store[$room_id]['participants'][$role]['version']++;
-        $store[$room_id]['participants'][$role]['data'] = $data;
+        $room['participants'][$role]['version']++;
+        $room['participants'][$role]['data'] = $data;
     }
     
-    $store[$room_id]['participants'][$role]['last_updated'] = time();
-    $store[$room_id]['version']++;
+    $room['participants'][$role]['last_updated'] = time();
+    $room['version']++;
     
     // If this is a client with mapping updates, trigger server notification
     if ($role === 'client' && $parsed_data && isset($parsed_data['mappings'])) {
-        $store[$room_id]['mapping_update_pending'] = true;
-        $store[$room_id]['mapping_version'] = time();
+        $room['mapping_update_pending'] = true;
+        // Strictly increasing, so two updates within one second are both seen
+        $room['mapping_version'] = max(time(), ($room['mapping_version'] ?? 0) + 1);
     }
     
-    save_store($store);
-    return $store[$room_id];
+    save_room($room_id, $room);
+    return $room;
 }
 
 function get_participant_data($room_id, $role) {
-    $store = get_store();
+    global $ACTIVITY_TOUCH_SECONDS;
+    $room = get_room($room_id);
     
-    if (!isset($store[$room_id]) || !isset($store[$room_id]['participants'][$role])) {
+    if ($room === null || !isset($room['participants'][$role])) {
         return null;
     }
     
-    // Touch activity when data is accessed
-    touch_room_activity($room_id);
+    // Touch activity when data is accessed; polls within
+    // $ACTIVITY_TOUCH_SECONDS of the last touch leave the room alone, so
+    // they do not queue up behind updates
+    if (time() - ($room['last_activity'] ?? 0) >= $ACTIVITY_TOUCH_SECONDS && lock_room($room_id)) {
+        // A room deleted meanwhile stays deleted
+        if (get_room($room_id) !== null) {
+            touch_room_activity($room_id);
+        }
+        unlock_room($room_id);
+    }
     
-    return $store[$room_id]['participants'][$role]['data'];
+    return $room['participants'][$role]['data'];
 }
 
 function check_mapping_updates($room_id, $last_known_version = 0) {
-    $store = get_store();
+    $room_data = get_room($room_id);
     
-    if (!isset($store[$room_id])) {
+    if ($room_data === null) {
         return null;
     }
     
-    $room_data = $store[$room_id];
     $current_mapping_version = $room_data['mapping_version'] ?? 0;
     
     if ($current_mapping_version > $last_known_version) {
@@ -136,12 +301,30 @@ if ($_SERVER['REQUEST_METHOD'] === 'OPTIONS') {
     exit;
 }
 
-// Cleanup expired rooms on every request
-cleanup_expired_rooms();
+// Throttle each client IP before doing any work
+if (!rate_limit_allow($_SERVER['REMOTE_ADDR'] ?? 'unknown')) {
+    reject_too_many("Rate limit exceeded", 1 / $RATE_LIMIT_PER_SECOND);
+}
+
+// Reject oversized bodies before parsing them
+if (in_array($_SERVER['REQUEST_METHOD'], ['POST', 'PUT'])) {
+    $raw = file_get_contents("php://input", false, null, 0, $MAX_PAYLOAD_BYTES + 1);
+    if (strlen($raw) > $MAX_PAYLOAD_BYTES) {
+        http_response_code(413);
+        echo json_encode(["error" => "Payload too large"]);
+        exit;
+    }
+}
+
+// Cleanup expired rooms on mutating requests, once the body is in so a slow
+// upload does not hold any room. GET polls read the last saved room without
+// waiting for its lock.
+if ($_SERVER['REQUEST_METHOD'] !== 'GET') {
+    cleanup_expired_rooms();
+}
 
 // POST: Register/Update participant data
 if ($_SERVER['REQUEST_METHOD'] === 'POST') {
-    $raw = file_get_contents("php://input");
     $data = json_decode($raw, true);
 
     if (!$data || !isset($data['room']) || !isset($data['role']) || !isset($data['data'])) {
@@ -150,6 +333,19 @@ if ($_SERVER['REQUEST_METHOD'] === 'POST') {
         exit;
     }
 
+    if (!is_string($data['data']) || strlen($data['data']) > $MAX_DATA_LENGTH) {
+        http_response_code(413);
+        echo json_encode(["error" => "Participant data too large"]);
+        exit;
+    }
+
+    // The room cap is soft: rooms created at the same moment may overshoot
+    // it by a few, as new rooms take no lock in common
+    lock_room_or_fail($data['room']);
+    if (get_room($data['room']) === null && count_rooms() >= $MAX_ROOMS) {
+        reject_too_many("Room limit reached", 60); // Idle rooms expire in minutes
+    }
+
     $room_data = update_participant_data($data['room'], $data['role'], $data['data']);
     
     echo json_encode([
@@ -194,7 +390,6 @@ if ($_SERVER['REQUEST_METHOD'] === 'GET') {
 
 // PUT: Update only mappings (for hot updates)
 if ($_SERVER['REQUEST_METHOD'] === 'PUT') {
-    $raw = file_get_contents("php://input");
     $data = json_decode($raw, true);
 
     if (!$data || !isset($data['room']) || !isset($data['mappings'])) {
@@ -204,23 +399,46 @@ if ($_SERVER['REQUEST_METHOD'] === 'PUT') {
     }
 
     $room_id = $data['room'];
-    $store = get_store();
+    lock_room_or_fail($room_id);
+    $room = get_room($room_id);
     
-    if (!isset($store[$room_id]['participants']['client'])) {
+    if (!isset($room['participants']['client'])) {
         http_response_code(404);
         echo json_encode(["error" => "Client not found in room"]);
         exit;
     }
 
     // Update client mappings
-    $client_data = json_decode($store[$room_id]['participants']['client']['data'], true);
+    $client_data = json_decode($room['participants']['client']['data'], true);
+
+    // A retried update that was already applied must not trigger a second allocation
+    $update_id = isset($data['update_id']) && is_string($data['update_id']) ? $data['update_id'] : null;
+    if ($update_id !== null && ($client_data['updateId'] ?? null) === $update_id) {
+        echo json_encode([
+            "status" => "duplicate",
+            "mapping_version" => $room['mapping_version'] ?? 0
+        ]);
+        exit;
+    }
+
     $client_data['mappings'] = $data['mappings'];
+    if ($update_id !== null) {
+        $client_data['updateId'] = $update_id;
+    } else {
+        unset($client_data['updateId']);
+    }
+    $encoded = json_encode($client_data);
+    if (strlen($encoded) > $MAX_DATA_LENGTH) {
+        http_response_code(413);
+        echo json_encode(["error" => "Participant data too large"]);
+        exit;
+    }
     
-    update_participant_data($room_id, 'client', json_encode($client_data));
+    $room_data = update_participant_data($room_id, 'client', $encoded);
     
     echo json_encode([
         "status" => "mappings_updated",
-        "mapping_version" => $store[$room_id]['mapping_version']
+        "mapping_version" => $room_data['mapping_version']
     ]);
     exit;
 }
@@ -235,12 +453,12 @@ if ($_SERVER['REQUEST_METHOD'] === 'DELETE') {
         exit;
     }
     
-    $store = get_store();
-    if (isset($store[$room])) {
-        unset($store[$room]);
-        save_store($store);
+    lock_room_or_fail($room);
+    if (get_room($room) !== null) {
+        delete_room($room);
         echo json_encode(["status" => "room_deleted"]);
     } else {
+        unlock_room($room);
         http_response_code(404);
         echo json_encode(["error" => "Room not found"]);
     }
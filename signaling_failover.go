@@ -0,0 +1,198 @@
+// Package main - Failover across multiple signaling servers
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// signalingDownAfter consecutive failures mark a signaling server down
+	signalingDownAfter = 3
+	// signalingDownPeriod is how long a down server is tried last
+	signalingDownPeriod = 30 * time.Second
+)
+
+// SignalingServer is an additional signaling server. In config files it is
+// either a URL string or an object with url and weight.
+type SignalingServer struct {
+	URL    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"` // Higher is tried first, default 1
+}
+
+// UnmarshalJSON accepts a plain URL string or an object
+func (s *SignalingServer) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*s = SignalingServer{URL: url}
+		return nil
+	}
+	type plain SignalingServer
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// UnmarshalYAML accepts a plain URL string or a mapping
+func (s *SignalingServer) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = SignalingServer{URL: value.Value}
+		return nil
+	}
+	type plain SignalingServer
+	return value.Decode((*plain)(s))
+}
+
+// signalingEndpoint is the health of one signaling server
+type signalingEndpoint struct {
+	url       string
+	weight    int
+	index     int // Position in the configuration, breaks weight ties
+	failures  int
+	downUntil time.Time
+}
+
+// signalingPool orders the configured signaling servers for each operation:
+// the last server that worked first, then by weight, with servers that keep
+// failing tried last
+type signalingPool struct {
+	primary   string
+	endpoints []*signalingEndpoint
+	lastGood  *signalingEndpoint
+	mutex     sync.Mutex
+}
+
+// newSignalingPool returns nil unless additional servers are configured
+func newSignalingPool(primary string, extra []SignalingServer) *signalingPool {
+	if len(extra) == 0 {
+		return nil
+	}
+	pool := &signalingPool{primary: primary}
+	pool.endpoints = append(pool.endpoints, &signalingEndpoint{url: primary, weight: 1})
+	for i, server := range extra {
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.endpoints = append(pool.endpoints, &signalingEndpoint{url: server.URL, weight: weight, index: i + 1})
+	}
+	return pool
+}
+
+// ordered returns the endpoints in the order they should be tried
+func (p *signalingPool) ordered() []*signalingEndpoint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	endpoints := append([]*signalingEndpoint(nil), p.endpoints...)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if aDown, bDown := now.Before(a.downUntil), now.Before(b.downUntil); aDown != bDown {
+			return bDown
+		}
+		if (a == p.lastGood) != (b == p.lastGood) {
+			return a == p.lastGood
+		}
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		return a.index < b.index
+	})
+	return endpoints
+}
+
+// markSuccess records a working request to ep
+func (p *signalingPool) markSuccess(ep *signalingEndpoint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if ep.failures >= signalingDownAfter {
+		log.Printf("✅ Signaling server %s is reachable again", ep.url)
+	}
+	ep.failures = 0
+	ep.downUntil = time.Time{}
+	p.lastGood = ep
+}
+
+// markFailure records a failed request to ep
+func (p *signalingPool) markFailure(ep *signalingEndpoint, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ep.failures++
+	if ep.failures >= signalingDownAfter {
+		if ep.failures == signalingDownAfter {
+			log.Printf("⚠️  Signaling server %s marked down after %d failures: %v", ep.url, ep.failures, err)
+		}
+		ep.downUntil = time.Now().Add(signalingDownPeriod)
+	}
+	if p.lastGood == ep {
+		p.lastGood = nil
+	}
+}
+
+// endpoints returns the servers to use for url: the whole pool for the
+// configured primary URL, otherwise url alone
+func (c *SignalingClient) endpoints(url string) []*signalingEndpoint {
+	if c.pool == nil || url != c.pool.primary {
+		return []*signalingEndpoint{{url: url}}
+	}
+	return c.pool.ordered()
+}
+
+// record updates the health of a pooled endpoint after a request
+func (c *SignalingClient) record(ep *signalingEndpoint, err error) {
+	if c.pool == nil {
+		return
+	}
+	if err != nil {
+		c.pool.markFailure(ep, err)
+	} else {
+		c.pool.markSuccess(ep)
+	}
+}
+
+// failover runs op against the servers for url in order until one succeeds
+func (c *SignalingClient) failover(url string, op func(url string) error) error {
+	var errs []error
+	for _, ep := range c.endpoints(url) {
+		err := op(ep.url)
+		c.record(ep, err)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", ep.url, err))
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return errors.Join(errs...)
+}
+
+// replicate runs op against every server for url, so whichever server the
+// peer reads from holds the data. It fails only if every server failed.
+func (c *SignalingClient) replicate(url string, op func(url string) error) error {
+	var errs []error
+	endpoints := c.endpoints(url)
+	for _, ep := range endpoints {
+		err := op(ep.url)
+		c.record(ep, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ep.url, err))
+		}
+	}
+	if len(errs) < len(endpoints) {
+		for _, err := range errs {
+			log.Printf("⚠️  Signaling replication failed: %v", err)
+		}
+		return nil
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,34 @@
+// Package main - TLS verification of HTTPS signaling servers
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// signalingTLSConfig returns the TLS settings of signaling requests: the
+// system roots plus the CA in signalingCACert, with verification turned off
+// only by signalingInsecureSkipVerify. Nil keeps Go's defaults.
+func signalingTLSConfig(config Configuration) (*tls.Config, error) {
+	if config.SignalingCACert == "" && !config.SignalingInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SignalingInsecureSkipVerify}
+	if config.SignalingCACert != "" {
+		pem, err := os.ReadFile(config.SignalingCACert)
+		if err != nil {
+			return nil, fmt.Errorf("'signalingCACert': %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("'signalingCACert': no PEM certificate in %s", config.SignalingCACert)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+// Package main - Socket buffer limits of Linux
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketBufferLimits returns the largest receive and send buffers a process
+// may set without privileges, 0 when unknown; the kernel clamps larger ones
+func socketBufferLimits() (recv, send int) {
+	return readSysctlInt("/proc/sys/net/core/rmem_max"), readSysctlInt("/proc/sys/net/core/wmem_max")
+}
+
+// readSysctlInt reads an integer sysctl from path, 0 on failure
+func readSysctlInt(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return value
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+// Package main - Socket buffer limits of other systems
+package main
+
+// socketBufferLimits returns 0 for both limits: they are not looked up
+// outside Linux, where the system silently caps the sizes it accepts
+func socketBufferLimits() (recv, send int) {
+	return 0, 0
+}
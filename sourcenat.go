@@ -0,0 +1,110 @@
+// Package main - Per-client source addresses of UDP relay sessions
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// maxSourcePoolSize caps the addresses of a udpSourcePool that are handed
+// out; larger prefixes only use their first addresses
+const maxSourcePoolSize = 1 << 16
+
+// udpSourcePool gives each UDP relay session on the server a source address
+// of its own towards the local service, nil when udpSourcePool is unset
+var udpSourcePool *sourceAddrPool
+
+// errSourcePoolExhausted is returned when every address of the pool is held
+// by a live session
+var errSourcePoolExhausted = errors.New("udpSourcePool exhausted")
+
+// sourceAddrPool hands out the addresses of a prefix to session keys. A key
+// gets its previous address back while no other key took it, and released
+// addresses are reused last, so a client returning after its session
+// expired usually keeps its address.
+type sourceAddrPool struct {
+	prefix *net.IPNet
+	size   int            // Addresses handed out, network address excluded
+	next   int            // Offset the search for a free address starts at
+	byKey  map[string]int // Offset last held by each key
+	holder map[int]string // Key last given each offset
+	inUse  map[int]bool   // Offsets held by live sessions
+	mutex  sync.Mutex
+}
+
+// newSourceAddrPool returns the pool of a udpSourcePool CIDR
+func newSourceAddrPool(cidr string) (*sourceAddrPool, error) {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("'udpSourcePool' must be a CIDR prefix such as 127.100.0.0/16: %w", err)
+	}
+	ones, bits := prefix.Mask.Size()
+	size := maxSourcePoolSize
+	if bits-ones < 17 {
+		size = 1<<(bits-ones) - 1
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("'udpSourcePool' %s holds no addresses to hand out", cidr)
+	}
+	return &sourceAddrPool{
+		prefix: prefix,
+		size:   size,
+		byKey:  make(map[string]int),
+		holder: make(map[int]string),
+		inUse:  make(map[int]bool),
+	}, nil
+}
+
+// addr returns the address at offset, counted from the one after the
+// prefix's network address
+func (p *sourceAddrPool) addr(offset int) net.IP {
+	base := p.prefix.IP
+	if v4 := base.To4(); v4 != nil {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(v4)+uint32(offset)+1)
+		return ip
+	}
+	n := new(big.Int).SetBytes(base)
+	n.Add(n, big.NewInt(int64(offset)+1))
+	ip := make(net.IP, net.IPv6len)
+	return n.FillBytes(ip)
+}
+
+// acquire returns the address the session keyed key sends from, until it
+// is released
+func (p *sourceAddrPool) acquire(key string) (net.IP, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if offset, ok := p.byKey[key]; ok && !p.inUse[offset] {
+		p.inUse[offset] = true
+		return p.addr(offset), nil
+	}
+	for i := 0; i < p.size; i++ {
+		offset := (p.next + i) % p.size
+		if p.inUse[offset] {
+			continue
+		}
+		if previous, ok := p.holder[offset]; ok {
+			delete(p.byKey, previous)
+		}
+		p.inUse[offset] = true
+		p.holder[offset] = key
+		p.byKey[key] = offset
+		p.next = (offset + 1) % p.size
+		return p.addr(offset), nil
+	}
+	return nil, errSourcePoolExhausted
+}
+
+// release returns the address of the session keyed key to the pool
+func (p *sourceAddrPool) release(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if offset, ok := p.byKey[key]; ok {
+		delete(p.inUse, offset)
+	}
+}
@@ -0,0 +1,69 @@
+// Package main - Overall time budget of the client bring-up
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// startupDeadlineKey carries the startup deadline in a context
+type startupDeadlineKey struct{}
+
+// withStartupDeadline marks ctx as belonging to a bring-up that must finish
+// by deadline. Only setup stages are bounded by it; forwarders keep running
+// on ctx itself.
+func withStartupDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, startupDeadlineKey{}, deadline)
+}
+
+// startupStageContext returns a context for a setup stage, ending at the
+// startup deadline carried by ctx if there is one
+func startupStageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Value(startupDeadlineKey{}).(time.Time); ok {
+		return context.WithDeadline(ctx, deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// stageTimeout caps a stage's own timeout to the time ctx has left
+func stageTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			return left
+		}
+	}
+	return timeout
+}
+
+// sleepContext waits for d, returning false early if ctx ends first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// discoverNetworkInfoWithin runs network discovery, giving up with ctx's
+// error when ctx ends first. The STUN queries cannot be interrupted and
+// finish in the background.
+func discoverNetworkInfoWithin(ctx context.Context, config Configuration) (*NetworkInfo, error) {
+	type discovery struct {
+		info *NetworkInfo
+		err  error
+	}
+	done := make(chan discovery, 1)
+	go func() {
+		info, err := discoverNetworkInfo(config)
+		done <- discovery{info, err}
+	}()
+	select {
+	case d := <-done:
+		return d.info, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
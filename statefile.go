@@ -0,0 +1,192 @@
+// Package main - Client connection state persisted across restarts
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ClientState is what a client remembers of its last session in the
+// stateFile, so a restart can ask the server for the same ports and keep
+// its NAT mapping instead of renegotiating from scratch
+type ClientState struct {
+	Room          string          `json:"room"`               // Hash of signaling URL and room ID the state belongs to
+	ClientID      string          `json:"clientId,omitempty"` // Identity the server keeps our allocations under
+	SavedAt       time.Time       `json:"savedAt"`
+	NATType       NATType         `json:"natType"`
+	HolePunchPort int             `json:"holePunchPort,omitempty"` // Local hole punching port, reused to keep the NAT mapping
+	ServerAddr    string          `json:"serverAddr"`              // Server's public address, changes when it restarts elsewhere
+	ServerNATType NATType         `json:"serverNatType"`
+	Mappings      []MappingRecord `json:"mappings"`
+}
+
+// MappingRecord is the allocation and connection type of one mapping
+type MappingRecord struct {
+	Mapping       string `json:"mapping"` // "protocol:localPort:remotePort"
+	AllocatedPort int    `json:"allocatedPort"`
+	Connection    string `json:"connection,omitempty"` // Last readiness state: connected or relay
+}
+
+// stateRoom identifies the room a state file belongs to without storing
+// the room ID, which grants access to the room
+func stateRoom(config Configuration) string {
+	sum := sha256.Sum256([]byte(config.SignalingURL + " " + config.RoomID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadClientState reads the stateFile. A missing file, or one written for
+// another room, yields nil and a full negotiation.
+func loadClientState(path string, config Configuration) *ClientState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("⚠️  Failed to read state file %s: %v", path, err)
+		}
+		return nil
+	}
+	var state ClientState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("⚠️  Ignoring unreadable state file %s: %v", path, err)
+		return nil
+	}
+	if state.Room != stateRoom(config) {
+		log.Printf("ℹ️  State file %s belongs to another room, negotiating from scratch", path)
+		return nil
+	}
+	log.Printf("💾 Resuming from state saved %s: server %s, %d mappings, NAT %s, server NAT %s",
+		state.SavedAt.Format(time.RFC3339), state.ServerAddr, len(state.Mappings), state.NATType, state.ServerNATType)
+	return &state
+}
+
+// savedClientID returns the client ID saved in the stateFile for config's
+// room, or "" without one
+func savedClientID(path string, config Configuration) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var state ClientState
+	if json.Unmarshal(data, &state) != nil || state.Room != stateRoom(config) {
+		return ""
+	}
+	return state.ClientID
+}
+
+// save writes the state atomically, so a crash never leaves a torn file
+func (s *ClientState) save(path string) error {
+	s.SavedAt = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// requestedPorts returns the ports to ask the server for, keyed by mapping
+func (s *ClientState) requestedPorts() map[string]int {
+	if s == nil || len(s.Mappings) == 0 {
+		return nil
+	}
+	ports := make(map[string]int, len(s.Mappings))
+	for _, record := range s.Mappings {
+		ports[record.Mapping] = record.AllocatedPort
+	}
+	return ports
+}
+
+// compare reports whether the server resumed the saved session: same
+// public address and every saved port honored. A mismatch means the server
+// restarted or moved, and the client has negotiated afresh.
+func (s *ClientState) compare(serverData *ServerRegistrationData) {
+	if s == nil {
+		return
+	}
+	if s.ServerAddr != serverData.NetworkInfo.PublicAddr {
+		log.Printf("🔄 Server address changed (%s -> %s), renegotiated from scratch",
+			s.ServerAddr, serverData.NetworkInfo.PublicAddr)
+		return
+	}
+	requested := s.requestedPorts()
+	resumed, moved := 0, 0
+	for _, pm := range serverData.PortMappings {
+		port, ok := requested[pm.ClientMapping.String()]
+		if !ok {
+			continue
+		}
+		if port == pm.AllocatedPort {
+			resumed++
+		} else {
+			moved++
+		}
+	}
+	if moved > 0 {
+		log.Printf("🔄 Server allocated new ports for %d mappings (restarted or ports taken), %d resumed", moved, resumed)
+		return
+	}
+	log.Printf("💾 Resumed %d mappings on their previous ports", resumed)
+}
+
+// newClientState records the session negotiated with the server
+func newClientState(config Configuration, networkInfo *NetworkInfo, serverData *ServerRegistrationData) *ClientState {
+	state := &ClientState{
+		Room:       stateRoom(config),
+		ClientID:   config.ClientID,
+		ServerAddr: serverData.NetworkInfo.PublicAddr,
+	}
+	if networkInfo.STUNResult != nil {
+		state.NATType = networkInfo.STUNResult.NATType
+	}
+	if networkInfo.HolePunchPort > 0 {
+		state.HolePunchPort = networkInfo.HolePunchPort
+	}
+	if serverData.NetworkInfo.STUNResult != nil {
+		state.ServerNATType = serverData.NetworkInfo.STUNResult.NATType
+	}
+	for _, pm := range serverData.PortMappings {
+		state.Mappings = append(state.Mappings, MappingRecord{
+			Mapping:       pm.ClientMapping.String(),
+			AllocatedPort: pm.AllocatedPort,
+		})
+	}
+	return state
+}
+
+// recordConnections fills in each mapping's connection type from the
+// readiness states
+func (s *ClientState) recordConnections(mappings []PortMapping) {
+	states := readiness.Report().Mappings
+	for i := range s.Mappings {
+		for _, mapping := range mappings {
+			if mapping.String() == s.Mappings[i].Mapping {
+				s.Mappings[i].Connection = states[forwardedPortKey(mapping)]
+			}
+		}
+	}
+}
+
+// saveClientState writes the state file, logging failures, which only cost
+// the next restart a full negotiation
+func saveClientState(path string, state *ClientState) {
+	if err := state.save(path); err != nil {
+		log.Printf("⚠️  Failed to save state file %s: %v", path, err)
+		return
+	}
+	defaultLogger.Debugf("State saved to %s", path)
+}
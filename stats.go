@@ -0,0 +1,45 @@
+// Package main - Forwarding statistics
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ForwarderStats counts forwarded connections across all mappings
+type ForwarderStats struct {
+	TCPAccepted atomic.Int64 // Connections proxied since start
+	TCPActive   atomic.Int64 // Connections currently proxied
+	TCPExpired  atomic.Int64 // Connections force-closed after maxConnLifetime
+
+	STUNCacheHits atomic.Int64 // Public address lookups answered from the STUN cache
+	STUNLookups   atomic.Int64 // Public address lookups sent to a STUN server
+
+	CompressedIn        atomic.Int64 // Bytes given to compressing TCP mappings
+	CompressedOut       atomic.Int64 // Bytes those mappings sent after compression
+	CompressionDisabled atomic.Int64 // Connections that stopped compressing incompressible data
+
+	UDPForeignDropped atomic.Int64 // Hole-punched datagrams dropped for not coming from the peer
+	UDPQueueDropped   atomic.Int64 // Datagrams dropped because a session's queue was full
+}
+
+// globalStats is the process-wide forwarding statistics
+var globalStats ForwarderStats
+
+// String summarises the statistics on one line
+func (s *ForwarderStats) String() string {
+	summary := fmt.Sprintf("TCP connections: %d total, %d active, %d expired; STUN: %d cache hits, %d fresh lookups",
+		s.TCPAccepted.Load(), s.TCPActive.Load(), s.TCPExpired.Load(),
+		s.STUNCacheHits.Load(), s.STUNLookups.Load())
+	if in := s.CompressedIn.Load(); in > 0 {
+		summary += fmt.Sprintf("; compression: %d -> %d bytes (ratio %.2f), disabled on %d connections",
+			in, s.CompressedOut.Load(), float64(s.CompressedOut.Load())/float64(in), s.CompressionDisabled.Load())
+	}
+	if dropped := s.UDPForeignDropped.Load(); dropped > 0 {
+		summary += fmt.Sprintf("; UDP: %d datagrams from non-peer sources dropped", dropped)
+	}
+	if dropped := s.UDPQueueDropped.Load(); dropped > 0 {
+		summary += fmt.Sprintf("; UDP: %d datagrams dropped by full session queues (%s)", dropped, udpQueuePolicy)
+	}
+	return summary
+}
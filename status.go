@@ -0,0 +1,205 @@
+// Package main - Liveness and readiness endpoints for orchestration
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mapping connection states reported by /readyz. Connected and relay are
+// terminal: the mapping forwards traffic. Failed mappings were not
+// allocated by the server and never forward.
+const (
+	MappingStateConnecting = "connecting"
+	MappingStateConnected  = "connected"
+	MappingStateRelay      = "relay"
+	MappingStateFailed     = "failed"
+)
+
+// livenessBeatInterval is how often the main loop reports that it runs; it
+// is considered stuck after missing three beats
+const livenessBeatInterval = 5 * time.Second
+
+// ReadinessTracker records discovery and per-mapping connection states
+type ReadinessTracker struct {
+	discovered bool
+	mappings   map[string]string
+	backing    map[string]bool // Mappings that only back another one, not counted for readiness
+	lastBeat   time.Time
+	mutex      sync.Mutex
+}
+
+// readiness is the process-wide readiness state
+var readiness = &ReadinessTracker{mappings: make(map[string]string), backing: make(map[string]bool), lastBeat: time.Now()}
+
+// ReadinessReport is the body of /readyz
+type ReadinessReport struct {
+	Ready     bool              `json:"ready"`
+	Discovery string            `json:"discovery"`           // "pending" or "complete"
+	Mappings  map[string]string `json:"mappings,omitempty"`  // "protocol:port" -> state
+	Pending   []string          `json:"pending,omitempty"`   // Mappings not yet connected or relayed
+	Health    map[string]string `json:"health,omitempty"`    // "protocol:port" -> health check status of the service
+	Unhealthy []string          `json:"unhealthy,omitempty"` // Mappings whose service fails its health check
+}
+
+// SetDiscovered records that network discovery completed
+func (r *ReadinessTracker) SetDiscovered() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.discovered = true
+}
+
+// SetMapping records the connection state of the mapping identified by key
+func (r *ReadinessTracker) SetMapping(key, state string) {
+	r.mutex.Lock()
+	r.mappings[key] = state
+	r.mutex.Unlock()
+	runMappingHooks(key, state, nil)
+}
+
+// Mapping returns the connection state of the mapping identified by key,
+// empty if none was recorded
+func (r *ReadinessTracker) Mapping(key string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.mappings[key]
+}
+
+// SetBacking marks the mapping identified by key as one leg of another
+// mapping, which is ready while any of its legs is; the leg's own state is
+// reported but not waited for
+func (r *ReadinessTracker) SetBacking(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.backing[key] = true
+}
+
+// FailMapping records that the mapping identified by key failed for err
+func (r *ReadinessTracker) FailMapping(key string, err error) {
+	r.mutex.Lock()
+	r.mappings[key] = MappingStateFailed
+	r.mutex.Unlock()
+	runMappingHooks(key, MappingStateFailed, err)
+}
+
+// Beat records that the main loop is running
+func (r *ReadinessTracker) Beat() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lastBeat = time.Now()
+}
+
+// Alive reports whether the main loop has beaten recently
+func (r *ReadinessTracker) Alive() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return time.Since(r.lastBeat) < 3*livenessBeatInterval
+}
+
+// Report returns the readiness breakdown
+func (r *ReadinessTracker) Report() ReadinessReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report := ReadinessReport{Discovery: "pending", Mappings: make(map[string]string, len(r.mappings))}
+	if r.discovered {
+		report.Discovery = "complete"
+	}
+	for key, state := range r.mappings {
+		report.Mappings[key] = state
+		if state != MappingStateConnected && state != MappingStateRelay && !r.backing[key] {
+			report.Pending = append(report.Pending, key)
+		}
+	}
+	sort.Strings(report.Pending)
+
+	if health, unhealthy := healthReport(); len(health) > 0 {
+		report.Health, report.Unhealthy = health, unhealthy
+	}
+	report.Ready = r.discovered && len(report.Pending) == 0 && len(report.Unhealthy) == 0
+	return report
+}
+
+// mappingStateKey identifies a mapping in the readiness report by protocol
+// and port: the local port on clients, the allocated port on servers
+func mappingStateKey(protocol string, port int) string {
+	return fmt.Sprintf("%s:%d", protocol, port)
+}
+
+// setMappingStates records state for every mapping of an allocation, keyed
+// by the client's local port or, on the server, the allocated port
+func setMappingStates(mappings []ServerPortMapping, server bool, state string) {
+	for _, pm := range mappings {
+		if server {
+			readiness.SetMapping(mappingStateKey(pm.ClientMapping.transport(), pm.AllocatedPort), state)
+		} else {
+			readiness.SetMapping(forwardedPortKey(pm.ClientMapping), state)
+		}
+	}
+}
+
+// statusHandler serves /livez, /readyz and /samples
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		if !readiness.Alive() {
+			http.Error(w, "main loop stalled", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := readiness.Report()
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	mux.HandleFunc("/samples", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if mappingKey := r.URL.Query().Get("mapping"); mappingKey != "" {
+			samples := trafficSamples.Samples(mappingKey)
+			if samples == nil {
+				samples = []Sample{}
+			}
+			json.NewEncoder(w).Encode(samples)
+			return
+		}
+		json.NewEncoder(w).Encode(trafficSamples.All())
+	})
+	return mux
+}
+
+// statusServerComponent serves the status endpoints on addr for the
+// lifetime of the process
+func statusServerComponent(addr string) Component {
+	server := &http.Server{Addr: addr, Handler: statusHandler(), ReadHeaderTimeout: 5 * time.Second}
+	return Component{
+		Name: "status server",
+		Start: func(ctx context.Context) error {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("status listen error: %w", err)
+			}
+			log.Printf("🩺 Status endpoints on http://%s/livez, /readyz and /samples", ln.Addr())
+			go func() {
+				if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Printf("Status server error: %v", err)
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return server.Shutdown(ctx)
+		},
+	}
+}
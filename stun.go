@@ -2,10 +2,12 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 
 // stunCache caches STUN discovery results
 type stunCache struct {
+	server     string // STUN server the cached address was discovered with
 	publicAddr string
 	timestamp  time.Time
 	mutex      sync.RWMutex
@@ -21,6 +24,9 @@ type stunCache struct {
 
 var globalSTUNCache = &stunCache{}
 
+// forceSTUNRefresh bypasses the STUN cache for this run
+var forceSTUNRefresh bool
+
 // NATType represents different types of NAT
 type NATType int
 
@@ -50,6 +56,40 @@ func (nt NATType) String() string {
 	}
 }
 
+// natTypeNames are the natType config values of the NAT types
+var natTypeNames = map[string]NATType{
+	"none":           NATTypeNone,
+	"fullCone":       NATTypeFullCone,
+	"restrictedCone": NATTypeRestrictedCone,
+	"portRestricted": NATTypePortRestricted,
+	"symmetric":      NATTypeSymmetric,
+}
+
+// parseNATType returns the NAT type named by a natType config value
+func parseNATType(name string) (NATType, error) {
+	natType, ok := natTypeNames[name]
+	if !ok {
+		return NATTypeUnknown, fmt.Errorf("unknown NAT type %q (want none, fullCone, restrictedCone, portRestricted or symmetric)", name)
+	}
+	return natType, nil
+}
+
+// knownNATType builds the STUN result of a host whose NAT type is set in
+// the config, discovering only its public address
+func knownNATType(stunServer string, natType NATType) (*STUNResult, error) {
+	publicAddr, err := getPublicIP(stunServer, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("NAT Detection - Skipped, NAT type set to %s by config", natType)
+	return &STUNResult{
+		PublicAddr:   publicAddr,
+		NATType:      natType,
+		Mappings:     []string{publicAddr},
+		CanHolePunch: natType != NATTypeSymmetric,
+	}, nil
+}
+
 // STUNResult contains comprehensive STUN discovery results
 type STUNResult struct {
 	PublicAddr  string
@@ -57,19 +97,29 @@ type STUNResult struct {
 	NATType     NATType
 	Mappings    []string // Different external mappings for symmetric NAT detection
 	CanHolePunch bool    // Whether hole punching is likely to work
+	IPv6        *STUNResult `json:",omitempty"` // Classification of the IPv6 NAT with dualStackNatDetection
 }
 
 // getPublicIP discovers public IP address with caching support, trying both IPv4 and IPv6
 func getPublicIP(stunServer string, cacheDuration time.Duration) (string, error) {
+	logger := defaultLogger.WithComponent("stun").WithFields(map[string]interface{}{"server": stunServer})
+
 	// 先检查缓存
 	globalSTUNCache.mutex.RLock()
-	if time.Since(globalSTUNCache.timestamp) < cacheDuration && globalSTUNCache.publicAddr != "" {
+	if !forceSTUNRefresh && globalSTUNCache.server == stunServer &&
+		time.Since(globalSTUNCache.timestamp) < cacheDuration && globalSTUNCache.publicAddr != "" {
 		addr := globalSTUNCache.publicAddr
+		age := time.Since(globalSTUNCache.timestamp)
 		globalSTUNCache.mutex.RUnlock()
+		globalStats.STUNCacheHits.Add(1)
+		logger.Infof("📦 STUN cache hit: %s (cached %v ago)", addr, age.Round(time.Second))
 		return addr, nil
 	}
 	globalSTUNCache.mutex.RUnlock()
 
+	globalStats.STUNLookups.Add(1)
+	logger.Infof("🔎 STUN fresh lookup (forceStunRefresh: %v)", forceSTUNRefresh)
+
 	// 缓存过期或不存在，重新获取 - 同时尝试IPv4和IPv6
 	publicAddr, err := performDualStackSTUNDiscovery(stunServer)
 	if err != nil {
@@ -78,6 +128,7 @@ func getPublicIP(stunServer string, cacheDuration time.Duration) (string, error)
 
 	// 更新缓存
 	globalSTUNCache.mutex.Lock()
+	globalSTUNCache.server = stunServer
 	globalSTUNCache.publicAddr = publicAddr
 	globalSTUNCache.timestamp = time.Now()
 	globalSTUNCache.mutex.Unlock()
@@ -103,8 +154,15 @@ func performDualStackSTUNDiscovery(stunServer string) (string, error) {
 
 // performSTUNDiscoveryWithNetwork performs STUN discovery with specific network type
 func performSTUNDiscoveryWithNetwork(stunServer, network string) (string, error) {
+	return withSTUNServer(network, stunServer, func(addr string) (string, error) {
+		return performSTUNBindingRequest(network, addr)
+	})
+}
+
+// performSTUNBindingRequest sends a binding request to a resolved STUN server address
+func performSTUNBindingRequest(network, serverAddr string) (string, error) {
 	// Create a new UDP connection to the STUN server with specific network type
-	conn, err := net.Dial(network, stunServer)
+	conn, err := dialFromBindInterface(network, serverAddr)
 	if err != nil {
 		return "", err
 	}
@@ -117,99 +175,230 @@ func performSTUNDiscoveryWithNetwork(stunServer, network string) (string, error)
 	}
 	defer client.Close()
 
-	// Create a binding request
+	return doSTUNBinding(client)
+}
+
+var (
+	// ErrSTUNTransaction is returned when a binding request gets no usable
+	// response, for example on timeout
+	ErrSTUNTransaction = errors.New("STUN transaction failed")
+	// ErrSTUNMalformedResponse is returned when a response arrives but lacks a
+	// valid XOR-MAPPED-ADDRESS
+	ErrSTUNMalformedResponse = errors.New("malformed STUN response")
+)
+
+// stunBindingResult is what the binding request callback hands back
+type stunBindingResult struct {
+	publicAddr string
+	err        error
+}
+
+// doSTUNBinding sends a binding request on client and returns the reflexive
+// address. The callback reports through a channel rather than shared state,
+// keeping transport and response parse errors distinct.
+func doSTUNBinding(client *stun.Client) (string, error) {
 	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	results := make(chan stunBindingResult, 1)
 
-	var publicAddr string
-	// The callback function will be called when a response is received
 	callback := func(res stun.Event) {
 		if res.Error != nil {
-			err = res.Error
+			results <- stunBindingResult{err: fmt.Errorf("%w: %w", ErrSTUNTransaction, res.Error)}
 			return
 		}
+		if stunVerbose {
+			logSTUNAttributes(res.Message)
+		}
 
 		var xorAddr stun.XORMappedAddress
-		if err = xorAddr.GetFrom(res.Message); err != nil {
+		if err := xorAddr.GetFrom(res.Message); err != nil {
+			results <- stunBindingResult{err: fmt.Errorf("%w: %w", ErrSTUNMalformedResponse, err)}
 			return
 		}
-		publicAddr = xorAddr.String()
+		results <- stunBindingResult{publicAddr: xorAddr.String()}
 	}
 
-	// Send the request and wait for the response
-	if err = client.Do(message, callback); err != nil {
-		return "", err
+	// Do blocks until the callback has run or the request could not be sent
+	if err := client.Do(message, callback); err != nil {
+		return "", fmt.Errorf("STUN request failed: %w", err)
 	}
 
-	if publicAddr == "" {
-		return "", errors.New("failed to get public IP from STUN server")
+	select {
+	case result := <-results:
+		return result.publicAddr, result.err
+	default:
+		return "", fmt.Errorf("%w: no response", ErrSTUNTransaction)
 	}
+}
 
-	return publicAddr, nil
+// performSTUNDiscoveryOnConn sends a binding request from an existing
+// unconnected socket, returning the reflexive address of that socket's port
+func performSTUNDiscoveryOnConn(conn *net.UDPConn, stunServer string) (string, error) {
+	return performSTUNDiscoveryOnConnWithNetwork(conn, "udp", stunServer)
 }
 
-// performSTUNDiscovery performs actual STUN discovery
-func performSTUNDiscovery(stunServer string) (string, error) {
-	// Create a new UDP connection to the STUN server.
-	conn, err := net.Dial("udp", stunServer)
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
+// performSTUNDiscoveryOnConnWithNetwork is performSTUNDiscoveryOnConn with
+// the STUN server resolved for network, "udp4" or "udp6" to pin the family
+func performSTUNDiscoveryOnConnWithNetwork(conn *net.UDPConn, network, stunServer string) (string, error) {
+	return withSTUNServer(network, stunServer, func(addr string) (string, error) {
+		serverAddr, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return "", err
+		}
 
-	// Create a new STUN client.
-	client, err := stun.NewClient(conn)
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
+		request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		if _, err := conn.WriteToUDP(request.Raw, serverAddr); err != nil {
+			return "", err
+		}
 
-	// Create a binding request.
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer conn.SetReadDeadline(time.Time{})
 
-	var publicAddr string
-	// The callback function will be called when a response is received.
-	callback := func(res stun.Event) {
-		if res.Error != nil {
-			err = res.Error
-			return
-		}
+		buffer := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return "", err
+			}
+			if !stun.IsMessage(buffer[:n]) {
+				continue
+			}
 
-		var xorAddr stun.XORMappedAddress
-		if err = xorAddr.GetFrom(res.Message); err != nil {
-			return
+			response := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+			if err := response.Decode(); err != nil || response.TransactionID != request.TransactionID {
+				continue
+			}
+			if stunVerbose {
+				logSTUNAttributes(response)
+			}
+
+			var xorAddr stun.XORMappedAddress
+			if err := xorAddr.GetFrom(response); err != nil {
+				return "", fmt.Errorf("%w: %w", ErrSTUNMalformedResponse, err)
+			}
+			return xorAddr.String(), nil
 		}
-		publicAddr = xorAddr.String()
-	}
+	})
+}
 
-	// Send the request and wait for the response.
-	if err = client.Do(message, callback); err != nil {
-		return "", err
+// stunVerbose logs every attribute of each STUN response when set
+var stunVerbose bool
+
+// logSTUNAttributes logs every attribute of a STUN response, decoding the
+// address, SOFTWARE and ERROR-CODE attributes and dumping others as hex
+func logSTUNAttributes(m *stun.Message) {
+	log.Printf("🔬 STUN %s with %d attributes", m.Type, len(m.Attributes))
+	for _, attr := range m.Attributes {
+		log.Printf("   %s: %s", attr.Type, describeSTUNAttribute(m, attr))
 	}
+}
 
-	if publicAddr == "" {
-		return "", errors.New("failed to get public IP from STUN server")
+// describeSTUNAttribute renders one attribute for logSTUNAttributes
+func describeSTUNAttribute(m *stun.Message, attr stun.RawAttribute) string {
+	switch attr.Type {
+	case stun.AttrXORMappedAddress:
+		var addr stun.XORMappedAddress
+		if err := addr.GetFrom(m); err == nil {
+			return addr.String()
+		}
+	case stun.AttrMappedAddress, stun.AttrOtherAddress, stun.AttrResponseOrigin,
+		stun.AttrChangedAddress, stun.AttrSourceAddress, stun.AttrAlternateServer:
+		var addr stun.MappedAddress
+		if err := addr.GetFromAs(m, attr.Type); err == nil {
+			return addr.String()
+		}
+	case stun.AttrSoftware:
+		return strconv.Quote(string(attr.Value))
+	case stun.AttrErrorCode:
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(m); err == nil {
+			return code.String()
+		}
 	}
+	return hex.EncodeToString(attr.Value)
+}
 
-	return publicAddr, nil
+// performSTUNDiscovery performs actual STUN discovery
+func performSTUNDiscovery(stunServer string) (string, error) {
+	return performSTUNDiscoveryWithNetwork(stunServer, "udp")
 }
 
 // clearSTUNCache clears STUN cache for testing or forced refresh
 func clearSTUNCache() {
 	globalSTUNCache.mutex.Lock()
+	globalSTUNCache.server = ""
 	globalSTUNCache.publicAddr = ""
 	globalSTUNCache.timestamp = time.Time{}
 	globalSTUNCache.mutex.Unlock()
 }
 
-// discoverNATType performs comprehensive NAT type detection
+// dualStackNATDetection classifies the IPv6 NAT too when the IPv4 one was
+// classified
+var dualStackNATDetection bool
+
+// natDetectionFamilies are the networks NAT detection tries in order; the
+// first that reaches the primary STUN server is classified
+var natDetectionFamilies = []string{"udp4", "udp6"}
+
+// secondarySTUNServer returns the STUN server NAT detection compares
+// stunServer's mapping with
+func secondarySTUNServer(stunServer string) string {
+	secondarySTUN := "stun.cloudflare.com:3478" // Use Cloudflare as secondary
+	if stunServer == secondarySTUN {
+		secondarySTUN = "stun.l.google.com:19302" // Fallback to Google
+	}
+	return secondarySTUN
+}
+
+// discoverNATType performs comprehensive NAT type detection on one address
+// family, so the local address and every mapping compared are of the same
+// family even on dual-stack hosts. With dualStackNATDetection an IPv4
+// classification is followed by an independent IPv6 one in result.IPv6.
 func discoverNATType(primarySTUN, secondarySTUN string) (*STUNResult, error) {
+	var lastErr error
+	for _, network := range natDetectionFamilies {
+		result, err := discoverNATTypeOn(network, primarySTUN, secondarySTUN)
+		if err != nil {
+			log.Printf("NAT Detection - %s failed: %v", network, err)
+			lastErr = err
+			continue
+		}
+		if dualStackNATDetection && network == "udp4" {
+			if v6, err := discoverNATTypeOn("udp6", primarySTUN, secondarySTUN); err != nil {
+				log.Printf("NAT Detection - udp6 failed: %v", err)
+			} else {
+				result.IPv6 = v6
+			}
+		}
+		return result, nil
+	}
+	return nil, lastErr
+}
+
+// sameFamily reports whether addr is of the address family of network,
+// "udp4" or "udp6"
+func sameFamily(network, addr string) bool {
+	ip := net.ParseIP(extractIP(addr))
+	return ip != nil && (ip.To4() != nil) == (network == "udp4")
+}
+
+// discoverNATTypeOn classifies the NAT with probes on network only. A STUN
+// response of the other family, e.g. from a server answering through a
+// NAT64, fails its test instead of being compared.
+func discoverNATTypeOn(network, primarySTUN, secondarySTUN string) (*STUNResult, error) {
 	result := &STUNResult{
 		NATType: NATTypeUnknown,
 		Mappings: make([]string, 0),
 	}
 
 	// Step 1: Get local address
-	localConn, err := net.Dial("udp", primarySTUN)
+	primaryAddrs, err := globalSTUNResolver.Resolve(network, primarySTUN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve primary STUN server: %w", err)
+	}
+	if len(primaryAddrs) == 0 {
+		return nil, fmt.Errorf("primary STUN server has no %s address", network)
+	}
+	localConn, err := dialFromBindInterface(network, primaryAddrs[0])
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to primary STUN server: %w", err)
 	}
@@ -219,10 +408,13 @@ func discoverNATType(primarySTUN, secondarySTUN string) (*STUNResult, error) {
 	log.Printf("NAT Detection - Local address: %s", result.LocalAddr)
 
 	// Step 2: Test 1 - Basic STUN discovery
-	mapping1, err := performSTUNDiscovery(primarySTUN)
+	mapping1, err := performSTUNDiscoveryWithNetwork(primarySTUN, network)
 	if err != nil {
 		return nil, fmt.Errorf("primary STUN discovery failed: %w", err)
 	}
+	if !sameFamily(network, mapping1) {
+		return nil, fmt.Errorf("primary STUN server mapped the %s probe to %s", network, mapping1)
+	}
 	result.PublicAddr = mapping1
 	result.Mappings = append(result.Mappings, mapping1)
 
@@ -239,7 +431,10 @@ func discoverNATType(primarySTUN, secondarySTUN string) (*STUNResult, error) {
 	}
 
 	// Step 3: Test 2 - Same server, different port (symmetric NAT detection)
-	mapping2, err := performSTUNDiscoveryFromSameLocalPort(primarySTUN, result.LocalAddr)
+	mapping2, err := performSTUNDiscoveryFromSameLocalPort(network, primarySTUN, result.LocalAddr)
+	if err == nil && !sameFamily(network, mapping2) {
+		err = fmt.Errorf("mapped the %s probe to %s", network, mapping2)
+	}
 	if err != nil {
 		log.Printf("Secondary mapping test failed: %v", err)
 		// Continue with limited detection
@@ -258,7 +453,10 @@ func discoverNATType(primarySTUN, secondarySTUN string) (*STUNResult, error) {
 
 	// Step 4: Test 3 - Different server (cone NAT type detection)
 	if secondarySTUN != "" && secondarySTUN != primarySTUN {
-		mapping3, err := performSTUNDiscovery(secondarySTUN)
+		mapping3, err := performSTUNDiscoveryWithNetwork(secondarySTUN, network)
+		if err == nil && !sameFamily(network, mapping3) {
+			err = fmt.Errorf("mapped the %s probe to %s", network, mapping3)
+		}
 		if err != nil {
 			log.Printf("Secondary STUN server test failed: %v", err)
 		} else {
@@ -286,7 +484,8 @@ func discoverNATType(primarySTUN, secondarySTUN string) (*STUNResult, error) {
 }
 
 // performSTUNDiscoveryFromSameLocalPort performs STUN discovery using specific local port
-func performSTUNDiscoveryFromSameLocalPort(stunServer, localAddr string) (string, error) {
+// on network
+func performSTUNDiscoveryFromSameLocalPort(network, stunServer, localAddr string) (string, error) {
 	// Parse local address to get IP and port
 	localIP, localPortStr, err := net.SplitHostPort(localAddr)
 	if err != nil {
@@ -294,15 +493,22 @@ func performSTUNDiscoveryFromSameLocalPort(stunServer, localAddr string) (string
 	}
 
 	// Create connection with same local address
-	localUDPAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(localIP, localPortStr))
+	localUDPAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(localIP, localPortStr))
 	if err != nil {
 		return "", fmt.Errorf("failed to resolve local UDP address: %w", err)
 	}
 
-	conn, err := net.DialUDP("udp", localUDPAddr, nil)
+	conn, err := listenUDPOnBindInterface(localUDPAddr)
 	if err != nil {
 		// Try with system-assigned port if exact port fails
-		genericConn, err2 := net.Dial("udp", stunServer)
+		serverAddrs, err2 := globalSTUNResolver.Resolve(network, stunServer)
+		if err2 != nil {
+			return "", fmt.Errorf("failed to resolve STUN server: %w", err2)
+		}
+		if len(serverAddrs) == 0 {
+			return "", fmt.Errorf("STUN server has no %s address", network)
+		}
+		genericConn, err2 := dialFromBindInterface(network, serverAddrs[0])
 		if err2 != nil {
 			return "", fmt.Errorf("failed to create UDP connection: %w", err2)
 		}
@@ -317,31 +523,7 @@ func performSTUNDiscoveryFromSameLocalPort(stunServer, localAddr string) (string
 	}
 	defer client.Close()
 
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-	var publicAddr string
-
-	callback := func(res stun.Event) {
-		if res.Error != nil {
-			err = res.Error
-			return
-		}
-
-		var xorAddr stun.XORMappedAddress
-		if err = xorAddr.GetFrom(res.Message); err != nil {
-			return
-		}
-		publicAddr = xorAddr.String()
-	}
-
-	if err = client.Do(message, callback); err != nil {
-		return "", fmt.Errorf("STUN request failed: %w", err)
-	}
-
-	if publicAddr == "" {
-		return "", errors.New("no public address received from STUN server")
-	}
-
-	return publicAddr, nil
+	return doSTUNBinding(client)
 }
 
 // extractPort extracts port from "ip:port" format
@@ -360,7 +542,7 @@ func createHolePunchingConn(localAddr string) (*net.UDPConn, error) {
 		if err != nil {
 			return nil, err
 		}
-		return net.ListenUDP("udp", addr)
+		return listenUDPOnBindInterface(addr)
 	}
 
 	// Use specific local address for consistent hole punching
@@ -368,5 +550,5 @@ func createHolePunchingConn(localAddr string) (*net.UDPConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return net.ListenUDP("udp", addr)
+	return listenUDPOnBindInterface(addr)
 }
\ No newline at end of file
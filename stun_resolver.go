@@ -0,0 +1,190 @@
+// Package main - STUN server DNS resolution with caching
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultSTUNDNSTTL is how long resolved STUN server addresses are reused
+const defaultSTUNDNSTTL = 10 * time.Minute
+
+// resolvedSTUN holds the cached addresses of one STUN server
+type resolvedSTUN struct {
+	addrs   []string // ip:port candidates
+	next    int      // rotation index of the preferred candidate
+	expires time.Time
+}
+
+// stunResolver resolves STUN hostnames once, caches the addresses with a TTL
+// and rotates through them when a candidate fails
+type stunResolver struct {
+	entries map[string]*resolvedSTUN
+	pinned  map[string]string
+	ttl     time.Duration
+	mutex   sync.Mutex
+}
+
+var globalSTUNResolver = newSTUNResolver()
+
+// newSTUNResolver creates a resolver with the default TTL
+func newSTUNResolver() *stunResolver {
+	return &stunResolver{
+		entries: make(map[string]*resolvedSTUN),
+		pinned:  make(map[string]string),
+		ttl:     defaultSTUNDNSTTL,
+	}
+}
+
+// SetTTL sets how long resolved addresses are cached
+func (r *stunResolver) SetTTL(ttl time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if ttl > 0 {
+		r.ttl = ttl
+	}
+}
+
+// Pin bypasses DNS for server, always using ip with the server's port
+func (r *stunResolver) Pin(server, ip string) error {
+	_, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("invalid STUN server %q: %w", server, err)
+	}
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid STUN server IP %q", ip)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pinned[server] = net.JoinHostPort(ip, port)
+	return nil
+}
+
+// Resolve returns the candidate addresses of server for network ("udp",
+// "udp4" or "udp6"), starting with the preferred one. A stale cache entry is
+// reused when re-resolution fails.
+func (r *stunResolver) Resolve(network, server string) ([]string, error) {
+	r.mutex.Lock()
+	if addr, ok := r.pinned[server]; ok {
+		r.mutex.Unlock()
+		candidates := filterAddrsByNetwork(network, []string{addr})
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("STUN server %s is pinned to %s, which is not a %s address", server, addr, network)
+		}
+		return candidates, nil
+	}
+	entry, ok := r.entries[server]
+	fresh := ok && time.Now().Before(entry.expires)
+	r.mutex.Unlock()
+
+	if !fresh {
+		addrs, err := lookupSTUNServer(server)
+		if err != nil {
+			if !ok {
+				return nil, err
+			}
+			log.Printf("Warning: re-resolving STUN server %s failed, using cached addresses: %v", server, err)
+		} else {
+			r.mutex.Lock()
+			entry = &resolvedSTUN{addrs: addrs, expires: time.Now().Add(r.ttl)}
+			r.entries[server] = entry
+			r.mutex.Unlock()
+		}
+	}
+
+	r.mutex.Lock()
+	ordered := make([]string, 0, len(entry.addrs))
+	for i := range entry.addrs {
+		ordered = append(ordered, entry.addrs[(entry.next+i)%len(entry.addrs)])
+	}
+	r.mutex.Unlock()
+
+	candidates := filterAddrsByNetwork(network, ordered)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("STUN server %s has no %s addresses", server, network)
+	}
+	return candidates, nil
+}
+
+// MarkFailed rotates past addr so the next lookup prefers another candidate
+func (r *stunResolver) MarkFailed(server, addr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[server]
+	if !ok {
+		return
+	}
+	for i, candidate := range entry.addrs {
+		if candidate == addr {
+			entry.next = (i + 1) % len(entry.addrs)
+			return
+		}
+	}
+}
+
+// lookupSTUNServer resolves all A/AAAA records of a host:port STUN server
+func lookupSTUNServer(server string) ([]string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN server %q: %w", server, err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses for STUN server " + host)
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// filterAddrsByNetwork keeps only the addresses matching the IP family of network
+func filterAddrsByNetwork(network string, addrs []string) []string {
+	if network != "udp4" && network != "udp6" {
+		return addrs
+	}
+	var filtered []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(extractIP(addr))
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (network == "udp4") {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// withSTUNServer runs fn against each resolved address of server in turn
+// until one succeeds, rotating failed candidates to the back
+func withSTUNServer(network, server string, fn func(addr string) (string, error)) (string, error) {
+	candidates, err := globalSTUNResolver.Resolve(network, server)
+	if err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for _, addr := range candidates {
+		result, err := fn(addr)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+		globalSTUNResolver.MarkFailed(server, addr)
+	}
+	return "", lastErr
+}
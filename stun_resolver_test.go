@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolvePinnedFamily(t *testing.T) {
+	r := newSTUNResolver()
+	if err := r.Pin("stun.example.com:3478", "192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, network := range []string{"udp", "udp4"} {
+		addrs, err := r.Resolve(network, "stun.example.com:3478")
+		if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.10:3478" {
+			t.Errorf("Resolve(%s) = %v, %v, want the pinned address", network, addrs, err)
+		}
+	}
+
+	// A pinned address of the other family is an error, not an empty list
+	addrs, err := r.Resolve("udp6", "stun.example.com:3478")
+	if err == nil || len(addrs) != 0 {
+		t.Fatalf("Resolve(udp6) of an IPv4 pin = %v, %v, want an error", addrs, err)
+	}
+	if !strings.Contains(err.Error(), "udp6") {
+		t.Errorf("error %q does not name the network", err)
+	}
+}
+
+func TestWithSTUNServerPinnedFamily(t *testing.T) {
+	saved := globalSTUNResolver
+	defer func() { globalSTUNResolver = saved }()
+	globalSTUNResolver = newSTUNResolver()
+	globalSTUNResolver.Pin("stun.example.com:3478", "2001:db8::1")
+
+	called := false
+	result, err := withSTUNServer("udp4", "stun.example.com:3478", func(addr string) (string, error) {
+		called = true
+		return addr, nil
+	})
+	if err == nil || result != "" {
+		t.Errorf("withSTUNServer = %q, %v, want an error", result, err)
+	}
+	if called {
+		t.Error("binding attempted without a candidate of the family")
+	}
+}
+
+func TestResolveLiteralFamily(t *testing.T) {
+	r := newSTUNResolver()
+	if _, err := r.Resolve("udp6", "192.0.2.10:3478"); err == nil {
+		t.Error("Resolve(udp6) of an IPv4 literal succeeded")
+	}
+	addrs, err := r.Resolve("udp4", "192.0.2.10:3478")
+	if err != nil || len(addrs) != 1 {
+		t.Errorf("Resolve(udp4) of an IPv4 literal = %v, %v", addrs, err)
+	}
+}
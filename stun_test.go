@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// fakeSTUNServer answers every binding request with the datagram reply
+// builds for it
+func fakeSTUNServer(t *testing.T, reply func(request *stun.Message) []byte) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go serveFakeSTUN(conn, func(request *stun.Message, _ *net.UDPAddr) []byte { return reply(request) })
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// serveFakeSTUN answers the binding requests conn receives until it is
+// closed, with the datagram reply builds for each request and its sender
+func serveFakeSTUN(conn *net.UDPConn, reply func(request *stun.Message, from *net.UDPAddr) []byte) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if request.Decode() != nil {
+			continue
+		}
+		conn.WriteToUDP(reply(request, addr), addr)
+	}
+}
+
+// bindingSuccess builds a success response to request with attrs
+func bindingSuccess(request *stun.Message, attrs ...stun.Setter) []byte {
+	setters := append([]stun.Setter{stun.NewTransactionIDSetter(request.TransactionID), stun.BindingSuccess}, attrs...)
+	return stun.MustBuild(setters...).Raw
+}
+
+// rawAttribute sets attribute t to value as is
+type rawAttribute struct {
+	t     stun.AttrType
+	value []byte
+}
+
+func (a rawAttribute) AddTo(m *stun.Message) error {
+	m.Add(a.t, a.value)
+	return nil
+}
+
+func TestSTUNBindingErrors(t *testing.T) {
+	mapped := &stun.XORMappedAddress{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	tests := []struct {
+		name    string
+		reply   func(*stun.Message) []byte
+		want    error
+		address string
+	}{
+		{"valid", func(r *stun.Message) []byte { return bindingSuccess(r, mapped) }, nil, "203.0.113.7:40000"},
+		{"no mapped address", func(r *stun.Message) []byte { return bindingSuccess(r) }, ErrSTUNMalformedResponse, ""},
+		{"truncated mapped address", func(r *stun.Message) []byte {
+			return bindingSuccess(r, rawAttribute{stun.AttrXORMappedAddress, []byte{0x00, 0x01}})
+		}, ErrSTUNMalformedResponse, ""},
+		{"garbage", func(*stun.Message) []byte { return []byte("not a STUN message at all") }, ErrSTUNTransaction, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeSTUNServer(t, tt.reply)
+			conn, err := net.DialUDP("udp4", nil, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := stun.NewClient(conn, stun.WithRTO(20*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			address, err := doSTUNBinding(client)
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if address != tt.address {
+				t.Errorf("got address %q, want %q", address, tt.address)
+			}
+			// A response that arrived is never reported as a failed transaction
+			if tt.want == ErrSTUNMalformedResponse && errors.Is(err, ErrSTUNTransaction) {
+				t.Errorf("malformed response reported as a transaction failure: %v", err)
+			}
+		})
+	}
+}
+
+func TestSTUNDiscoveryOnConnMalformedResponse(t *testing.T) {
+	server := fakeSTUNServer(t, func(r *stun.Message) []byte {
+		return bindingSuccess(r, rawAttribute{stun.AttrXORMappedAddress, []byte{0x00}})
+	})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := performSTUNDiscoveryOnConnWithNetwork(conn, "udp4", server.String()); !errors.Is(err, ErrSTUNMalformedResponse) {
+		t.Errorf("got %v, want ErrSTUNMalformedResponse", err)
+	}
+}
+
+// dualStackSTUN runs a fake STUN server answering on 127.0.0.1 and ::1 at
+// the same port, seeds globalSTUNResolver with both addresses for host and
+// returns the server's host:port. Each binding is answered with the address
+// mapped returns for its sender.
+func dualStackSTUN(t *testing.T, host string, mapped func(from *net.UDPAddr) *net.UDPAddr) string {
+	t.Helper()
+	var v4, v6 *net.UDPConn
+	for attempt := 0; v6 == nil; attempt++ {
+		var err error
+		v4, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v6, err = net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: v4.LocalAddr().(*net.UDPAddr).Port})
+		if err != nil {
+			v4.Close()
+			if attempt == 5 {
+				t.Skipf("no IPv6 loopback: %v", err)
+			}
+		}
+	}
+	for _, conn := range []*net.UDPConn{v4, v6} {
+		t.Cleanup(func() { conn.Close() })
+		go serveFakeSTUN(conn, func(request *stun.Message, from *net.UDPAddr) []byte {
+			addr := mapped(from)
+			return bindingSuccess(request, &stun.XORMappedAddress{IP: addr.IP, Port: addr.Port})
+		})
+	}
+
+	port := strconv.Itoa(v4.LocalAddr().(*net.UDPAddr).Port)
+	server := net.JoinHostPort(host, port)
+	globalSTUNResolver.mutex.Lock()
+	globalSTUNResolver.entries[server] = &resolvedSTUN{
+		// IPv6 first, so a lookup ignoring the family would pick it for IPv4
+		addrs:   []string{net.JoinHostPort("::1", port), net.JoinHostPort("127.0.0.1", port)},
+		expires: time.Now().Add(time.Hour),
+	}
+	globalSTUNResolver.mutex.Unlock()
+	return server
+}
+
+// natMapping maps senders to a public address of their own family, as a
+// dual-stack NAT would
+func natMapping(from *net.UDPAddr) *net.UDPAddr {
+	if from.IP.To4() != nil {
+		return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5), Port: from.Port}
+	}
+	return &net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: from.Port}
+}
+
+// checkOneFamily fails unless every address result compared is of network's
+// family
+func checkOneFamily(t *testing.T, network string, result *STUNResult) {
+	t.Helper()
+	addrs := append([]string{result.LocalAddr, result.PublicAddr}, result.Mappings...)
+	for _, addr := range addrs {
+		if !sameFamily(network, addr) {
+			t.Errorf("%s detection compared %s, of the other family (addresses %v)", network, addr, addrs)
+		}
+	}
+	if len(result.Mappings) < 2 {
+		t.Errorf("%s detection compared %d mappings, want both servers' (%v)", network, len(result.Mappings), result.Mappings)
+	}
+}
+
+func TestNATDetectionStaysOnOneFamily(t *testing.T) {
+	saved, savedDualStack := globalSTUNResolver, dualStackNATDetection
+	defer func() { globalSTUNResolver, dualStackNATDetection = saved, savedDualStack }()
+	globalSTUNResolver = newSTUNResolver()
+	dualStackNATDetection = true
+
+	primary := dualStackSTUN(t, "stun1.dual.test", natMapping)
+	secondary := dualStackSTUN(t, "stun2.dual.test", natMapping)
+
+	result, err := discoverNATType(primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOneFamily(t, "udp4", result)
+	if result.IPv6 == nil {
+		t.Fatal("no IPv6 classification with dualStackNatDetection")
+	}
+	checkOneFamily(t, "udp6", result.IPv6)
+}
+
+func TestNATDetectionRefusesCrossFamilyMapping(t *testing.T) {
+	saved, savedDualStack := globalSTUNResolver, dualStackNATDetection
+	defer func() { globalSTUNResolver, dualStackNATDetection = saved, savedDualStack }()
+	globalSTUNResolver = newSTUNResolver()
+	dualStackNATDetection = false
+
+	// The server maps IPv4 probes to an IPv6 address, as through a NAT64
+	primary := dualStackSTUN(t, "stun1.nat64.test", func(from *net.UDPAddr) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP("2001:db8::64"), Port: from.Port}
+	})
+	secondary := dualStackSTUN(t, "stun2.nat64.test", natMapping)
+
+	if _, err := discoverNATTypeOn("udp4", primary, secondary); err == nil {
+		t.Error("udp4 detection accepted an IPv6 mapping")
+	}
+
+	// Detection moves on to IPv6 instead of comparing across families
+	result, err := discoverNATType(primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOneFamily(t, "udp6", result)
+}
@@ -0,0 +1,118 @@
+// Package main - Connection negotiation timeline for --profile-connection
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TraceEvent is one milestone of the connection negotiation
+type TraceEvent struct {
+	Time    time.Time `json:"time"`
+	Elapsed string    `json:"elapsed"`
+	Event   string    `json:"event"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// ConnectionTrace records negotiation milestones from startup until the
+// first forwarded byte. The file is rewritten after every milestone, so a
+// run that dies on a fatal error still leaves its timeline behind.
+type ConnectionTrace struct {
+	path      string
+	start     time.Time
+	events    []TraceEvent
+	firstByte sync.Once
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// connectionTrace is set when --profile-connection is given; nil disables tracing
+var connectionTrace *ConnectionTrace
+
+// NewConnectionTrace starts a trace at the current time, written to path
+func NewConnectionTrace(path string) *ConnectionTrace {
+	return &ConnectionTrace{
+		path:  path,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+}
+
+// Record appends a milestone and rewrites the timeline file
+func (ct *ConnectionTrace) Record(event, detail string) {
+	now := time.Now()
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	ct.events = append(ct.events, TraceEvent{
+		Time:    now,
+		Elapsed: now.Sub(ct.start).Round(time.Millisecond).String(),
+		Event:   event,
+		Detail:  detail,
+	})
+	if err := ct.write(); err != nil {
+		log.Printf("⚠️  Failed to write connection profile: %v", err)
+	}
+}
+
+// Done is closed once the first byte has been forwarded
+func (ct *ConnectionTrace) Done() <-chan struct{} {
+	return ct.done
+}
+
+// write writes the timeline as JSON; callers hold the mutex
+func (ct *ConnectionTrace) write() error {
+	data, err := json.MarshalIndent(ct.events, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ct.path, append(data, '\n'), 0644)
+}
+
+// traceEvent records a milestone when connection profiling is enabled
+func traceEvent(event, format string, args ...interface{}) {
+	if connectionTrace == nil {
+		return
+	}
+	connectionTrace.Record(event, fmt.Sprintf(format, args...))
+}
+
+// traceFirstByte records the first forwarded byte and completes the trace
+func traceFirstByte(direction string) {
+	if connectionTrace == nil {
+		return
+	}
+	connectionTrace.firstByte.Do(func() {
+		connectionTrace.Record("first_byte_forwarded", direction)
+		close(connectionTrace.done)
+	})
+}
+
+// traceDone returns the channel closed when the trace completes, or nil
+// (blocking forever) when profiling is off
+func traceDone() <-chan struct{} {
+	if connectionTrace == nil {
+		return nil
+	}
+	return connectionTrace.Done()
+}
+
+// firstByteWriter reports the first successful write through it
+type firstByteWriter struct {
+	dst       io.Writer
+	direction string
+	seen      bool
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	if n > 0 && !w.seen {
+		w.seen = true
+		traceFirstByte(w.direction)
+	}
+	return n, err
+}
@@ -0,0 +1,266 @@
+// Package main - Multiple independent tunnels supervised by one process
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// TunnelConfig is one entry of the 'tunnels' list. Every tunnel registers in
+// its own room and runs independently of the others; settings left empty are
+// inherited from the top level of the configuration.
+type TunnelConfig struct {
+	Name           string            `json:"name,omitempty" yaml:"name,omitempty"` // Label in logs, defaults to the room ID
+	Mode           string            `json:"mode,omitempty" yaml:"mode,omitempty"`
+	PeerSide       string            `json:"peerSide,omitempty" yaml:"peerSide,omitempty"`
+	RoomID         string            `json:"roomId,omitempty" yaml:"roomId,omitempty"`
+	SignalingURL   string            `json:"signalingUrl,omitempty" yaml:"signalingUrl,omitempty"`
+	SignalingURLs  []SignalingServer `json:"signalingUrls,omitempty" yaml:"signalingUrls,omitempty"`
+	STUNServer     string            `json:"stunServer,omitempty" yaml:"stunServer,omitempty"`
+	Mappings       []PortMapping     `json:"mappings,omitempty" yaml:"mappings,omitempty"`
+	Services       map[string]int    `json:"services,omitempty" yaml:"services,omitempty"`
+	ServiceTargets []string          `json:"serviceTargets,omitempty" yaml:"serviceTargets,omitempty"`
+	ICMPTargets    []string          `json:"icmpTargets,omitempty" yaml:"icmpTargets,omitempty"`
+	Transport      string            `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+// tunnel is the effective configuration of one tunnel
+type tunnel struct {
+	Name   string
+	Config Configuration
+}
+
+// tunnels returns the tunnels the configuration defines: one per 'tunnels'
+// entry, or the top-level configuration itself when the list is empty
+func (c Configuration) tunnels() []tunnel {
+	if len(c.Tunnels) == 0 {
+		return []tunnel{{Name: c.RoomID, Config: c}}
+	}
+
+	result := make([]tunnel, 0, len(c.Tunnels))
+	for _, t := range c.Tunnels {
+		config := c
+		config.Tunnels = nil
+		if t.Mode != "" {
+			config.Mode = t.Mode
+		}
+		if t.PeerSide != "" {
+			config.PeerSide = t.PeerSide
+		}
+		if t.RoomID != "" {
+			config.RoomID = t.RoomID
+		}
+		if t.SignalingURL != "" {
+			config.SignalingURL = t.SignalingURL
+			// Failover servers of another signaling server do not apply
+			config.SignalingURLs = nil
+		}
+		if t.SignalingURLs != nil {
+			config.SignalingURLs = t.SignalingURLs
+		}
+		if t.STUNServer != "" {
+			config.STUNServer = t.STUNServer
+		}
+		if t.Mappings != nil {
+			config.Mappings = t.Mappings
+			config.MappingsFile = ""
+		}
+		if t.Services != nil {
+			config.Services = t.Services
+		}
+		if t.ServiceTargets != nil {
+			config.ServiceTargets = t.ServiceTargets
+		}
+		if t.ICMPTargets != nil {
+			config.ICMPTargets = t.ICMPTargets
+		}
+		if t.Transport != "" {
+			config.Transport = t.Transport
+		}
+
+		name := t.Name
+		if name == "" {
+			name = config.RoomID
+		}
+		result = append(result, tunnel{Name: name, Config: config})
+	}
+	return result
+}
+
+// validateTunnels checks that tunnels can run side by side in one process
+func validateTunnels(tunnels []tunnel) error {
+	names := make(map[string]bool)
+	rooms := make(map[string]string)
+	for _, t := range tunnels {
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tunnel name %q", t.Name)
+		}
+		names[t.Name] = true
+
+		// Two tunnels of one mode in one room overwrite each other's registrations
+		room := t.Config.SignalingURL + " " + t.Config.RoomID + " " + t.Config.Mode
+		if other, ok := rooms[room]; ok {
+			return fmt.Errorf("tunnels %q and %q are both %ss in the same room", other, t.Name, t.Config.Mode)
+		}
+		rooms[room] = t.Name
+	}
+	return nil
+}
+
+// validateTunnelConfig checks the per-tunnel settings of config
+func validateTunnelConfig(config *Configuration) error {
+	if config.Mode != "client" && config.Mode != "server" && config.Mode != "peer" {
+		return fmt.Errorf("'mode' must be 'client', 'server' or 'peer'")
+	}
+	if config.SignalingURL == "" {
+		return fmt.Errorf("'signalingUrl' is required")
+	}
+	for _, server := range config.SignalingURLs {
+		if server.URL == "" {
+			return fmt.Errorf("'signalingUrls' entries need a 'url'")
+		}
+	}
+	if config.RoomID == "" {
+		return fmt.Errorf("'roomId' is required")
+	}
+	// A client may start without mappings and add them through the mapping
+	// CLI, which needs stdin
+	if config.Mode == "client" && len(config.Mappings) == 0 && config.NoInteractive {
+		return fmt.Errorf("client mode with -no-interactive requires at least one port 'mapping'")
+	}
+	if err := validateMappings(config.Mappings); err != nil {
+		return err
+	}
+	if err := validateServiceTargets(config.ServiceTargets); err != nil {
+		return err
+	}
+	if err := validateICMPTargets(config.ICMPTargets); err != nil {
+		return err
+	}
+	for _, mapping := range config.Mappings {
+		if warning := swappedPortsWarning(mapping); warning != "" {
+			log.Printf("⚠️  %s", warning)
+		}
+	}
+	if err := validateServices(config.Services); err != nil {
+		return fmt.Errorf("'services': %v", err)
+	}
+	if config.Transport != "" && config.Transport != TransportQUIC && config.Transport != TransportDirect {
+		return fmt.Errorf("unknown 'transport' %q (want 'quic' or 'direct')", config.Transport)
+	}
+	if config.NATType != "" {
+		if _, err := parseNATType(config.NATType); err != nil {
+			return fmt.Errorf("'natType': %v", err)
+		}
+	}
+	if config.DirectAddr != "" {
+		if err := validateDirectAddr(config.DirectAddr); err != nil {
+			return fmt.Errorf("'directAddr': %v", err)
+		}
+	}
+	if config.Transport == TransportDirect && config.Mode == "client" && config.DirectAddr == "" {
+		return fmt.Errorf("'transport: direct' requires 'directAddr'")
+	}
+	if config.UDPFin && config.Mode == "client" && !config.UDPMux {
+		return fmt.Errorf("'udpFin' requires 'udpMux'")
+	}
+	for _, mapping := range config.Mappings {
+		if len(mapping.Peers) > 0 && config.Mode != "client" {
+			return fmt.Errorf("mapping %s: 'peers' applies to client mappings only", mapping)
+		}
+	}
+	if config.Mode == "peer" {
+		if config.PeerSide != PeerSideA && config.PeerSide != PeerSideB {
+			return fmt.Errorf("peer mode requires 'peerSide' to be 'a' or 'b'")
+		}
+		if err := validatePeerMappings(config.Mappings); err != nil {
+			return err
+		}
+	}
+	// Server ignores mappings
+	if config.Mode == "server" {
+		config.Mappings = nil // Clear any mappings for server
+	}
+	return nil
+}
+
+// swappedPortsWarning returns a warning when a mapping looks like its local
+// and remote ports were swapped, e.g. tcp:80:8080 meant as tcp:8080:80: the
+// local port is a privileged one below 1024, which the client needs root to
+// bind, while the remote port is not. Service mappings and mappings with
+// noSwapWarning are not checked.
+func swappedPortsWarning(mapping PortMapping) string {
+	if mapping.NoSwapWarning || mapping.Service != "" || mapping.Protocol == "icmp" {
+		return ""
+	}
+	if mapping.LocalPort <= 0 || mapping.LocalPort >= 1024 || mapping.RemotePort < 1024 {
+		return ""
+	}
+	swapped := mapping
+	swapped.LocalPort, swapped.RemotePort = mapping.RemotePort, mapping.LocalPort
+	return fmt.Sprintf("Mapping %s forwards privileged local port %d to remote port %d: are the ports swapped (%s)? Set 'noSwapWarning' on the mapping if not",
+		mapping, mapping.LocalPort, mapping.RemotePort, swapped)
+}
+
+// validateMappings checks the options of each mapping and that no two
+// mappings share a local port
+func validateMappings(mappings []PortMapping) error {
+	for _, mapping := range mappings {
+		if _, err := ParseLogLevel(mapping.LogLevel); err != nil {
+			return fmt.Errorf("mapping %s: %v", mapping, err)
+		}
+		if mapping.ConnectTimeout < 0 {
+			return fmt.Errorf("mapping %s: 'connectTimeout' must be positive", mapping)
+		}
+		if err := validateSourcePort(mapping.SourcePort); err != nil {
+			return fmt.Errorf("mapping %s: %v", mapping, err)
+		}
+		if mapping.SourcePort != "" && mapping.Protocol != "udp" {
+			return fmt.Errorf("mapping %s: 'sourcePort' applies to UDP mappings only", mapping)
+		}
+		if mapping.UDPResponseTimeout < 0 {
+			return fmt.Errorf("mapping %s: 'udpResponseTimeout' must not be negative", mapping)
+		}
+		if mapping.UDPResponseTimeout > 0 && mapping.transport() != "udp" {
+			return fmt.Errorf("mapping %s: 'udpResponseTimeout' applies to UDP mappings only", mapping)
+		}
+		if err := validateUDPSessionKey(mapping.UDPSessionKey); err != nil {
+			return fmt.Errorf("mapping %s: %v", mapping, err)
+		}
+		if mapping.UDPSessionKey != "" && mapping.transport() != "udp" {
+			return fmt.Errorf("mapping %s: 'udpSessionKey' applies to UDP mappings only", mapping)
+		}
+		if err := validateUDPCoalesceDelay(mapping.UDPCoalesceDelay); err != nil {
+			return fmt.Errorf("mapping %s: %v", mapping, err)
+		}
+		if mapping.RelayMux && mapping.Protocol != "tcp" {
+			return fmt.Errorf("mapping %s: 'relayMux' applies to TCP mappings only", mapping)
+		}
+		if mapping.UDPCoalesceDelay > 0 && mapping.Protocol != "udp" {
+			return fmt.Errorf("mapping %s: 'udpCoalesceDelay' applies to UDP mappings only", mapping)
+		}
+		if mapping.Protocol == "icmp" {
+			if err := validateICMPMapping(mapping); err != nil {
+				return fmt.Errorf("mapping %s: %v", mapping, err)
+			}
+		} else if mapping.ServiceTarget != "" {
+			if err := validateServiceTarget(mapping.ServiceTarget); err != nil {
+				return fmt.Errorf("mapping %s: %v", mapping, err)
+			}
+		}
+		if mapping.HealthCheck != nil {
+			if err := mapping.HealthCheck.Validate(); err != nil {
+				return fmt.Errorf("mapping %s: %v", mapping, err)
+			}
+		}
+		if mapping.JitterBuffer != nil {
+			if err := mapping.JitterBuffer.Validate(); err != nil {
+				return fmt.Errorf("mapping %s: %v", mapping, err)
+			}
+		}
+		if err := validatePeers(mapping); err != nil {
+			return fmt.Errorf("mapping %s: %v", mapping, err)
+		}
+	}
+	return validateUniqueMappings(mappings)
+}
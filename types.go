@@ -7,25 +7,201 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // PortMapping defines a single port forwarding rule.
-// The format for the string representation is "proto:local:remote".
+// The format for the string representation is "proto:local:remote", where
+// remote may be "@name" to use a service the server advertises.
 type PortMapping struct {
 	Protocol   string `json:"protocol" yaml:"protocol"`
 	LocalPort  int    `json:"localPort" yaml:"localPort"`
 	RemotePort int    `json:"remotePort" yaml:"remotePort"`
+	Service    string `json:"service,omitempty" yaml:"service,omitempty"`   // Server service name; the server fills in RemotePort
+	DualPath   bool   `json:"dualPath,omitempty" yaml:"dualPath,omitempty"` // Keep LAN and WAN paths, fail over between them
+	LogLevel   string `json:"logLevel,omitempty" yaml:"logLevel,omitempty"` // Per-mapping log level override
+	Quiet      bool   `json:"quiet,omitempty" yaml:"quiet,omitempty"`       // Suppress per-connection logs, keep warnings and errors
+
+	HealthCheck *HealthCheckConfig `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"` // Server-side check of the local service
+	ServiceTarget string          `json:"serviceTarget,omitempty" yaml:"serviceTarget,omitempty"` // host:port the server dials instead of 127.0.0.1:remotePort
+
+	LocalConnPool     bool `json:"localConnPool,omitempty" yaml:"localConnPool,omitempty"`         // Keep TCP connections to the service pre-dialed
+	LocalConnPoolSize int  `json:"localConnPoolSize,omitempty" yaml:"localConnPoolSize,omitempty"` // Pre-dialed connections, default 4
+
+	JitterBuffer *JitterBufferConfig `json:"jitterBuffer,omitempty" yaml:"jitterBuffer,omitempty"` // Reorder hole-punched UDP datagrams
+
+	UDPCoalesceDelay Duration `json:"udpCoalesceDelay,omitempty" yaml:"udpCoalesceDelay,omitempty"` // Bundle small hole-punched UDP datagrams sent within this delay
+
+	Compress bool `json:"compress,omitempty" yaml:"compress,omitempty"` // Deflate the peer-to-peer hop of a TCP mapping
+	RelayMux bool `json:"relayMux,omitempty" yaml:"relayMux,omitempty"` // Carry a TCP mapping's connections over one framed connection to the server
+
+	ConnectTimeout Duration `json:"connectTimeout,omitempty" yaml:"connectTimeout,omitempty"` // Overrides the global connectTimeout for this mapping's dials
+
+	SourcePort string `json:"sourcePort,omitempty" yaml:"sourcePort,omitempty"` // UDP relay: "preserve" or a fixed local port for outbound sessions
+
+	UDPResponseTimeout Duration `json:"udpResponseTimeout,omitempty" yaml:"udpResponseTimeout,omitempty"` // UDP relay: how long a session awaits the next datagram, default 5m
+
+	UDPSessionKey string `json:"udpSessionKey,omitempty" yaml:"udpSessionKey,omitempty"` // UDP relay on the server: "full5tuple" or "sourceIP" session keying
+
+	NoSwapWarning bool `json:"noSwapWarning,omitempty" yaml:"noSwapWarning,omitempty"` // Privileged local port to a high remote port is intended
+
+	Peers        []string `json:"peers,omitempty" yaml:"peers,omitempty"`               // Client: rooms of server peers to forward through, with failover
+	PeerFailover string   `json:"peerFailover,omitempty" yaml:"peerFailover,omitempty"` // preferFirst (default) or sticky
+}
+
+// dialTimeout returns the timeout of the mapping's TCP dials: its own
+// connectTimeout, or the global one
+func (pm PortMapping) dialTimeout() time.Duration {
+	if pm.ConnectTimeout > 0 {
+		return time.Duration(pm.ConnectTimeout)
+	}
+	return connectTimeout
+}
+
+// udpSessionTimeout returns how long the mapping's UDP relay sessions are
+// kept without a datagram in either direction
+func (pm PortMapping) udpSessionTimeout() time.Duration {
+	if pm.UDPResponseTimeout > 0 {
+		return time.Duration(pm.UDPResponseTimeout)
+	}
+	return defaultUDPSessionTimeout
+}
+
+// transport returns the protocol a mapping is forwarded over: ICMP mappings
+// travel as UDP
+func (pm PortMapping) transport() string {
+	if pm.Protocol == "icmp" {
+		return "udp"
+	}
+	return pm.Protocol
+}
+
+// String returns the mapping in "proto:local:remote" form
+func (pm PortMapping) String() string {
+	if pm.Service != "" {
+		return fmt.Sprintf("%s:%d:@%s", pm.Protocol, pm.LocalPort, pm.Service)
+	}
+	return fmt.Sprintf("%s:%d:%d", pm.Protocol, pm.LocalPort, pm.RemotePort)
 }
 
 // Configuration holds the application configuration.
 type Configuration struct {
 	Mode         string        `json:"mode" yaml:"mode"`
+	PeerSide     string        `json:"peerSide,omitempty" yaml:"peerSide,omitempty"` // "a" or "b" in peer mode; side a initiates
 	RoomID       string        `json:"roomId" yaml:"roomId"`
 	SignalingURL string        `json:"signalingUrl" yaml:"signalingUrl"`
 	STUNServer   string        `json:"stunServer,omitempty" yaml:"stunServer,omitempty"`
+	STUNServerIP string        `json:"stunServerIp,omitempty" yaml:"stunServerIp,omitempty"` // Pin the STUN server IP, bypassing DNS
+	STUNDNSTTL   Duration      `json:"stunDnsTtl,omitempty" yaml:"stunDnsTtl,omitempty"`     // How long resolved STUN addresses are cached
+	STUNVerbose  bool          `json:"stunVerbose,omitempty" yaml:"stunVerbose,omitempty"`   // Log every attribute of STUN responses
+	NATType      string        `json:"natType,omitempty" yaml:"natType,omitempty"`           // Known NAT type, skipping detection
+	DualStackNATDetection bool `json:"dualStackNatDetection,omitempty" yaml:"dualStackNatDetection,omitempty"` // Classify the IPv6 NAT as well as the IPv4 one
 	Mappings     []PortMapping `json:"mappings,omitempty" yaml:"mappings,omitempty"`
+	MappingsFile string        `json:"mappingsFile,omitempty" yaml:"mappingsFile,omitempty"` // YAML or JSON file with more mappings, watched for changes
+	UDPMux       bool          `json:"udpMux,omitempty" yaml:"udpMux,omitempty"` // Multiplex hole-punched UDP mappings over one socket
+	UDPFin       bool          `json:"udpFin,omitempty" yaml:"udpFin,omitempty"` // Propagate the end of UDP sessions over the mux
+	Transport    string        `json:"transport,omitempty" yaml:"transport,omitempty"` // "quic" carries TCP mappings as QUIC streams, "direct" connects over directAddr
+	DirectAddr   string        `json:"directAddr,omitempty" yaml:"directAddr,omitempty"` // This host's address on a VPN shared with the peer
+
+	HolePunchLocalPort int `json:"holePunchLocalPort,omitempty" yaml:"holePunchLocalPort,omitempty"` // Fixed local UDP port for hole punching
+	HolePunchStrategies []string `json:"holePunchStrategies,omitempty" yaml:"holePunchStrategies,omitempty"` // Hole punching strategies to run, in order
+	HolePunchRetries    int      `json:"holePunchRetries,omitempty" yaml:"holePunchRetries,omitempty"`       // Punch retries from fresh ports before relaying
+	MaxConcurrentPunches int     `json:"maxConcurrentPunches,omitempty" yaml:"maxConcurrentPunches,omitempty"` // Hole punching attempts in flight at once, 0 is unlimited
+	MaxConnLifetime    Duration `json:"maxConnLifetime,omitempty" yaml:"maxConnLifetime,omitempty"`     // Force-close forwarded TCP connections after this long
+	ConnectTimeout     Duration `json:"connectTimeout,omitempty" yaml:"connectTimeout,omitempty"`       // Timeout of TCP dials to the peer and the local service, default 5s
+	ASCIILogs          bool     `json:"asciiLogs,omitempty" yaml:"asciiLogs,omitempty"`                 // Strip emoji from log output
+	LogLevel           string   `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`                   // debug, info, warn or error; default info
+	LogSummaryInterval Duration `json:"logSummaryInterval,omitempty" yaml:"logSummaryInterval,omitempty"` // How often repeats of a forwarding error are summarized, default 30s
+	StatusListen       string   `json:"statusListen,omitempty" yaml:"statusListen,omitempty"`           // host:port serving /livez and /readyz
+	ControlListen      string   `json:"controlListen,omitempty" yaml:"controlListen,omitempty"`         // Unix socket path or host:port taking console commands
+	InterfaceWatch     bool     `json:"interfaceWatch,omitempty" yaml:"interfaceWatch,omitempty"`       // Re-register when local interfaces change
+	BindInterface      string   `json:"bindInterface,omitempty" yaml:"bindInterface,omitempty"`         // Interface name or "auto" for STUN and hole punching sockets
+	StartupTimeout     Duration `json:"startupTimeout,omitempty" yaml:"startupTimeout,omitempty"`       // Client: bound on the whole bring-up, 0 is unbounded
+	StateFile          string   `json:"stateFile,omitempty" yaml:"stateFile,omitempty"`                 // Client: session state kept across restarts to resume with the same ports
+	ClientID           string   `json:"clientId,omitempty" yaml:"clientId,omitempty"`                   // Client: identity the server keeps allocations under, generated when empty
+	AffinityWindow     Duration `json:"affinityWindow,omitempty" yaml:"affinityWindow,omitempty"`       // Server: how long a replaced client's allocations are held, default 2m
+	PeerWaitTimeout    *Duration `json:"peerWaitTimeout,omitempty" yaml:"peerWaitTimeout,omitempty"`    // How long either side waits for the other to register, 0 waits indefinitely
+	ServerLivenessTimeout Duration `json:"serverLivenessTimeout,omitempty" yaml:"serverLivenessTimeout,omitempty"` // Client: re-register after no server heartbeat for this long, default 3 beats
+	ServerFullRetry       Duration `json:"serverFullRetry,omitempty" yaml:"serverFullRetry,omitempty"`             // Client: wait before registering again with a full server, 0 exits
+
+	LocalDialRetries      int      `json:"localDialRetries,omitempty" yaml:"localDialRetries,omitempty"` // Server: retries of a failed dial to the local service, default 0
+	LocalDialBackoff      Duration `json:"localDialBackoff,omitempty" yaml:"localDialBackoff,omitempty"` // Server: wait before the first retry, doubling after each, default 200ms
+	ServiceFallbackDelay  Duration `json:"serviceFallbackDelay,omitempty" yaml:"serviceFallbackDelay,omitempty"` // Server: head start of the first address family of a dual-stack service, default 300ms
+	AllocationConcurrency int `json:"allocationConcurrency,omitempty" yaml:"allocationConcurrency,omitempty"` // Server: mappings allocated at once, default 8
+	UDPQueueDepth         int    `json:"udpQueueDepth,omitempty" yaml:"udpQueueDepth,omitempty"`   // Datagrams queued per UDP session, default 256
+	UDPQueuePolicy        string `json:"udpQueuePolicy,omitempty" yaml:"udpQueuePolicy,omitempty"` // dropNewest (default) or dropOldest when a queue is full
+	UDPSourcePool         string `json:"udpSourcePool,omitempty" yaml:"udpSourcePool,omitempty"`   // Server: CIDR prefix UDP sessions get a source address from, advanced
+	ForceSTUNRefresh   bool     `json:"forceStunRefresh,omitempty" yaml:"forceStunRefresh,omitempty"`   // Bypass the STUN cache for this run
+
+	TCPNoDelay           *bool    `json:"tcpNoDelay,omitempty" yaml:"tcpNoDelay,omitempty"`                     // Disable Nagle on forwarded TCP sockets, default true
+	TCPKeepAlive         *bool    `json:"tcpKeepAlive,omitempty" yaml:"tcpKeepAlive,omitempty"`                 // Enable keep-alive on forwarded TCP sockets, default true
+	TCPKeepAliveInterval Duration `json:"tcpKeepAliveInterval,omitempty" yaml:"tcpKeepAliveInterval,omitempty"` // Keep-alive probe interval, default 15s
+	TCPSocketBufferSize  int      `json:"tcpSocketBufferSize,omitempty" yaml:"tcpSocketBufferSize,omitempty"`   // SO_RCVBUF/SO_SNDBUF of forwarded TCP sockets, 0 autotunes
+
+	NoInteractive bool          `json:"-" yaml:"-"` // -no-interactive: skip the mapping CLI on stdin
+	Duration      time.Duration `json:"-" yaml:"-"` // -duration: stop after this long, 0 runs until signaled
+
+	inlineMappings []PortMapping // Mappings written in the config itself when a mappingsFile adds more
+
+	Services       map[string]int `json:"services,omitempty" yaml:"services,omitempty"`             // Server: service name -> local port, advertised to clients
+	ServiceTargets []string       `json:"serviceTargets,omitempty" yaml:"serviceTargets,omitempty"` // Server: serviceTarget hosts clients may use, host[:port] or CIDR[:port]
+	ICMPTargets    []string       `json:"icmpTargets,omitempty" yaml:"icmpTargets,omitempty"`       // Server: IPv4 addresses, CIDRs or "gateway" icmp mappings may ping
+
+	MaxSignalingResponseSize int64 `json:"maxSignalingResponseSize,omitempty" yaml:"maxSignalingResponseSize,omitempty"` // Bytes, default 4MB
+	SignalingURLs            []SignalingServer `json:"signalingUrls,omitempty" yaml:"signalingUrls,omitempty"` // Failover signaling servers after signalingUrl
+	SignalingAuthFailurePolicy string `json:"signalingAuthFailurePolicy,omitempty" yaml:"signalingAuthFailurePolicy,omitempty"` // abort (default) or retry on a 401 or 403
+	SignalingCACert            string `json:"signalingCACert,omitempty" yaml:"signalingCACert,omitempty"`                       // PEM CA trusted for HTTPS signaling besides the system roots
+	SignalingInsecureSkipVerify bool  `json:"signalingInsecureSkipVerify,omitempty" yaml:"signalingInsecureSkipVerify,omitempty"` // Skip certificate verification of HTTPS signaling, unsafe
+
+	Tunnels []TunnelConfig `json:"tunnels,omitempty" yaml:"tunnels,omitempty"` // Independent tunnels run by this process, overriding the settings above
+}
+
+// Duration is a time.Duration written as a string like "30s" or "5m" in config files
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+		}
+		*d = Duration(n)
+		return nil
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON writes the duration in string form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// MarshalYAML writes the duration in string form
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// parse parses a Go duration string
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
 }
 
 // SignalingData represents data exchanged with signaling server
@@ -42,12 +218,37 @@ type NetworkInfo struct {
 	IsLAN         bool
 	STUNResult    *STUNResult // Enhanced STUN information
 	HolePunchPort int         // Dedicated port for hole punching
+	DirectAddr    string      `json:",omitempty"` // VPN address, published for the direct transport
+	ProbePort     int         `json:",omitempty"` // Port of the server's LAN path probe responder, for dual path mappings
+
+	HolePunchPortFixed bool `json:"-"` // HolePunchPort is the configured holePunchLocalPort
 }
 
 // ClientRegistrationData contains client network info and mappings
 type ClientRegistrationData struct {
 	NetworkInfo NetworkInfo `json:"networkInfo"`
 	Mappings    []string    `json:"mappings"` // Use string format for JSON compatibility
+	UDPMux      bool        `json:"udpMux,omitempty"` // Carry hole-punched UDP mappings over one multiplexed socket
+	UDPFin      bool        `json:"udpFin,omitempty"` // Send FIN frames over the mux when a UDP session's local socket fails
+	Transport   string      `json:"transport,omitempty"` // Requested transport for TCP mappings
+
+	MappingDetails []PortMapping  `json:"mappingDetails,omitempty"` // Full mappings including per-mapping options
+	UpdateID       string         `json:"updateId,omitempty"`       // Set by the signaling server on mapping updates
+	RequestedPorts map[string]int `json:"requestedPorts,omitempty"` // Ports of the previous session by mapping, honored when free
+	ClientID       string         `json:"clientId,omitempty"`       // Stable identity, so a re-registration keeps its allocations
+	RegistrationID string         `json:"registrationId,omitempty"` // Random per registration, echoed by the allocation answering it
+	Diagnostics    *Diagnostics   `json:"diagnostics,omitempty"`    // Client environment, logged by the server for debugging
+}
+
+// mappingDetails returns the full form of a mapping parsed from Mappings, so
+// per-mapping options survive the string encoding
+func (c *ClientRegistrationData) mappingDetails(mapping PortMapping) PortMapping {
+	for _, detail := range c.MappingDetails {
+		if detail.String() == mapping.String() {
+			return detail
+		}
+	}
+	return mapping
 }
 
 // ServerPortMapping represents a mapping between client request and server allocated port
@@ -60,6 +261,18 @@ type ServerPortMapping struct {
 type ServerRegistrationData struct {
 	NetworkInfo  NetworkInfo         `json:"networkInfo"`
 	PortMappings []ServerPortMapping `json:"portMappings"`
+
+	FailedMappings      []MappingFailure `json:"failedMappings,omitempty"`      // Mappings the server could not allocate
+	QUICFingerprint     string           `json:"quicFingerprint,omitempty"`     // SHA-256 of the server's QUIC certificate, set when QUIC is offered
+	Services            map[string]int   `json:"services,omitempty"`            // Named services clients may map to as "@name"
+	AckedUpdateID       string           `json:"ackedUpdateId,omitempty"`       // Mapping update these allocations answer
+	AckedRegistrationID string           `json:"ackedRegistrationId,omitempty"` // Client registration these allocations answer
+
+	Capabilities *ServerCapabilities `json:"capabilities,omitempty"` // What the server supports, nil from servers that predate it
+	Heartbeat    *Heartbeat          `json:"heartbeat,omitempty"`    // Latest presence refresh, nil from servers that predate it
+	Diagnostics  *Diagnostics        `json:"diagnostics,omitempty"`  // Server environment, logged by the client for debugging
+	Error        *RegistrationError  `json:"error,omitempty"`        // Why the server refused the registration, nil when it did not
+	Migrate      *MigrateHint        `json:"migrate,omitempty"`      // Set while the server drains for maintenance
 }
 
 // UnmarshalJSON allows PortMapping to be parsed from either string or object format.
@@ -72,22 +285,46 @@ func (pm *PortMapping) UnmarshalJSON(data []byte) error {
 	
 	// If string parsing fails, try to unmarshal as object
 	type portMappingAlias PortMapping
-	var alias portMappingAlias
-	if err := json.Unmarshal(data, &alias); err != nil {
+	var obj struct {
+		Map string `json:"map"`
+		portMappingAlias
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
 		return fmt.Errorf("port map must be a string or object: %w", err)
 	}
 	
-	*pm = PortMapping(alias)
+	*pm = PortMapping(obj.portMappingAlias)
+	if obj.Map != "" {
+		return pm.parseFromString(obj.Map)
+	}
 	return nil
 }
 
-// UnmarshalYAML allows PortMapping to be parsed from a simple string format in YAML.
+// UnmarshalYAML allows PortMapping to be parsed from either a simple string
+// or an object in YAML. The object form may use a "map" key holding the string
+// form alongside per-mapping options.
 func (pm *PortMapping) UnmarshalYAML(value *yaml.Node) error {
-	var s string
-	if err := value.Decode(&s); err != nil {
-		return fmt.Errorf("port map must be a string: %w", err)
+	if value.Kind == yaml.ScalarNode {
+		var s string
+		if err := value.Decode(&s); err != nil {
+			return fmt.Errorf("port map must be a string: %w", err)
+		}
+		return pm.parseFromString(s)
 	}
-	return pm.parseFromString(s)
+
+	type portMappingAlias PortMapping
+	var obj struct {
+		Map              string `yaml:"map"`
+		portMappingAlias `yaml:",inline"`
+	}
+	if err := value.Decode(&obj); err != nil {
+		return fmt.Errorf("port map must be a string or object: %w", err)
+	}
+	*pm = PortMapping(obj.portMappingAlias)
+	if obj.Map != "" {
+		return pm.parseFromString(obj.Map)
+	}
+	return nil
 }
 
 // unmarshalString is a helper for both JSON and YAML parsing
@@ -107,12 +344,23 @@ func (pm *PortMapping) parseFromString(s string) error {
 	}
 
 	proto := strings.ToLower(parts[0])
-	if proto != "tcp" && proto != "udp" {
-		return errors.New("protocol must be tcp or udp")
+	if proto != "tcp" && proto != "udp" && proto != "icmp" {
+		return errors.New("protocol must be tcp, udp or icmp")
+	}
+
+	// A remote of "@name" is resolved to a port by the server
+	var service string
+	remotePart := parts[2]
+	if strings.HasPrefix(remotePart, "@") {
+		service = remotePart[1:]
+		if service == "" {
+			return errors.New("service name after @ must not be empty")
+		}
+		remotePart = "0"
 	}
 
 	local, err1 := strconv.Atoi(parts[1])
-	remote, err2 := strconv.Atoi(parts[2])
+	remote, err2 := strconv.Atoi(remotePart)
 	if err1 != nil || err2 != nil {
 		return fmt.Errorf("invalid port numbers in map: %v, %v", err1, err2)
 	}
@@ -120,5 +368,6 @@ func (pm *PortMapping) parseFromString(s string) error {
 	pm.Protocol = proto
 	pm.LocalPort = local
 	pm.RemotePort = remote
+	pm.Service = service
 	return nil
 }
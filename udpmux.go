@@ -0,0 +1,411 @@
+// Package main - UDP multiplexing over a single hole-punched socket
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mux frame layout (all mappings share one punched socket):
+//
+//	0      1      2             4
+//	+------+------+-------------+----------------
+//	| 0xA7 | type | mapping ID  | payload ...
+//	+------+------+-------------+----------------
+//
+// The mapping ID is the server-allocated port of the mapping, which both
+// peers already know from the registration exchange. Frames carry no session
+// of their own, so a mapping carries one local application at a time: while
+// one application's session is active, datagrams from other local addresses
+// are dropped rather than answered with the first application's replies.
+//
+// In client/server mode every frame is a data frame. In peer mode both sides
+// carry mappings, so frames answering a peer's mapping are reply frames.
+//
+// With udpFin, a side whose local socket for a mapping fails (the service or
+// application went away) sends a FIN frame whose one-byte payload is the
+// data frame type it sends for that mapping, so the peer can tell which of
+// its routes the session belongs to and end it too. UDP has no EOF of its
+// own. Peers without FIN support drop the frame.
+const (
+	muxFrameMagic  byte = 0xA7
+	muxFrameData   byte = 1
+	muxFrameReply  byte = 2
+	muxFrameFin    byte = 3
+	muxHeaderSize       = 4
+	muxMaxFrameLen      = UDPBufferSize
+)
+
+// errNotMuxFrame is returned for datagrams that are not mux frames, such as
+// leftover hole punching probes
+var errNotMuxFrame = errors.New("not a mux frame")
+
+// encodeMuxFrame writes a frame into buf and returns the encoded slice
+func encodeMuxFrame(buf []byte, frameType byte, mappingID uint16, payload []byte) ([]byte, error) {
+	if muxHeaderSize+len(payload) > len(buf) {
+		return nil, fmt.Errorf("mux payload of %d bytes too large", len(payload))
+	}
+	buf[0] = muxFrameMagic
+	buf[1] = frameType
+	binary.BigEndian.PutUint16(buf[2:4], mappingID)
+	n := copy(buf[muxHeaderSize:], payload)
+	return buf[:muxHeaderSize+n], nil
+}
+
+// decodeMuxFrame splits a frame into its type, mapping ID and payload
+func decodeMuxFrame(frame []byte) (byte, uint16, []byte, error) {
+	if len(frame) < muxHeaderSize || frame[0] != muxFrameMagic {
+		return 0, 0, nil, errNotMuxFrame
+	}
+	return frame[1], binary.BigEndian.Uint16(frame[2:4]), frame[muxHeaderSize:], nil
+}
+
+// muxRoute is one mapping carried over the mux
+type muxRoute struct {
+	id        uint16
+	conn      *net.UDPConn   // Local application listener or service socket
+	listening bool           // conn is a local listener, replies go to peer
+	sendType  byte           // Frame type used for datagrams read from conn
+	peer      *net.UDPAddr   // Local application of the session (listeners only)
+	peerSeen  time.Time      // Last datagram from peer
+	service   *ServiceTarget // Redialed when the session ends (service routes only)
+	mutex     sync.Mutex
+	mapping   PortMapping
+}
+
+// listenMuxRoute listens on localPort for application datagrams
+func listenMuxRoute(id uint16, localPort int, sendType byte, mapping PortMapping) (*muxRoute, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localPort})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on local port %d: %w", localPort, portInUse(err, "udp", localPort))
+	}
+	return &muxRoute{id: id, conn: conn, listening: true, sendType: sendType, mapping: mapping}, nil
+}
+
+// serviceMuxRoute connects to the mapping's service
+func serviceMuxRoute(id uint16, service *ServiceTarget, sendType byte, mapping PortMapping) (*muxRoute, error) {
+	conn, err := service.Dial("udp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to service %s: %w", service, err)
+	}
+	return &muxRoute{id: id, conn: conn.(*net.UDPConn), sendType: sendType, service: service, mapping: mapping}, nil
+}
+
+// localConn returns the route's current local socket
+func (r *muxRoute) localConn() *net.UDPConn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.conn
+}
+
+// reset ends the route's session: a listener forgets the application
+// address, a service route redials the service so the next datagram starts
+// a new session there
+func (r *muxRoute) reset() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.listening {
+		r.peer = nil
+		return nil
+	}
+	conn, err := r.service.Dial("udp")
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to service %s: %w", r.service, err)
+	}
+	r.conn.Close()
+	r.conn = conn.(*net.UDPConn)
+	return nil
+}
+
+// admit reports whether a datagram from addr, read on a listener, belongs
+// to the route's session. The first application to send owns the session
+// until it ended or was idle for the mapping's session timeout, after which
+// the next sender takes over; datagrams from others are refused meanwhile.
+func (r *muxRoute) admit(addr *net.UDPAddr, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.peer != nil && !samePeer(addr, r.peer) && now.Sub(r.peerSeen) < r.mapping.udpSessionTimeout() {
+		return false
+	}
+	r.peer, r.peerSeen = addr, now
+	return true
+}
+
+// write hands a payload from the peer to the route's local side
+func (r *muxRoute) write(payload []byte) error {
+	r.mutex.Lock()
+	conn, peer := r.conn, r.peer
+	r.mutex.Unlock()
+	if !r.listening {
+		_, err := conn.Write(payload)
+		return err
+	}
+	if peer == nil {
+		return nil
+	}
+	_, err := conn.WriteToUDP(payload, peer)
+	return err
+}
+
+// UDPMux carries several UDP mappings over one punched socket
+type UDPMux struct {
+	p2pConn     *net.UDPConn
+	peerAddr    *net.UDPAddr
+	routes      map[uint16]*muxRoute // Routes receiving data frames
+	replyRoutes map[uint16]*muxRoute // Routes receiving reply frames (peer mode)
+	fin         bool                 // Send FIN frames when a local socket fails
+	logger      *Logger
+	writeMu     sync.Mutex
+}
+
+// newUDPMux creates a mux on an established P2P socket
+func newUDPMux(p2pConn *net.UDPConn, peerAddr *net.UDPAddr, fin bool, logger *Logger) *UDPMux {
+	return &UDPMux{
+		p2pConn:     p2pConn,
+		peerAddr:    peerAddr,
+		routes:      make(map[uint16]*muxRoute),
+		replyRoutes: make(map[uint16]*muxRoute),
+		fin:         fin,
+		logger:      logger,
+	}
+}
+
+// start forwards every route's local traffic to the peer
+func (m *UDPMux) start(ctx context.Context) {
+	for _, route := range m.routes {
+		go m.readRoute(ctx, route)
+	}
+	for _, route := range m.replyRoutes {
+		go m.readRoute(ctx, route)
+	}
+}
+
+// close closes every route's local socket
+func (m *UDPMux) close() {
+	for _, route := range m.routes {
+		route.localConn().Close()
+	}
+	for _, route := range m.replyRoutes {
+		route.localConn().Close()
+	}
+}
+
+// send frames payload for mappingID and writes it to the peer
+func (m *UDPMux) send(frameType byte, mappingID uint16, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	frame, err := encodeMuxFrame(buf, frameType, mappingID, payload)
+	if err != nil {
+		return err
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.p2pConn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	_, err = m.p2pConn.WriteToUDP(frame, m.peerAddr)
+	return err
+}
+
+// readRoute forwards datagrams read from a route's local socket to the peer
+func (m *UDPMux) readRoute(ctx context.Context, route *muxRoute) {
+	buffer := make([]byte, muxMaxFrameLen-muxHeaderSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		conn := route.localConn()
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if conn != route.localConn() {
+				continue // Replaced by reset
+			}
+			if m.fin && !route.listening && ctx.Err() == nil {
+				// The service went away, e.g. its socket closed and the
+				// kernel reported the port unreachable
+				m.endSession(route, err)
+				continue
+			}
+			m.logger.Errorf("UDP mux read error on mapping %d: %v", route.id, err)
+			return
+		}
+
+		if route.listening && !route.admit(addr, time.Now()) {
+			m.logger.LimitedErrorf("UDP mux dropping datagram from %s on mapping %d: the mapping carries one application at a time and another one is active", addr, route.id)
+			continue
+		}
+
+		if err := m.send(route.sendType, route.id, buffer[:n]); err != nil {
+			m.logger.LimitedErrorf("UDP mux write error on mapping %d: %v", route.id, err)
+		}
+	}
+}
+
+// endSession ends a route's session after its local socket failed and tells
+// the peer with a FIN frame
+func (m *UDPMux) endSession(route *muxRoute, cause error) {
+	m.logger.Infof("🔚 UDP mux session on mapping %d ended: %v", route.id, cause)
+	if err := route.reset(); err != nil {
+		m.logger.Errorf("UDP mux reset error on mapping %d: %v", route.id, err)
+	}
+	if err := m.send(muxFrameFin, route.id, []byte{route.sendType}); err != nil {
+		m.logger.Errorf("UDP mux FIN write error on mapping %d: %v", route.id, err)
+	}
+}
+
+// lookupRoute returns the route receiving frames of frameType for mappingID
+func (m *UDPMux) lookupRoute(frameType byte, mappingID uint16) (*muxRoute, bool) {
+	switch frameType {
+	case muxFrameData:
+		route, ok := m.routes[mappingID]
+		return route, ok
+	case muxFrameReply:
+		route, ok := m.replyRoutes[mappingID]
+		return route, ok
+	}
+	return nil, false
+}
+
+// demux reads frames from the peer and delivers each payload to its route
+func (m *UDPMux) demux(ctx context.Context) {
+	buffer := make([]byte, muxMaxFrameLen)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		m.p2pConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := m.p2pConn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			m.logger.Errorf("UDP mux P2P read error: %v", err)
+			return
+		}
+		if !samePeer(addr, m.peerAddr) {
+			globalStats.UDPForeignDropped.Add(1)
+			m.logger.Debugf("UDP mux dropping datagram from %s: not the punched peer %s", addr, m.peerAddr)
+			continue
+		}
+
+		frameType, mappingID, payload, err := decodeMuxFrame(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		if frameType == muxFrameFin {
+			if len(payload) == 1 {
+				m.handleFin(payload[0], mappingID)
+			}
+			continue
+		}
+
+		route, ok := m.lookupRoute(frameType, mappingID)
+		if !ok {
+			m.logger.Debugf("UDP mux dropping frame for unknown mapping %d", mappingID)
+			continue
+		}
+		if err := route.write(payload); err != nil {
+			if m.fin {
+				m.endSession(route, err)
+				continue
+			}
+			m.logger.LimitedErrorf("UDP mux local write error on mapping %d: %v", route.id, err)
+		}
+	}
+}
+
+// handleFin ends our side of a session the peer ended. dataType is the
+// frame type the peer sends data for the mapping with, which selects the
+// route like a data frame would.
+func (m *UDPMux) handleFin(dataType byte, mappingID uint16) {
+	route, ok := m.lookupRoute(dataType, mappingID)
+	if !ok {
+		return
+	}
+	m.logger.Infof("🔚 Peer ended the UDP mux session on mapping %d", mappingID)
+	if err := route.reset(); err != nil {
+		m.logger.Errorf("UDP mux reset error on mapping %d: %v", route.id, err)
+	}
+}
+
+// runUDPMuxClient listens locally for every mapping and carries their traffic
+// over the shared P2P socket
+func runUDPMuxClient(ctx context.Context, logger *Logger, p2pConn *net.UDPConn, peerAddr *net.UDPAddr, mappings []ServerPortMapping, fin bool) error {
+	mux := newUDPMux(p2pConn, peerAddr, fin, logger)
+	defer mux.close()
+
+	for _, pm := range mappings {
+		route, err := listenMuxRoute(uint16(pm.AllocatedPort), pm.ClientMapping.LocalPort, muxFrameData, pm.ClientMapping)
+		if err != nil {
+			return err
+		}
+		mux.routes[route.id] = route
+	}
+
+	mux.start(ctx)
+	logger.Infof("✅ UDP mux established, carrying %d mappings over %s", len(mux.routes), peerAddr)
+	mux.demux(ctx)
+	return nil
+}
+
+// runUDPMuxServer dials the local service of every mapping and demuxes the
+// shared P2P socket to them
+func runUDPMuxServer(ctx context.Context, logger *Logger, p2pConn *net.UDPConn, peerAddr *net.UDPAddr, mappings []ServerPortMapping, fin bool) error {
+	mux := newUDPMux(p2pConn, peerAddr, fin, logger)
+	defer mux.close()
+
+	for _, pm := range mappings {
+		route, err := serviceMuxRoute(uint16(pm.AllocatedPort), newServiceTarget(pm.ClientMapping), muxFrameData, pm.ClientMapping)
+		if err != nil {
+			return err
+		}
+		mux.routes[route.id] = route
+	}
+
+	mux.start(ctx)
+	logger.Infof("✅ UDP mux established, serving %d mappings for %s", len(mux.routes), peerAddr)
+	mux.demux(ctx)
+	return nil
+}
+
+// runUDPMuxPeer carries both peers' mappings over one punched socket. Our
+// mappings are identified by their remote port and sent as data frames; the
+// peer's mappings are served from our local services and answered with reply
+// frames.
+func runUDPMuxPeer(ctx context.Context, logger *Logger, p2pConn *net.UDPConn, peerAddr *net.UDPAddr, localMappings, peerMappings []PortMapping, fin bool) error {
+	mux := newUDPMux(p2pConn, peerAddr, fin, logger)
+	defer mux.close()
+
+	for _, mapping := range localMappings {
+		route, err := listenMuxRoute(uint16(mapping.RemotePort), mapping.LocalPort, muxFrameData, mapping)
+		if err != nil {
+			return err
+		}
+		mux.replyRoutes[route.id] = route
+	}
+	for _, mapping := range peerMappings {
+		route, err := serviceMuxRoute(uint16(mapping.RemotePort), newServiceTarget(mapping), muxFrameReply, mapping)
+		if err != nil {
+			return err
+		}
+		mux.routes[route.id] = route
+	}
+
+	mux.start(ctx)
+	logger.Infof("✅ Peer UDP mux established with %s: %d local, %d peer mappings", peerAddr, len(localMappings), len(peerMappings))
+	mux.demux(ctx)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxTestPeer runs a client mux for one mapping against a socket standing in
+// for the server, returning that socket and the mapping's local address
+func muxTestPeer(t *testing.T, ctx context.Context, timeout time.Duration) (*net.UDPConn, *net.UDPAddr) {
+	t.Helper()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	p2p, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p2p.Close() })
+
+	local, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := local.LocalAddr().(*net.UDPAddr).Port
+	local.Close()
+
+	mapping := PortMapping{Protocol: "udp", LocalPort: localPort, RemotePort: 5000, UDPResponseTimeout: Duration(timeout)}
+	go runUDPMuxClient(ctx, defaultLogger, p2p, server.LocalAddr().(*net.UDPAddr), []ServerPortMapping{{ClientMapping: mapping, AllocatedPort: 40000}}, false)
+	return server, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort}
+}
+
+// readMux reads the payload of the next frame the mux sent, or "" on timeout
+func readMux(conn *net.UDPConn) (string, *net.UDPAddr) {
+	buf := make([]byte, muxMaxFrameLen)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return "", nil
+	}
+	_, _, payload, err := decodeMuxFrame(buf[:n])
+	if err != nil {
+		return "", nil
+	}
+	return string(payload), addr
+}
+
+// readApp reads the next datagram an application received, or "" on timeout
+func readApp(conn *net.UDPConn) string {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestUDPMuxOneApplicationPerMapping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, mapped := muxTestPeer(t, ctx, time.Hour)
+
+	first, err := net.DialUDP("udp4", nil, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.DialUDP("udp4", nil, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// The listener may not be up yet
+	var p2pAddr *net.UDPAddr
+	for i := 0; i < 20 && p2pAddr == nil; i++ {
+		first.Write([]byte("first"))
+		_, p2pAddr = readMux(server)
+	}
+	if p2pAddr == nil {
+		t.Fatal("mux forwarded nothing")
+	}
+
+	second.Write([]byte("second"))
+	if payload, _ := readMux(server); payload != "" {
+		t.Errorf("second application's datagram %q forwarded while the first one's session is active", payload)
+	}
+
+	reply, _ := encodeMuxFrame(make([]byte, muxMaxFrameLen), muxFrameData, 40000, []byte("reply"))
+	server.WriteToUDP(reply, p2pAddr)
+	if got := readApp(first); got != "reply" {
+		t.Errorf("first application read %q, want the reply", got)
+	}
+	if got := readApp(second); got != "" {
+		t.Errorf("second application received %q meant for the first", got)
+	}
+}
+
+func TestUDPMuxTakeoverAfterIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, mapped := muxTestPeer(t, ctx, 100*time.Millisecond)
+
+	first, err := net.DialUDP("udp4", nil, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.DialUDP("udp4", nil, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	var p2pAddr *net.UDPAddr
+	for i := 0; i < 20 && p2pAddr == nil; i++ {
+		first.Write([]byte("first"))
+		_, p2pAddr = readMux(server)
+	}
+	if p2pAddr == nil {
+		t.Fatal("mux forwarded nothing")
+	}
+
+	// Once the first session idled out the second application takes over
+	time.Sleep(150 * time.Millisecond)
+	second.Write([]byte("second"))
+	if payload, _ := readMux(server); payload != "second" {
+		t.Fatalf("mux forwarded %q after the first session idled out, want the second application's datagram", payload)
+	}
+	reply, _ := encodeMuxFrame(make([]byte, muxMaxFrameLen), muxFrameData, 40000, []byte("reply"))
+	server.WriteToUDP(reply, p2pAddr)
+	if got := readApp(second); got != "reply" {
+		t.Errorf("second application read %q, want the reply", got)
+	}
+	if got := readApp(first); got != "" {
+		t.Errorf("first application received %q after its session ended", got)
+	}
+}
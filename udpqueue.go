@@ -0,0 +1,64 @@
+// Package main - Bounded per-session queues for forwarded UDP datagrams
+package main
+
+import "sync"
+
+// Overflow policies of UDP session queues
+const (
+	UDPQueueDropNewest = "dropNewest" // Discard the datagram that does not fit
+	UDPQueueDropOldest = "dropOldest" // Discard the longest-queued datagram to make room
+)
+
+// defaultUDPQueueDepth is how many datagrams a UDP session queues for its
+// destination unless udpQueueDepth says otherwise
+const defaultUDPQueueDepth = 256
+
+// UDP session queue settings, set from the configuration
+var (
+	udpQueueDepth  = defaultUDPQueueDepth
+	udpQueuePolicy = UDPQueueDropNewest
+)
+
+// udpSendQueue holds datagrams for a session's writer, so a destination
+// slower than the source costs at most depth datagrams of memory instead of
+// stalling the shared read loop
+type udpSendQueue struct {
+	packets chan []byte
+	policy  string
+	mutex   sync.Mutex // Makes dropOldest's evict-and-retry atomic
+}
+
+// newUDPSendQueue creates a queue with the configured depth and policy
+func newUDPSendQueue() *udpSendQueue {
+	return &udpSendQueue{packets: make(chan []byte, udpQueueDepth), policy: udpQueuePolicy}
+}
+
+// push queues a copy of p. When the queue is full a datagram is dropped
+// according to the policy and counted; push reports whether p was queued.
+func (q *udpSendQueue) push(p []byte) bool {
+	packet := append([]byte(nil), p...)
+	select {
+	case q.packets <- packet:
+		return true
+	default:
+	}
+
+	globalStats.UDPQueueDropped.Add(1)
+	if q.policy != UDPQueueDropOldest {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		select {
+		case q.packets <- packet:
+			return true
+		default:
+		}
+		select {
+		case <-q.packets:
+		default:
+		}
+	}
+}
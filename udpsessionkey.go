@@ -0,0 +1,44 @@
+// Package main - Keying of UDP relay sessions by the datagrams' source
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// UDP session keying strategies of a mapping's udpSessionKey
+const (
+	UDPSessionKeyFull5Tuple = "full5tuple" // Source IP and port, the default
+	UDPSessionKeySourceIP   = "sourceIP"   // Source IP only
+)
+
+// udpSessionKeyFunc returns the key of the relay session a datagram from
+// addr belongs to; datagrams with equal keys share one session and socket
+// to the destination
+type udpSessionKeyFunc func(addr *net.UDPAddr) string
+
+// udpSessionKeyFuncs are the keying strategies by udpSessionKey setting
+var udpSessionKeyFuncs = map[string]udpSessionKeyFunc{
+	UDPSessionKeyFull5Tuple: func(addr *net.UDPAddr) string { return addr.String() },
+	UDPSessionKeySourceIP:   func(addr *net.UDPAddr) string { return addr.IP.String() },
+}
+
+// validateUDPSessionKey checks a mapping's udpSessionKey
+func validateUDPSessionKey(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	if _, ok := udpSessionKeyFuncs[setting]; !ok {
+		return fmt.Errorf("'udpSessionKey' must be %q or %q, got %q", UDPSessionKeyFull5Tuple, UDPSessionKeySourceIP, setting)
+	}
+	return nil
+}
+
+// udpSessionKeyer returns the keying strategy of a udpSessionKey setting,
+// keying by the full source address when it is unset
+func udpSessionKeyer(setting string) udpSessionKeyFunc {
+	if keyFunc, ok := udpSessionKeyFuncs[setting]; ok {
+		return keyFunc
+	}
+	return udpSessionKeyFuncs[UDPSessionKeyFull5Tuple]
+}